@@ -0,0 +1,47 @@
+package autocrop
+
+// adaptive.go contains the adaptive sample count, which spends more samples
+// only on the pages that need them.
+
+import (
+	"math"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+const (
+	// adaptAngleErr is the AngleErr (in radians) below which more samples
+	// aren't worth taking: a hundredth of a degree.
+	adaptAngleErr = 0.01 * math.Pi / 180
+	// adaptGain is how much doubling the samples must narrow AngleErr by to
+	// count as an improvement. Pure noise narrows it by 1/√2.
+	adaptGain = 0.9
+	// adaptPatience is how many doublings in a row may fail to improve on
+	// the best fit before giving up. Few samples give noisy fits, so one
+	// failure isn't enough to tell.
+	adaptPatience = 2
+)
+
+// adapt fits the page with fit, which takes a.N samples per side. If MaxN is
+// larger than N, it doubles a.N and fits the page again, up to MaxN, for as
+// long as the best AngleErr so far is wide and the doublings keep narrowing
+// it. The best fit is returned; a.N is left at the samples it took.
+func (a *analysis) adapt(fit func() *Transform) *Transform {
+	best, n := fit(), a.N
+	for failed := 0; failed < adaptPatience && a.N < a.MaxN && a.failed == nil && !best.NoBorder && !(best.AngleErr <= adaptAngleErr); {
+		a.N = min(2*a.N, a.MaxN)
+		t := fit()
+		a.debug("samples", "n", a.N, "angle_err", util.Rad2deg(t.AngleErr), "best", util.Rad2deg(best.AngleErr))
+		if t.AngleErr < adaptGain*best.AngleErr {
+			best, n, failed = t, a.N, 0
+		} else {
+			failed++
+		}
+	}
+	if a.N != n {
+		// the diagnostics are of the last fit; make them the best's
+		a.N = n
+		fit()
+	}
+	return best
+}
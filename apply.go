@@ -0,0 +1,319 @@
+package autocrop
+
+// apply.go contains the native counterpart of the ImageMagick command that
+// String gives, which turns, straightens and crops an image in Go.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Fit is how the crop is fitted to the page once the image is rotated.
+// ImageMagick grows the image as it rotates it to keep every pixel, and fills
+// the triangles that leaves at its corners with the background color.
+type Fit int
+
+const (
+	// FitPage crops to the page, the size of Bounds.
+	FitPage Fit = iota
+
+	// FitInner shrinks the crop of FitPage until none of the background
+	// added by the rotation is in it. It only differs from FitPage if the
+	// page runs off the image.
+	FitInner
+
+	// FitOuter grows the crop until it keeps every pixel of Bounds, which
+	// brings in some of the background at the corners.
+	FitOuter
+)
+
+var fitNames = []string{
+	FitPage:  "page",
+	FitInner: "inner",
+	FitOuter: "outer",
+}
+
+func (f Fit) String() string {
+	if f >= 0 && int(f) < len(fitNames) {
+		return fitNames[f]
+	}
+	return fmt.Sprintf("Fit(%d)", int(f))
+}
+
+// ParseFit returns the Fit with the given name.
+func ParseFit(name string) (Fit, error) {
+	for i, s := range fitNames {
+		if s == name {
+			return Fit(i), nil
+		}
+	}
+	return 0, fmt.Errorf("autocrop: unknown fit %q", name)
+}
+
+// Pivot is the point that the page is rotated about.
+type Pivot int
+
+const (
+	// PivotImage rotates about the center of the image and grows the image
+	// to hold all of it, as ImageMagick's -rotate does.
+	PivotImage Pivot = iota
+
+	// PivotPage rotates about the center of the page (Bounds), which stays
+	// where it is. The image keeps its size, so the corners of the page can
+	// be cut off if it's close to the edge of the image.
+	PivotPage
+
+	// PivotCorner rotates about the top left corner of the image and keeps
+	// its size, like PivotPage.
+	PivotCorner
+)
+
+var pivotNames = []string{
+	PivotImage:  "image",
+	PivotPage:   "page",
+	PivotCorner: "corner",
+}
+
+func (p Pivot) String() string {
+	if p >= 0 && int(p) < len(pivotNames) {
+		return pivotNames[p]
+	}
+	return fmt.Sprintf("Pivot(%d)", int(p))
+}
+
+// ParsePivot returns the Pivot with the given name.
+func ParsePivot(name string) (Pivot, error) {
+	for i, s := range pivotNames {
+		if s == name {
+			return Pivot(i), nil
+		}
+	}
+	return 0, fmt.Errorf("autocrop: unknown pivot %q", name)
+}
+
+// Crop returns the rectangle that String crops to, in the coordinates of the
+// image after it has been turned upright and rotated (or corrected for
+// perspective). Rotating about the center of the image grows it to hold all
+// of it, to the size that ImageMagick makes it to within a pixel; about any
+// other Pivot, the image keeps its size and the crop is cut down to fit in
+// it.
+//
+// Where the page ends up depends on the size of the image, so Size must be
+// set for a Transform with an Angle, as it is by the analysis, Consensus and
+// Merge. Without it, as in a Transform built by hand, Crop can't place the
+// page and returns Bounds as they are, which is only right for an Angle of 0.
+// Apply takes the size from the image it is given instead.
+func (t *Transform) Crop() image.Rectangle {
+	if t.Perspective {
+		_, _, r := t.perspectiveRect()
+		return r
+	}
+	if t.Size == (image.Point{}) {
+		return t.Bounds
+	}
+
+	// the page, straightened out around where its center ends up
+	b := t.Bounds
+	cx, cy := t.rotate(float64(b.Min.X+b.Max.X)/2, float64(b.Min.Y+b.Max.Y)/2)
+	at := image.Pt(int(math.Round(cx-float64(b.Dx())/2)), int(math.Round(cy-float64(b.Dy())/2)))
+	page := image.Rectangle{at, at.Add(b.Size())}
+
+	switch t.Fit {
+	case FitInner:
+		w, h := float64(t.Size.X), float64(t.Size.Y)
+		inside := func(x, y int) bool {
+			u, v := t.unrotate(float64(x), float64(y))
+			const eps = 1e-6
+			return u >= -eps && v >= -eps && u <= w+eps && v <= h+eps
+		}
+		for !page.Empty() {
+			tl, tr := inside(page.Min.X, page.Min.Y), inside(page.Max.X, page.Min.Y)
+			bl, br := inside(page.Min.X, page.Max.Y), inside(page.Max.X, page.Max.Y)
+			if tl && tr && bl && br {
+				break
+			}
+			if !tl || !tr {
+				page.Min.Y++
+			}
+			if !bl || !br {
+				page.Max.Y--
+			}
+			if !tl || !bl {
+				page.Min.X++
+			}
+			if !tr || !br {
+				page.Max.X--
+			}
+		}
+	case FitOuter:
+		lo, hi := [2]float64{math.Inf(1), math.Inf(1)}, [2]float64{math.Inf(-1), math.Inf(-1)}
+		for _, p := range [4]image.Point{b.Min, {b.Max.X, b.Min.Y}, b.Max, {b.Min.X, b.Max.Y}} {
+			x, y := t.rotate(float64(p.X), float64(p.Y))
+			lo = [2]float64{math.Min(lo[0], x), math.Min(lo[1], y)}
+			hi = [2]float64{math.Max(hi[0], x), math.Max(hi[1], y)}
+		}
+		page = image.Rect(int(math.Floor(lo[0])), int(math.Floor(lo[1])), int(math.Ceil(hi[0])), int(math.Ceil(hi[1])))
+	}
+	if t.Pivot != PivotImage {
+		page = page.Intersect(image.Rectangle{Max: t.Size})
+	}
+	return page
+}
+
+// canvas returns the size of the upright image once it has been rotated by
+// Angle, grown to hold all of it if the pivot is the center of the image.
+func (t *Transform) canvas() (w, h float64) {
+	x, y := float64(t.Size.X), float64(t.Size.Y)
+	if t.Pivot != PivotImage {
+		return x, y
+	}
+	sin, cos := math.Sincos(t.Angle)
+	sin, cos = math.Abs(sin), math.Abs(cos)
+	return math.Ceil(x*cos + y*sin - 1e-6), math.Ceil(x*sin + y*cos - 1e-6)
+}
+
+// pivot returns the point that the upright image is rotated about, and where
+// that point ends up on the canvas.
+func (t *Transform) pivot() (px, py, qx, qy float64) {
+	switch t.Pivot {
+	case PivotPage:
+		b := t.Bounds
+		px, py = float64(b.Min.X+b.Max.X)/2, float64(b.Min.Y+b.Max.Y)/2
+		return px, py, px, py
+	case PivotCorner:
+		return 0, 0, 0, 0
+	}
+	w, h := t.canvas()
+	return float64(t.Size.X) / 2, float64(t.Size.Y) / 2, w / 2, h / 2
+}
+
+// rotate maps the point (x, y) of the upright image to where it ends up on
+// the canvas once the image is rotated clockwise by Angle about the pivot.
+func (t *Transform) rotate(x, y float64) (float64, float64) {
+	sin, cos := math.Sincos(t.Angle)
+	px, py, qx, qy := t.pivot()
+	x -= px
+	y -= py
+	return x*cos - y*sin + qx, x*sin + y*cos + qy
+}
+
+// unrotate is the inverse of rotate.
+func (t *Transform) unrotate(x, y float64) (float64, float64) {
+	sin, cos := math.Sincos(t.Angle)
+	px, py, qx, qy := t.pivot()
+	x -= qx
+	y -= qy
+	return x*cos + y*sin + px, -x*sin + y*cos + py
+}
+
+// Apply turns img upright, straightens it and crops it as the ImageMagick
+// command that String gives would, and returns the result. img must be the
+// image that was analyzed, or the same image at the size that t was scaled
+// to. Whatever comes from outside of img is white, like ImageMagick's
+// default background. If img doesn't start at (0, 0), like a SubImage, t is
+// in its coordinates, as AnalyzeWith gives it: those of an image from (0, 0)
+// to the far corner of img, turned by Orientation.
+//
+// The result is an *image.Gray16 or an *image.NRGBA64 if img has 16 bits per
+// sample, as 16-bit PNGs and TIFFs decode to, so that the depth of archival
+// masters is kept, and an *image.NRGBA otherwise.
+//
+// Angles of up to 10°, as deskewing gives, are rotated by three shears with
+// cubic filtering, which is quicker than resampling each pixel and keeps the
+// page sharper. Larger ones, and corrections for perspective, are resampled
+// bilinearly.
+func (t *Transform) Apply(img image.Image) image.Image {
+	u := *t
+	var src image.Image
+	if t.Orientation%360 == 0 {
+		src = img
+		u.Size = img.Bounds().Max
+	} else {
+		src = rotate90(region{img, image.Rectangle{Max: img.Bounds().Max}}, t.Orientation)
+		u.Size = src.Bounds().Size()
+	}
+	r := u.Crop()
+	back := u.unrotate
+	if u.Perspective {
+		c, dst, _ := u.perspectiveRect()
+		back = homography(dst, c).Point
+	}
+
+	dst := applyImage(img, image.Rect(0, 0, r.Dx(), r.Dy()))
+	if !u.Perspective && math.Abs(u.Angle) <= maxShear {
+		u.shearRotate(dst, src, r)
+		return dst
+	}
+	rows := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := range rows {
+				for x := 0; x < r.Dx(); x++ {
+					// pixel centers are at half pixels
+					sx, sy := back(float64(r.Min.X+x)+0.5, float64(r.Min.Y+y)+0.5)
+					dst.Set(x, y, bilinear(src, sx-0.5, sy-0.5))
+				}
+			}
+		}()
+	}
+	for y := 0; y < r.Dy(); y++ {
+		rows <- y
+	}
+	close(rows)
+	wg.Wait()
+	return dst
+}
+
+// applyImage returns the image that Apply draws the result of img into.
+func applyImage(img image.Image, r image.Rectangle) draw.RGBA64Image {
+	switch img.(type) {
+	case *image.Gray16:
+		return image.NewGray16(r)
+	case *image.RGBA64, *image.NRGBA64:
+		return image.NewNRGBA64(r)
+	}
+	return image.NewNRGBA(r)
+}
+
+// bilinear returns the color of img at (x, y) interpolated between the four
+// pixels around it. Pixels outside of img are white.
+func bilinear(img image.Image, x, y float64) color.Color {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	b := img.Bounds()
+
+	var sum [4]float64
+	for _, p := range [4]struct {
+		dx, dy int
+		w      float64
+	}{
+		{0, 0, (1 - fx) * (1 - fy)},
+		{1, 0, fx * (1 - fy)},
+		{0, 1, (1 - fx) * fy},
+		{1, 1, fx * fy},
+	} {
+		if p.w == 0 {
+			continue
+		}
+		px, py := int(x0)+p.dx, int(y0)+p.dy
+		c := [4]uint32{ColorMax, ColorMax, ColorMax, ColorMax}
+		if (image.Point{px, py}).In(b) {
+			c[0], c[1], c[2], c[3] = img.At(px, py).RGBA()
+		}
+		for i := range sum {
+			sum[i] += p.w * float64(c[i])
+		}
+	}
+	return color.RGBA64{
+		uint16(math.Round(sum[0])), uint16(math.Round(sum[1])),
+		uint16(math.Round(sum[2])), uint16(math.Round(sum[3])),
+	}
+}
@@ -0,0 +1,36 @@
+package autocrop
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestTransformString(t *testing.T) {
+	const deg = math.Pi / 180
+	page := image.Rect(40, 60, 1040, 1460)
+	size := image.Pt(1100, 1520)
+	tests := []struct {
+		name string
+		tr   Transform
+		want string
+	}{
+		{"straight", Transform{Bounds: page, Size: size}, "-rotate 0.000000 +repage -crop 1000x1400+40+60"},
+		{"clockwise", Transform{Angle: 2 * deg, Bounds: page, Size: size}, "-rotate 2.000000 +repage -crop 1000x1400+67+79"},
+		{"counterclockwise", Transform{Angle: -2 * deg, Bounds: page, Size: size}, "-rotate -2.000000 +repage -crop 1000x1400+67+79"},
+		{"turned", Transform{Orientation: 90, Angle: 0.5 * deg, Bounds: page, Size: size}, "-rotate 90 -rotate 0.500000 +repage -crop 1000x1400+47+65"},
+		{"inner", Transform{Angle: 2 * deg, Bounds: image.Rect(0, 0, 1100, 1520), Size: size, Fit: FitInner}, "-rotate 2.000000 +repage -crop 1049x1469+52+44"},
+		{"outer", Transform{Angle: 2 * deg, Bounds: page, Size: size, Fit: FitOuter}, "-rotate 2.000000 +repage -crop 1049x1435+42+61"},
+		{"perspective", Transform{
+			Bounds:      page,
+			Size:        size,
+			Corners:     [4]image.Point{{40, 60}, {1040, 70}, {1030, 1460}, {50, 1450}},
+			Perspective: true,
+		}, "-distort Perspective '40,60 40,60 1040,70 1030,60 1030,1460 1030,1450 50,1450 40,1450' -crop 990x1390+40+60"},
+	}
+	for _, tt := range tests {
+		if got := tt.tr.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
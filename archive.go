@@ -0,0 +1,150 @@
+package autocrop
+
+// archive.go contains the reading of pages out of archives, since comic and
+// manga scans are passed around as CBZ files: ZIP archives of the page images
+// in order. CBR files, which are RAR archives, are read by rar.go.
+
+import (
+	"archive/zip"
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// archive is an archive of files, open for reading.
+type archive interface {
+	// Names returns the names of the files in the archive, in order.
+	Names() []string
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// archiveFormats opens the archives with each extension.
+var archiveFormats = map[string]func(name string) (archive, error){
+	".cbz": openZip,
+	".zip": openZip,
+	".cbr": openRAR,
+	".rar": openRAR,
+}
+
+// IsArchive reports whether name is that of an archive that ArchivePages can
+// read, by its extension.
+func IsArchive(name string) bool {
+	_, ok := archiveFormats[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// SplitArchive splits a name that goes through an archive, like
+// book.cbz/001.jpg, into the name of the archive and the name of the file in
+// it.
+func SplitArchive(name string) (arc, member string, ok bool) {
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' && IsArchive(name[:i]) {
+			return name[:i], name[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// ArchivePages returns the names of the images in the named archive, in the
+// order they are in it, as names that Open opens: the name of the archive, a
+// slash, and the name of the image in it. The images are the files in it that
+// image.DecodeConfig recognizes, which leaves out the likes of ComicInfo.xml.
+// An archive with a file whose name leads out of it, like ../001.jpg or an
+// absolute path, is an error. If name isn't an archive, it returns name
+// alone.
+func ArchivePages(name string) ([]string, error) {
+	open, ok := archiveFormats[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		return []string{name}, nil
+	}
+	a, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	var pages []string
+	for _, member := range a.Names() {
+		if !filepath.IsLocal(member) {
+			// it would be written outside of where the pages go
+			return nil, fmt.Errorf("autocrop: %s has a file outside of it: %s", name, member)
+		}
+		if strings.HasSuffix(member, "/") {
+			continue
+		}
+		f, err := a.Open(member)
+		if err != nil {
+			return nil, err
+		}
+		_, _, err = image.DecodeConfig(f)
+		f.Close()
+		if err == nil {
+			pages = append(pages, name+"/"+member)
+		}
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("autocrop: no images in %s", name)
+	}
+	return pages, nil
+}
+
+// openMember opens the file member of the archive arc.
+func openMember(arc, member string) (io.ReadCloser, error) {
+	a, err := archiveFormats[strings.ToLower(filepath.Ext(arc))](arc)
+	if err != nil {
+		return nil, err
+	}
+	f, err := a.Open(member)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	return &archiveFile{f, a}, nil
+}
+
+// archiveFile is a file in an archive, which closes the archive with it.
+type archiveFile struct {
+	io.ReadCloser
+	a archive
+}
+
+func (f *archiveFile) Close() error {
+	err := f.ReadCloser.Close()
+	if aerr := f.a.Close(); err == nil {
+		err = aerr
+	}
+	return err
+}
+
+// zipArchive is a ZIP archive.
+type zipArchive struct {
+	*zip.ReadCloser
+}
+
+func openZip(name string) (archive, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return zipArchive{r}, nil
+}
+
+func (z zipArchive) Names() []string {
+	names := make([]string, len(z.File))
+	for i, f := range z.File {
+		names[i] = f.Name
+	}
+	return names
+}
+
+func (z zipArchive) Open(name string) (io.ReadCloser, error) {
+	for _, f := range z.File {
+		if f.Name == name {
+			return f.Open()
+		}
+	}
+	return nil, fmt.Errorf("autocrop: no %s in the archive", name)
+}
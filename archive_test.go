@@ -0,0 +1,216 @@
+package autocrop
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// pngBytes returns a small PNG, gray at level.
+func pngBytes(t *testing.T, level uint8) []byte {
+	img := image.NewGray(image.Rect(0, 0, 4, 3))
+	for i := range img.Pix {
+		img.Pix[i] = level
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// archiveEntry is a file to put in an archive for a test.
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+// writeZip writes a ZIP archive of the files, in order, to the named file.
+// A name that ends in a slash is a directory.
+func writeZip(t *testing.T, name string, files []archiveEntry) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, e := range files {
+		fw, err := w.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(e.data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchivePages(t *testing.T) {
+	dir := t.TempDir()
+	page1, page2, page3 := pngBytes(t, 10), pngBytes(t, 20), pngBytes(t, 30)
+	book := filepath.Join(dir, "book.CBZ")
+	writeZip(t, book, []archiveEntry{
+		{"ComicInfo.xml", []byte("<ComicInfo/>")},
+		{"002.png", page2},
+		{"001.png", page1},
+		{"extra/", nil},
+		{"extra/003.png", page3},
+		{"notes.txt", []byte("not an image")},
+	})
+	empty := filepath.Join(dir, "empty.zip")
+	writeZip(t, empty, []archiveEntry{{"readme.txt", []byte("nothing here")}})
+
+	// the pages are in the order of the archive, not of their names
+	got, err := ArchivePages(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{book + "/002.png", book + "/001.png", book + "/extra/003.png"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pages %q, want %q", got, want)
+	}
+	for i, data := range [][]byte{page2, page1, page3} {
+		f, err := Open(got[i])
+		if err != nil {
+			t.Errorf("%s: %v", got[i], err)
+			continue
+		}
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("%s: read %d bytes, %v, want %d", got[i], len(b), err, len(data))
+		}
+	}
+	if _, err := Open(book + "/004.png"); err == nil {
+		t.Error("opened a page that isn't in the archive")
+	}
+
+	if _, err := ArchivePages(empty); err == nil {
+		t.Error("no error for an archive without images")
+	}
+	if got, err := ArchivePages("page.png"); err != nil || !reflect.DeepEqual(got, []string{"page.png"}) {
+		t.Errorf("a plain image gives %q, %v", got, err)
+	}
+}
+
+func TestSplitArchive(t *testing.T) {
+	tests := []struct {
+		name, arc, member string
+		ok                bool
+	}{
+		{"book.cbz/001.jpg", "book.cbz", "001.jpg", true},
+		{"scans/book.ZIP/ch1/001.jpg", "scans/book.ZIP", "ch1/001.jpg", true},
+		{"a.cbr/b.rar/c.png", "a.cbr", "b.rar/c.png", true},
+		{"scans/001.jpg", "", "", false},
+		{"book.cbz", "", "", false},
+		{"book.cbz.d/001.jpg", "", "", false},
+	}
+	for _, tt := range tests {
+		arc, member, ok := SplitArchive(tt.name)
+		if arc != tt.arc || member != tt.member || ok != tt.ok {
+			t.Errorf("%s: split into %q, %q, %v", tt.name, arc, member, ok)
+		}
+	}
+}
+
+// rarVintBytes writes v as a variable length integer of RAR 5.
+func rarVintBytes(v uint64) []byte {
+	var b []byte
+	for ; v >= 0x80; v >>= 7 {
+		b = append(b, byte(v)|0x80)
+	}
+	return append(b, byte(v))
+}
+
+// writeRAR writes a RAR archive of version 4 or 5 of the files, stored
+// uncompressed, to the named file. The CRCs are left zero, as openRAR doesn't
+// check them.
+func writeRAR(t *testing.T, name string, version int, files []archiveEntry) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	if version == 4 {
+		buf.WriteString("Rar!\x1a\x07\x00")
+		buf.Write([]byte{0, 0, 0x73, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0})
+		for _, e := range files {
+			head := make([]byte, 7+25)
+			head[2] = 0x74
+			le.PutUint16(head[3:], 0x8000)
+			le.PutUint16(head[5:], uint16(len(head)+len(e.name)))
+			le.PutUint32(head[7:], uint32(len(e.data)))
+			le.PutUint32(head[11:], uint32(len(e.data)))
+			head[7+18] = 0x30 // stored
+			le.PutUint16(head[7+19:], uint16(len(e.name)))
+			buf.Write(head)
+			buf.WriteString(e.name)
+			buf.Write(e.data)
+		}
+		buf.Write([]byte{0, 0, 0x7b, 0, 0, 7, 0})
+	} else {
+		buf.WriteString("Rar!\x1a\x07\x01\x00")
+		header := func(h []byte) {
+			buf.Write([]byte{0, 0, 0, 0})
+			buf.Write(rarVintBytes(uint64(len(h))))
+			buf.Write(h)
+		}
+		header([]byte{1, 0, 0}) // the archive
+		for _, e := range files {
+			var h []byte
+			h = append(h, 2, 2) // a file, with data
+			h = append(h, rarVintBytes(uint64(len(e.data)))...)
+			h = append(h, 0) // file flags
+			h = append(h, rarVintBytes(uint64(len(e.data)))...)
+			h = append(h, 0, 0, 0) // attributes, stored, host OS
+			h = append(h, rarVintBytes(uint64(len(e.name)))...)
+			header(append(h, e.name...))
+			buf.Write(e.data)
+		}
+		header([]byte{5, 0, 0}) // the end
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveMembersOutside(t *testing.T) {
+	dir := t.TempDir()
+	page := pngBytes(t, 10)
+	for _, format := range []struct {
+		ext   string
+		write func(name string, files []archiveEntry)
+	}{
+		{".cbz", func(name string, files []archiveEntry) { writeZip(t, name, files) }},
+		{".cbr", func(name string, files []archiveEntry) { writeRAR(t, name, 4, files) }},
+		{".rar", func(name string, files []archiveEntry) { writeRAR(t, name, 5, files) }},
+	} {
+		// the archives can be read when they are sound
+		sound := filepath.Join(dir, "sound"+format.ext)
+		format.write(sound, []archiveEntry{{"001.png", page}, {"ch2/002.png", page}})
+		got, err := ArchivePages(sound)
+		if err != nil || len(got) != 2 {
+			t.Errorf("%s: pages %q, %v", sound, got, err)
+			continue
+		}
+		if f, err := Open(got[1]); err != nil {
+			t.Errorf("%s: %v", got[1], err)
+		} else {
+			f.Close()
+		}
+
+		for i, member := range []string{"../001.png", "ch1/../../001.png", "/tmp/001.png", ".."} {
+			name := filepath.Join(dir, fmt.Sprintf("outside%d%s", i, format.ext))
+			format.write(name, []archiveEntry{{"000.png", page}, {member, page}})
+			if got, err := ArchivePages(name); err == nil {
+				t.Errorf("%s with %s: pages %q, want an error", format.ext, member, got)
+			}
+		}
+	}
+}
@@ -1,15 +1,22 @@
 package autocrop
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"image"
 	"image/color"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"math"
-	"os"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 
+	_ "golang.org/x/image/webp"
 	"ktkr.us/pkg/autocrop/util"
 )
 
@@ -17,6 +24,18 @@ const (
 	// ColorMax is maximum color value returned by the image/color API
 	// functions, representing solid white.
 	ColorMax = 0xFFFF
+
+	// minSize is the smallest width and height of an image that can be
+	// analyzed, and of a hint. Each side is searched over a band of at least
+	// minBand pixels, which may reach at most halfway across.
+	minSize = 2 * minBand
+
+	// minBand is the narrowest band of pixels an edge is looked for in.
+	minBand = 8
+
+	// minSamples is the fewest edges a line is fitted to. Sides with fewer
+	// are left alone, and so is the image if every side has fewer.
+	minSamples = 3
 )
 
 var (
@@ -28,42 +47,202 @@ var (
 // Transform is a transformation plan that, if used, should probably straighten
 // the image it's associated with.
 type Transform struct {
+	// Orientation is a coarse clockwise rotation in degrees (0, 90, 180 or
+	// 270) that makes the page upright. It comes before Angle, and Bounds are
+	// in the coordinates of the page after it.
+	Orientation int
+
 	Angle  float64         // rotate by this angle (in radians) to make it straight
 	Bounds image.Rectangle // change the image bounds to this rectangle to fit
 	// r^2 values of linear regression on each side; CSS box side order (T,R,B,L)
 	Confidence [4]float64
+	// the sides that were fitted and cropped; the others are left as they are
+	// and have zero confidence and errors
+	Sides Sides
+	// Fitted are the sides that a line could actually be fitted to, and
+	// SideAngles the angle that each of them would give on its own.
+	Fitted     Sides
+	SideAngles [4]float64
+	// Conservative keeps everything that might be part of the page, out to
+	// the outermost detected edge on each side. Aggressive cuts in to the
+	// innermost detected edge. Bounds lies between the two.
+	Conservative image.Rectangle
+	Aggressive   image.Rectangle
+	// AngleErr and CropErr are the half widths of 95% confidence intervals on
+	// Angle (in radians) and on the position of each side of Bounds (T,R,B,L,
+	// in pixels), derived from the standard errors of the line fits.
+	AngleErr float64
+	CropErr  [4]float64
+	// Corners are the corners of the page (TL, TR, BR, BL) where the lines
+	// fitted to its sides meet. They are only known if all four sides were
+	// fitted. If opposite sides of the page are not parallel, as in photos
+	// of pages taken at an angle, Perspective is set and the page should be
+	// corrected by mapping the corners to a rectangle instead of rotating
+	// it.
+	Corners     [4]image.Point
+	Perspective bool
+	// Curl is how far (in pixels) the edge on each side (T,R,B,L) bows away
+	// from a straight line, as it does near the spine of a book that doesn't
+	// lie flat.
+	Curl [4]float64
+	// Estimates holds the angle found by each algorithm when several were
+	// combined (see Fused).
+	Estimates []Estimate
+	// fraction of samples on each side in which an edge was found (T,R,B,L)
+	Coverage [4]float64
+	// NoBorder is set if no side of the image appears to have a border. The
+	// Border algorithm then returns the identity Transform.
+	NoBorder bool
+	// Size is the size of the image that Bounds are in, once turned by
+	// Orientation, which String needs to place the crop of a rotated page
+	// (see Crop). Fit is how String and Apply fit the crop to the page after
+	// rotating it about Pivot.
+	Size  image.Point
+	Fit   Fit
+	Pivot Pivot
+	// Margins are how far (in pixels) the ink on the page is in from each
+	// side (T,R,B,L) of the page, if Options.Margins asked for them. They
+	// are zero if there is no ink, and at least the width of the corners
+	// that a tilted page leaves inside Bounds.
+	Margins [4]int
+	// Targets are the calibration targets and rulers found along the sides
+	// of the upright image, if Options.Targets asked for them.
+	Targets []image.Rectangle
+	// Overcrop are the sides of the crop that still cut through ink after
+	// Options.Overcrop moved them out as far as it could.
+	Overcrop Sides
+}
+
+// Estimate is one algorithm's estimate of the angle of a page.
+type Estimate struct {
+	Algorithm  Algorithm
+	Angle      float64
+	Confidence float64 // between 0 and 1
+}
+
+// Disagreement returns the largest difference between any two of t's angle
+// Estimates, or 0 if there are fewer than two.
+func (t *Transform) Disagreement() float64 {
+	if len(t.Estimates) < 2 {
+		return 0
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, e := range t.Estimates {
+		lo = math.Min(lo, e.Angle)
+		hi = math.Max(hi, e.Angle)
+	}
+	return hi - lo
 }
 
+// ciZ is the z-score of a 95% confidence interval.
+const ciZ = 1.96
+
+// minCoverage is the fraction of samples on a side that must find an edge for
+// that side to be considered to have a border at all.
+const minCoverage = 0.1
+
 // String returns the ImageMagick/GraphicsMagick flags required to perform the
 // transformation.
 //
 // When ImageMagick rotates an image, it adds long thin triangles on each side
-// to avoid losing any pixels in the original image. This adds more width that
-// we need to add to the crop bounds.
+// to avoid losing any pixels in the original image, which moves the page. The
+// crop is where the page ends up on the grown image (see Crop), with +repage
+// so that ImageMagick measures it from the corner of that image rather than
+// of the original. Fit says what to do about the triangles. With any other
+// Pivot, the rotation is done with -distort SRT about the pivot instead,
+// which keeps the size of the image and fills in white.
+//
+// If the page needs a perspective correction, it is done with -distort
+// Perspective instead of the rotation.
 func (t Transform) String() string {
+	return t.Format(DefaultFormat)
+}
 
-	r := math.Sin(-t.Angle) / 2
-	left := t.Bounds.Min.X + int(float64(t.Bounds.Dy())*r)
-	top := t.Bounds.Min.Y + int(float64(t.Bounds.Dx())*r)
+// Format is like String, with the numbers written as f says.
+func (t Transform) Format(f NumberFormat) string {
+	orientation := ""
+	if t.Orientation != 0 {
+		orientation = fmt.Sprintf("-rotate %d ", t.Orientation)
+	}
+
+	if t.Perspective {
+		return orientation + t.perspectiveString(f)
+	}
 
-	return fmt.Sprintf("-rotate %f -crop %dx%d+%d+%d",
-		util.Rad2deg(t.Angle), t.Bounds.Dx(), t.Bounds.Dy(), left, top)
+	r := t.Crop()
+	if t.Pivot != PivotImage {
+		px, py, _, _ := t.pivot()
+		return fmt.Sprintf("%s-virtual-pixel white -distort SRT '%s,%s %s' -crop %s +repage", orientation,
+			strconv.FormatFloat(px, 'f', -1, 64), strconv.FormatFloat(py, 'f', -1, 64),
+			f.angle(util.Rad2deg(t.Angle)), f.geometry(r))
+	}
+	return fmt.Sprintf("%s-rotate %s +repage -crop %s", orientation,
+		f.angle(util.Rad2deg(t.Angle)), f.geometry(r))
 }
 
-// AnalyzeFile loads a PNG or JPEG file and performs Analyze on the resulting
-// image.
+// AnalyzeFile loads an image file (PNG, JPEG, GIF, TIFF, WebP or netpbm) and
+// performs Analyze on the resulting image.
 func AnalyzeFile(filename string, thresh, fc float64, n int) (*Transform, error) {
-	file, err := os.Open(filename)
+	return AnalyzeFileWith(filename, Options{Thresh: thresh, Fc: fc, N: n})
+}
+
+// AnalyzeFileWith loads an image file, or an image from a registered Source
+// (see Open), and performs AnalyzeReader on it.
+func AnalyzeFileWith(filename string, opts Options) (*Transform, error) {
+	file, err := Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
+	return AnalyzeReader(file, opts)
+}
 
-	img, _, err := image.Decode(file)
+// AnalyzeReader decodes a PNG, JPEG, GIF, TIFF, WebP or netpbm image, or one
+// of a format added with RegisterDecoder (HEIF and AVIF with the heif build
+// tag), from r and performs AnalyzeWith on it; see AnalyzeAll for all frames of a GIF and all
+// pages of a TIFF. The rotation asked for by the EXIF orientation of a JPEG
+// is added to opts.SourceRotation, so it ends up in the Orientation of the
+// Transform, which still acts on the image as stored; a mirrored one is an
+// error. If opts.DPI is zero, it is read
+// from the metadata as well. The first page of a TIFF is decoded a strip or
+// tile at a time as the analysis reads it, so the middle of a large master
+// that is stored in small strips or tiles is never decoded. A broken strip is
+// then only an error if the analysis reads it.
+func AnalyzeReader(r io.Reader, opts Options) (t *Transform, err error) {
+	if opts.Hardened {
+		defer func() {
+			if v := recover(); v != nil {
+				t, err = nil, recovered(v, opts.Logger)
+			}
+		}()
+	}
+	rot, br, err := exifRotation(bufio.NewReaderSize(r, exifPeek))
+	if err != nil {
+		return nil, err
+	}
+	opts.SourceRotation += rot
+	if opts.DPI == 0 {
+		opts.DPI = metadataDPI(br)
+	}
+	r = br
+	if opts.MaxPixels > 0 {
+		// read the header twice, once for the size and once to decode
+		var head bytes.Buffer
+		c, _, err := image.DecodeConfig(io.TeeReader(br, &head))
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.budget(c.Width, c.Height); err != nil {
+			return nil, err
+		}
+		r = io.MultiReader(&head, br)
+	}
+	img, err := decodeLazily(r)
 	if err != nil {
 		return nil, err
 	}
 
-	return Analyze(img, thresh, fc, n), nil
+	return analyzeLazily(img, opts)
 }
 
 // Analyze examines a tilted image (book page scan) with a black border to
@@ -79,8 +258,8 @@ func AnalyzeFile(filename string, thresh, fc float64, n int) (*Transform, error)
 //
 // The analysis looks in from each edge of the image, searching for the edge of
 // the page on each side. n samples are taken per side. More samples may mean
-// more accuracy, but at the cost of CPU time and memory. Each sample gets its
-// own goroutine.
+// more accuracy, but at the cost of CPU time and memory. The samples are taken
+// concurrently.
 //
 // For each sample, the distance to the edge is discovered by tracking the
 // derivative of the pixel values as a function of displacement and looking for
@@ -92,14 +271,201 @@ func AnalyzeFile(filename string, thresh, fc float64, n int) (*Transform, error)
 // this, an angle of rotation (from the slope) and the crop width (from the
 // y-intercept) are determined.
 //
+// Reproducibility
+//
+// The result depends only on the image and the options. Concurrent work only
+// ever writes each sample to its own slot, and everything that combines
+// samples runs afterwards in a fixed order, so the Transform is bit for bit
+// the same however the goroutines are scheduled and whatever GOMAXPROCS is.
+// It may differ in the last bits between architectures, since Go may fuse
+// multiplications and additions on those that can.
+//
 // Assumptions
 //
 // The analysis assumes that the background is black and the page is mostly
 // white around the edges. It only looks for rising edges (black to white).
 // Falling edges will be ignored.
+//
+// If hardly any samples on any side find a rising edge, the image is assumed
+// to be cropped already. Analyze then returns the identity Transform with
+// NoBorder set instead of fitting lines to noise. The same goes when no side
+// has at least three edges to fit a line to.
+//
+// Images less than 16 pixels wide or high can't be analyzed, and neither can
+// nonsensical parameters. Analyze returns nil for those; AnalyzeWith says why.
+// Small images are otherwise handled like large ones: n is lowered to the
+// number of pixels along the shortest side, and each side is searched at
+// least 8 pixels in (but never more than halfway across).
 func Analyze(img image.Image, thresh, fc float64, n int) *Transform {
+	t, _ := AnalyzeWith(img, Options{Thresh: thresh, Fc: fc, N: n})
+	return t
+}
+
+// AnalyzeWith is like Analyze, but takes its parameters from opts. It returns
+// an error if the options are invalid.
+func AnalyzeWith(img image.Image, opts Options) (*Transform, error) {
+	_, t, err := analyze(img, opts)
+	return t, err
+}
+
+// analyze does the work of AnalyzeWith. It also returns the analysis, which
+// holds the upright image and what was found on each side of it.
+func analyze(img image.Image, opts Options) (*analysis, *Transform, error) {
+	return analyzeGuided(img, opts, nil)
+}
+
+// analyzeGuided is analyze, looking for the edges of the upright image only
+// near the guides that aren't nil, if there are any.
+func analyzeGuided(img image.Image, opts Options, guides *[4]*guide) (a *analysis, t *Transform, err error) {
+	if opts.Hardened {
+		defer func() {
+			if v := recover(); v != nil {
+				a, t, err = nil, nil, recovered(v, opts.Logger)
+			}
+		}()
+	}
+	if b := img.Bounds(); b.Min != (image.Point{}) {
+		return analyzeMoved(img, opts)
+	}
+	if opts.Downsample > 1 {
+		return analyzeDownsampled(img, opts)
+	}
+	opts = opts.fill()
+	if err := opts.check(); err != nil {
+		return nil, nil, err
+	}
+	if b := img.Bounds(); b.Dx() < minSize || b.Dy() < minSize {
+		return nil, nil, fmt.Errorf("autocrop: image %v is too small to analyze", b)
+	} else if err := opts.budget(b.Dx(), b.Dy()); err != nil {
+		return nil, nil, err
+	}
+	if opts.Mask != nil && opts.Mask.Bounds() != img.Bounds() {
+		return nil, nil, fmt.Errorf("autocrop: mask bounds %v don't match image bounds %v", opts.Mask.Bounds(), img.Bounds())
+	}
+	mask := newExclusion(&opts, img.Bounds())
+	hint := opts.Hint
+	if !hint.Empty() {
+		if hint = hint.Intersect(img.Bounds()); hint.Empty() {
+			return nil, nil, fmt.Errorf("autocrop: hint %v is outside of the image %v", opts.Hint, img.Bounds())
+		}
+		if hint.Dx() < minSize || hint.Dy() < minSize {
+			return nil, nil, fmt.Errorf("autocrop: hint %v is too small", hint)
+		}
+	}
+
+	// a side has no more distinct positions to sample than it has pixels
+	opts.N = min(opts.N, img.Bounds().Dx(), img.Bounds().Dy())
+	opts.MaxN = min(opts.MaxN, img.Bounds().Dx(), img.Bounds().Dy())
+	if !hint.Empty() {
+		opts.N = min(opts.N, hint.Dx(), hint.Dy())
+		opts.MaxN = min(opts.MaxN, hint.Dx(), hint.Dy())
+	}
+
+	rotation, turn := (opts.SourceRotation%360+360)%360, 0
+	if !opts.PreRotated {
+		hint = rotateRect(hint, img, rotation)
+		img = rotate90(img, rotation)
+		mask = rotateMask(mask, rotation)
+		turn = rotation
+	}
+
+	orientation := 0
+	if opts.Orientation {
+		orientation = opts.session.orientation(img, turn)
+		hint = rotateRect(hint, img, orientation)
+		img = rotate90(img, orientation)
+		mask = rotateMask(mask, orientation)
+	}
+
+	a = &analysis{img: img, mask: mask, hint: hint, guides: guides, gray: opts.Gray.fixed(), alpha: hasAlpha(img), Options: &opts}
+	a.palette = a.grayPalette()
+	a.plane = opts.session.plane(a, turn+orientation)
+	var targets []image.Rectangle
+	if opts.Targets || opts.CropTargets {
+		if targets = a.findTargets(); len(targets) > 0 {
+			a.mask = exclusion{mask, targets, img.Bounds()}
+		}
+	}
+	a.debug("analyzing", "size", img.Bounds().Size(), "algorithm", opts.Algorithm, "n", opts.N, "thresh", opts.Thresh)
+	if len(targets) > 0 {
+		a.debug("targets", "rects", targets)
+	}
+	if opts.Algorithm == Hough {
+		t = a.adapt(a.hough)
+	} else {
+		t = a.adapt(a.border)
+	}
+	if a.failed != nil {
+		return nil, nil, a.failed
+	}
+	t.Orientation = (rotation + orientation) % 360
+	t.Size = img.Bounds().Size()
+	t.Fit = opts.Fit
+	t.Pivot = opts.Pivot
+
+	switch {
+	case t.NoBorder && (opts.Algorithm == Border || opts.Algorithm == Hough):
+		// leave the image alone
+	case opts.Angle != nil:
+		t.Angle = *opts.Angle
+		t.AngleErr = 0
+	case opts.Algorithm == Projection:
+		t.Angle, _ = a.projectionAngle(t)
+		t.AngleErr = projErr
+	case opts.Algorithm == Fused:
+		a.fuse(t)
+	case customAlgorithms[opts.Algorithm] != nil:
+		angle, angleErr, err := customAlgorithms[opts.Algorithm](a.img, t)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.Angle, t.AngleErr = angle, angleErr
+	}
+
+	if opts.MaxAngle > 0 && opts.Angle == nil && math.Abs(t.Angle) > opts.MaxAngle {
+		switch opts.OverAngle {
+		case OverError:
+			return nil, nil, fmt.Errorf("autocrop: angle %.3f° is beyond the maximum of %.3f°",
+				util.Rad2deg(t.Angle), util.Rad2deg(opts.MaxAngle))
+		case OverClamp:
+			a.debug("angle beyond maximum", "angle", util.Rad2deg(t.Angle), "action", opts.OverAngle)
+			t.Angle = math.Copysign(opts.MaxAngle, t.Angle)
+		case OverZero:
+			a.debug("angle beyond maximum", "angle", util.Rad2deg(t.Angle), "action", opts.OverAngle)
+			t.Angle = 0
+		}
+		// the corners came from the same failed fit
+		t.Perspective = false
+	}
+	a.debug("fit", "angle", util.Rad2deg(t.Angle), "angle_err", util.Rad2deg(t.AngleErr),
+		"bounds", t.Bounds, "perspective", t.Perspective, "no_border", t.NoBorder)
+	t.Targets = targets
+	if opts.CropTargets {
+		t.cropTargets(targets, img.Bounds())
+	}
+	if opts.Margins {
+		a.measureMargins(t)
+	}
+	if opts.Content {
+		a.cropContent(t)
+	}
+	if opts.Overcrop && !t.NoBorder && !opts.Content {
+		a.guardOvercrop(t)
+	}
+	if !t.NoBorder || opts.Content {
+		b := a.img.Bounds()
+		t.inset(b.Dx(), b.Dy(), opts.Inset, opts.InsetFrac)
+		t.constrain(b.Dx(), b.Dy(), opts.Aspect, opts.Size)
+		t.align(b.Dx(), b.Dy(), opts.Modulus)
+	}
+
+	return a, t, nil
+}
+
+// border finds the page borders on each side and fits the Transform to them.
+func (a *analysis) border() *Transform {
 	var (
-		a      = &analysis{img, thresh, fc}
+		n      = a.N
 		b      = a.img.Bounds()
 		dx     = b.Dx()
 		dy     = b.Dy()
@@ -107,156 +473,976 @@ func Analyze(img image.Image, thresh, fc float64, n int) *Transform {
 		right  = make([]float64, n)
 		top    = make([]float64, n)
 		bottom = make([]float64, n)
-		wg     = new(sync.WaitGroup)
+		holes  = [4][]bool{make([]bool, n), make([]bool, n), make([]bool, n), make([]bool, n)}
+		spans  = a.spans(dx, dy)
 	)
 
-	wg.Add(n)
+	// sample takes the samples at the indices rows and cols of the rows
+	// and the columns.
+	sample := func(rows, cols []int) {
+		a.parallel(len(rows), 0, func(lo, hi int) {
+			for _, i := range rows[lo:hi] {
+				var h [2]bool
+				left[i], right[i], h = a.analyzeX(spans[3].at(i, n), &spans)
+				holes[3][i], holes[1][i] = h[0], h[1]
+			}
+		})
+
+		// The columns are read a row at a time, so they are split into a
+		// few long runs instead of short batches. The split doesn't change
+		// any sample.
+		workers := runtime.GOMAXPROCS(0)
+		a.parallel(len(cols), (len(cols)+workers-1)/workers, func(lo, hi int) {
+			a.analyzeColumns(cols[lo:hi], &spans, top, bottom, holes[0], holes[2])
+		})
+	}
+	if a.Block > 1 {
+		a.makeTables(&spans)
+	}
+	edges := [4][]float64{top, right, bottom, left}
+	strides := [2]int{1, 1} // of the samples taken of the rows and the columns
+	if a.EarlyStop {
+		strides = a.sampleEarly(n, sample, func(i, stride int) side {
+			return a.fitSide(i, every(edges[i], stride), stride, n, spans[i], [4]int{dx, dy, dx, dy}[i])
+		})
+	} else {
+		all := stridedIndices(n, 1, 0)
+		sample(all, all)
+	}
+	if a.failed != nil {
+		return &Transform{}
+	}
 
-	for i := 0; i < n; i++ {
-		go func(i int) {
-			left[i], right[i] = a.analyzeX(i * dy / n)
-			top[i], bottom[i] = a.analyzeY(i * dx / n)
-			wg.Done()
-		}(i)
+	// only every stride of the samples were taken
+	for i := range edges {
+		edges[i] = every(edges[i], strides[1-i%2])
+		holes[i] = every(holes[i], strides[1-i%2])
 	}
 
+	t := &Transform{Sides: a.Sides}
+	for i := range edges {
+		t.Coverage[i] = coverage(edges[i])
+	}
+	if t.borderless() {
+		a.debug("no border", "coverage", t.Coverage)
+		t.identity(dx, dy)
+		return t
+	}
+
+	if a.MaskHoles {
+		for i := range edges {
+			maskHoles(edges[i], holes[i])
+		}
+	}
+
+	var sides [4]side
+	for i := range sides {
+		sides[i] = a.fitSide(i, edges[i], strides[1-i%2], n, spans[i], [4]int{dx, dy, dx, dy}[i])
+		a.debugSide(i, &sides[i], t.Coverage[i])
+	}
+
+	t.fit(dx, dy, &sides)
+	a.sides = sides
+
+	return t
+}
+
+// parallel calls f with the batches lo to hi of the indices 0 to n, of size
+// each but the last, on at most GOMAXPROCS goroutines, each of which takes
+// the next batch when it is done with one. A size of 0 makes a few batches
+// for each goroutine. It returns when every batch is done.
+func (a *analysis) parallel(n, size int, f func(lo, hi int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if size <= 0 {
+		size = max(1, n/(4*workers))
+	}
+	workers = min(workers, (n+size-1)/size)
+	var (
+		next atomic.Int64
+		wg   sync.WaitGroup
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			defer a.guard()
+			for {
+				lo := int(next.Add(int64(size))) - size
+				if lo >= n {
+					return
+				}
+				f(lo, min(lo+size, n))
+			}
+		}()
+	}
 	wg.Wait()
+}
 
-	t := &Transform{}
-	angles := make([]float64, 4)
+// fitSide fits side i, whose span is sp along a side of the image size pixels
+// long, to its edges, which were found by every stride of n samples.
+func (a *analysis) fitSide(i int, edges []float64, stride, n int, sp span, size int) side {
+	s := a.analyzeResult(edges, [4]float64{-1, -1, 1, 1}[i], n, stride*sp.length)
+	s.stride = stride
+	// The side was fitted to the middle of its samples rather than of the
+	// image. The middle of the samples is past that of the span if the
+	// stride doesn't divide n.
+	past := float64(len(edges)*stride-n) / 2 * float64(sp.length) / float64(n)
+	s.shift(sp.offset(size) - past)
+	return s
+}
 
-	angles[0], t.Confidence[0], t.Bounds.Min.Y = analyzeResult(top, -1, n, dx, 0)
-	angles[1], t.Confidence[1], t.Bounds.Max.X = analyzeResult(right, -1, n, dy, 1)
-	angles[2], t.Confidence[2], t.Bounds.Max.Y = analyzeResult(bottom, 1, n, dx, 2)
-	angles[3], t.Confidence[3], t.Bounds.Min.X = analyzeResult(left, 1, n, dy, 3)
+// borderless reports whether too few samples found an edge on every side for
+// the image to have a border at all.
+func (t *Transform) borderless() bool {
+	for i, c := range t.Coverage {
+		if t.Sides.Has(i) && c >= minCoverage {
+			return false
+		}
+	}
+	return true
+}
 
-	t.Bounds.Max.X = dx - t.Bounds.Max.X
-	t.Bounds.Max.Y = dy - t.Bounds.Max.Y
+// identity makes t leave a dx×dy image as it is, and marks it as having no
+// border.
+func (t *Transform) identity(dx, dy int) {
+	t.Bounds = image.Rect(0, 0, dx, dy)
+	t.Conservative = t.Bounds
+	t.Aggressive = t.Bounds
+	t.NoBorder = true
+}
+
+// fit sets the angle, crops and confidence of t from the lines fitted to each
+// side of a dx×dy image. Sides on which hardly any edges were found are left
+// alone, like the sides that weren't asked for. If that leaves no sides, the
+// image is left alone as if it had no border.
+func (t *Transform) fit(dx, dy int, sides *[4]side) {
+	var angles []float64
+	for i := range sides {
+		if !t.Sides.Has(i) || t.Coverage[i] < minCoverage || sides[i].found < minSamples {
+			sides[i] = side{}
+			continue
+		}
+		angles = append(angles, sides[i].angle)
+		t.Fitted |= 1 << uint(i)
+		t.SideAngles[i] = sides[i].angle
+		t.Confidence[i] = sides[i].confidence
+		t.Curl[i] = sides[i].curl
+	}
+	if len(angles) == 0 {
+		t.identity(dx, dy)
+		return
+	}
+
+	t.Bounds = sideRect(dx, dy, sides, func(s side) int { return s.crop })
+	t.Conservative = sideRect(dx, dy, sides, func(s side) int { return s.outer })
+	t.Aggressive = sideRect(dx, dy, sides, func(s side) int { return s.inner })
 
 	t.Angle = util.Mean(angles...)
+	t.keystone(dx, dy, sides)
 
-	return t
+	// The angle is the mean of independent estimates.
+	variance := 0.
+	for i, s := range sides {
+		variance += s.angleErr * s.angleErr
+		t.CropErr[i] = ciZ * s.cropErr
+	}
+	t.AngleErr = ciZ * math.Sqrt(variance) / float64(len(angles))
+}
+
+// coverage returns the fraction of edges that were found, i.e. are nonzero.
+func coverage(edges []float64) float64 {
+	found := 0
+	for _, e := range edges {
+		if e != 0 {
+			found++
+		}
+	}
+	return float64(found) / float64(len(edges))
+}
+
+// side is the interpretation of the edges found on one side of the image.
+// Distances are measured inwards from the edge of the image.
+type side struct {
+	angle      float64 // rotation that would make the side straight
+	slope      float64 // change in distance per pixel along the side
+	curl       float64 // how far the samples bow away from a line
+	confidence float64 // r^2 of the linear fit
+	crop       int     // distance to the fitted line at the middle of the side
+	outer      int     // distance to the outermost edge sample
+	inner      int     // distance to the innermost edge sample
+	cropErr    float64 // standard error of crop
+	angleErr   float64 // standard error of angle
+	found      int     // number of edges the line was fitted to
+
+	trace // for diagnostics
+}
+
+// trace is what a side was fitted from: the edge found by each sample, the
+// samples after cleaning, the window [lo, hi) of them that was trusted, and
+// the line a + b*x fitted to them. With EarlyStop, the samples may be only
+// every stride of them.
+type trace struct {
+	raw, cleaned []float64
+	lo, hi       int
+	a, b         float64
+	stride       int // of the N samples, every one of which raw holds
+}
+
+// shift moves the distances of s from the middle of the samples it was
+// fitted to by d pixels along the side.
+func (s *side) shift(d float64) {
+	if d == 0 {
+		return
+	}
+	by := int(math.Round(s.slope * d))
+	s.crop += by
+	s.inner += by
+	s.outer += by
+}
+
+// sideRect returns the rectangle inside a dx×dy image that is d(s) in from
+// each of the sides, which are in CSS box order.
+func sideRect(dx, dy int, sides *[4]side, d func(side) int) image.Rectangle {
+	return image.Rect(d(sides[3]), d(sides[0]), dx-d(sides[1]), dy-d(sides[2]))
 }
 
 // Interpret a sample set for the angle and crop size.
-func analyzeResult(edges []float64, dir float64, n, d, i int) (angle, confidence float64, crop int) {
-	q := 200
-	lo, hi := util.Trim(edges, float64(q))
+//
+// If AvoidCurl is set and the samples curve, only the straight part of them is
+// fitted.
+func (a *analysis) analyzeResult(edges []float64, dir float64, n, d int) (s side) {
+	p := &a.Params
+	lo, hi := util.Trim(edges, p.TrimDepth)
 
-	edges = util.Lowpass(edges, .1)
-	util.Clean(edges, float64(q), 24, 4, 8)
-	a, b, r := util.LinearFit(edges)
-	crop = int(a + b*float64(len(edges))/2)
+	raw := edges
+	edges = util.Lowpass(edges, p.EdgeFc)
+	for t, e := range raw {
+		// the filter leaves a tail running off into runs of missing edges,
+		// like those of excluded areas, which would be fitted as edges
+		if e == 0 {
+			edges[t] = 0
+		}
+	}
+	s.curl = curl(edges, lo, hi)
+	if a.AvoidCurl && s.curl > curlTolerance {
+		from, to := straightPart(edges, lo, hi)
+		for t := range edges {
+			if t < from || t >= to {
+				edges[t] = 0
+			}
+		}
+		lo, hi = from, to
+	}
+	for _, e := range raw[lo:hi] {
+		if e != 0 {
+			s.found++
+		}
+	}
+	util.Clean(edges, p.LineDev, p.ChunkDev, p.ChunkSize)
+	alpha, b, r, ok := util.LinearFitOK(edges)
+	if !ok {
+		// every edge was thrown out as noise
+		s.found = 0
+		return
+	}
+	mid := alpha + b*float64(len(edges))/2
+	s.crop = int(mid)
+	s.trace = trace{raw, edges, lo, hi, alpha, b, 1}
 
-	/*
-		chart(edges, crop, lo, hi, func(x int) int {
-			return int(b*float64(x) + a)
-		}, fmt.Sprintf("side%d.png", i))
-	*/
+	// How far the samples stray from the line either way gives the range in
+	// which the page edge could be, once the line has been straightened out.
+	var in, out float64
+	for t := lo; t < hi; t++ {
+		res := edges[t] - (alpha + b*float64(t))
+		in = math.Max(in, res)
+		out = math.Min(out, res)
+	}
+	s.inner = int(mid + in)
+	s.outer = int(mid + out)
 
-	edges = edges[lo:hi]
+	s.slope = b * float64(n) / float64(d)
+	s.angle = math.Atan(s.slope * dir)
+	s.confidence = r
+	s.cropErr, s.angleErr = lineErr(raw, alpha, b, dir*float64(n)/float64(d), p.LineDev)
 
-	angle = math.Atan(b * dir * float64(n) / float64(d))
-	confidence = r
+	return
+}
 
+// lineErr returns the standard errors of the crop and angle of a side whose
+// edges were fitted to the line a + b*x, where the angle is atan(k*b). Only
+// the raw edges within dev of the line are used, since the others have been
+// replaced to fit it.
+func lineErr(edges []float64, a, b, k, dev float64) (cropErr, angleErr float64) {
+	inliers := make([]float64, len(edges))
+	for x, y := range edges {
+		if math.Abs(y-(a+b*float64(x))) <= dev {
+			inliers[x] = y
+		}
+	}
+
+	cropErr, seB, ok := util.StdErrOK(inliers, a, b, float64(len(edges))/2)
+	if !ok {
+		// too few inliers to tell; the side could be anywhere
+		return math.Inf(1), math.Inf(1)
+	}
+	angleErr = math.Abs(k) * seB / (1 + k*b*k*b)
 	return
 }
 
 type analysis struct {
-	img    image.Image // image data
-	thresh float64     // color value rising edge threshold
-	fc     float64     // cutoff frequency for low-pass denoise filter
+	img     image.Image     // image data
+	mask    image.Image     // areas to leave out, or nil
+	hint    image.Rectangle // rough bounds of the page, or empty
+	guides  *[4]*guide      // lines near the edges, from the analysis of a shrunk copy, or nil
+	gray    [3]uint64       // fixed point Options.Gray, or zero for the average
+	palette []float64       // gray values of the colors of a paletted img, or nil
+	plane   *grayPlane      // gray values of img, or nil to convert them each time
+	tables  [4]*integral    // summed-area tables of the strips along the sides (T,R,B,L), with Block
+	alpha   bool            // img may have transparent pixels
+	moved   image.Point     // how far the Transform was moved from img
+	shrink  int             // how many times smaller img is than the Transform's image, if more than 1
+	*Options
+
+	failMu sync.Mutex
+	failed error // the first panic recovered by guard
+
+	sides [4]side // what was found on each side, for diagnostics
+}
+
+// grayAt returns the image's gray value at the x, y coordinate, from 0 to
+// 255. Images with more than 8 bits per channel keep their precision in the
+// fraction, so that faint shadows along the edge of the page survive.
+// Colors are premultiplied by their alpha, so transparent pixels are black,
+// like the background. The values come from the gray plane once analyze has
+// made it.
+func (a *analysis) grayAt(x, y int) float64 {
+	if p := a.plane; p != nil {
+		if !(image.Point{x, y}.In(p.rect)) {
+			return p.outside
+		}
+		return float64(p.row(y)[x-p.rect.Min.X]) / 257
+	}
+	return a.convertAt(x, y)
+}
+
+// grayPlane holds the gray values of the whole image, times 257 so that 16
+// bits of precision survive, to spare grayAt converting a pixel through the
+// image.Image interface each time it is sampled. Each row is converted when
+// it is first read, since the border is found from a few of them.
+type grayPlane struct {
+	pix     []uint16 // row by row
+	rect    image.Rectangle
+	outside float64 // the gray value of the points outside of rect
+	convert func(x, y, dx, dy int, px []uint16)
+	pixels  bool          // convert takes about as long for a pixel as for each of a row
+	done    []atomic.Bool // rows converted
+	mu      sync.Mutex    // held while converting a row
+}
+
+// makePlane returns a gray plane of the image, if its pixels can be read
+// without going through At, as those of the types that decoders return can.
+// Converting every pixel through At costs more than the samples that grayAt
+// is asked for, so the likes of custom images are still converted a sample at
+// a time. A Gray image is a plane already.
+func (a *analysis) makePlane() *grayPlane {
+	convert := a.planeRun()
+	if convert == nil {
+		return nil
+	}
+	b := a.img.Bounds()
+	_, lazy := a.img.(*lazyTIFF) // which finds the strip of each call
+	return &grayPlane{
+		pix:     make([]uint16, b.Dx()*b.Dy()),
+		rect:    b,
+		outside: a.convertAt(b.Min.X-1, b.Min.Y-1),
+		convert: convert,
+		pixels:  !lazy,
+		done:    make([]atomic.Bool, b.Dy()),
+	}
+}
+
+// row returns row y of the plane, converting it first if no one has yet.
+func (p *grayPlane) row(y int) []uint16 {
+	i, dx := y-p.rect.Min.Y, p.rect.Dx()
+	row := p.pix[i*dx : (i+1)*dx]
+	if !p.done[i].Load() {
+		p.mu.Lock()
+		if !p.done[i].Load() {
+			p.convert(p.rect.Min.X, y, 1, 0, row)
+			p.done[i].Store(true)
+		}
+		p.mu.Unlock()
+	}
+	return row
+}
+
+// runPool holds the buffers that grayPlane.sample converts runs of pixels
+// into, which would otherwise be allocated for each run, as convert keeps the
+// compiler from knowing that they don't outlive it.
+var runPool = sync.Pool{New: func() any { return new([256]uint16) }}
+
+// sample stores in samples the gray values of the pixels at x+i*dx, y+i*dy,
+// like grayAt, converting them straight from the image a run at a time
+// instead of converting the rows they are in into the plane. The run is a row
+// or a column, as for convert, and the pixels of it outside of the image
+// take the gray value of the points there.
+func (p *grayPlane) sample(samples []float64, x, y, dx, dy int) {
+	buf := runPool.Get().(*[256]uint16)
+	defer runPool.Put(buf)
+	for len(samples) > 0 {
+		if !(image.Point{x, y}.In(p.rect)) {
+			samples[0] = p.outside
+			samples = samples[1:]
+			x, y = x+dx, y+dy
+			continue
+		}
+		// up to the side of the image, a buffer at a time
+		n := min(len(samples), len(buf))
+		switch {
+		case dx > 0:
+			n = min(n, p.rect.Max.X-x)
+		case dx < 0:
+			n = min(n, x-p.rect.Min.X+1)
+		case dy > 0:
+			n = min(n, p.rect.Max.Y-y)
+		case dy < 0:
+			n = min(n, y-p.rect.Min.Y+1)
+		}
+		p.convert(x, y, dx, dy, buf[:n])
+		for i, v := range buf[:n] {
+			samples[i] = float64(v) / 257
+		}
+		samples = samples[n:]
+		x, y = x+n*dx, y+n*dy
+	}
+}
+
+// planeRun returns a function that converts the run of pixels of the image
+// at x+i*dx, y+i*dy, for each i of px, to their gray values times 257, as
+// makePlane stores them, for the images that makePlane converts. The run is a
+// row with dx ±1 and dy 0, or a column with dx 0 and dy ±1, and must be in
+// the image. Each is converted in one loop over the image's Pix, stepping
+// from pixel to pixel instead of finding each. It returns nil for the others.
+func (a *analysis) planeRun() func(x, y, dx, dy int, px []uint16) {
+	return a.planeRunOf(a.img)
+}
+
+// planeRunOf is planeRun for img, which is a.img or a part of it.
+func (a *analysis) planeRunOf(img image.Image) func(x, y, dx, dy int, px []uint16) {
+	switch p := img.(type) {
+	case *lazyTIFF:
+		if p.tiled {
+			return nil // a row would decode every tile across it
+		}
+		return func(x, y, dx, dy int, px []uint16) {
+			for len(px) > 0 {
+				// to the end of the strip, which a row doesn't leave
+				n := len(px)
+				if top := y / p.size.Y * p.size.Y; dy > 0 {
+					n = min(n, top+p.size.Y-y)
+				} else if dy < 0 {
+					n = min(n, y-top+1)
+				}
+				strip := p.blockAt(x, y)
+				if convert := a.planeRunOf(strip); convert != nil && !strip.Bounds().Empty() {
+					convert(x, y, dx, dy, px[:n])
+				} else {
+					// a Gray strip, or one that couldn't be decoded
+					for i := range px[:n] {
+						px[i] = uint16(a.convertIn(strip, x+i*dx, y+i*dy)*257 + 0.5)
+					}
+				}
+				px = px[n:]
+				x, y = x+n*dx, y+n*dy
+			}
+		}
+	case *image.YCbCr:
+		return func(x, y, dx, dy int, px []uint16) {
+			for i := range px {
+				yi, ci := p.YOffset(x, y), p.COffset(x, y)
+				r, g, b, _ := color.YCbCr{Y: p.Y[yi], Cb: p.Cb[ci], Cr: p.Cr[ci]}.RGBA()
+				px[i] = a.level16(r, g, b)
+				x, y = x+dx, y+dy
+			}
+		}
+	case *image.RGBA:
+		return func(x, y, dx, dy int, px []uint16) {
+			o, step := p.PixOffset(x, y), 4*dx+p.Stride*dy
+			for i := range px {
+				c := p.Pix[o : o+3 : o+3]
+				px[i] = a.level16(uint32(c[0])*0x101, uint32(c[1])*0x101, uint32(c[2])*0x101)
+				o += step
+			}
+		}
+	case *image.NRGBA:
+		return func(x, y, dx, dy int, px []uint16) {
+			o, step := p.PixOffset(x, y), 4*dx+p.Stride*dy
+			for i := range px {
+				c := p.Pix[o : o+4 : o+4]
+				o += step
+				if c[3] == 0xff {
+					px[i] = a.level16(uint32(c[0])*0x101, uint32(c[1])*0x101, uint32(c[2])*0x101)
+					continue
+				}
+				r, g, b, _ := color.NRGBA{c[0], c[1], c[2], c[3]}.RGBA()
+				px[i] = a.level16(r, g, b)
+			}
+		}
+	case *image.RGBA64:
+		return func(x, y, dx, dy int, px []uint16) {
+			o, step := p.PixOffset(x, y), 8*dx+p.Stride*dy
+			for i := range px {
+				c := p.Pix[o : o+6 : o+6]
+				px[i] = a.level16(uint32(c[0])<<8|uint32(c[1]), uint32(c[2])<<8|uint32(c[3]), uint32(c[4])<<8|uint32(c[5]))
+				o += step
+			}
+		}
+	case *image.NRGBA64:
+		return func(x, y, dx, dy int, px []uint16) {
+			o, step := p.PixOffset(x, y), 8*dx+p.Stride*dy
+			for i := range px {
+				c := p.Pix[o : o+8 : o+8]
+				r, g, b, _ := color.NRGBA64{
+					uint16(c[0])<<8 | uint16(c[1]), uint16(c[2])<<8 | uint16(c[3]),
+					uint16(c[4])<<8 | uint16(c[5]), uint16(c[6])<<8 | uint16(c[7]),
+				}.RGBA()
+				px[i] = a.level16(r, g, b)
+				o += step
+			}
+		}
+	case *image.Gray16:
+		return func(x, y, dx, dy int, px []uint16) {
+			o, step := p.PixOffset(x, y), 2*dx+p.Stride*dy
+			for i := range px {
+				px[i] = uint16(p.Pix[o])<<8 | uint16(p.Pix[o+1])
+				o += step
+			}
+		}
+	case *image.CMYK:
+		return func(x, y, dx, dy int, px []uint16) {
+			o, step := p.PixOffset(x, y), 4*dx+p.Stride*dy
+			for i := range px {
+				c := p.Pix[o : o+4 : o+4]
+				v := a.blend(255-float64(c[0]), 255-float64(c[1]), 255-float64(c[2])) * (255 - float64(c[3])) / 255
+				px[i] = uint16(v*257 + 0.5)
+				o += step
+			}
+		}
+	case *image.Paletted:
+		if a.palette == nil {
+			return nil
+		}
+		grays := make([]uint16, 256)
+		for i := range grays {
+			grays[i] = uint16(a.palette[min(i, len(a.palette)-1)]*257 + 0.5)
+		}
+		return func(x, y, dx, dy int, px []uint16) {
+			o, step := p.PixOffset(x, y), dx+p.Stride*dy
+			for i := range px {
+				if c := p.Pix[o]; int(c) < len(a.palette) {
+					px[i] = grays[c]
+				} else {
+					px[i] = uint16(a.convertAt(x+i*dx, y+i*dy)*257 + 0.5)
+				}
+				o += step
+			}
+		}
+	}
+	return nil
+}
+
+// convertAt converts the pixel at x, y to the gray value that grayAt returns.
+// This function is a pain point due to I2T conversions and sheer # of calls,
+// which is why the gray plane and the samplers convert runs of pixels
+// straight from the image instead where they can.
+func (a *analysis) convertAt(x, y int) float64 {
+	return a.convertIn(a.img, x, y)
+}
+
+// convertIn is convertAt for img, which is a.img or a part of it.
+func (a *analysis) convertIn(img image.Image, x, y int) float64 {
+	switch p := img.(type) {
+	case *image.Gray:
+		if !(image.Point{x, y}.In(p.Rect)) {
+			return 0 // like At
+		}
+		return float64(p.Pix[p.PixOffset(x, y)])
+	case *image.Gray16:
+		if !(image.Point{x, y}.In(p.Rect)) {
+			return 0
+		}
+		i := p.PixOffset(x, y)
+		return float64(uint16(p.Pix[i])<<8|uint16(p.Pix[i+1])) / 257
+	case *image.CMYK:
+		if !(image.Point{x, y}.In(p.Rect)) {
+			return 0
+		}
+		// The light that is left after the cyan, magenta and yellow inks
+		// is weighed like red, green and blue, and then the black ink
+		// takes its share of what is left. Going through At would round
+		// each component to 16 bits first.
+		i := p.PixOffset(x, y)
+		c := p.Pix[i : i+4 : i+4]
+		return a.blend(255-float64(c[0]), 255-float64(c[1]), 255-float64(c[2])) * (255 - float64(c[3])) / 255
+	case *image.YCbCr:
+		if !(image.Point{x, y}.In(p.Rect)) {
+			return 0
+		}
+		yi, ci := p.YOffset(x, y), p.COffset(x, y)
+		r, g, b, _ := color.YCbCr{Y: p.Y[yi], Cb: p.Cb[ci], Cr: p.Cr[ci]}.RGBA()
+		return a.gray16(r, g, b)
+	case *image.RGBA:
+		if !(image.Point{x, y}.In(p.Rect)) {
+			return 0
+		}
+		i := p.PixOffset(x, y)
+		c := p.Pix[i : i+3 : i+3]
+		return a.gray16(uint32(c[0])*0x101, uint32(c[1])*0x101, uint32(c[2])*0x101)
+	case *image.NRGBA:
+		if !(image.Point{x, y}.In(p.Rect)) {
+			return 0
+		}
+		i := p.PixOffset(x, y)
+		c := p.Pix[i : i+4 : i+4]
+		r, g, b, _ := color.NRGBA{c[0], c[1], c[2], c[3]}.RGBA()
+		return a.gray16(r, g, b)
+	case *image.Paletted:
+		if a.palette != nil {
+			if !(image.Point{x, y}.In(p.Rect)) {
+				return a.palette[0] // like At
+			}
+			if i := p.Pix[p.PixOffset(x, y)]; int(i) < len(a.palette) {
+				return a.palette[i]
+			}
+		}
+	case *lazyTIFF:
+		return a.convertIn(p.blockAt(x, y), x, y)
+	}
+	return a.grayOf(img.At(x, y))
+}
+
+// grayOf returns the gray value of c, like grayAt.
+func (a *analysis) grayOf(c color.Color) float64 {
+	r, g, b, _ := c.RGBA()
+	return a.gray16(r, g, b)
+}
+
+// gray16 returns the gray value of the 16 bit red, green and blue levels r,
+// g, b, like grayAt.
+func (a *analysis) gray16(r, g, b uint32) float64 {
+	if w := a.gray; w != [3]uint64{} {
+		return float64(w[0]*uint64(r)+w[1]*uint64(g)+w[2]*uint64(b)) / (1 << 24 * 257)
+	}
+	return float64(r+g+b) / (3 * 257)
+}
+
+// level16 returns the gray value of the 16 bit levels r, g, b times 257, as
+// makePlane stores it, in integers.
+func (a *analysis) level16(r, g, b uint32) uint16 {
+	if w := a.gray; w != [3]uint64{} {
+		return uint16((w[0]*uint64(r) + w[1]*uint64(g) + w[2]*uint64(b) + 1<<23) >> 24)
+	}
+	return uint16((2*(r+g+b) + 3) / 6)
 }
 
-// grayAt returns the image's gray value at the x, y coordinate.
-// This function is a pain point due to I2T conversions and sheer # of calls.
-func (a *analysis) grayAt(x, y int) uint8 {
-	if p, ok := a.img.(*image.Gray); ok {
-		return p.Pix[p.PixOffset(x, y)]
+// grayPalette returns the gray values of the colors of img if it is paletted,
+// like the scans in GIFs, or a lazyTIFF whose blocks are, so that convertAt
+// can look them up. Otherwise it returns nil.
+func (a *analysis) grayPalette() []float64 {
+	p, ok := a.img.ColorModel().(color.Palette)
+	if !ok || len(p) == 0 {
+		return nil
+	}
+	grays := make([]float64, len(p))
+	for i, c := range p {
+		grays[i] = a.grayOf(c)
 	}
+	return grays
+}
 
-	r, g, b, _ := a.img.At(x, y).RGBA()
-	return uint8((r + g + b) / 3) // dumb blend, no need for visual aesthetics
+// blend returns the gray level of the red, green and blue levels r, g, b,
+// weighed by Options.Gray.
+func (a *analysis) blend(r, g, b float64) float64 {
+	if w := a.gray; w != [3]uint64{} {
+		return (float64(w[0])*r + float64(w[1])*g + float64(w[2])*b) / (1 << 24)
+	}
+	return (r + g + b) / 3
+}
+
+// ink reports whether the pixel at x, y is ink. Fully transparent pixels, as
+// around the page of a scan that was already matted, are background however
+// dark they are.
+func (a *analysis) ink(x, y int) bool {
+	if a.grayAt(x, y) >= inkLevel {
+		return false
+	}
+	if a.alpha {
+		_, _, _, alpha := a.img.At(x, y).RGBA()
+		return alpha != 0
+	}
+	return true
 }
 
-func (a *analysis) analyzeX(y int) (left, right float64) {
+// hasAlpha reports whether img may have pixels that aren't opaque.
+func hasAlpha(img image.Image) bool {
+	o, ok := img.(interface{ Opaque() bool })
+	return !ok || !o.Opaque()
+}
+
+// analyzeX finds the left and right edges of row y within the spans of the
+// sides. holes reports for each whether the paper past it is broken by a dark
+// blob.
+func (a *analysis) analyzeX(y int, spans *[4]span) (left, right float64, holes [2]bool) {
 	dx := a.img.Bounds().Dx()
-	m := dx / 16 // this is the portion of the image that is processed.
-	samples := make([]float64, m)
+	l, r := spans[3], spans[1]
 
-	a.sampleX(samples, y, 0, m, 1)
-	left = a.search(samples)
+	buf := getSamples(max(l.m, r.m))
+	defer putSamples(buf)
 
-	a.sampleX(samples, y, dx, dx-m, -1)
-	right = a.search(samples)
+	ld, rd := l.depthAt(y), r.depthAt(y)
+	reach := int(holeReach * float64(dx))
+	samples := buf[:l.m]
+	a.sampleX(samples, y, ld, ld+l.m, 1)
+	if !a.excluded(image.Rect(ld, y, ld+l.m, y+1)) {
+		left, holes[0] = a.search(samples, reach)
+		left = deepen(left, ld)
+	}
+
+	samples = buf[:r.m]
+	a.sampleX(samples, y, dx-rd, dx-rd-r.m, -1)
+	if !a.excluded(image.Rect(dx-rd-r.m, y, dx-rd, y+1)) {
+		right, holes[1] = a.search(samples, reach)
+		right = deepen(right, rd)
+	}
 
 	return
 }
 
-func (a *analysis) analyzeY(x int) (top, bottom float64) {
+// deepen turns an edge found in samples starting depth pixels in into a
+// distance from the edge of the image. Zero still means no edge was found.
+func deepen(edge float64, depth int) float64 {
+	if edge == 0 {
+		return 0
+	}
+	return edge + float64(depth)
+}
+
+// analyzeColumns is like analyzeX for the top and bottom edges of the columns
+// of the samples at indices, storing them and their holes at the same
+// indices.
+func (a *analysis) analyzeColumns(indices []int, spans *[4]span, top, bottom []float64, topHoles, bottomHoles []bool) {
 	dy := a.img.Bounds().Dy()
-	m := dy / 16
-	samples := make([]float64, m)
+	t, b := spans[0], spans[2]
+	reach := int(holeReach * float64(dy))
 
-	a.sampleY(samples, x, 0, m, 1)
-	top = a.search(samples)
+	xs := make([]int, len(indices))
+	depths := make([]int, len(indices))
+	for k, i := range indices {
+		xs[k] = t.at(i, a.N)
+		depths[k] = t.depthAt(xs[k])
+	}
 
-	a.sampleY(samples, x, dy, dy-m, -1)
-	bottom = a.search(samples)
+	band, buf := makeBand(len(xs), t.m)
+	a.sampleRows(band, xs, depths, 1)
+	for k, samples := range band {
+		if !a.excluded(image.Rect(xs[k], depths[k], xs[k]+1, depths[k]+t.m)) {
+			i := indices[k]
+			top[i], topHoles[i] = a.search(samples, reach)
+			top[i] = deepen(top[i], depths[k])
+		}
+	}
 
-	return
+	putSamples(buf)
+
+	starts := make([]int, len(xs))
+	for k, x := range xs {
+		depths[k] = b.depthAt(x)
+		starts[k] = dy - depths[k]
+	}
+	band, buf = makeBand(len(xs), b.m)
+	defer putSamples(buf)
+	a.sampleRows(band, xs, starts, -1)
+	for k, samples := range band {
+		if !a.excluded(image.Rect(xs[k], dy-depths[k]-b.m, xs[k]+1, dy-depths[k])) {
+			i := indices[k]
+			bottom[i], bottomHoles[i] = a.search(samples, reach)
+			bottom[i] = deepen(bottom[i], depths[k])
+		}
+	}
 }
 
+// makeBand returns n sets of m samples for sampleRows, and the buffer from
+// samplePool that they are in, which goes back to it when they are done with.
+func makeBand(n, m int) (band [][]float64, buf []float64) {
+	buf = getSamples(n * m)
+	band = make([][]float64, n)
+	for k := range band {
+		band[k] = buf[k*m : (k+1)*m : (k+1)*m]
+	}
+	return band, buf
+}
+
+// samplePool holds the buffers of samples and their derivatives, which each
+// sample along each side needs one of, so that the analysis of one image
+// after another doesn't keep the garbage collector busy.
+var samplePool sync.Pool
+
+// sampleBoxes holds the pointers that samplePool held buffers in, for
+// putSamples to put the next buffer in instead of allocating one.
+var sampleBoxes sync.Pool
+
+// getSamples returns a buffer of n samples from samplePool, or a new one if
+// it has none that big. The samples in it are left over from before.
+func getSamples(n int) []float64 {
+	if p, ok := samplePool.Get().(*[]float64); ok {
+		s := *p
+		*p = nil
+		sampleBoxes.Put(p)
+		if cap(s) >= n {
+			return s[:n]
+		}
+	}
+	return make([]float64, n)
+}
+
+// putSamples puts the buffer s back in samplePool.
+func putSamples(s []float64) {
+	p, ok := sampleBoxes.Get().(*[]float64)
+	if !ok {
+		p = new([]float64)
+	}
+	*p = s
+	samplePool.Put(p)
+}
+
+// sampleX stores in samples the samples of row y from x = start to end,
+// exclusive, by steps of delta, which is 1 or -1. Where it can, it converts
+// the run of them straight from the image, rather than the whole row into the
+// gray plane for the few pixels near a side that it samples.
 func (a *analysis) sampleX(samples []float64, y, start, end, delta int) {
+	if p := a.plane; p != nil && p.pixels && a.Block <= 1 {
+		p.sample(samples[:(end-start)*delta], start, y, delta, 0)
+		return
+	}
 	for x, i := start, 0; x != end; x, i = x+delta, i+1 {
-		samples[i] = float64(a.grayAt(x, y))
+		samples[i] = a.sampleAt(x, y)
+	}
+}
+
+// sampleRows is like sampleX for the columns xs, storing the samples of column
+// xs[k], from row starts[k] on, by steps of delta, in band[k]. Where it can,
+// it converts the run of each column straight from the image, instead of the
+// whole width of each row of the strip into the gray plane for the few
+// columns sampled in it. Otherwise it reads all of the columns together a
+// row at a time, which is the order the pixels are stored in, rather than
+// down each column.
+func (a *analysis) sampleRows(band [][]float64, xs, starts []int, delta int) {
+	if len(band) == 0 {
+		return
+	}
+	if p := a.plane; p != nil && p.pixels && a.Block <= 1 {
+		for k, x := range xs {
+			p.sample(band[k], x, starts[k], 0, delta)
+		}
+		return
+	}
+	for i := range band[0] {
+		for k, x := range xs {
+			band[k][i] = a.sampleAt(x, starts[k]+i*delta)
+		}
 	}
 }
 
-func (a *analysis) sampleY(samples []float64, x, start, end, delta int) {
-	for y, i := start, 0; y != end; y, i = y+delta, i+1 {
-		samples[i] = float64(a.grayAt(x, y))
+// derivative returns the derivative of samples, with noise filtered out of
+// both, in a buffer from samplePool for the caller to put back. A FilterTo
+// filters into the buffer, which is then differentiated and filtered again
+// in place.
+func (a *analysis) derivative(samples []float64) []float64 {
+	d := getSamples(len(samples))
+	if f, ok := a.Filter.(FilterTo); ok {
+		d = f.FilterTo(d, samples)
+	} else {
+		copy(d, a.Filter.Filter(samples))
 	}
+	util.DifferentiateTo(d, d)
+	return util.LowpassTo(d, d, a.Params.DerivFc)
 }
 
 // search a contiguous set of samples for a rising edge.
-func (a *analysis) search(samples []float64) (edge float64) {
-	samples = util.Lowpass(samples, a.fc)
-	d := util.Differentiate(samples)
+//
+// hole reports whether the paper after the first rising edge is broken by a
+// dark blob, as where the sample passes through a punched hole or a staple,
+// that starts within reach samples of the edge.
+func (a *analysis) search(samples []float64, reach int) (edge float64, hole bool) {
+	d := a.derivative(samples)
+	defer putSamples(d)
+	skip := a.Skip
 
 	// find the center of the peak in the derivative which indicates where a
 	// page edge is
-findPeak:
-	for i, sample := range d {
-		if sample > a.thresh {
-			max := sample
-			maxI := i
-
-		findPeakFallingEdge:
-			for ; i < len(d); i++ {
-				sample = d[i]
-				if sample <= a.thresh {
-					break findPeakFallingEdge
-				}
-				if sample > max {
-					max = sample
-					maxI = i
-				}
-			}
+	for i := 0; i < len(d); {
+		peak, end, ok := util.FindPeak(d, a.Thresh, i)
+		if !ok {
+			break
+		}
+		if i == 0 {
+			hole = a.blob(d[end:], reach)
+		}
+		i = end
 
-			edge = float64(maxI)
-			break findPeak
+		if !a.whiteRun(d[end:]) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
 		}
+
+		edge = float64(peak)
+		break
 	}
 
 	return
 }
 
-func chart(samples []float64, cutoff, lo, hi int, line func(int) int, name string) {
-	img := image.NewNRGBA(image.Rect(0, 0, len(samples), 200))
-	util.Histo(img, samples, color.NRGBA{180, 180, 255, 255}, color.White, color.White, nil)
-	util.RectOver(img, lo, hi, color.NRGBA{0, 255, 0, 30})
-	util.Line(img, line, color.Black)
-	util.DashedLine(img, 200-cutoff, RED)
-	util.WriteImage(img, name)
+// whiteRun reports whether the derivative d, starting right after an edge,
+// stays clear of falling edges for at least MinRun samples. Running off the
+// end of the samples counts as clear.
+func (a *analysis) whiteRun(d []float64) bool {
+	for i := 0; i < a.MinRun && i < len(d); i++ {
+		if d[i] < -a.Thresh {
+			return false
+		}
+	}
+	return true
+}
+
+// chart plots the edge samples of a side, before and after cleaning, against
+// the line fitted to them and the crop taken from it.
+func chart(s side, title string) *util.Chart {
+	fit := make([]float64, len(s.raw))
+	cut := make([]float64, len(s.raw))
+	for x := range fit {
+		fit[x] = s.a + s.b*float64(x)
+		cut[x] = float64(s.crop)
+	}
+
+	return &util.Chart{
+		Title:  title,
+		XLabel: "sample",
+		YLabel: "edge (px)",
+		Width:  max(len(s.raw), 200),
+		Height: 200,
+		Min:    0,
+		Max:    200,
+		Spans: []util.Span{
+			{Name: "trimmed", Lo: s.lo, Hi: s.hi, Color: color.NRGBA{0, 255, 0, 30}},
+		},
+		Series: []util.Series{
+			{Name: "raw", Values: s.raw, Color: color.NRGBA{180, 180, 255, 255}, Style: util.Bars},
+			{Name: "cleaned", Values: s.cleaned, Color: color.NRGBA{90, 90, 200, 255}, Style: util.Lines},
+			{Name: "fit", Values: fit, Color: color.Black, Style: util.Lines},
+			{Name: "crop", Values: cut, Color: RED, Style: util.Dashed},
+		},
+	}
 }
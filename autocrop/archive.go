@@ -0,0 +1,137 @@
+package main
+
+// archive.go writes the pages of the images that come out of an archive, like
+// a CBZ or a CBR, into a new CBZ or a directory, under the names they have in
+// the old one.
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ktkr.us/pkg/autocrop"
+)
+
+// outArchive is an archive being written.
+type outArchive struct {
+	file *atomicFile
+	zw   *zip.Writer
+}
+
+// outArchives holds the archives being written by create, by name.
+var outArchives = map[string]*outArchive{}
+
+// outName returns the name of the file written for the named image, with
+// prefix before the name of the image: _ and the name of the image, or, for
+// an image in an archive, the name of the archive written after _ and then
+// the name of the image in it. The file is in the same directory as the
+// image, or the archive.
+func outName(name, prefix string) string {
+	if arc, member, ok := autocrop.SplitArchive(name); ok {
+		dir, file := path.Split(member)
+		// the archive written is a ZIP, like a CBR's pages go into a CBZ,
+		// or with -unpack a directory
+		switch ext := filepath.Ext(arc); {
+		case *flagUnpack:
+			arc = strings.TrimSuffix(arc, ext)
+		case !strings.EqualFold(ext, ".zip"):
+			arc = strings.TrimSuffix(arc, ext) + ".cbz"
+		}
+		return underscore(arc, "") + "/" + dir + prefix + file
+	}
+	return underscore(name, prefix)
+}
+
+// underscore returns the named file with _ and prefix before its base name.
+func underscore(name, prefix string) string {
+	return filepath.Join(filepath.Dir(name), "_"+prefix+filepath.Base(name))
+}
+
+// output is a file being written by create. Close finishes it, and Abort,
+// once it can't be finished, closes it leaving what was there before.
+type output interface {
+	io.WriteCloser
+	Abort()
+}
+
+// create creates the file out, or, if it goes through an archive like
+// _book.cbz/001.jpg, adds it to the archive, which is created the first time.
+// Files and archives take their names only once they are finished, as
+// createAtomic makes them. Files are added to an archive in the order they
+// are created, and only the last one can be written to, so the pages of
+// archives are written one at a time.
+func create(out string) (output, error) {
+	arc, member, ok := autocrop.SplitArchive(out)
+	if !ok {
+		// the directory of an unpacked archive
+		if err := os.MkdirAll(filepath.Dir(out), 0777); err != nil {
+			return nil, err
+		}
+		return createAtomic(out)
+	}
+	a := outArchives[arc]
+	if a == nil {
+		file, err := createAtomic(arc)
+		if err != nil {
+			return nil, err
+		}
+		a = &outArchive{file, zip.NewWriter(file)}
+		outArchives[arc] = a
+	}
+
+	// images that are compressed already are stored as they are
+	method := zip.Deflate
+	switch strings.ToLower(path.Ext(member)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		method = zip.Store
+	}
+	w, err := a.zw.CreateHeader(&zip.FileHeader{Name: member, Method: method, Modified: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	return archiveMember{w}, nil
+}
+
+// archiveMember is a file being written into an archive, which is closed
+// with it.
+type archiveMember struct {
+	io.Writer
+}
+
+func (archiveMember) Close() error { return nil }
+
+// Abort leaves the archive as it is, for closeArchives to finish.
+func (archiveMember) Abort() {}
+
+// writeFile writes data to the file out, as create creates it.
+func writeFile(out string, data []byte) error {
+	w, err := create(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// closeArchives finishes the archives written by create.
+func closeArchives() error {
+	for name, a := range outArchives {
+		if err := a.zw.Close(); err != nil {
+			a.file.Abort()
+			return err
+		}
+		if err := a.file.Close(); err != nil {
+			return err
+		}
+		delete(outArchives, name)
+	}
+	return nil
+}
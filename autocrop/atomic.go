@@ -0,0 +1,88 @@
+package main
+
+// atomic.go writes the output files under temporary names and renames them
+// to their own once they are complete, so that a run that is interrupted
+// leaves no truncated files behind, only whole ones, which -apply -resume
+// skips when the command is run again.
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// The files being written, which are removed if the run is interrupted.
+var (
+	pendingMu sync.Mutex
+	pending   = map[*atomicFile]bool{}
+)
+
+func init() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		pendingMu.Lock()
+		for f := range pending {
+			os.Remove(f.File.Name())
+		}
+		fmt.Fprintln(os.Stderr, sig)
+		os.Exit(1)
+	}()
+}
+
+// atomicFile is a file being written under a temporary name next to name,
+// which Close renames it to.
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+// createAtomic creates a file to be renamed to name once it is written. It
+// is named like .name.pid.tmp, in the same directory, so that the rename
+// replaces name at once.
+func createAtomic(name string) (*atomicFile, error) {
+	dir, base := filepath.Split(name)
+	tmp := filepath.Join(dir, fmt.Sprintf(".%s.%d.tmp", base, os.Getpid()))
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	f := &atomicFile{file, name}
+	pendingMu.Lock()
+	pending[f] = true
+	pendingMu.Unlock()
+	return f, nil
+}
+
+// done takes f off the files being written.
+func (f *atomicFile) done() {
+	pendingMu.Lock()
+	delete(pending, f)
+	pendingMu.Unlock()
+}
+
+// Close closes the file and renames it to its name, replacing any file there.
+func (f *atomicFile) Close() error {
+	defer f.done()
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	if err := os.Rename(f.File.Name(), f.name); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort closes the file and removes it, leaving any file under its name as
+// it was.
+func (f *atomicFile) Abort() {
+	defer f.done()
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
@@ -0,0 +1,104 @@
+package main
+
+// encode.go writes the pages of -apply in the format the flags ask for, since
+// digitization projects have strict requirements for their files, with the
+// metadata of the file they come from.
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"ktkr.us/pkg/autocrop"
+	"ktkr.us/pkg/autocrop/util"
+)
+
+var pngLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// The settings of the encoders of the pages, from the flags.
+var (
+	jpegOpts autocrop.JPEGOptions
+	pngOpts  autocrop.PNGOptions
+	tiffOpts autocrop.TIFFOptions
+)
+
+// setEncoders sets the encoders of the pages for JPEG, PNG and TIFF up as
+// -quality, -subsampling, -png-compression and -tiff-compression say.
+func setEncoders() error {
+	sub, err := autocrop.ParseSubsampling(*flagSubsamp)
+	if err != nil {
+		return err
+	}
+	if *flagQuality < 1 || *flagQuality > 100 {
+		return fmt.Errorf("-quality %d is not from 1 to 100", *flagQuality)
+	}
+	jpegOpts = autocrop.JPEGOptions{Quality: *flagQuality, Subsampling: sub}
+
+	level, ok := pngLevels[*flagPNGComp]
+	if !ok {
+		return fmt.Errorf("unknown PNG compression %q", *flagPNGComp)
+	}
+	pngOpts = autocrop.PNGOptions{CompressionLevel: level}
+
+	comp, err := autocrop.ParseTIFFCompression(*flagTIFFComp)
+	if err != nil {
+		return err
+	}
+	tiffOpts = autocrop.TIFFOptions{Compression: comp}
+	return nil
+}
+
+// writePage writes the page img to the file out, with the metadata md of its
+// source made to fit it if it isn't nil. Formats other than JPEG, PNG and
+// TIFF are written by util.Encode, without it.
+func writePage(img image.Image, out string, md *autocrop.Metadata) error {
+	var meta autocrop.Metadata
+	if md != nil {
+		meta = *md.Upright(img.Bounds().Size())
+	}
+	var enc func(w io.Writer) error
+	switch strings.ToLower(filepath.Ext(out)) {
+	case ".jpg", ".jpeg":
+		o := jpegOpts
+		o.Metadata = meta
+		enc = func(w io.Writer) error { return autocrop.EncodeJPEG(w, img, &o) }
+	case ".png":
+		o := pngOpts
+		o.Metadata = meta
+		enc = func(w io.Writer) error { return autocrop.EncodePNG(w, img, &o) }
+	case ".tif", ".tiff":
+		o := tiffOpts
+		o.Metadata = meta
+		enc = func(w io.Writer) error { return autocrop.EncodeTIFF(w, img, &o) }
+	default:
+		enc = func(w io.Writer) error { return util.Encode(w, img, filepath.Ext(out)) }
+	}
+
+	file, err := create(out)
+	if err != nil {
+		return err
+	}
+	if err := enc(file); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Close()
+}
+
+// readMetadata returns the metadata of the named image file.
+func readMetadata(name string) (*autocrop.Metadata, error) {
+	file, err := autocrop.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return autocrop.ReadMetadata(file)
+}
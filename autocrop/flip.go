@@ -0,0 +1,81 @@
+package main
+
+// flip.go renders the pages written by -apply into a short video, which is
+// the quickest way to check that a whole volume came out consistent: pages
+// that jump, jiggle or turn stand out when flipped through.
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// flipHeight is the height of the frames of the video, in pixels.
+const flipHeight = 720
+
+// flipThrough renders the images named by pages into the video out, fps pages
+// a second, by running ffmpeg. The pages are scaled to fit the frame and
+// padded with white, so pages of different sizes still line up. The format
+// of the video is taken from the extension of out, e.g. .mp4 or .webm.
+func flipThrough(pages []string, out string, fps int) error {
+	if len(pages) == 0 {
+		return fmt.Errorf("no pages to flip through")
+	}
+	if fps <= 0 {
+		return fmt.Errorf("invalid frame rate %d", fps)
+	}
+
+	// ffmpeg's concat demuxer reads the pages, and how long each is shown,
+	// from a list; the last one has to be given twice to be shown at all
+	list, err := os.CreateTemp("", "autocrop-flip-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	for _, p := range append(pages, pages[len(pages)-1]) {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			list.Close()
+			return err
+		}
+		fmt.Fprintf(list, "file '%s'\nduration %g\n", strings.ReplaceAll(abs, "'", `'\''`), 1/float64(fps))
+	}
+	if err := list.Close(); err != nil {
+		return err
+	}
+
+	// the frame is as wide as the first page at that height, rounded to
+	// even, which the usual encoders need
+	w, h := frameSize(pages[0])
+	vf := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:white,format=yuv420p",
+		w, h, w, h)
+	cmd := exec.Command("ffmpeg", "-y", "-loglevel", "error",
+		"-f", "concat", "-safe", "0", "-i", list.Name(),
+		"-vf", vf, "-r", fmt.Sprint(fps), out)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	log.Println(strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %v", err)
+	}
+	return nil
+}
+
+// frameSize returns the size of the frames of a video of pages like the named
+// one.
+func frameSize(name string) (w, h int) {
+	w, h = flipHeight*2/3, flipHeight
+	f, err := os.Open(name)
+	if err != nil {
+		return w, h
+	}
+	defer f.Close()
+	c, _, err := image.DecodeConfig(f)
+	if err == nil && c.Height > 0 {
+		w = c.Width * flipHeight / c.Height
+	}
+	return max(w&^1, 2), h
+}
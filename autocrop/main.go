@@ -1,24 +1,210 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
 	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
 
 	"ktkr.us/pkg/autocrop"
+	"ktkr.us/pkg/autocrop/util"
 )
 
 var (
-	flagFc       = flag.Float64("fc", 0.1, "cutoff frequency")
-	flagThresh   = flag.Float64("d", 12, "color value d/dx considered to be page border")
-	flagNSamples = flag.Int("n", 500, "number of samples to take per side")
+	flagFc       = flag.Float64("fc", autocrop.DefaultOptions.Fc, "cutoff frequency")
+	flagFilter   = flag.String("filter", "", "`filter` for the noise in the samples: none, lowpass:fc, median:radius or gaussian:sigma (default lowpass at -fc)")
+	flagBlock    = flag.Int("block", 0, "sample the average of the `k`×k pixels around each point instead of the pixel")
+	flagThresh   = flag.Float64("d", autocrop.DefaultOptions.Thresh, "color value d/dx considered to be page border")
+	flagNSamples = flag.Int("n", autocrop.DefaultOptions.N, "number of samples to take per side")
+	flagMaxN     = flag.Int("max-n", 0, "double the samples per side up to `N` while that narrows the angle's confidence interval")
+	flagEarly    = flag.Bool("early-stop", false, "take the samples coarse to fine and stop once the fitted sides settle")
 	flagProf     = flag.Bool("prof", false, "produce a CPU profile")
+	flagMaxPix   = flag.Int("max-pixels", 0, "refuse images of more than `N` pixels (default 150000000 with -http)")
+	flagDown     = flag.Int("downsample", 0, "analyze a copy of each image shrunk by a factor of `k`, for speed on high resolution scans")
+	flagRefine   = flag.Bool("refine", false, "with -downsample, find the edges again at full resolution near those found on the shrunk copy")
+	flagDebug    = flag.Bool("debug", false, "log what the analysis finds on each side to stderr")
+	flagAlgo     = flag.String("algo", "border", "angle estimation `algorithm`: border, projection, hough or fused")
+	flagAngle    optFloat
+	flagMaxAngle = flag.Float64("max-angle", 0, "largest plausible skew in `degrees`; larger fitted angles are handled as -over-angle says")
+	flagOver     = flag.String("over-angle", "error", "what to do about angles beyond -max-angle: error, clamp or zero")
+	flagRef      = flag.String("ref", "", "take the rotation angle from this reference page")
+	flagSides    = flag.String("sides", "trbl", "`sides` to fit and crop: any of t, r, b and l")
+	flagOrient   = flag.Bool("orient", false, "detect sideways and upside down pages")
+	flagRotation = flag.Int("rotation", 0, "clockwise rotation in `degrees` declared by the source's metadata")
+	flagPreRot   = flag.Bool("prerotated", false, "the input has already been rotated as -rotation says")
+	flagGray     = flag.String("gray", "average", "`weights` of red, green and blue in the gray levels searched for edges: average, 601, 709 or r,g,b")
+	flagSkip     = flag.Int("skip", 0, "number of rising edges to skip (for printed black frames)")
+	flagMinRun   = flag.String("run", "0", "minimum white run required after an edge, in pixels or as a `length` like 2mm")
+	flagLock     = flag.Bool("lock", false, "use one robust angle estimated from all pages for every page")
+	flagSmooth   = flag.Int("smooth", 0, "median filter page crops over this many neighboring pages on each side")
+	flagSmoothA  = flag.Int("smooth-angles", 0, "median filter page angles over this many neighboring pages on each side")
+	flagJump     = flag.Float64("jump", 0.5, "with -smooth-angles, leave pages whose angle is further than this many `degrees` from their neighbors'")
+	flagFallback = flag.Float64("fallback", 0, "give pages that score below this the consensus angle and crop of the pages turned as most are")
+	flagOutliers = flag.Float64("outliers", 0, "mark pages for review whose angle or crop size is more than `k` MADs from the median of all pages")
+	flagPolicy   = flag.Bool("policy", false, "mark pages for review and comment out rejected ones")
+	flagSpread   = flag.Bool("spread", false, "detect double-page spreads and crop each page separately")
+	flagExclude  rectList
+	flagRect     = flag.String("rect", "", "analyze only the part `WxH+X+Y` of each image")
+	flagHint     = flag.String("hint", "", "rough crop `WxH+X+Y` to look for the edges near")
+	flagMask     = flag.String("mask", "", "image whose opaque pixels cover areas to leave out of the analysis")
+	flagHoles    = flag.Bool("mask-holes", false, "leave punched holes and staples out of the edge fit")
+	flagCurl     = flag.Bool("avoid-curl", false, "fit only the straight part of curved page edges")
+	flagContent  = flag.Bool("content", false, "crop to the ink on the page instead of the page")
+	flagMargins  = flag.Bool("margins", false, "print the margins of the ink on each page")
+	flagOvercrop = flag.Bool("overcrop", false, "move crops out that cut through ink, and mark pages where they still do")
+	flagTargets  = flag.Bool("targets", false, "leave color targets and rulers along the sides out of the edge fit")
+	flagCropTgt  = flag.Bool("crop-targets", false, "like -targets, and also crop them off the page")
+	flagCMargin  = flag.String("content-margin", "0", "margin to keep around the ink with -content, in pixels or as a `length` like 5mm")
+	flagSize     = flag.String("size", "", "crop every page to exactly `WxH`, centered on the page; in pixels or in a unit like 210x297mm")
+	flagDPI      = flag.Float64("dpi", 0, "resolution of the images in pixels per inch, for lengths in mm, cm, in or pt (default from their metadata)")
+	flagAspect   = flag.String("aspect", "", "grow the crop to the aspect `ratio` W:H (or W/H as a number)")
+	flagFit      = flag.String("fit", "page", "how to `fit` the crop to the rotated page: page, inner (no background) or outer (keep every pixel)")
+	flagPivot    = flag.String("pivot", "image", "`point` to rotate about: image (center, growing the image as -rotate does), page (center) or corner (top left)")
+	flagApply    = flag.Bool("apply", false, "write the cropped pages instead of printing convert commands")
+	flagResume   = flag.Bool("resume", false, "with -apply, skip the pages that an interrupted run of the same command wrote already")
+	flagEncoders = flag.Int("encoders", 0, "with -apply, encode up to `N` pages at once (default the number of CPUs; pages of archives one at a time)")
+	flagQuality  = flag.Int("quality", 95, "`quality` of the JPEGs written with -apply, 1 to 100")
+	flagSubsamp  = flag.String("subsampling", "420", "chroma `subsampling` of the JPEGs written with -apply: 420, 422 or 444")
+	flagPNGComp  = flag.String("png-compression", "default", "compression `level` of the PNGs written with -apply: default, none, fast or best")
+	flagTIFFComp = flag.String("tiff-compression", "deflate", "`compression` of the TIFFs written with -apply: deflate, lzw or none")
+	flagLossless = flag.Float64("lossless", 0, "with -apply, crop JPEGs whose angle is under this many `degrees` without re-encoding them, leaving out the rotation")
+	flagAnnotate = flag.Bool("annotate", false, "write each JPEG or PNG with its crop recorded in its EXIF and XMP instead of applying it")
+	flagFlip     = flag.String("flip", "", "with -apply, render the written pages into a flip-through video `file` (.mp4, .webm) with ffmpeg")
+	flagFlipFPS  = flag.Int("flip-fps", 8, "pages per second of the -flip video")
+	flagUnpack   = flag.Bool("unpack", false, "write the pages of archives into a directory named after the archive instead of a new CBZ")
+	flagPDF      = flag.String("pdf", "", "with -apply, also assemble the written pages into the PDF `file`, one image per page at its physical size")
+	flagModulus  = flag.Int("modulus", 0, "shrink the crop so its offsets and size are multiples of `N`")
+	flagInset    = flag.String("inset", "", "move the crop in by `N` pixels, N% of the page if it ends in %, or a length like 1mm; out if negative")
+	flagHTTP     = flag.String("http", "", "serve analyses of images POSTed to /analyze on `addr` instead")
+	flagProfiles = flag.String("profiles", "", "`file` of named parameter profiles for -http requests")
+	flagOutput   = flag.String("output", "convert", "`format` of the output, convert, json or one registered with autocrop.RegisterFormatter")
+	flagPrec     = flag.Int("precision", 0, "`decimals` of the angles in the commands (default 6, or as few as are exact if negative)")
+	flagWidth    = flag.Int("width", 0, "pad the geometry in the commands with zeros to `digits` wide")
+	flagSketch   = flag.Int("sketch", 0, "draw each crop in the output, `width` characters across")
+	flagDiag     = flag.Bool("diag", false, "write a diagnostic image of the analysis of each file next to its output")
+	flagTune     = flag.Bool("tune", false, "keep the one image decoded and analyze it again for each line of parameters like fc=0.2 n=800 read from the standard input")
 )
 
+// optFloat is a float flag that remembers whether it was given at all.
+type optFloat struct {
+	set bool
+	v   float64
+}
+
+func (f *optFloat) String() string {
+	if !f.set {
+		return ""
+	}
+	return strconv.FormatFloat(f.v, 'f', -1, 64)
+}
+
+func (f *optFloat) Set(s string) (err error) {
+	f.v, err = strconv.ParseFloat(s, 64)
+	f.set = err == nil
+	return
+}
+
+// rectList is a flag that collects rectangles given as ImageMagick geometries
+// (WxH+X+Y).
+type rectList []image.Rectangle
+
+func (l *rectList) String() string {
+	var s []string
+	for _, r := range *l {
+		s = append(s, fmt.Sprintf("%dx%d+%d+%d", r.Dx(), r.Dy(), r.Min.X, r.Min.Y))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *rectList) Set(s string) error {
+	r, err := parseGeometry(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// parseGeometry parses an ImageMagick geometry WxH+X+Y.
+func parseGeometry(s string) (image.Rectangle, error) {
+	var w, h, x, y int
+	if _, err := fmt.Sscanf(s, "%dx%d+%d+%d", &w, &h, &x, &y); err != nil {
+		return image.Rectangle{}, fmt.Errorf("bad geometry %q: %v", s, err)
+	}
+	return image.Rect(x, y, x+w, y+h), nil
+}
+
+// parseInset parses an inset given in pixels (N), as a percentage (N%) or as
+// a length.
+func parseInset(s string) (px int, frac float64, l autocrop.Length, err error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		frac, err = strconv.ParseFloat(p, 64)
+		return 0, frac / 100, 0, err
+	}
+	px, l, err = parseLength(s)
+	return px, 0, l, err
+}
+
+// parseLength parses a length given in pixels (N) or with a unit, like 5mm.
+func parseLength(s string) (px int, l autocrop.Length, err error) {
+	if strings.TrimRight(s, "abcdefghijklmnopqrstuvwxyz") != s {
+		l, err = autocrop.ParseLength(s)
+		return 0, l, err
+	}
+	px, err = strconv.Atoi(s)
+	return px, 0, err
+}
+
+// parseSize parses a page size WxH into opts, in pixels or, if it ends in a
+// unit like 210x297mm, in that unit.
+func parseSize(s string, opts *autocrop.Options) error {
+	num := strings.TrimRight(s, "abcdefghijklmnopqrstuvwxyz")
+	if num == s {
+		if _, err := fmt.Sscanf(s, "%dx%d", &opts.Size.X, &opts.Size.Y); err != nil {
+			return fmt.Errorf("bad size %q: %v", s, err)
+		}
+		return nil
+	}
+	unit := s[len(num):]
+	w, h, ok := strings.Cut(num, "x")
+	if !ok {
+		return fmt.Errorf("bad size %q", s)
+	}
+	var err error
+	if opts.Physical.Width, err = autocrop.ParseLength(w + unit); err != nil {
+		return err
+	}
+	opts.Physical.Height, err = autocrop.ParseLength(h + unit)
+	return err
+}
+
+// parseAspect parses an aspect ratio given as W:H or as a number.
+func parseAspect(s string) (float64, error) {
+	var w, h float64
+	if _, err := fmt.Sscanf(s, "%g:%g", &w, &h); err == nil {
+		if h == 0 {
+			return 0, fmt.Errorf("bad aspect ratio %q", s)
+		}
+		return w / h, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
 func init() {
 	log.SetFlags(0)
+	flag.Var(&flagAngle, "angle", "force the rotation angle in `degrees` instead of fitting it")
+	flag.Var(&flagExclude, "exclude", "leave the area WxH+X+Y out of the analysis (may be repeated)")
 	flag.Parse()
 }
 
@@ -36,14 +222,581 @@ func main() {
 		}()
 	}
 
-	if flag.NArg() < 1 {
+	if flag.NArg() < 1 && *flagHTTP == "" {
 		log.Fatal("top lel")
 	}
+	if *flagDiag && *flagSpread {
+		log.Fatal("-diag can't be used with -spread")
+	}
+	if *flagRect != "" && (*flagDiag || *flagSpread) {
+		log.Fatal("-rect can't be used with -diag or -spread")
+	}
+	if *flagTune && (flag.NArg() != 1 || autocrop.IsArchive(flag.Arg(0))) {
+		log.Fatal("-tune takes one image file")
+	}
+	if *flagTune && (*flagRect != "" || *flagSpread || *flagFlip != "" || *flagPDF != "") {
+		log.Fatal("-tune can't be used with -rect, -spread, -flip or -pdf")
+	}
+	if *flagFlip != "" && !*flagApply {
+		log.Fatal("-flip needs -apply")
+	}
+	if *flagPDF != "" && !*flagApply {
+		log.Fatal("-pdf needs -apply")
+	}
+	if *flagFlip != "" && slices.ContainsFunc(flag.Args(), autocrop.IsArchive) {
+		log.Fatal("-flip can't be used with archives")
+	}
+	if *flagAnnotate && *flagApply {
+		log.Fatal("-annotate can't be used with -apply")
+	}
+	if *flagApply {
+		if err := setEncoders(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	algo, err := autocrop.ParseAlgorithm(*flagAlgo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sides, err := autocrop.ParseSides(*flagSides)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gray, err := autocrop.ParseGrayWeights(*flagGray)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var logger *slog.Logger
+	if *flagDebug {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	var filter autocrop.Filter
+	if *flagFilter != "" {
+		if filter, err = autocrop.ParseFilter(*flagFilter); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	t, err := autocrop.AnalyzeFile(flag.Arg(0), *flagThresh, *flagFc, *flagNSamples)
+	fit, err := autocrop.ParseFit(*flagFit)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("convert", flag.Arg(0), t, "_"+flag.Arg(0))
-	//fmt.Println("confidence", t.Confidence)
+
+	pivot, err := autocrop.ParsePivot(*flagPivot)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	over, err := autocrop.ParseOverAngle(*flagOver)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := autocrop.Options{
+		Thresh:    *flagThresh,
+		Fc:        *flagFc,
+		N:         *flagNSamples,
+		MaxN:      *flagMaxN,
+		EarlyStop: *flagEarly,
+		Algorithm: algo,
+		Sides:     sides,
+
+		Orientation:    *flagOrient,
+		SourceRotation: *flagRotation,
+		PreRotated:     *flagPreRot,
+		Gray:           gray,
+		MaxPixels:      *flagMaxPix,
+		Downsample:     *flagDown,
+		Refine:         *flagRefine,
+		Logger:         logger,
+		Filter:         filter,
+		Block:          *flagBlock,
+		Skip:           *flagSkip,
+		DPI:            *flagDPI,
+		MaskHoles:      *flagHoles,
+		Exclude:        flagExclude,
+		AvoidCurl:      *flagCurl,
+
+		Content:     *flagContent,
+		Margins:     *flagMargins,
+		Overcrop:    *flagOvercrop,
+		Targets:     *flagTargets,
+		CropTargets: *flagCropTgt,
+		Modulus:     *flagModulus,
+		Fit:         fit,
+		Pivot:       pivot,
+		MaxAngle:    util.Deg2rad(*flagMaxAngle),
+		OverAngle:   over,
+	}
+
+	if opts.MinRun, opts.Physical.MinRun, err = parseLength(*flagMinRun); err != nil {
+		log.Fatal(err)
+	}
+	if opts.ContentMargin, opts.Physical.ContentMargin, err = parseLength(*flagCMargin); err != nil {
+		log.Fatal(err)
+	}
+	if *flagInset != "" {
+		opts.Inset, opts.InsetFrac, opts.Physical.Inset, err = parseInset(*flagInset)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *flagSize != "" {
+		if err := parseSize(*flagSize, &opts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *flagAspect != "" {
+		opts.Aspect, err = parseAspect(*flagAspect)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *flagHint != "" {
+		opts.Hint, err = parseGeometry(*flagHint)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *flagMask != "" {
+		opts.Mask, err = decode(*flagMask)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch {
+	case flagAngle.set:
+		angle := util.Deg2rad(flagAngle.v)
+		opts.Angle = &angle
+	case *flagRef != "":
+		ref, err := autocrop.AnalyzeFileWith(*flagRef, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Angle = &ref.Angle
+	}
+
+	if *flagHTTP != "" {
+		log.Fatal(serve(*flagHTTP, opts, *flagProfiles))
+	}
+
+	format := autocrop.NumberFormat{Precision: *flagPrec, Width: *flagWidth}
+	output, err := autocrop.LookupFormatter(*flagOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		pages        []page
+		ts           []*autocrop.Transform
+		written      []string
+		writtenPages []page
+	)
+	// note prints the comments about the page p, and returns what its line
+	// is prefixed with: nothing, or "# rejected: " if -policy rejects it
+	note := func(p page, o *autocrop.Outlier) (prefix string) {
+		if o != nil {
+			var what []string
+			if o.Angle {
+				what = append(what, "angle")
+			}
+			if o.Size {
+				what = append(what, "size")
+			}
+			fmt.Printf("# outlier: %s (%s, %.1f MADs)\n", p.out, strings.Join(what, " and "), o.Dev)
+		}
+		if s := p.t.Overcrop; s != 0 {
+			fmt.Printf("# overcrop: %s (%s)\n", p.out, s)
+		}
+		if *flagPolicy {
+			switch autocrop.DefaultPolicy.Decide(p.t) {
+			case autocrop.Review:
+				fmt.Println("# review:", p.out)
+			case autocrop.Reject:
+				prefix = "# rejected: "
+			}
+		}
+		// as comments, so that the output is still a script
+		if *flagMargins {
+			m := p.t.Margins
+			fmt.Printf("# margins: %d %d %d %d\n", m[0], m[1], m[2], m[3])
+		}
+		for _, line := range sketch(p.t, *flagSketch) {
+			fmt.Println("#", line)
+		}
+		return prefix
+	}
+	// emit prints the page p, or writes it cropped out of img if that has
+	// been decoded already, or else out of its file
+	emit := func(p page, img image.Image, o *autocrop.Outlier) error {
+		prefix := note(p, o)
+		if *flagApply {
+			if prefix == "" {
+				if err := apply(p, img); err != nil {
+					return err
+				}
+				written = append(written, p.out)
+				writtenPages = append(writtenPages, p)
+			}
+			return nil
+		}
+		if *flagAnnotate {
+			if prefix == "" {
+				return annotate(p)
+			}
+			return nil
+		}
+		fmt.Print(prefix)
+		return output(os.Stdout, p.name, p.out, p.t, format)
+	}
+
+	if *flagTune {
+		name := flag.Arg(0)
+		err := tune(name, opts, os.Stdin, func(t *autocrop.Transform, img image.Image) error {
+			return emit(newPage(name, -1, t), img, nil)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var names []string
+	for _, arg := range flag.Args() {
+		// the images in an archive, or the file itself
+		in, err := autocrop.ArchivePages(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		names = append(names, in...)
+	}
+	if *flagDiag || *flagRect != "" || *flagSpread {
+		for _, name := range names {
+			spread, err := analyze(name, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for i, t := range spread {
+				p := newPage(name, -1, t)
+				if len(spread) > 1 {
+					p.out = outName(name, fmt.Sprintf("%d_", i+1))
+				}
+				pages = append(pages, p)
+				ts = append(ts, t)
+			}
+		}
+	} else {
+		// the files are read while the pages before them are analyzed, and
+		// written, several at once, while those after them are, unless their
+		// crops depend on those of the others
+		pl := autocrop.Pipeline{Options: opts, Encoders: *flagEncoders}
+		if pl.Encoders <= 0 {
+			pl.Encoders = runtime.GOMAXPROCS(0)
+		}
+		if slices.ContainsFunc(flag.Args(), autocrop.IsArchive) {
+			pl.Encoders = 1 // as create adds to archives
+		}
+		batch := *flagFallback > 0 || *flagLock || *flagSmoothA > 0 || *flagSmooth > 0 || *flagOutliers > 0
+		if *flagApply && !batch {
+			pl.Encode = func(pg *autocrop.Page) error {
+				p := newPage(pg.Name, pg.Frame, pg.Transform)
+				if *flagPolicy && autocrop.DefaultPolicy.Decide(p.t) == autocrop.Reject {
+					return nil
+				}
+				return apply(p, pg.Image)
+			}
+		}
+		done, err := pl.Run(names)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, pg := range done {
+			p := newPage(pg.Name, pg.Frame, pg.Transform)
+			if pl.Encode == nil {
+				pages = append(pages, p)
+				ts = append(ts, pg.Transform)
+				continue
+			}
+			// written already, in whatever order the encoders finished
+			if note(p, nil) == "" {
+				written = append(written, p.out)
+				writtenPages = append(writtenPages, p)
+			}
+		}
+	}
+
+	if *flagFallback > 0 {
+		c, err := autocrop.Consensus(ts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n := autocrop.Fallback(ts, c, *flagFallback); n > 0 {
+			log.Printf("consensus for %d low scoring pages: %v", n, c)
+		}
+	}
+	if *flagLock {
+		autocrop.LockAngle(ts)
+	}
+	autocrop.SmoothAngles(ts, *flagSmoothA, util.Deg2rad(*flagJump))
+	autocrop.SmoothCrops(ts, *flagSmooth)
+
+	outliers := make(map[int]autocrop.Outlier)
+	if *flagOutliers > 0 {
+		for _, o := range autocrop.Outliers(ts, *flagOutliers) {
+			outliers[o.Index] = o
+		}
+	}
+
+	for i, p := range pages {
+		var o *autocrop.Outlier
+		if oi, ok := outliers[i]; ok {
+			o = &oi
+		}
+		if err := emit(p, nil, o); err != nil {
+			log.Fatal(err)
+		}
+		//fmt.Println("confidence", p.t.Confidence)
+	}
+
+	if err := closeArchives(); err != nil {
+		log.Fatal(err)
+	}
+	if *flagFlip != "" {
+		if err := flipThrough(written, *flagFlip, *flagFlipFPS); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *flagPDF != "" {
+		if err := assemblePDF(writtenPages, *flagPDF); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// page is one output page: the file it comes from, the file it goes to, and
+// how to get there.
+type page struct {
+	name, out string
+	t         *autocrop.Transform
+	frame     int // index of the frame of a multi-frame file, or -1
+}
+
+// newPage returns the page of the frame of the named file, or of the file
+// itself if frame is -1, whose Transform is t.
+func newPage(name string, frame int, t *autocrop.Transform) page {
+	if frame < 0 {
+		return page{name, outName(name, ""), t, -1}
+	}
+	// named as ImageMagick picks them out
+	return page{
+		fmt.Sprintf("%s[%d]", name, frame),
+		outName(strings.TrimSuffix(name, filepath.Ext(name))+".png", fmt.Sprintf("%d_", frame+1)),
+		t, frame,
+	}
+}
+
+// analyze analyzes the named image on its own, for -diag, -rect or -spread,
+// splitting it into pages if it is a spread.
+func analyze(name string, opts autocrop.Options) ([]*autocrop.Transform, error) {
+	if *flagDiag {
+		return diagnose(name, opts)
+	}
+	if *flagRect != "" {
+		r, err := parseGeometry(*flagRect)
+		if err != nil {
+			return nil, err
+		}
+		img, err := decode(name)
+		if err != nil {
+			return nil, err
+		}
+		t, err := autocrop.AnalyzeRect(img, r, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []*autocrop.Transform{t}, nil
+	}
+	img, err := decode(name)
+	if err != nil {
+		return nil, err
+	}
+	return autocrop.AnalyzeSpread(img, opts)
+}
+
+// apply writes the page p cropped out of img, the image or the frame it
+// comes from, or out of its file if img is nil. With -resume, a page that
+// has been written already is skipped.
+func apply(p page, img image.Image) error {
+	if *flagResume && upToDate(p) {
+		log.Printf("skipping %s: %s is written already", p.name, p.out)
+		return nil
+	}
+	if p.frame >= 0 {
+		return applyFrame(p, img)
+	}
+	if *flagLossless > 0 && p.t.Lossless(util.Deg2rad(*flagLossless)) {
+		err := applyJPEG(p)
+		var notLossless *autocrop.NotLossless
+		if !errors.As(err, &notLossless) {
+			return err
+		}
+	}
+	if img == nil {
+		var err error
+		if img, err = decode(p.name); err != nil {
+			return err
+		}
+	}
+	md, err := readMetadata(p.name)
+	if err != nil {
+		return err
+	}
+	return writePage(p.t.Apply(img), p.out, md)
+}
+
+// upToDate reports whether the page p has been written already, by a run that
+// was interrupted: whether its output is newer than the file it comes from.
+// As outputs are written under another name until they are whole, an output
+// that is there at all is complete. Nothing records the flags it was written
+// with, so this only holds for a run of the same command. The pages of an
+// archive are all written again, as the archive they go into is, unless it is
+// unpacked.
+func upToDate(p page) bool {
+	if _, _, ok := autocrop.SplitArchive(p.out); ok {
+		return false
+	}
+	name := p.name
+	if p.frame >= 0 {
+		name = strings.TrimSuffix(name, fmt.Sprintf("[%d]", p.frame))
+	}
+	if arc, _, ok := autocrop.SplitArchive(name); ok {
+		name = arc
+	}
+	in, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	out, err := os.Stat(p.out)
+	return err == nil && !out.ModTime().Before(in.ModTime())
+}
+
+// applyJPEG writes the page p cropped out of its file losslessly, if the file
+// is a JPEG that can be.
+func applyJPEG(p page) error {
+	file, err := autocrop.Open(p.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	if _, err := p.t.ApplyJPEG(&buf, file); err != nil {
+		return err
+	}
+	return writeFile(p.out, buf.Bytes())
+}
+
+// applyFrame writes the page p cropped out of img, its frame of a
+// multi-frame file, or out of the file if img is nil.
+func applyFrame(p page, img image.Image) error {
+	name := strings.TrimSuffix(p.name, fmt.Sprintf("[%d]", p.frame))
+	if img == nil {
+		file, err := autocrop.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		frames, _, err := autocrop.DecodeFrames(file)
+		if err != nil {
+			return err
+		}
+		if p.frame >= len(frames) {
+			return fmt.Errorf("%s: no frame %d", p.name, p.frame)
+		}
+		img = frames[p.frame]
+	}
+	md, err := readMetadata(name)
+	if err != nil {
+		return err
+	}
+	return writePage(p.t.Apply(img), p.out, md)
+}
+
+// annotate writes the file of the page p with p's crop recorded in its
+// metadata.
+func annotate(p page) error {
+	if p.frame >= 0 {
+		return fmt.Errorf("%s: can't annotate a frame of a multi-frame file", p.name)
+	}
+	file, err := autocrop.Open(p.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	if err := p.t.Annotate(&buf, file); err != nil {
+		return fmt.Errorf("%s: %v", p.name, err)
+	}
+	return writeFile(p.out, buf.Bytes())
+}
+
+// decode reads the named image file. With -max-pixels, an image that is
+// larger is refused from its header before it is decoded, as AnalyzeReader
+// does.
+func decode(name string) (image.Image, error) {
+	file, err := autocrop.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := io.Reader(file)
+	if *flagMaxPix > 0 {
+		// read the header twice, once for the size and once to decode
+		var head bytes.Buffer
+		c, _, err := image.DecodeConfig(io.TeeReader(file, &head))
+		if err != nil {
+			return nil, err
+		}
+		if int64(c.Width)*int64(c.Height) > int64(*flagMaxPix) {
+			return nil, &autocrop.TooLarge{Size: image.Pt(c.Width, c.Height), MaxPixels: *flagMaxPix}
+		}
+		r = io.MultiReader(&head, file)
+	}
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// diagnose analyzes the named image like analyze, and writes a composite
+// diagnostic image of the analysis to _name.diag.png.
+func diagnose(name string, opts autocrop.Options) ([]*autocrop.Transform, error) {
+	img, err := decode(name)
+	if err != nil {
+		return nil, err
+	}
+	comp, t, err := autocrop.Composite(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeDiag(name, comp); err != nil {
+		return nil, err
+	}
+	return []*autocrop.Transform{t}, nil
+}
+
+// writeDiag writes the composite diagnostic image of the named image to
+// _name.diag.png.
+func writeDiag(name string, comp image.Image) error {
+	out := outName(strings.TrimSuffix(name, filepath.Ext(name))+".diag.png", "")
+	file, err := create(out)
+	if err != nil {
+		return err
+	}
+	if err := util.Encode(file, comp, ".png"); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Close()
 }
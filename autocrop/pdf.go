@@ -0,0 +1,83 @@
+package main
+
+// pdf.go assembles the pages written by -apply into a PDF, at the resolution
+// of the files they come from so that they print at their real size.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"ktkr.us/pkg/autocrop"
+)
+
+// assemblePDF writes the written pages into the PDF out, in order. JPEGs go
+// in as they are; other pages are decoded and compressed losslessly.
+func assemblePDF(pages []page, out string) error {
+	if len(pages) == 0 {
+		return fmt.Errorf("no pages to assemble")
+	}
+	file, err := createAtomic(out)
+	if err != nil {
+		return err
+	}
+	pdf := autocrop.NewPDFWriter(file)
+	for _, p := range pages {
+		if err := addPage(pdf, p); err != nil {
+			file.Abort()
+			return fmt.Errorf("%s: %v", p.out, err)
+		}
+	}
+	if err := pdf.Close(); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Close()
+}
+
+// addPage adds the file written for p to pdf.
+func addPage(pdf *autocrop.PDFWriter, p page) error {
+	dpi := *flagDPI
+	if dpi == 0 {
+		dpi = sourceDPI(p)
+	}
+	file, err := autocrop.Open(p.out)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(p.out)) {
+	case ".jpg", ".jpeg":
+		return pdf.AddJPEG(b, dpi)
+	}
+	md, err := autocrop.ReadMetadata(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	img, err := decode(p.out)
+	if err != nil {
+		return err
+	}
+	return pdf.AddImage(img, dpi, md.ICC)
+}
+
+// sourceDPI returns the resolution recorded in the file that p comes from, or
+// 0 if there is none.
+func sourceDPI(p page) float64 {
+	name := p.name
+	if p.frame >= 0 {
+		name = strings.TrimSuffix(name, fmt.Sprintf("[%d]", p.frame))
+	}
+	file, err := autocrop.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	return autocrop.ReadDPI(file)
+}
@@ -0,0 +1,20 @@
+//go:build plugins
+
+package main
+
+// plugin.go adds -plugin, which loads Go plugins that register algorithms,
+// sources and formatters with the autocrop package from their init functions.
+// It is only built with the plugins tag, since it makes the binary depend on
+// cgo and the dynamic linker.
+
+import (
+	"flag"
+	"plugin"
+)
+
+func init() {
+	flag.Func("plugin", "load the Go plugin `file` before anything else (may be repeated)", func(name string) error {
+		_, err := plugin.Open(name)
+		return err
+	})
+}
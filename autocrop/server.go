@@ -0,0 +1,222 @@
+package main
+
+// server.go contains the HTTP server run by -http, which analyzes images
+// posted to it. A request can adjust the options the server was started
+// with, by naming a profile or giving parameters in its query string, so that
+// one server can serve several kinds of scanner.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ktkr.us/pkg/autocrop"
+)
+
+// maxUpload is the largest image accepted, in bytes.
+const maxUpload = 256 << 20
+
+// maxPixels is the largest image analyzed if -max-pixels isn't given, a
+// little more than a letter page at 1200 dpi. Decoding one takes up to 4 bytes
+// a pixel, and a few bytes of the header can claim any size.
+const maxPixels = 150_000_000
+
+// The time a client has to send the headers and the whole of a request, the
+// server has to answer it once the headers are in, and a kept alive
+// connection may go unused. A 256 MB upload needs a few Mbit/s.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 10 * time.Minute
+	writeTimeout      = 12 * time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+// server analyzes the images posted to /analyze with opts, adjusted by the
+// profile and parameters of each request.
+type server struct {
+	opts     autocrop.Options
+	profiles map[string]url.Values
+}
+
+// serve runs the server on addr until it fails.
+func serve(addr string, opts autocrop.Options, profiles string) error {
+	s := &server{opts: opts}
+	s.opts.Hardened = true // the images come from anyone
+	if s.opts.MaxPixels == 0 {
+		s.opts.MaxPixels = maxPixels
+	}
+	if profiles != "" {
+		var err error
+		if s.profiles, err = readProfiles(profiles); err != nil {
+			return err
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/analyze", s.analyze)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	log.Println("listening on", addr)
+	return srv.ListenAndServe()
+}
+
+// analyze handles POST /analyze?profile=name&param=value..., where the body is
+// the image. It responds with the ImageMagick flags of the Transform.
+func (s *server) analyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST an image", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	opts := s.opts
+	if name := q.Get("profile"); name != "" {
+		p, ok := s.profiles[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown profile %q", name), http.StatusBadRequest)
+			return
+		}
+		if err := override(&opts, p); err != nil {
+			http.Error(w, fmt.Sprintf("profile %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+	}
+	q.Del("profile")
+	if err := override(&opts, q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := autocrop.AnalyzeReader(http.MaxBytesReader(w, r.Body, maxUpload), opts)
+	var tooLarge *autocrop.TooLarge
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	fmt.Fprintln(w, t)
+}
+
+// bounds are the ranges the numeric parameters of a request must be in. They
+// are narrower than what the analysis accepts, to keep requests from tying up
+// the server or asking for nonsense.
+var bounds = map[string][2]float64{
+	"fc":         {0.001, 1},
+	"d":          {1, 255},
+	"dpi":        {0, 20000},
+	"n":          {3, 10000},
+	"max-n":      {0, 10000},
+	"skip":       {0, 16},
+	"run":        {0, 10000},
+	"downsample": {0, 16},
+	"block":      {0, 64},
+}
+
+// override sets the options named in v, with the same names and meanings as
+// the command line flags.
+func override(opts *autocrop.Options, v url.Values) error {
+	for key := range v {
+		val := v.Get(key)
+		if b, ok := bounds[key]; ok {
+			f, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return fmt.Errorf("bad %s: %v", key, err)
+			}
+			if !(f >= b[0] && f <= b[1]) {
+				return fmt.Errorf("%s=%s is out of range [%g, %g]", key, val, b[0], b[1])
+			}
+		}
+
+		var err error
+		switch key {
+		case "fc":
+			opts.Fc, err = strconv.ParseFloat(val, 64)
+		case "filter":
+			opts.Filter, err = autocrop.ParseFilter(val)
+		case "block":
+			opts.Block, err = strconv.Atoi(val)
+		case "d":
+			opts.Thresh, err = strconv.ParseFloat(val, 64)
+		case "n":
+			opts.N, err = strconv.Atoi(val)
+		case "max-n":
+			opts.MaxN, err = strconv.Atoi(val)
+		case "early-stop":
+			opts.EarlyStop, err = strconv.ParseBool(val)
+		case "skip":
+			opts.Skip, err = strconv.Atoi(val)
+		case "run":
+			opts.MinRun, err = strconv.Atoi(val)
+		case "algo":
+			opts.Algorithm, err = autocrop.ParseAlgorithm(val)
+		case "sides":
+			opts.Sides, err = autocrop.ParseSides(val)
+		case "orient":
+			opts.Orientation, err = strconv.ParseBool(val)
+		case "content":
+			opts.Content, err = strconv.ParseBool(val)
+		case "dpi":
+			opts.DPI, err = strconv.ParseFloat(val, 64)
+		case "overcrop":
+			opts.Overcrop, err = strconv.ParseBool(val)
+		case "downsample":
+			opts.Downsample, err = strconv.Atoi(val)
+		case "refine":
+			opts.Refine, err = strconv.ParseBool(val)
+		default:
+			return fmt.Errorf("unknown parameter %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("bad %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// readProfiles reads the named profiles file. Each line is a profile name and
+// its parameters as a query string, like
+//
+//	flatbed fc=0.2&n=800
+//
+// Blank lines and lines starting with # are skipped. The parameters are
+// checked as they would be in a request.
+func readProfiles(name string) (map[string]url.Values, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	profiles := make(map[string]url.Values)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, query, _ := strings.Cut(text, " ")
+		v, err := url.ParseQuery(strings.TrimSpace(query))
+		if err == nil {
+			err = override(new(autocrop.Options), v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", f.Name(), line, err)
+		}
+		profiles[name] = v
+	}
+	return profiles, sc.Err()
+}
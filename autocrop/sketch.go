@@ -0,0 +1,76 @@
+package main
+
+// sketch.go draws the crop of a page in the terminal, for a quick look
+// without an image viewer.
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"ktkr.us/pkg/autocrop"
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// sketch draws the frame of the upright image that t was found on, in light
+// lines, and the page in it, in heavy lines, width characters across. The
+// numbers go alongside. Character cells are about twice as tall as they are
+// wide, so there are half as many rows as the proportions would give.
+func sketch(t *autocrop.Transform, width int) []string {
+	size := t.Size
+	if width < 3 || size.X <= 0 || size.Y <= 0 {
+		return nil
+	}
+	height := max(int(math.Round(float64(width*size.Y)/float64(size.X)/2)), 3)
+	grid := make([][]rune, height)
+	for y := range grid {
+		grid[y] = []rune(strings.Repeat(" ", width))
+	}
+
+	box(grid, 0, 0, width-1, height-1, []rune("─│┌┐└┘"))
+	col := func(x int) int { return min(max(int(math.Round(float64(x*(width-1))/float64(size.X))), 0), width-1) }
+	row := func(y int) int { return min(max(int(math.Round(float64(y*(height-1))/float64(size.Y))), 0), height-1) }
+	b := t.Bounds
+	box(grid, col(b.Min.X), row(b.Min.Y), col(b.Max.X), row(b.Max.Y), []rune("━┃┏┓┗┛"))
+
+	var notes []string
+	notes = append(notes, fmt.Sprintf("page %dx%d+%d+%d of %dx%d", b.Dx(), b.Dy(), b.Min.X, b.Min.Y, size.X, size.Y))
+	switch {
+	case t.Perspective:
+		notes = append(notes, "perspective corrected")
+	case t.Angle > 0:
+		notes = append(notes, fmt.Sprintf("turned ↻ %.3f°", util.Rad2deg(t.Angle)))
+	case t.Angle < 0:
+		notes = append(notes, fmt.Sprintf("turned ↺ %.3f°", -util.Rad2deg(t.Angle)))
+	default:
+		notes = append(notes, "not turned")
+	}
+	if t.Orientation != 0 {
+		notes = append(notes, fmt.Sprintf("after turning %d°", t.Orientation))
+	}
+	if t.NoBorder {
+		notes = append(notes, "no border")
+	}
+
+	lines := make([]string, height)
+	for y, r := range grid {
+		lines[y] = string(r)
+		if y < len(notes) {
+			lines[y] += "  " + notes[y]
+		}
+	}
+	return lines
+}
+
+// box draws a rectangle with corners (x0, y0) and (x1, y1) on grid, with the
+// runes of style: horizontal, vertical, and the TL, TR, BL and BR corners.
+func box(grid [][]rune, x0, y0, x1, y1 int, style []rune) {
+	for x := x0; x <= x1; x++ {
+		grid[y0][x], grid[y1][x] = style[0], style[0]
+	}
+	for y := y0; y <= y1; y++ {
+		grid[y][x0], grid[y][x1] = style[1], style[1]
+	}
+	grid[y0][x0], grid[y0][x1] = style[2], style[3]
+	grid[y1][x0], grid[y1][x1] = style[4], style[5]
+}
@@ -0,0 +1,70 @@
+package main
+
+// tune.go contains -tune, which keeps one image decoded while its parameters
+// are tried out, so that a large scan is only read once.
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"ktkr.us/pkg/autocrop"
+)
+
+// tune analyzes the named image with opts, and then again for each line read
+// from r, with opts changed by the parameters on it, until r ends. The
+// parameters are those of -http requests, separated by spaces or &, like
+// "fc=0.2 n=800", and what they change holds for the lines after; an empty
+// line analyzes the image again as it was. Each Transform is passed to emit
+// with the image. With -diag, the diagnostic image is written again each
+// time. A line with bad parameters, or whose analysis fails, is reported on
+// the standard error and changes nothing.
+func tune(name string, opts autocrop.Options, r io.Reader, emit func(t *autocrop.Transform, img image.Image) error) error {
+	img, err := decode(name)
+	if err != nil {
+		return err
+	}
+	s := autocrop.NewSession(img)
+	analyze := func(opts autocrop.Options) error {
+		if !*flagDiag {
+			t, err := s.Analyze(opts)
+			if err != nil {
+				return err
+			}
+			return emit(t, img)
+		}
+		comp, t, err := s.Composite(opts)
+		if err != nil {
+			return err
+		}
+		if err := writeDiag(name, comp); err != nil {
+			return err
+		}
+		return emit(t, img)
+	}
+
+	if err := analyze(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		v, err := url.ParseQuery(strings.Join(strings.Fields(sc.Text()), "&"))
+		next := opts
+		if err == nil {
+			err = override(&next, v)
+		}
+		if err == nil {
+			err = analyze(next)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			continue
+		}
+		opts = next
+	}
+	return sc.Err()
+}
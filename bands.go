@@ -0,0 +1,109 @@
+package autocrop
+
+// bands.go contains the analysis of the bands along the sides of an image,
+// extracted beforehand, so that decoding whole images can be left to another
+// part of a pipeline.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// BandRects returns the parts of an image of the given size that AnalyzeBands
+// needs with opts: a band along each side (T,R,B,L) of the image, in its
+// coordinates. The bands overlap at the corners.
+func BandRects(size image.Point, opts Options) ([4]image.Rectangle, error) {
+	var rects [4]image.Rectangle
+	opts = opts.fill()
+	if err := checkBands(&opts); err != nil {
+		return rects, err
+	}
+
+	img := image.Image(banded{size: size})
+	rotation := 0
+	if !opts.PreRotated {
+		rotation = (opts.SourceRotation%360 + 360) % 360
+	}
+	hint := opts.Hint.Intersect(img.Bounds())
+	hint = rotateRect(hint, img, rotation)
+	img = rotate90(img, rotation)
+
+	a := &analysis{img: img, hint: hint, gray: opts.Gray.fixed(), Options: &opts}
+	dx, dy := img.Bounds().Dx(), img.Bounds().Dy()
+	s := a.spans(dx, dy)
+	upright := [4]image.Rectangle{
+		image.Rect(s[0].start, s[0].depth, s[0].start+s[0].length, s[0].depth+s[0].m),
+		image.Rect(dx-s[1].depth-s[1].m, s[1].start, dx-s[1].depth, s[1].start+s[1].length),
+		image.Rect(s[2].start, dy-s[2].depth-s[2].m, s[2].start+s[2].length, dy-s[2].depth),
+		image.Rect(s[3].depth, s[3].start, s[3].depth+s[3].m, s[3].start+s[3].length),
+	}
+
+	// back to the coordinates of the image as stored, where each side is a
+	// quarter turn on from the upright side for every quarter turn of the
+	// rotation
+	for i, r := range upright {
+		rects[(i+4-rotation/90)%4] = rotateRect(r, img, 360-rotation)
+	}
+	return rects, nil
+}
+
+// AnalyzeBands is like AnalyzeWith, but only has the bands along the sides of
+// an image of the given size to go on, as returned by BandRects. Each band
+// has its bounds in the coordinates of the image; anything outside of them
+// reads as black. Since the middle of the page is missing, the Projection and
+// Fused algorithms, Orientation, Content and Margins can't be used.
+func AnalyzeBands(size image.Point, bands [4]*image.Gray, opts Options) (*Transform, error) {
+	o := opts.fill()
+	if err := checkBands(&o); err != nil {
+		return nil, err
+	}
+	for i, b := range bands {
+		if b == nil {
+			return nil, fmt.Errorf("autocrop: band %d is missing", i)
+		}
+	}
+	return AnalyzeWith(banded{size, bands}, opts)
+}
+
+// checkBands reports whether the (filled) options can be used with
+// AnalyzeBands.
+func checkBands(opts *Options) error {
+	if err := opts.check(); err != nil {
+		return err
+	}
+	switch {
+	case opts.Algorithm != Border && opts.Algorithm != Hough:
+		return fmt.Errorf("autocrop: the %v algorithm needs the whole image", opts.Algorithm)
+	case opts.Orientation:
+		return fmt.Errorf("autocrop: orientation detection needs the whole image")
+	case opts.Content:
+		return fmt.Errorf("autocrop: content cropping needs the whole image")
+	case opts.Margins:
+		return fmt.Errorf("autocrop: margins need the whole image")
+	}
+	return nil
+}
+
+// banded presents bands extracted from an image of the given size as the
+// image, black outside of the bands.
+type banded struct {
+	size  image.Point
+	bands [4]*image.Gray
+}
+
+func (g banded) ColorModel() color.Model { return color.GrayModel }
+
+func (g banded) Bounds() image.Rectangle {
+	return image.Rectangle{Max: g.size}
+}
+
+func (g banded) At(x, y int) color.Color {
+	p := image.Pt(x, y)
+	for _, b := range g.bands {
+		if b != nil && p.In(b.Rect) {
+			return b.GrayAt(x, y)
+		}
+	}
+	return color.Gray{}
+}
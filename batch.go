@@ -0,0 +1,306 @@
+package autocrop
+
+// batch.go contains routines that work on the Transforms of a whole sequence
+// of pages at once, e.g. every page of a scanned book.
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// GlobalAngle estimates a single rotation angle for a sequence of pages that
+// were scanned on the same setup. It is the median of the pages' angles,
+// weighted by their mean confidence, so that a few badly fitted pages don't
+// pull it off. Pages without a border are ignored. If there are no usable
+// pages, it returns 0.
+func GlobalAngle(ts []*Transform) float64 {
+	angles := make([]float64, len(ts))
+	weights := make([]float64, len(ts))
+
+	for i, t := range ts {
+		if t == nil || t.NoBorder {
+			continue
+		}
+		angles[i] = t.Angle
+		weights[i] = util.Mean(t.Confidence[:]...)
+	}
+
+	angle := util.WeightedMedian(angles, weights)
+	if math.IsNaN(angle) {
+		return 0
+	}
+	return angle
+}
+
+// LockAngle sets the angle of every page in ts that has a border to their
+// GlobalAngle, and returns it. This removes the page to page jitter in the
+// fitted angles, which is very visible when the pages are flipped through in
+// sequence. The crops are not affected.
+func LockAngle(ts []*Transform) float64 {
+	angle := GlobalAngle(ts)
+	for _, t := range ts {
+		if t != nil && !t.NoBorder {
+			t.Angle = angle
+		}
+	}
+	return angle
+}
+
+// SmoothCrops runs a median filter over the crops of a sequence of pages, so
+// that the output pages don't visibly jiggle when flipped through quickly.
+// Each edge of a page's bounds is replaced by the median of that edge over the
+// pages no more than radius pages away from it. Pages without a border are
+// neither changed nor taken into account.
+func SmoothCrops(ts []*Transform, radius int) {
+	if radius <= 0 {
+		return
+	}
+
+	var (
+		bounds = make([]image.Rectangle, len(ts))
+		edges  = make([][4]float64, 0, 2*radius+1)
+		edge   = make([]float64, 0, 2*radius+1)
+	)
+	for i, t := range ts {
+		if t != nil {
+			bounds[i] = t.Bounds
+		}
+	}
+
+	for i, t := range ts {
+		if t == nil || t.NoBorder {
+			continue
+		}
+
+		edges = edges[:0]
+		for j := max(0, i-radius); j <= min(len(ts)-1, i+radius); j++ {
+			if ts[j] == nil || ts[j].NoBorder {
+				continue
+			}
+			b := bounds[j]
+			edges = append(edges, [4]float64{
+				float64(b.Min.X), float64(b.Min.Y), float64(b.Max.X), float64(b.Max.Y),
+			})
+		}
+
+		var smoothed [4]int
+		for k := range smoothed {
+			edge = edge[:0]
+			for _, e := range edges {
+				edge = append(edge, e[k])
+			}
+			smoothed[k] = int(math.Round(util.Median(edge...)))
+		}
+		t.Bounds = image.Rect(smoothed[0], smoothed[1], smoothed[2], smoothed[3])
+	}
+}
+
+// SmoothAngles runs a median filter over the angles of a sequence of pages,
+// which damps the page to page jitter of the fits without blurring a real
+// change of skew, like where a page was scanned again, into its neighbors.
+// Each page's angle is replaced by the median of the angles of the pages no
+// more than radius pages away from it, unless it is further than jump
+// (in radians) from it, when the page is taken to really lie at another
+// angle and is left alone. If jump is 0, every page is smoothed. Pages
+// without a border or corrected for perspective are neither changed nor taken
+// into account.
+func SmoothAngles(ts []*Transform, radius int, jump float64) {
+	if radius <= 0 {
+		return
+	}
+
+	var (
+		angles = make([]float64, len(ts))
+		window = make([]float64, 0, 2*radius+1)
+	)
+	usable := func(t *Transform) bool {
+		return t != nil && !t.NoBorder && !t.Perspective
+	}
+	for i, t := range ts {
+		if usable(t) {
+			angles[i] = t.Angle
+		}
+	}
+
+	for i, t := range ts {
+		if !usable(t) {
+			continue
+		}
+		window = window[:0]
+		for j := max(0, i-radius); j <= min(len(ts)-1, i+radius); j++ {
+			if usable(ts[j]) {
+				window = append(window, angles[j])
+			}
+		}
+		m := util.Median(window...)
+		if jump <= 0 || math.Abs(angles[i]-m) <= jump {
+			t.Angle = m
+		}
+	}
+}
+
+// Consensus returns the Transform that the pages in ts, scanned on the same
+// rig, agree on: the medians of their angles, of their sizes and of each edge
+// of their crops (as fractions of their sizes), weighted by Score so that
+// the pages that failed don't pull it off. It isn't fitted to any page, so
+// its confidences and errors are zero. Pages that Score 0, like those
+// without a border, are left out; if that leaves none, Consensus returns an
+// error.
+//
+// Sizes and crops are in the coordinates of the pages turned upright, which
+// only line up between pages turned the same way, so the consensus is of the
+// pages of the Orientation with the most Score between them, and has that
+// Orientation. The rest are left out too.
+func Consensus(ts []*Transform) (*Transform, error) {
+	usable := func(t *Transform) bool {
+		return t != nil && t.Size.X > 0 && t.Size.Y > 0 && t.Score() > 0
+	}
+	var byOrientation [4]float64
+	for _, t := range ts {
+		if usable(t) {
+			byOrientation[orientationIndex(t.Orientation)] += t.Score()
+		}
+	}
+	o := 0
+	for i, w := range byOrientation {
+		if w > byOrientation[o] {
+			o = i
+		}
+	}
+
+	var (
+		weights []float64
+		angles  []float64
+		sizes   [2][]float64
+		edges   [4][]float64
+		sides   [4]float64
+		total   float64
+	)
+	for _, t := range ts {
+		if !usable(t) || orientationIndex(t.Orientation) != o {
+			continue
+		}
+		w := t.Score()
+		weights = append(weights, w)
+		angles = append(angles, t.Angle)
+		sizes[0] = append(sizes[0], float64(t.Size.X))
+		sizes[1] = append(sizes[1], float64(t.Size.Y))
+		dx, dy := float64(t.Size.X), float64(t.Size.Y)
+		b := t.Bounds
+		for i, e := range [4]float64{float64(b.Min.Y) / dy, float64(b.Max.X) / dx, float64(b.Max.Y) / dy, float64(b.Min.X) / dx} {
+			edges[i] = append(edges[i], e)
+			if t.Sides.Has(i) {
+				sides[i] += w
+			}
+		}
+		total += w
+	}
+	if len(weights) == 0 {
+		return nil, fmt.Errorf("autocrop: no pages to agree on")
+	}
+
+	c := &Transform{
+		Orientation: o * 90,
+		Angle:       util.WeightedMedian(angles, weights),
+		Size: image.Pt(
+			int(math.Round(util.WeightedMedian(sizes[0], weights))),
+			int(math.Round(util.WeightedMedian(sizes[1], weights)))),
+	}
+	var e [4]int
+	for i := range edges {
+		k := float64(c.Size.Y)
+		if i%2 == 1 {
+			k = float64(c.Size.X)
+		}
+		e[i] = int(math.Round(util.WeightedMedian(edges[i], weights) * k))
+		if sides[i] >= total/2 {
+			c.Sides |= 1 << uint(i)
+		}
+	}
+	c.Bounds = image.Rect(e[3], e[0], e[1], e[2])
+	c.Conservative, c.Aggressive = c.Bounds, c.Bounds
+	return c, nil
+}
+
+// Fallback gives the pages in ts that Score below minConf the angle and crop
+// of c, as returned by Consensus, scaled to their size. Only the pages of the
+// Orientation of c are changed. They keep their Orientation, Fit, Pivot and
+// Targets, but lose the rest of what their own analysis found, and so Score 0
+// from then on. It returns how many pages it changed.
+func Fallback(ts []*Transform, c *Transform, minConf float64) int {
+	n := 0
+	for _, t := range ts {
+		if t == nil || t.Score() >= minConf || c.Size.X <= 0 || c.Size.Y <= 0 ||
+			orientationIndex(t.Orientation) != orientationIndex(c.Orientation) {
+			continue
+		}
+		size := t.Size
+		if size == (image.Point{}) {
+			size = c.Size
+		}
+		u := c.scale(float64(size.X)/float64(c.Size.X), float64(size.Y)/float64(c.Size.Y))
+		u.Orientation, u.Fit, u.Pivot, u.Targets = t.Orientation, t.Fit, t.Pivot, t.Targets
+		*t = u
+		n++
+	}
+	return n
+}
+
+// An Outlier is a page whose angle or crop stands out from the rest of its
+// batch, as found by Outliers.
+type Outlier struct {
+	Index int     // of the page in the batch
+	Angle bool    // its angle is off
+	Size  bool    // the width or height of its crop is off
+	Dev   float64 // the largest of the deviations, in MADs
+}
+
+// The smallest MADs that Outliers divides by, so that a page only a hair off
+// a batch of pages that all came out the same isn't flagged.
+const (
+	minAngleMAD = 0.0002 // radians, about 0.01°
+	minSizeMAD  = 1      // pixels
+)
+
+// Outliers returns the pages in ts whose angle, or the width or height of
+// whose crop, is more than k median absolute deviations (MADs) from the
+// median of those of the batch, in the order they are in ts. They are the
+// pages that should be looked at before the batch is applied. Pages without
+// a border are neither taken into account nor returned, as their angle and
+// crop are those of the whole image.
+func Outliers(ts []*Transform, k float64) []Outlier {
+	var angles, widths, heights []float64
+	for _, t := range ts {
+		if t != nil && !t.NoBorder {
+			angles = append(angles, t.Angle)
+			widths = append(widths, float64(t.Bounds.Dx()))
+			heights = append(heights, float64(t.Bounds.Dy()))
+		}
+	}
+	if len(angles) == 0 {
+		return nil
+	}
+
+	// dev returns how many MADs x is from the median of xs
+	dev := func(xs []float64, minMAD float64) func(x float64) float64 {
+		m, mad := util.Median(xs...), math.Max(util.MAD(xs...), minMAD)
+		return func(x float64) float64 { return math.Abs(x-m) / mad }
+	}
+	angle, width, height := dev(angles, minAngleMAD), dev(widths, minSizeMAD), dev(heights, minSizeMAD)
+
+	var outliers []Outlier
+	for i, t := range ts {
+		if t == nil || t.NoBorder {
+			continue
+		}
+		a := angle(t.Angle)
+		s := math.Max(width(float64(t.Bounds.Dx())), height(float64(t.Bounds.Dy())))
+		if a > k || s > k {
+			outliers = append(outliers, Outlier{i, a > k, s > k, math.Max(a, s)})
+		}
+	}
+	return outliers
+}
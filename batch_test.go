@@ -0,0 +1,72 @@
+package autocrop
+
+import (
+	"image"
+	"testing"
+)
+
+func TestConsensusOrientation(t *testing.T) {
+	page := func(orientation int, angle float64, size image.Point, bounds image.Rectangle) *Transform {
+		return &Transform{
+			Orientation: orientation,
+			Angle:       angle,
+			Bounds:      bounds,
+			Size:        size,
+			Sides:       AllSides,
+			Fitted:      AllSides,
+			Confidence:  [4]float64{1, 1, 1, 1},
+			Coverage:    [4]float64{1, 1, 1, 1},
+		}
+	}
+	upright, sideways := image.Pt(1000, 1400), image.Pt(1400, 1000)
+	ts := []*Transform{
+		page(0, 0.01, upright, image.Rect(50, 60, 950, 1340)),
+		page(90, -0.02, sideways, image.Rect(100, 40, 1300, 960)),
+		page(0, 0.01, upright, image.Rect(52, 60, 950, 1342)),
+		page(270, -0.02, sideways, image.Rect(100, 40, 1300, 960)),
+		page(360, 0.01, upright, image.Rect(50, 62, 948, 1340)),
+		{Orientation: 90, NoBorder: true, Size: sideways},
+		{NoBorder: true, Size: upright},
+	}
+	c, err := Consensus(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Orientation != 0 || c.Angle != 0.01 || c.Size != upright || c.Bounds != image.Rect(50, 60, 950, 1340) {
+		t.Errorf("consensus turned by %d at %g of %v in %v, want the upright pages", c.Orientation, c.Angle, c.Bounds, c.Size)
+	}
+
+	// only the upright page that failed falls back on it
+	if n := Fallback(ts, c, 0.5); n != 1 {
+		t.Errorf("%d pages fell back, want 1", n)
+	}
+	if !ts[5].NoBorder || ts[6].NoBorder || ts[6].Bounds != c.Bounds {
+		t.Errorf("fell back to %v and %v, want only the second on %v", ts[5].Bounds, ts[6].Bounds, c.Bounds)
+	}
+}
+
+func TestConsensusNone(t *testing.T) {
+	if _, err := Consensus([]*Transform{nil, {NoBorder: true, Size: image.Pt(10, 10)}}); err == nil {
+		t.Error("no error without usable pages")
+	}
+}
+
+func TestOutliersNoBorder(t *testing.T) {
+	page := func(angle float64, w, h int) *Transform {
+		return &Transform{Angle: angle, Bounds: image.Rect(0, 0, w, h), Size: image.Pt(1000, 1400)}
+	}
+	whole := func() *Transform {
+		return &Transform{NoBorder: true, Bounds: image.Rect(0, 0, 1000, 1400), Size: image.Pt(1000, 1400)}
+	}
+	// as many pages without a border as with one, which would otherwise
+	// pull the medians halfway to them
+	ts := []*Transform{
+		page(0.010, 900, 1300), whole(), page(0.011, 902, 1301), whole(),
+		page(0.009, 899, 1299), whole(), page(0.030, 900, 1300), whole(),
+		page(0.010, 901, 1302), whole(), page(0.010, 900, 1180),
+	}
+	got := Outliers(ts, 5)
+	if len(got) != 2 || got[0].Index != 6 || !got[0].Angle || got[0].Size || got[1].Index != 10 || got[1].Angle || !got[1].Size {
+		t.Errorf("outliers %+v, want the angle of page 6 and the size of page 10", got)
+	}
+}
@@ -0,0 +1,99 @@
+package autocrop
+
+// compare.go contains the comparison of Transforms, to pick out the pages of
+// a batch whose correction differs from a reference or from an earlier run.
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// IsTrivial reports whether applying t would leave the image as it is, give
+// or take a rotation of eps radians: it doesn't turn the page, doesn't
+// correct its perspective, and crops to the whole image.
+func (t *Transform) IsTrivial(eps float64) bool {
+	if t.Orientation%360 != 0 || t.Perspective || !(math.Abs(t.Angle) <= eps) {
+		return false
+	}
+	if t.Size == (image.Point{}) {
+		return t.NoBorder
+	}
+	return t.Bounds == image.Rectangle{Max: t.Size}
+}
+
+// Delta is the difference between two Transforms, as returned by Diff.
+type Delta struct {
+	Orientation int        // difference in Orientation, in degrees (0, 90, 180 or 270)
+	Perspective bool       // one is corrected for perspective and the other isn't
+	Angle       float64    // difference in Angle, in radians
+	Sides       [4]int     // how far each side (T,R,B,L) of Bounds moved out, in pixels
+	Corners     [4]float64 // how far each of the Corners moved, in pixels
+}
+
+// Diff returns how u differs from t.
+func (t *Transform) Diff(u *Transform) Delta {
+	d := Delta{
+		Orientation: ((u.Orientation-t.Orientation)%360 + 360) % 360,
+		Perspective: t.Perspective != u.Perspective,
+		Angle:       u.Angle - t.Angle,
+		Sides: [4]int{
+			t.Bounds.Min.Y - u.Bounds.Min.Y,
+			u.Bounds.Max.X - t.Bounds.Max.X,
+			u.Bounds.Max.Y - t.Bounds.Max.Y,
+			t.Bounds.Min.X - u.Bounds.Min.X,
+		},
+	}
+	for i, p := range t.Corners {
+		q := u.Corners[i]
+		d.Corners[i] = math.Hypot(float64(q.X-p.X), float64(q.Y-p.Y))
+	}
+	return d
+}
+
+// Tolerance is how far apart two Transforms may be and still be equal.
+type Tolerance struct {
+	Angle  float64 // in radians
+	Pixels int     // for each side of Bounds and each of the Corners
+}
+
+// Within reports whether d is within tol. A change of orientation or of
+// perspective correction never is.
+func (d Delta) Within(tol Tolerance) bool {
+	if d.Orientation != 0 || d.Perspective || !(math.Abs(d.Angle) <= tol.Angle) {
+		return false
+	}
+	for i := range d.Sides {
+		if abs(d.Sides[i]) > tol.Pixels || !(d.Corners[i] <= float64(tol.Pixels)) {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes d briefly, for a log or a report.
+func (d Delta) String() string {
+	s := fmt.Sprintf("angle %+.3f°, sides %+d %+d %+d %+d", util.Rad2deg(d.Angle),
+		d.Sides[0], d.Sides[1], d.Sides[2], d.Sides[3])
+	if d.Orientation != 0 {
+		s += fmt.Sprintf(", turned %d°", d.Orientation)
+	}
+	if d.Perspective {
+		s += ", perspective differs"
+	}
+	return s
+}
+
+// Equal reports whether t and u are the same correction to within tol.
+func (t *Transform) Equal(u *Transform, tol Tolerance) bool {
+	return t.Diff(u).Within(tol)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
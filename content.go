@@ -0,0 +1,113 @@
+package autocrop
+
+// content.go contains the content-aware analysis, which looks at the ink on
+// the page rather than at the page's border.
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// inkLevel is the gray value below which a pixel is considered ink.
+	inkLevel = 128
+	// minInkDensity is the fraction of ink a row or column of the page must
+	// contain to count as content.
+	minInkDensity = 0.01
+)
+
+// cropContent shrinks t.Bounds to the block of ink inside it, grown by
+// ContentMargin pixels on every side but never past the page. If there is no
+// ink at all, t is left alone. Otherwise the alternative crops are set to the
+// same bounds, since there is only one content block.
+func (a *analysis) cropContent(t *Transform) {
+	content, ok := a.contentBlock(t)
+	if !ok {
+		return
+	}
+	t.Bounds = content.Inset(-a.ContentMargin).Intersect(t.Bounds)
+	t.Conservative = t.Bounds
+	t.Aggressive = t.Bounds
+}
+
+// measureMargins sets t.Margins to how far the block of ink is in from each
+// side of t.Bounds. They are left at zero if there is no ink.
+func (a *analysis) measureMargins(t *Transform) {
+	content, ok := a.contentBlock(t)
+	if !ok {
+		return
+	}
+	b := t.Bounds
+	t.Margins = [4]int{
+		content.Min.Y - b.Min.Y,
+		b.Max.X - content.Max.X,
+		b.Max.Y - content.Max.Y,
+		content.Min.X - b.Min.X,
+	}
+}
+
+// contentBlock returns the block of ink inside t.Bounds, found from the ink
+// density projection profiles of the page onto each axis. ok is false if
+// there is no ink.
+func (a *analysis) contentBlock(t *Transform) (content image.Rectangle, ok bool) {
+	// The corners of a tilted page leave triangles of background inside the
+	// bounds, which would read as ink. Stay clear of them.
+	page := t.Bounds
+	dx, dy := page.Dx(), page.Dy()
+	skew := int(math.Ceil(float64(max(dx, dy))*math.Abs(math.Sin(t.Angle))/2)) + 4
+	page = page.Inset(skew)
+	if page.Empty() {
+		return content, false
+	}
+
+	rows := a.inkProfile(page, false)
+	cols := a.inkProfile(page, true)
+
+	top, bottom, ok := contentSpan(rows)
+	if !ok {
+		return content, false
+	}
+	left, right, _ := contentSpan(cols)
+	return image.Rect(page.Min.X+left, page.Min.Y+top, page.Min.X+right, page.Min.Y+bottom), true
+}
+
+// inkProfile returns the fraction of ink pixels in every row of r, or every
+// column if cols is set. Only some pixels of large rows are looked at.
+func (a *analysis) inkProfile(r image.Rectangle, cols bool) []float64 {
+	length, across := r.Dy(), r.Dx()
+	if cols {
+		length, across = across, length
+	}
+	step := max(1, across/1000)
+
+	profile := make([]float64, length)
+	for i := range profile {
+		ink := 0
+		for j := 0; j < across; j += step {
+			x, y := r.Min.X+j, r.Min.Y+i
+			if cols {
+				x, y = r.Min.X+i, r.Min.Y+j
+			}
+			if a.ink(x, y) {
+				ink++
+			}
+		}
+		profile[i] = float64(ink*step) / float64(across)
+	}
+	return profile
+}
+
+// contentSpan returns the first and one past the last index of profile that
+// have enough ink to be content. ok is false if none do.
+func contentSpan(profile []float64) (lo, hi int, ok bool) {
+	lo = -1
+	for i, density := range profile {
+		if density >= minInkDensity {
+			if lo < 0 {
+				lo = i
+			}
+			hi = i + 1
+		}
+	}
+	return lo, hi, lo >= 0
+}
@@ -0,0 +1,80 @@
+package autocrop
+
+// curl.go contains the detection of curved page edges, as near the spine of a
+// book that doesn't lie flat on the scanner.
+
+import (
+	"math"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// curlTolerance is how far (in pixels) an edge sample may stray from the line
+// through the straight part of a side and still be counted as part of it.
+const curlTolerance = 2
+
+// curl returns how far (in pixels) the edge samples in edges[lo:hi] bow away
+// from a straight line, measured as the height of the parabola fitted to them
+// over the chord between its ends.
+func curl(edges []float64, lo, hi int) float64 {
+	if hi-lo < 3 {
+		return 0
+	}
+	_, _, c, ok := util.QuadFitOK(edges[lo:hi])
+	if !ok {
+		return 0
+	}
+	half := float64(hi-lo) / 2
+	return math.Abs(c) * half * half
+}
+
+// straightPart returns the window of edges[lo:hi] that lies on a straight
+// line. The straighter half of the window is taken as the seed, and grown
+// outward as long as the samples stay within curlTolerance of its line.
+func straightPart(edges []float64, lo, hi int) (int, int) {
+	if hi-lo < 6 {
+		return lo, hi
+	}
+	mid := (lo + hi) / 2
+
+	a0, b0, rms0 := fitPart(edges, lo, mid)
+	a1, b1, rms1 := fitPart(edges, mid, hi)
+	a, b := a0, b0
+	from, to := lo, mid
+	if rms1 < rms0 {
+		a, b = a1, b1
+		from, to = mid, hi
+	}
+
+	off := func(t int) bool {
+		return edges[t] != 0 && math.Abs(edges[t]-(a+b*float64(t))) > curlTolerance
+	}
+	for from > lo && !off(from-1) {
+		from--
+	}
+	for to < hi && !off(to) {
+		to++
+	}
+	return from, to
+}
+
+// fitPart fits a line to edges[lo:hi] in the coordinates of edges, and returns
+// the root mean square of its residuals.
+func fitPart(edges []float64, lo, hi int) (a, b, rms float64) {
+	a, b, _, ok := util.LinearFitOK(edges[lo:hi])
+	if !ok {
+		return 0, 0, math.Inf(1)
+	}
+	a -= b * float64(lo)
+
+	n := 0.
+	for t := lo; t < hi; t++ {
+		if edges[t] == 0 {
+			continue
+		}
+		res := edges[t] - (a + b*float64(t))
+		rms += res * res
+		n++
+	}
+	return a, b, math.Sqrt(rms / n)
+}
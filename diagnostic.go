@@ -0,0 +1,154 @@
+package autocrop
+
+// diagnostic.go contains the composite diagnostic image, which shows how the
+// Transform of a page came about, and the data it is drawn from.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// previewHeight is the height of the preview of the page in the composite.
+const previewHeight = 400
+
+// Composite is like AnalyzeWith, but also returns an image for reviewing the
+// analysis. It has a chart of the edge samples and the line fitted to them on
+// each side, and a preview of the page with the fitted lines and the crops
+// drawn over it: Bounds in green, Conservative in blue and Aggressive in
+// orange.
+func Composite(img image.Image, opts Options) (*image.NRGBA, *Transform, error) {
+	a, t, err := analyze(img, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	panels := []image.Image{a.preview(t)}
+	labels := []string{"preview"}
+	for i, s := range a.sides {
+		if !t.Sides.Has(i) || s.raw == nil {
+			continue
+		}
+		panels = append(panels, chart(s, "").Draw())
+		labels = append(labels, fmt.Sprintf("%s: angle %.3f deg, r2 %.3f, coverage %.2f, curl %.1f px",
+			sideNames[i], util.Rad2deg(s.angle), s.confidence, t.Coverage[i], s.curl))
+	}
+
+	title := fmt.Sprintf("%v: angle %.3f +/- %.3f deg", a.Algorithm, util.Rad2deg(t.Angle), util.Rad2deg(t.AngleErr))
+	if t.NoBorder {
+		title += ", no border"
+	}
+	return util.Tile(title, panels, labels, 3), t, nil
+}
+
+// Diagnostics is the data behind the Transform of a page, for building other
+// views of the analysis than Composite, or working out why a side came out
+// with a low confidence.
+type Diagnostics struct {
+	// Size is the size of the upright image the sides were sampled on.
+	Size image.Point
+	// Sides holds what was found on each side (T,R,B,L). Sides that weren't
+	// analyzed are zero.
+	Sides [4]SideDiagnostics
+}
+
+// SideDiagnostics is how a line was fitted to one side of a page.
+type SideDiagnostics struct {
+	// Sample i was taken at Start + i*Length/len(Raw) pixels along the side,
+	// from the top or the left of the upright image.
+	Start, Length int
+	// Raw is the distance in (in pixels) from the side of the image to the
+	// edge found by each sample, or 0 where none was found. Cleaned is what
+	// the line was fitted to: Raw smoothed and with the outliers replaced.
+	// The Hough algorithm doesn't clean its samples.
+	Raw, Cleaned []float64
+	// Lo and Hi are the window [Lo, Hi) of the samples that was trusted,
+	// once the ends were trimmed.
+	Lo, Hi int
+	// Intercept and Slope are the fitted line, Intercept + Slope*i for
+	// sample i.
+	Intercept, Slope float64
+	// Confidence is the r^2 of the fit (or the coverage, for Hough) and
+	// Found the number of samples in the window that found an edge.
+	Confidence float64
+	Found      int
+}
+
+// Diagnose is like AnalyzeWith, but also returns the Diagnostics of the
+// analysis.
+func Diagnose(img image.Image, opts Options) (*Transform, *Diagnostics, error) {
+	a, t, err := analyze(img, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b := a.img.Bounds()
+	d := &Diagnostics{Size: b.Size()}
+	spans := a.spans(b.Dx(), b.Dy())
+	for i, s := range a.sides {
+		if !t.Sides.Has(i) || s.raw == nil {
+			continue
+		}
+		// with EarlyStop, the last of every stride of the samples falls
+		// short of the end if the stride doesn't divide N
+		length := spans[i].length * len(s.raw) * s.stride / a.N
+		d.Sides[i] = SideDiagnostics{
+			Start:      spans[i].start,
+			Length:     length,
+			Raw:        s.raw,
+			Cleaned:    s.cleaned,
+			Lo:         s.lo,
+			Hi:         s.hi,
+			Intercept:  s.a,
+			Slope:      s.b,
+			Confidence: s.confidence,
+			Found:      s.found,
+		}
+	}
+	return t, d, nil
+}
+
+// preview returns a small copy of the upright image with the fitted lines of
+// t drawn over it.
+func (a *analysis) preview(t *Transform) image.Image {
+	b := a.img.Bounds()
+	dx, dy := b.Dx(), b.Dy()
+	k := math.Min(1, previewHeight/float64(dy))
+	img := image.NewNRGBA(image.Rect(0, 0, int(float64(dx)*k), int(float64(dy)*k)))
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			img.Set(x, y, a.img.At(b.Min.X+int(float64(x)/k), b.Min.Y+int(float64(y)/k)))
+		}
+	}
+
+	// the Transform is of the image before it was shrunk, if it was
+	kt := k / float64(max(1, a.shrink))
+	scale := func(r image.Rectangle) image.Rectangle {
+		return image.Rect(int(float64(r.Min.X)*kt), int(float64(r.Min.Y)*kt), int(float64(r.Max.X)*kt), int(float64(r.Max.Y)*kt))
+	}
+	util.Outline(img, scale(t.Conservative.Sub(a.moved)), BLUE)
+	util.Outline(img, scale(t.Aggressive.Sub(a.moved)), color.NRGBA{255, 160, 0, 255})
+	util.Outline(img, scale(t.Bounds.Sub(a.moved)), GREEN)
+	if t.NoBorder {
+		return img
+	}
+
+	pt := func(x, y float64) image.Point {
+		return image.Pt(int(x*k), int(y*k))
+	}
+	top, right, bottom, left := sideLines(dx, dy, &a.sides)
+	for i, l := range [4][2]float64{top, right, bottom, left} {
+		if !t.Sides.Has(i) {
+			continue
+		}
+		if i%2 == 0 {
+			util.Segment(img, pt(0, l[0]), pt(float64(dx), l[0]+l[1]*float64(dx)), RED)
+		} else {
+			util.Segment(img, pt(l[0], 0), pt(l[0]+l[1]*float64(dy), float64(dy)), RED)
+		}
+	}
+	return img
+}
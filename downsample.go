@@ -0,0 +1,187 @@
+package autocrop
+
+// downsample.go contains the analysis of a shrunk copy of an image, for scans
+// of far higher resolution than finding the edges of the page takes.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// analyzeDownsampled does the work of analyze on a copy of img shrunk by a
+// factor of opts.Downsample, and scales the Transform back up to img. The
+// lengths in opts are shrunk with the image, except for those that shape the
+// crop once it is found, which are applied to the Transform of img.
+func analyzeDownsampled(img image.Image, opts Options) (*analysis, *Transform, error) {
+	f := opts.Downsample
+	opts = opts.fill()
+	if err := opts.check(); err != nil {
+		return nil, nil, err
+	}
+	b := img.Bounds()
+	if err := opts.budget(b.Dx(), b.Dy()); err != nil {
+		return nil, nil, err
+	}
+	if opts.Mask != nil && opts.Mask.Bounds() != b {
+		return nil, nil, fmt.Errorf("autocrop: mask bounds %v don't match image bounds %v", opts.Mask.Bounds(), b)
+	}
+
+	small := opts
+	small.Downsample = 0
+	small.Gray = GrayWeights{} // the copy is gray already
+	small.Physical = Physical{}
+	small.DPI /= float64(f)
+	small.MinRun = shrinkLength(opts.MinRun, f)
+	small.Block = shrinkLength(opts.Block, f)
+	small.ContentMargin = shrinkLength(opts.ContentMargin, f)
+	small.Params.TrimDepth /= float64(f)
+	small.Params.LineDev /= float64(f)
+	small.Params.ChunkDev /= float64(f)
+	small.Inset, small.InsetFrac = 0, 0
+	small.Size, small.Aspect, small.Modulus = image.Point{}, 0, 0
+	if mask := newExclusion(&opts, b); mask != nil {
+		small.Mask, small.Exclude = blockMask{mask, f}, nil
+	}
+	if !opts.Hint.Empty() {
+		small.Hint = image.Rect(opts.Hint.Min.X/f, opts.Hint.Min.Y/f,
+			(opts.Hint.Max.X+f-1)/f, (opts.Hint.Max.Y+f-1)/f)
+	}
+
+	conv := &analysis{img: img, gray: opts.Gray.fixed(), Options: &opts}
+	conv.palette = conv.grayPalette()
+	small.session = opts.session.shrunkBy(f, conv.gray)
+	a, st, err := analyze(opts.session.shrunk(conv, f), small)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.shrink = f
+	if opts.Refine && !st.NoBorder {
+		ra, rt, err := refine(img, opts, a, st)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !rt.NoBorder {
+			return ra, rt, nil
+		}
+	}
+
+	t := st.Scale(float64(f))
+	t.Size = b.Size()
+	if t.Orientation%180 != 0 {
+		t.Size.X, t.Size.Y = t.Size.Y, t.Size.X
+	}
+	// the last blocks may be short of f pixels
+	whole := image.Rectangle{Max: t.Size}
+	t.Bounds = t.Bounds.Intersect(whole)
+	t.Conservative = t.Conservative.Intersect(whole)
+	t.Aggressive = t.Aggressive.Intersect(whole)
+	if !t.NoBorder || opts.Content {
+		t.inset(t.Size.X, t.Size.Y, opts.Inset, opts.InsetFrac)
+		t.constrain(t.Size.X, t.Size.Y, opts.Aspect, opts.Size)
+		t.align(t.Size.X, t.Size.Y, opts.Modulus)
+	}
+	return a, &t, nil
+}
+
+// refine analyzes img again at full resolution with opts, looking for each
+// edge only near the line fitted to it on the shrunk copy, whose analysis is
+// a and whose Transform is st. The sides that no line was fitted to are
+// searched as usual.
+func refine(img image.Image, opts Options, a *analysis, st *Transform) (*analysis, *Transform, error) {
+	f := a.shrink
+	var guides [4]*guide
+	for i, s := range a.sides {
+		if st.Fitted.Has(i) {
+			// a pixel either way of the copy's edge, and then some for the
+			// filters to settle in
+			guides[i] = &guide{depth: float64(s.crop * f), slope: s.slope, reach: 2*f + minBand}
+		}
+	}
+
+	// the copy was turned upright before its analysis, so the image is
+	// turned the same way rather than looked at again
+	turn := st.Orientation
+	if opts.PreRotated {
+		turn -= opts.SourceRotation
+	}
+	full := opts
+	full.Downsample, full.Refine, full.Orientation = 0, false, false
+	full.SourceRotation, full.PreRotated = (turn%360+360)%360, false
+	ra, t, err := analyzeGuided(img, full, &guides)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.Orientation = st.Orientation
+	return ra, t, nil
+}
+
+// shrinkLength returns the length of px pixels in an image shrunk by a factor
+// of f, keeping lengths that were set at least a pixel long.
+func shrinkLength(px, f int) int {
+	if px <= 0 {
+		return px
+	}
+	return max(1, int(math.Round(float64(px)/float64(f))))
+}
+
+// shrunk returns a copy of the image shrunk by a factor of f, each pixel of
+// which is the average gray value of a block of f×f pixels. The blocks along
+// the right and bottom are short if the image doesn't divide evenly.
+func (a *analysis) shrunk(f int) *image.Gray16 {
+	b := a.img.Bounds()
+	dx, dy := b.Dx(), b.Dy()
+	small := image.NewGray16(image.Rect(0, 0, (dx+f-1)/f, (dy+f-1)/f))
+	convert := a.planeRun()
+	row := make([]uint16, dx)
+	sums := make([]uint64, small.Rect.Dx())
+	for sy := 0; sy < small.Rect.Dy(); sy++ {
+		clear(sums)
+		y0, y1 := sy*f, min(sy*f+f, dy)
+		for y := y0; y < y1; y++ {
+			if convert != nil {
+				convert(b.Min.X, b.Min.Y+y, 1, 0, row)
+			} else {
+				for x := range row {
+					row[x] = uint16(a.convertAt(b.Min.X+x, b.Min.Y+y)*257 + 0.5)
+				}
+			}
+			for x, v := range row {
+				sums[x/f] += uint64(v)
+			}
+		}
+		for sx, sum := range sums {
+			n := uint64((y1 - y0) * (min(sx*f+f, dx) - sx*f))
+			small.SetGray16(sx, sy, color.Gray16{uint16((sum + n/2) / n)})
+		}
+	}
+	return small
+}
+
+// blockMask presents an exclusion mask shrunk by a factor of f, covering each
+// block of f×f pixels that it covers any of.
+type blockMask struct {
+	mask image.Image
+	f    int
+}
+
+func (m blockMask) ColorModel() color.Model { return color.Alpha16Model }
+
+func (m blockMask) Bounds() image.Rectangle {
+	b := m.mask.Bounds()
+	return image.Rect(0, 0, (b.Dx()+m.f-1)/m.f, (b.Dy()+m.f-1)/m.f)
+}
+
+func (m blockMask) At(x, y int) color.Color {
+	b := m.mask.Bounds()
+	r := image.Rect(x*m.f, y*m.f, (x+1)*m.f, (y+1)*m.f).Add(b.Min).Intersect(b)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if _, _, _, alpha := m.mask.At(x, y).RGBA(); alpha >= 0x8000 {
+				return color.Opaque
+			}
+		}
+	}
+	return color.Transparent
+}
@@ -0,0 +1,103 @@
+package autocrop
+
+// earlystop.go contains EarlyStop, which takes the samples along the sides a
+// level at a time, and stops taking them once the lines fitted to them settle.
+
+import "math"
+
+const (
+	// earlyMin is about the fewest samples per side that EarlyStop fits the
+	// sides to before it decides whether to take more.
+	earlyMin = 60
+	// earlyCrop (in pixels) and earlyConfidence are how far the crop and
+	// the confidence of a side may move from one level of samples to the
+	// next, with the angle moving less than adaptAngleErr, for the side to
+	// count as settled.
+	earlyCrop       = 1
+	earlyConfidence = 0.02
+)
+
+// sampleEarly takes the n samples of the rows and the columns with sample, a
+// level at a time. The first level is every stride of them, at the coarsest
+// stride that takes at least earlyMin, and each level after it takes those
+// halfway between, halving the stride. Whatever level they stop at, the
+// samples are as evenly spread along the sides as if fewer had been asked for.
+// The rows (or the columns) stop once the sides they find have settled: fit,
+// which fits side i to every stride of its samples, has come out the same for
+// both of them on the last two levels. It returns the strides of the rows and
+// the columns that were reached.
+func (a *analysis) sampleEarly(n int, sample func(rows, cols []int), fit func(i, stride int) side) [2]int {
+	first := 1
+	for (n+2*first-1)/(2*first) >= earlyMin {
+		first *= 2
+	}
+	strides := [2]int{first, first}
+	take := [2][]int{stridedIndices(n, first, 0), stridedIndices(n, first, 0)}
+	var last [4]side
+	for level := 0; take[0] != nil || take[1] != nil; level++ {
+		sample(take[0], take[1])
+		if a.failed != nil {
+			break
+		}
+		for k, stride := range strides {
+			if take[k] == nil {
+				continue
+			}
+			take[k] = nil
+			if stride == 1 {
+				continue
+			}
+			// the rows find the right and left sides, the columns the top
+			// and bottom
+			settled := level > 0
+			for _, i := range [2]int{1 - k, 3 - k} {
+				s := fit(i, stride)
+				if a.Sides.Has(i) && !settledSide(last[i], s) {
+					settled = false
+				}
+				last[i] = s
+			}
+			if settled {
+				a.debug("early stop", "sides", sideNames[1-k]+","+sideNames[3-k], "samples", (n+stride-1)/stride)
+				continue
+			}
+			strides[k] /= 2
+			take[k] = stridedIndices(n, 2*strides[k], strides[k])
+		}
+	}
+	return strides
+}
+
+// settledSide reports whether side s, fitted to a level of samples, came out
+// close enough to p, fitted to the level before, that more samples wouldn't
+// change it.
+func settledSide(p, s side) bool {
+	if p.found == 0 || s.found == 0 {
+		return p.found == 0 && s.found == 0
+	}
+	return math.Abs(float64(s.crop-p.crop)) <= earlyCrop &&
+		math.Abs(s.angle-p.angle) < adaptAngleErr &&
+		math.Abs(s.confidence-p.confidence) <= earlyConfidence
+}
+
+// stridedIndices returns the indices from, from+stride, and so on, below n.
+func stridedIndices(n, stride, from int) []int {
+	var indices []int
+	for i := from; i < n; i += stride {
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+// every returns every stride of x from the first, which is x itself for a
+// stride of 1.
+func every[T any](x []T, stride int) []T {
+	if stride == 1 {
+		return x
+	}
+	var y []T
+	for i := 0; i < len(x); i += stride {
+		y = append(y, x[i])
+	}
+	return y
+}
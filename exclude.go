@@ -0,0 +1,65 @@
+package autocrop
+
+// exclude.go contains the exclusion mask, which keeps known trouble areas of
+// an image out of the analysis.
+
+import (
+	"image"
+	"image/color"
+)
+
+// exclusion is a mask that covers the opaque parts of a mask image and a list
+// of rectangles. Either may be empty.
+type exclusion struct {
+	mask   image.Image
+	rects  []image.Rectangle
+	bounds image.Rectangle
+}
+
+// newExclusion returns the mask of the exclusions in opts over an image with
+// bounds b, or nil if there are none.
+func newExclusion(opts *Options, b image.Rectangle) image.Image {
+	if opts.Mask == nil && len(opts.Exclude) == 0 {
+		return nil
+	}
+	return exclusion{opts.Mask, opts.Exclude, b}
+}
+
+func (e exclusion) ColorModel() color.Model { return color.Alpha16Model }
+func (e exclusion) Bounds() image.Rectangle { return e.bounds }
+
+func (e exclusion) At(x, y int) color.Color {
+	p := image.Pt(x, y)
+	for _, r := range e.rects {
+		if p.In(r) {
+			return color.Opaque
+		}
+	}
+	if e.mask != nil {
+		return e.mask.At(x, y)
+	}
+	return color.Transparent
+}
+
+// rotateMask returns the mask turned like rotate90, or nil if there is none.
+func rotateMask(mask image.Image, deg int) image.Image {
+	if mask == nil {
+		return nil
+	}
+	return rotate90(mask, deg)
+}
+
+// excluded reports whether any pixel of r is covered by the exclusion mask.
+func (a *analysis) excluded(r image.Rectangle) bool {
+	if a.mask == nil {
+		return false
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if _, _, _, alpha := a.mask.At(x, y).RGBA(); alpha >= 0x8000 {
+				return true
+			}
+		}
+	}
+	return false
+}
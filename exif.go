@@ -0,0 +1,132 @@
+package autocrop
+
+// exif.go reads the orientation that cameras record in the EXIF metadata of
+// a JPEG, since the image package decodes the pixels as they are stored.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// exifPeek is how far into a file the EXIF metadata is looked for.
+const exifPeek = 64 << 10
+
+// exifReach is how much of the segments of a JPEG before its scan are read
+// to find the EXIF metadata, which can come after large ones like an ICC
+// profile or a thumbnail.
+const exifReach = 16 << 20
+
+// exifRotation returns the clockwise rotation in degrees that the EXIF
+// orientation tag of the JPEG being read by br asks for on display, and a
+// reader that reads the whole of it again, since the segments before the tag
+// can be longer than br can peek at. It returns 0 and br if there is no tag.
+// The mirrored orientations (2, 4, 5 and 7), which scanners don't produce,
+// are an error, as a Transform can't undo the flip.
+func exifRotation(br *bufio.Reader) (int, *bufio.Reader, error) {
+	if b, _ := br.Peek(2); len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return 0, br, nil
+	}
+	head := []byte{0xff, 0xd8}
+	br.Discard(2)
+
+	// walk the segments up to the start of the scan
+	o := 0
+	for len(head) < exifReach {
+		at := len(head)
+		head = append(head, 0, 0, 0, 0)
+		if _, err := io.ReadFull(br, head[at:]); err != nil {
+			head = head[:at]
+			break
+		}
+		marker := head[at+1]
+		n := int(binary.BigEndian.Uint16(head[at+2:]))
+		if head[at] != 0xff || marker == 0xda || n < 2 {
+			break
+		}
+		head = append(head, make([]byte, n-2)...)
+		if _, err := io.ReadFull(br, head[at+4:]); err != nil {
+			head = head[:at+4]
+			break
+		}
+		if seg := head[at+4:]; marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			o = exifOrientation(seg[6:])
+			break
+		}
+	}
+	r := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(head), br), exifPeek)
+
+	switch o {
+	case 3:
+		return 180, r, nil
+	case 6:
+		return 90, r, nil
+	case 8:
+		return 270, r, nil
+	case 2, 4, 5, 7:
+		return 0, r, fmt.Errorf("autocrop: mirrored EXIF orientation %d is not supported", o)
+	}
+	return 0, r, nil
+}
+
+// exifOrientation returns the orientation tag in the first IFD of the TIFF
+// structure tiff, or 0 if there is none.
+func exifOrientation(tiff []byte) int {
+	// the orientation is a SHORT stored in the entry itself
+	e, order := tiffEntry(tiff, 0x0112)
+	if e == nil {
+		return 0
+	}
+	return int(order.Uint16(e[8:]))
+}
+
+// tiffEntry returns the 12 byte entry for tag in the first IFD of the TIFF
+// structure tiff, and the byte order of tiff. The entry is nil if there is
+// none.
+func tiffEntry(tiff []byte, tag uint16) ([]byte, binary.ByteOrder) {
+	order := tiffOrder(tiff)
+	if order == nil {
+		return nil, nil
+	}
+	e := tiffIFDEntry(tiff, order, int(order.Uint32(tiff[4:8])), tag)
+	if e == nil {
+		return nil, nil
+	}
+	return e, order
+}
+
+// tiffOrder returns the byte order of the TIFF structure tiff, or nil if it
+// isn't one.
+func tiffOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// tiffIFDEntry returns the entry for tag in the IFD at offset ifd of the
+// TIFF structure tiff, or nil.
+func tiffIFDEntry(tiff []byte, order binary.ByteOrder, ifd int, tag uint16) []byte {
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return nil
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(tiff) {
+			return nil
+		}
+		if order.Uint16(tiff[e:]) == tag {
+			return tiff[e : e+12]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package autocrop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// exifJPEG returns a JPEG with the EXIF orientation o, after an APP2 segment
+// of pad bytes.
+func exifJPEG(t *testing.T, o uint16, pad int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 32, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	segment := func(marker byte, data []byte) []byte {
+		s := []byte{0xff, marker, 0, 0}
+		binary.BigEndian.PutUint16(s[2:], uint16(2+len(data)))
+		return append(s, data...)
+	}
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint16(tiff[18:], o)
+
+	out := append([]byte(nil), b[:2]...)
+	for ; pad > 0; pad -= 60000 {
+		out = append(out, segment(0xe2, make([]byte, min(pad, 60000)))...)
+	}
+	out = append(out, segment(0xe1, append([]byte("Exif\x00\x00"), tiff...))...)
+	return append(out, b[2:]...)
+}
+
+func TestEXIFRotation(t *testing.T) {
+	tests := []struct {
+		o    uint16
+		pad  int
+		want int
+		err  bool
+	}{
+		{1, 0, 0, false},
+		{6, 0, 90, false},
+		{3, 100000, 180, false},
+		{8, 300000, 270, false},
+		{2, 0, 0, true},
+		{7, 100000, 0, true},
+	}
+	for _, tt := range tests {
+		rot, r, err := exifRotation(bufio.NewReaderSize(bytes.NewReader(exifJPEG(t, tt.o, tt.pad)), exifPeek))
+		if rot != tt.want || (err != nil) != tt.err {
+			t.Errorf("orientation %d after %d bytes: got %d, %v, want %d", tt.o, tt.pad, rot, err, tt.want)
+			continue
+		}
+		// the image is still all there to decode
+		if c, err := jpeg.DecodeConfig(r); err != nil || c.Width != 32 || c.Height != 16 {
+			t.Errorf("orientation %d after %d bytes: decoded %dx%d, %v", tt.o, tt.pad, c.Width, c.Height, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package autocrop
+
+// filter.go contains the filters that take the noise out of the samples
+// across the edges of the page before the edges are looked for in them.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// A Filter takes the noise out of a sample of gray levels taken across the
+// edge of the page, before it is differentiated. It returns the filtered
+// sample, which may be samples itself filtered in place, and must not keep
+// samples. It is called from several goroutines at once.
+type Filter interface {
+	Filter(samples []float64) []float64
+}
+
+// A FilterTo is a Filter that can also write the filtered samples into dst,
+// which is as long as samples and not the same slice, and return it. The
+// analysis filters every sample into a buffer that it reuses, rather than
+// have a new slice allocated for each of the thousands of samples of an
+// image. The filters of this package are all FilterTos.
+type FilterTo interface {
+	Filter
+	FilterTo(dst, samples []float64) []float64
+}
+
+// FilterFunc adapts an ordinary function to a Filter.
+type FilterFunc func(samples []float64) []float64
+
+// Filter returns f(samples).
+func (f FilterFunc) Filter(samples []float64) []float64 {
+	return f(samples)
+}
+
+// LowpassFilter is a single pole low-pass filter with the cutoff frequency
+// Fc. It is what the analysis uses if Options.Filter is nil, with Fc taken
+// from Options.Fc. It is cheap and smooths out film grain and paper texture
+// well, but it lags, so it shifts the edges it finds a little into the page.
+type LowpassFilter struct {
+	Fc float64
+}
+
+func (f LowpassFilter) Filter(samples []float64) []float64 {
+	return util.Lowpass(samples, f.Fc)
+}
+
+func (f LowpassFilter) FilterTo(dst, samples []float64) []float64 {
+	return util.LowpassTo(dst, samples, f.Fc)
+}
+
+// MedianFilter replaces each sample by the median of the samples no more than
+// Radius away from it. It gets rid of specks of dust and salt and pepper
+// noise without blurring the edge.
+type MedianFilter struct {
+	Radius int
+}
+
+func (f MedianFilter) Filter(samples []float64) []float64 {
+	if f.Radius <= 0 {
+		return samples
+	}
+	return f.FilterTo(make([]float64, len(samples)), samples)
+}
+
+func (f MedianFilter) FilterTo(dst, samples []float64) []float64 {
+	dst = dst[:len(samples)]
+	if f.Radius <= 0 {
+		copy(dst, samples)
+		return dst
+	}
+	window := getSamples(2*f.Radius + 1)
+	defer putSamples(window)
+	for i := range samples {
+		w := append(window[:0], samples[max(0, i-f.Radius):min(len(samples), i+f.Radius+1)]...)
+		sort.Float64s(w)
+		dst[i] = w[len(w)/2]
+	}
+	return dst
+}
+
+// GaussianFilter blurs the samples with a Gaussian of standard deviation
+// Sigma samples. Unlike LowpassFilter it doesn't shift the edge.
+type GaussianFilter struct {
+	Sigma float64
+}
+
+func (f GaussianFilter) Filter(samples []float64) []float64 {
+	if !(f.Sigma > 0) {
+		return samples
+	}
+	return f.FilterTo(make([]float64, len(samples)), samples)
+}
+
+func (f GaussianFilter) FilterTo(dst, samples []float64) []float64 {
+	dst = dst[:len(samples)]
+	if !(f.Sigma > 0) {
+		copy(dst, samples)
+		return dst
+	}
+	r := int(math.Ceil(3 * f.Sigma))
+	kernel := getSamples(2*r + 1)
+	defer putSamples(kernel)
+	for i := range kernel {
+		d := float64(i-r) / f.Sigma
+		kernel[i] = math.Exp(-d * d / 2)
+	}
+
+	// near the ends the kernel is cut off and what is left of it is
+	// normalized, so the ends aren't pulled towards zero
+	for i := range samples {
+		var sum, weight float64
+		for k, w := range kernel {
+			if j := i + k - r; j >= 0 && j < len(samples) {
+				sum += w * samples[j]
+				weight += w
+			}
+		}
+		dst[i] = sum / weight
+	}
+	return dst
+}
+
+// NoFilter leaves the samples as they are, for clean scans in which any
+// filtering only blurs the edge.
+var NoFilter Filter = FilterFunc(func(samples []float64) []float64 { return samples })
+
+// The largest radius and standard deviation, in samples, of the filters that
+// ParseFilter gives. Each filtered sample needs a buffer of twice the radius,
+// or six standard deviations, which a spec from a request could otherwise
+// make as large as it likes.
+const (
+	maxFilterRadius = 1000
+	maxFilterSigma  = 300
+)
+
+// ParseFilter returns the Filter named by spec: "none", or "lowpass",
+// "median" or "gaussian" followed by a colon and its cutoff frequency, radius
+// or standard deviation respectively, like "median:2". The radius can be up
+// to 1000 samples, and the standard deviation up to 300.
+func ParseFilter(spec string) (Filter, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	if name == "none" && arg == "" {
+		return NoFilter, nil
+	}
+	var (
+		f   Filter
+		err error
+	)
+	switch name {
+	case "lowpass":
+		var fc float64
+		if fc, err = strconv.ParseFloat(arg, 64); err == nil && !(fc > 0 && finite(fc)) {
+			err = fmt.Errorf("cutoff frequency must be positive")
+		}
+		f = LowpassFilter{fc}
+	case "median":
+		var r int
+		if r, err = strconv.Atoi(arg); err == nil && !(r >= 1 && r <= maxFilterRadius) {
+			err = fmt.Errorf("radius must be from 1 to %d", maxFilterRadius)
+		}
+		f = MedianFilter{r}
+	case "gaussian":
+		var sigma float64
+		if sigma, err = strconv.ParseFloat(arg, 64); err == nil && !(sigma > 0 && sigma <= maxFilterSigma) {
+			err = fmt.Errorf("standard deviation must be positive and at most %d", maxFilterSigma)
+		}
+		f = GaussianFilter{sigma}
+	default:
+		return nil, fmt.Errorf("autocrop: unknown filter %q", spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("autocrop: invalid filter %q: %v", spec, err)
+	}
+	return f, nil
+}
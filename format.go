@@ -0,0 +1,70 @@
+package autocrop
+
+// format.go contains the formatting of the numbers in the commands given by
+// Format, which are kept byte for byte the same between runs so that they can
+// be cached and diffed.
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// NumberFormat is how the numbers in the commands given by Format are
+// written. The output never depends on the locale: the decimal separator is
+// always a point and there are no group separators.
+type NumberFormat struct {
+	// Precision is the number of decimals that angles are written with. If
+	// zero it is 6; if negative, angles are written with as few decimals as
+	// it takes to read them back exactly.
+	Precision int
+
+	// Width, if positive, pads the integers of geometry (sizes, offsets and
+	// points) with zeros to at least Width digits, so that the commands for
+	// a whole book line up.
+	Width int
+}
+
+// DefaultFormat is the NumberFormat used by String.
+var DefaultFormat = NumberFormat{Precision: 6}
+
+// angle formats an angle in degrees. Angles that round to zero are written
+// without a sign.
+func (f NumberFormat) angle(deg float64) string {
+	prec := f.Precision
+	if prec == 0 {
+		prec = DefaultFormat.Precision
+	}
+	if prec < 0 {
+		prec = -1
+	}
+	s := strconv.FormatFloat(deg, 'f', prec, 64)
+	if strings.Trim(s, "-0.") == "" {
+		s = strings.TrimPrefix(s, "-")
+	}
+	return s
+}
+
+// int formats an integer of geometry.
+func (f NumberFormat) int(v int) string {
+	return fmt.Sprintf("%0*d", max(f.Width, 0), v)
+}
+
+// offset formats an offset of geometry, with its sign.
+func (f NumberFormat) offset(v int) string {
+	if v < 0 {
+		return "-" + f.int(-v)
+	}
+	return "+" + f.int(v)
+}
+
+// geometry formats r as an ImageMagick geometry, WxH+X+Y.
+func (f NumberFormat) geometry(r image.Rectangle) string {
+	return f.int(r.Dx()) + "x" + f.int(r.Dy()) + f.offset(r.Min.X) + f.offset(r.Min.Y)
+}
+
+// point formats p as X,Y.
+func (f NumberFormat) point(p image.Point) string {
+	return f.int(p.X) + "," + f.int(p.Y)
+}
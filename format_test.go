@@ -0,0 +1,31 @@
+package autocrop
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	const deg = math.Pi / 180
+	page := image.Rect(40, 60, 1040, 1460)
+	size := image.Pt(1100, 1520)
+	tests := []struct {
+		name string
+		tr   Transform
+		f    NumberFormat
+		want string
+	}{
+		{"default", Transform{Angle: -2 * deg, Bounds: page, Size: size}, DefaultFormat, "-rotate -2.000000 +repage -crop 1000x1400+67+79"},
+		{"negative zero", Transform{Angle: -1e-9, Bounds: page}, DefaultFormat, "-rotate 0.000000 +repage -crop 1000x1400+40+60"},
+		{"negative offset", Transform{Bounds: image.Rect(-5, -3, 995, 1397), Size: size}, DefaultFormat, "-rotate 0.000000 +repage -crop 1000x1400-5-3"},
+		{"precision", Transform{Angle: 0.25 * deg, Bounds: page}, NumberFormat{Precision: 2}, "-rotate 0.25 +repage -crop 1000x1400+40+60"},
+		{"exact", Transform{Angle: 0.25 * deg, Bounds: page}, NumberFormat{Precision: -1}, "-rotate 0.25 +repage -crop 1000x1400+40+60"},
+		{"width", Transform{Bounds: image.Rect(-5, 60, 995, 1460)}, NumberFormat{Width: 5}, "-rotate 0.000000 +repage -crop 01000x01400-00005+00060"},
+	}
+	for _, tt := range tests {
+		if got := tt.tr.Format(tt.f); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package autocrop
+
+// frames.go contains the analysis of images with more than one frame, like
+// animated GIFs and multi-page TIFFs from document feeders.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// FramesDecoder decodes every frame of a multi-frame image from r, each as
+// an image of its own that looks like the frame does when it is shown.
+type FramesDecoder func(r io.Reader) ([]image.Image, error)
+
+// framesFormat is a registered FramesDecoder and the magic string that
+// picks it.
+type framesFormat struct {
+	name, magic string
+	decode      FramesDecoder
+}
+
+// framesFormats holds the registered FramesDecoders, GIF's and TIFF's first.
+var framesFormats = []framesFormat{
+	{"gif", "GIF8?a", decodeGIF},
+	{"tiff", "II*\x00", decodeTIFF},
+	{"tiff", "MM\x00*", decodeTIFF},
+}
+
+// RegisterFrames makes DecodeFrames (and so AnalyzeAll) decode the images
+// whose data starts with magic with d. Like with image.RegisterFormat, each
+// "?" in magic matches any one byte.
+func RegisterFrames(name, magic string, d FramesDecoder) error {
+	for _, f := range framesFormats {
+		if f.name == name {
+			return fmt.Errorf("autocrop: frames format %q is already registered", name)
+		}
+	}
+	framesFormats = append(framesFormats, framesFormat{name, magic, d})
+	return nil
+}
+
+// DecodeFrames decodes every frame of the image read from r, and returns
+// them with the name of the format. Images of formats that have no
+// registered FramesDecoder are decoded by the image package as a single
+// frame.
+func DecodeFrames(r io.Reader) ([]image.Image, string, error) {
+	br := bufio.NewReader(r)
+	if f, ok := sniffFrames(br); ok {
+		frames, err := f.decode(br)
+		return frames, f.name, err
+	}
+	img, format, err := image.Decode(br)
+	if err != nil {
+		return nil, "", err
+	}
+	return []image.Image{img}, format, nil
+}
+
+// sniffFrames returns the registered format of the data being read by r,
+// without consuming any of it.
+func sniffFrames(r *bufio.Reader) (framesFormat, bool) {
+	for _, f := range framesFormats {
+		b, err := r.Peek(len(f.magic))
+		if err != nil {
+			continue
+		}
+		match := true
+		for i := range b {
+			if f.magic[i] != '?' && f.magic[i] != b[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return f, true
+		}
+	}
+	return framesFormat{}, false
+}
+
+// AnalyzeAll decodes every frame of the image read from r with DecodeFrames,
+// and analyzes each with AnalyzeWith. The Transforms are in the order of the
+// frames. An image with only one frame, like a PNG or a JPEG, is analyzed as
+// AnalyzeReader would, EXIF orientation and all. MaxPixels applies to each
+// frame; it is checked before decoding if the image package knows the
+// format, as it does GIF and TIFF. The pages of a TIFF are decoded as
+// AnalyzeReader decodes its first.
+func AnalyzeAll(r io.Reader, opts Options) (ts []*Transform, err error) {
+	if opts.Hardened {
+		defer func() {
+			if v := recover(); v != nil {
+				ts, err = nil, recovered(v, opts.Logger)
+			}
+		}()
+	}
+	frames, multi, err := decodeAll(bufio.NewReaderSize(r, exifPeek), &opts, true)
+	if err != nil {
+		return nil, err
+	}
+	for i, img := range frames {
+		t, err := analyzeLazily(img, opts)
+		if err != nil {
+			if multi {
+				err = fmt.Errorf("autocrop: frame %d: %w", i+1, err)
+			}
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// decodeAll decodes the frames of the image read from br for AnalyzeAll, and
+// adds to opts what the image's metadata says: the rotation of its EXIF
+// orientation if it is of a format of one frame, and its resolution if opts
+// has none. The pages of a TIFF are decoded lazily if lazy is set. It also
+// reports whether the format is one of several frames.
+func decodeAll(br *bufio.Reader, opts *Options, lazy bool) ([]image.Image, bool, error) {
+	f, multi := sniffFrames(br)
+	if !multi {
+		rot, r, err := exifRotation(br)
+		if err != nil {
+			return nil, false, err
+		}
+		opts.SourceRotation += rot
+		br = r
+	}
+	if opts.DPI == 0 {
+		opts.DPI = metadataDPI(br)
+	}
+	r := io.Reader(br)
+	if opts.MaxPixels > 0 {
+		// read the header twice, once for the size and once to decode; the
+		// image package needn't know a format of several frames
+		var head bytes.Buffer
+		c, _, err := image.DecodeConfig(io.TeeReader(br, &head))
+		if err == nil {
+			err = opts.budget(c.Width, c.Height)
+		}
+		if err != nil && (!multi || err != image.ErrFormat) {
+			return nil, multi, err
+		}
+		r = io.MultiReader(&head, br)
+	}
+
+	switch {
+	case !multi && lazy:
+		img, err := decodeLazily(r)
+		if err != nil {
+			return nil, false, err
+		}
+		return []image.Image{img}, false, nil
+	case multi && lazy && f.name == "tiff":
+		// the pages of a TIFF are decoded as they are analyzed, and only
+		// as far as they are
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, true, err
+		}
+		frames, err := tiffPages(data, true)
+		return frames, true, err
+	}
+	frames, _, err := DecodeFrames(r)
+	return frames, multi, err
+}
+
+// decodeGIF decodes the frames of an animated GIF, each drawn over what the
+// frames before it left on the logical screen.
+func decodeGIF(r io.Reader) ([]image.Image, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	screen := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]image.Image, len(g.Image))
+	for i, p := range g.Image {
+		var saved *image.RGBA
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			saved = image.NewRGBA(screen.Rect)
+			copy(saved.Pix, screen.Pix)
+		}
+
+		draw.Draw(screen, p.Bounds(), p, p.Bounds().Min, draw.Over)
+		frame := image.NewRGBA(screen.Rect)
+		copy(frame.Pix, screen.Pix)
+		frames[i] = frame
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(screen, p.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			screen = saved
+		}
+	}
+	return frames, nil
+}
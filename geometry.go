@@ -0,0 +1,86 @@
+package autocrop
+
+// geometry.go contains the adjustments made to the crop once the page has
+// been found.
+
+import (
+	"image"
+	"math"
+)
+
+// inset moves the fitted sides of t.Bounds in by px pixels plus frac of the
+// width (for the left and right) or height (for the top and bottom) of the
+// crop, or out if negative. The crop stays within the dx×dy image. It is
+// empty if the sides cross.
+func (t *Transform) inset(dx, dy, px int, frac float64) {
+	if px == 0 && frac == 0 {
+		return
+	}
+	b := t.Bounds
+	h := px + int(math.Round(frac*float64(b.Dx())))
+	v := px + int(math.Round(frac*float64(b.Dy())))
+	if t.Sides.Has(0) {
+		b.Min.Y += v
+	}
+	if t.Sides.Has(1) {
+		b.Max.X -= h
+	}
+	if t.Sides.Has(2) {
+		b.Max.Y -= v
+	}
+	if t.Sides.Has(3) {
+		b.Min.X += h
+	}
+	t.Bounds = b.Intersect(image.Rect(0, 0, dx, dy))
+}
+
+// constrain makes t.Bounds exactly size, or else grows its width or height
+// until its width divided by its height is aspect, keeping it centered on the
+// page. It is moved as needed to stay within the dx×dy image, and cut down if
+// it is bigger.
+func (t *Transform) constrain(dx, dy int, aspect float64, size image.Point) {
+	b := t.Bounds
+	switch {
+	case size != image.Point{}:
+	case aspect > 0:
+		size = b.Size()
+		if w := int(math.Round(float64(size.Y) * aspect)); w >= size.X {
+			size.X = w
+		} else {
+			size.Y = int(math.Round(float64(size.X) / aspect))
+		}
+	default:
+		return
+	}
+
+	c := b.Min.Add(b.Max).Div(2)
+	b = image.Rectangle{c.Sub(size.Div(2)), c.Sub(size.Div(2)).Add(size)}
+	b = b.Sub(image.Pt(max(b.Max.X-dx, 0), max(b.Max.Y-dy, 0)))
+	b = b.Add(image.Pt(max(-b.Min.X, 0), max(-b.Min.Y, 0)))
+	t.Bounds = b.Intersect(image.Rect(0, 0, dx, dy))
+}
+
+// align shrinks t.Bounds to the multiples of n within it, so that the offsets,
+// width and height of the crop are all multiples of n. A crop that would then
+// be less than n across is made n across instead, as far as the dx×dy image
+// allows.
+func (t *Transform) align(dx, dy, n int) {
+	if n <= 1 {
+		return
+	}
+	up := func(v int) int { return (v + n - 1) / n * n }
+	down := func(v int) int { return v / n * n }
+
+	b := t.Bounds
+	// not image.Rect, which would swap the sides if they cross
+	r := image.Rectangle{image.Pt(up(b.Min.X), up(b.Min.Y)), image.Pt(down(b.Max.X), down(b.Max.Y))}
+	if r.Dx() < n {
+		r.Min.X = down(b.Min.X)
+		r.Max.X = min(r.Min.X+n, dx)
+	}
+	if r.Dy() < n {
+		r.Min.Y = down(b.Min.Y)
+		r.Max.Y = min(r.Min.Y+n, dy)
+	}
+	t.Bounds = r
+}
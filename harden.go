@@ -0,0 +1,36 @@
+package autocrop
+
+// harden.go contains the recovery from panics in the analysis of untrusted
+// images, when Options.Hardened asks for it.
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// guard recovers from a panic in the goroutine that defers it, if the
+// analysis is hardened, and keeps the first one as the error of the
+// analysis. Otherwise the panic goes on.
+func (a *analysis) guard() {
+	if a.Options == nil || !a.Hardened {
+		return
+	}
+	if v := recover(); v != nil {
+		err := recovered(v, a.Logger)
+		a.failMu.Lock()
+		if a.failed == nil {
+			a.failed = err
+		}
+		a.failMu.Unlock()
+	}
+}
+
+// recovered returns the error for the value v recovered from a panic, and
+// logs where it came from to logger, if not nil.
+func recovered(v any, logger *slog.Logger) error {
+	if logger != nil {
+		logger.Error("panic in analysis", "panic", v, "stack", string(debug.Stack()))
+	}
+	return fmt.Errorf("autocrop: panic in analysis: %v", v)
+}
@@ -0,0 +1,107 @@
+//go:build heif
+
+package autocrop
+
+// heif.go registers a decoder for HEIF and AVIF images, the formats phones
+// save photos in, with libheif. It is only built with the heif tag, since it
+// needs cgo and libheif (with its HEVC and AV1 plugins) to be installed.
+
+// #cgo pkg-config: libheif
+// #include <stdlib.h>
+// #include <libheif/heif.h>
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"unsafe"
+)
+
+func init() {
+	// the major brand in the ftyp box that starts the file
+	for _, f := range []struct{ name, brand string }{
+		{"heif", "heic"}, {"heif", "heix"}, {"heif", "mif1"}, {"heif", "msf1"},
+		{"avif", "avif"}, {"avif", "avis"},
+	} {
+		RegisterDecoder(f.name, "????ftyp"+f.brand, decodeHEIF, decodeHEIFConfig)
+	}
+}
+
+// heifImage reads the primary image of the HEIF file in r into a libheif
+// context, and calls f with its handle.
+func heifImage(r io.Reader, f func(h *C.struct_heif_image_handle) error) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	buf := C.CBytes(data)
+	defer C.free(buf)
+
+	ctx := C.heif_context_alloc()
+	defer C.heif_context_free(ctx)
+	if err := heifError(C.heif_context_read_from_memory_without_copy(ctx, buf, C.size_t(len(data)), nil)); err != nil {
+		return err
+	}
+	var h *C.struct_heif_image_handle
+	if err := heifError(C.heif_context_get_primary_image_handle(ctx, &h)); err != nil {
+		return err
+	}
+	defer C.heif_image_handle_release(h)
+	return f(h)
+}
+
+func heifError(e C.struct_heif_error) error {
+	if e.code == C.heif_error_Ok {
+		return nil
+	}
+	return fmt.Errorf("autocrop: heif: %s", C.GoString(e.message))
+}
+
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	var c image.Config
+	err := heifImage(r, func(h *C.struct_heif_image_handle) error {
+		c.Width = int(C.heif_image_handle_get_width(h))
+		c.Height = int(C.heif_image_handle_get_height(h))
+		c.ColorModel = color.NRGBAModel
+		return nil
+	})
+	return c, err
+}
+
+// decodeHEIF decodes the primary image of a HEIF or AVIF file into an
+// *image.NRGBA. libheif applies the rotation and mirroring that the file asks
+// for, so the image comes out upright, unlike a JPEG with an EXIF
+// orientation.
+func decodeHEIF(r io.Reader) (image.Image, error) {
+	var img *image.NRGBA
+	err := heifImage(r, func(h *C.struct_heif_image_handle) error {
+		var hi *C.struct_heif_image
+		if err := heifError(C.heif_decode_image(h, &hi, C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, nil)); err != nil {
+			return err
+		}
+		defer C.heif_image_release(hi)
+
+		w := int(C.heif_image_get_width(hi, C.heif_channel_interleaved))
+		ht := int(C.heif_image_get_height(hi, C.heif_channel_interleaved))
+		var stride C.int
+		p := C.heif_image_get_plane_readonly(hi, C.heif_channel_interleaved, &stride)
+		if p == nil || w <= 0 || ht <= 0 {
+			return fmt.Errorf("autocrop: heif: no interleaved RGBA plane")
+		}
+		src := unsafe.Slice((*byte)(unsafe.Pointer(p)), int(stride)*ht)
+		img = image.NewNRGBA(image.Rect(0, 0, w, ht))
+		for y := 0; y < ht; y++ {
+			copy(img.Pix[y*img.Stride:y*img.Stride+4*w], src[y*int(stride):])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
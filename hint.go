@@ -0,0 +1,143 @@
+package autocrop
+
+// hint.go contains the spans that the edges are looked for in, which can be
+// narrowed down by a hint rectangle.
+
+import (
+	"image"
+	"math"
+)
+
+// hintSkew is the steepest skew (in radians) of a page against its hint. The
+// sides of a hint drawn around or inside a skewed page are that far out at one
+// end.
+const hintSkew = 5 * math.Pi / 180
+
+// span is where the edge on one side is looked for: at positions spread over
+// [start, start+length) along the side, from depth to depth+m pixels in from
+// the edge of the image. A span that follows a guide line gets slope deeper
+// for each pixel along the side, and never deeper than limit.
+type span struct {
+	start, length int
+	depth, m      int
+	slope         float64
+	limit         int
+}
+
+// depthAt returns the depth of the span at position p along the side.
+func (s span) depthAt(p int) int {
+	if s.slope == 0 {
+		return s.depth
+	}
+	return min(max(s.depth+int(math.Round(s.slope*float64(p-s.start))), 0), s.limit)
+}
+
+// guide is a line near which the edge on one side is known to be, from the
+// analysis of a shrunk copy of the image: depth pixels in from the edge of
+// the image at the middle of the side, and slope deeper for each pixel along
+// it. The edge is looked for no further than reach either way of it.
+type guide struct {
+	depth, slope float64
+	reach        int
+}
+
+// at returns the position along the side of sample i of n.
+func (s span) at(i, n int) int {
+	return s.start + i*s.length/n
+}
+
+// offset is how far (in pixels along the side) the middle of the image is
+// from the middle of the span.
+func (s span) offset(size int) float64 {
+	return float64(size)/2 - float64(s.start) - float64(s.length)/2
+}
+
+// spans returns the spans of the sides (T,R,B,L) of a dx×dy image. Without a
+// hint, each spans its whole side and reaches 1/Band of the image in. With
+// one, each spans only the side of the hint, and reaches as far either way
+// from it as a skewed page could be, plus half that much. Either way the band
+// is at least minBand pixels deep.
+func (a *analysis) spans(dx, dy int) [4]span {
+	if a.guides != nil {
+		return a.guidedSpans(dx, dy)
+	}
+	h := a.hint
+	if h.Empty() {
+		return [4]span{
+			{length: dx, m: a.band(dy)},
+			{length: dy, m: a.band(dx)},
+			{length: dx, m: a.band(dy)},
+			{length: dy, m: a.band(dx)},
+		}
+	}
+
+	near := func(depth, size, length int) (int, int) {
+		reach := max(size/(2*a.Params.Band)+int(float64(length)*math.Sin(hintSkew)), minBand)
+		lo := max(depth-reach, 0)
+		hi := min(depth+reach, size)
+		return lo, hi - lo
+	}
+	var s [4]span
+	s[0] = span{start: h.Min.X, length: h.Dx()}
+	s[1] = span{start: h.Min.Y, length: h.Dy()}
+	s[2] = span{start: h.Min.X, length: h.Dx()}
+	s[3] = span{start: h.Min.Y, length: h.Dy()}
+	s[0].depth, s[0].m = near(h.Min.Y, dy, h.Dx())
+	s[1].depth, s[1].m = near(dx-h.Max.X, dx, h.Dy())
+	s[2].depth, s[2].m = near(dy-h.Max.Y, dy, h.Dx())
+	s[3].depth, s[3].m = near(h.Min.X, dx, h.Dy())
+	return s
+}
+
+// guidedSpans returns the spans of the sides (T,R,B,L) of a dx×dy image that
+// have a guide: each spans its whole side, following the guide line. The
+// sides without one are spanned as they are without a hint.
+func (a *analysis) guidedSpans(dx, dy int) [4]span {
+	var s [4]span
+	for i, g := range a.guides {
+		length, across := dx, dy
+		if i%2 == 1 {
+			length, across = dy, dx
+		}
+		if g == nil {
+			s[i] = span{length: length, m: a.band(across)}
+			continue
+		}
+		m := min(2*g.reach, across/2)
+		s[i] = span{
+			length: length,
+			depth:  int(math.Round(g.depth-g.slope*float64(length)/2)) - g.reach,
+			m:      m,
+			slope:  g.slope,
+			limit:  across - m,
+		}
+		if s[i].slope == 0 {
+			s[i].depth = min(max(s[i].depth, 0), s[i].limit)
+		}
+	}
+	return s
+}
+
+// band returns how far in from the edge of an image size pixels across the
+// edge is looked for: 1/Band of the way, but no less than minBand and no more
+// than halfway.
+func (a *analysis) band(size int) int {
+	return min(max(size/a.Params.Band, minBand), size/2)
+}
+
+// rotateRect returns r, a rectangle in img, where it ends up in rotate90(img,
+// deg).
+func rotateRect(r image.Rectangle, img image.Image, deg int) image.Rectangle {
+	b := img.Bounds()
+	r = r.Sub(b.Min)
+	dx, dy := b.Dx(), b.Dy()
+	switch (deg%360 + 360) % 360 {
+	case 90:
+		return image.Rect(dy-r.Max.Y, r.Min.X, dy-r.Min.Y, r.Max.X)
+	case 180:
+		return image.Rect(dx-r.Max.X, dy-r.Max.Y, dx-r.Min.X, dy-r.Min.Y)
+	case 270:
+		return image.Rect(r.Min.Y, dx-r.Max.X, r.Max.Y, dx-r.Min.X)
+	}
+	return r.Add(b.Min)
+}
@@ -0,0 +1,55 @@
+package autocrop
+
+// holes.go contains the masking of punched holes and staples near the edges
+// of a page.
+
+// holeRun is the largest fraction of the samples on a side that a hole may
+// span. Longer runs of blobs are taken to be printed on the page.
+const holeRun = 0.06
+
+// holeReach is how far past an edge a hole may start, as a fraction of the
+// size of the image across the side. The holes of the common punches start
+// within 10 mm of the edge of the paper, about 1/20 of the width of A4 or
+// letter, and the text on a page seldom starts as close.
+const holeReach = 0.045
+
+// blob reports whether the derivative d, starting right after an edge, falls
+// within reach samples and then rises again: something dark sits on the paper
+// close to the edge.
+func (a *analysis) blob(d []float64, reach int) bool {
+	fallen := false
+	for i, v := range d {
+		switch {
+		case !fallen && i >= reach:
+			return false
+		case v < -a.Thresh:
+			fallen = true
+		case v > a.Thresh && fallen:
+			return true
+		}
+	}
+	return false
+}
+
+// maskHoles zeroes the edges of the samples in short runs of holes, and of
+// the samples on either side of them, whose edges the hole may still have
+// moved.
+func maskHoles(edges []float64, holes []bool) {
+	maxRun := int(holeRun * float64(len(edges)))
+	for i := 0; i < len(holes); {
+		if !holes[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(holes) && holes[j] {
+			j++
+		}
+		if j-i <= maxRun {
+			for k := max(i-1, 0); k < min(j+1, len(edges)); k++ {
+				edges[k] = 0
+			}
+		}
+		i = j
+	}
+}
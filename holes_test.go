@@ -0,0 +1,41 @@
+package autocrop
+
+import "testing"
+
+func TestSearchHole(t *testing.T) {
+	opts := DefaultOptions.fill()
+	a := &analysis{Options: &opts}
+
+	// 20 samples of background, then paper, with a dark blob 10 samples
+	// wide at the given distance past the edge
+	samples := func(at int) []float64 {
+		s := make([]float64, 200)
+		for i := range s {
+			switch {
+			case i < 20:
+				s[i] = 20
+			case i >= 20+at && i < 30+at:
+				s[i] = 60
+			default:
+				s[i] = 230
+			}
+		}
+		return s
+	}
+	tests := []struct {
+		at, reach int
+		hole      bool
+	}{
+		{at: 12, reach: 40, hole: true},
+		{at: 30, reach: 40, hole: true},
+		{at: 80, reach: 40, hole: false},
+		{at: 80, reach: 120, hole: true},
+		{at: 170, reach: 40, hole: false},
+	}
+	for _, tt := range tests {
+		edge, hole := a.search(samples(tt.at), tt.reach)
+		if edge < 15 || edge > 25 || hole != tt.hole {
+			t.Errorf("blob %d past the edge, reach %d: edge %g, hole %v; want an edge at 20, hole %v", tt.at, tt.reach, edge, hole, tt.hole)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package autocrop
+
+// hough.go contains the Hough transform edge detector.
+
+import (
+	"image"
+	"math"
+	"sync"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+const (
+	// houghMaxAngle is the largest skew (in radians) of a page edge the Hough
+	// transform will look for.
+	houghMaxAngle = 5 * math.Pi / 180
+	// houghStep is the angular resolution of the Hough accumulator.
+	houghStep = 0.05 * math.Pi / 180
+	// houghTolerance is how far (in pixels) an edge point may be from the
+	// winning line to count as supporting it.
+	houghTolerance = 2
+)
+
+// hough finds the page borders on each side with a Hough transform and fits
+// the Transform to them.
+func (a *analysis) hough() *Transform {
+	var (
+		b     = a.img.Bounds()
+		dx    = b.Dx()
+		dy    = b.Dy()
+		t     = &Transform{Sides: a.Sides}
+		spans = a.spans(dx, dy)
+		sides [4]side
+		wg    sync.WaitGroup
+	)
+
+	wg.Add(4)
+	for i := range sides {
+		go func(i int) {
+			defer wg.Done()
+			defer a.guard()
+			sides[i], t.Coverage[i] = a.houghSide(i, dx, dy, spans[i])
+		}(i)
+	}
+	wg.Wait()
+	if a.failed != nil {
+		return t
+	}
+
+	if t.borderless() {
+		a.debug("no border", "coverage", t.Coverage)
+		t.identity(dx, dy)
+		return t
+	}
+
+	for i := range sides {
+		a.debugSide(i, &sides[i], t.Coverage[i])
+	}
+	t.fit(dx, dy, &sides)
+	a.sides = sides
+
+	return t
+}
+
+// houghSide finds the strongest straight edge on side i (in CSS box order) of
+// a dx×dy image. Every peak of the derivative above the threshold in every
+// sample votes for all of the lines through it. The line with the most
+// votes is taken as the page edge.
+//
+// The confidence of the side is the fraction of samples that support the
+// line, which is also returned as the coverage.
+func (a *analysis) houghSide(i, dx, dy int, sp span) (s side, cover float64) {
+	size, m, dir := dx, sp.m, -1.
+	if i == 1 || i == 3 {
+		size = dy
+	}
+	if i >= 2 {
+		dir = 1
+	}
+
+	// collect the edge points as (position along side, distance inwards)
+	var pos, dist []float64
+	buf := getSamples(m)
+	defer putSamples(buf)
+
+	// the columns of the top and bottom are read a row at a time up front
+	var band [][]float64
+	if i == 0 || i == 2 {
+		xs := make([]int, a.N)
+		starts := make([]int, a.N)
+		for k := range xs {
+			xs[k] = sp.at(k, a.N)
+			if starts[k] = sp.depthAt(xs[k]); i == 2 {
+				starts[k] = dy - starts[k]
+			}
+		}
+		var bandBuf []float64
+		band, bandBuf = makeBand(a.N, m)
+		defer putSamples(bandBuf)
+		delta := 1
+		if i == 2 {
+			delta = -1
+		}
+		a.sampleRows(band, xs, starts, delta)
+	}
+
+	for k := 0; k < a.N; k++ {
+		p := sp.at(k, a.N)
+		depth := sp.depthAt(p)
+		samples := buf
+		var r image.Rectangle
+		switch i {
+		case 0:
+			samples, r = band[k], image.Rect(p, depth, p+1, depth+m)
+		case 1:
+			a.sampleX(samples, p, dx-depth, dx-depth-m, -1)
+			r = image.Rect(dx-depth-m, p, dx-depth, p+1)
+		case 2:
+			samples, r = band[k], image.Rect(p, dy-depth-m, p+1, dy-depth)
+		case 3:
+			a.sampleX(samples, p, depth, depth+m, 1)
+			r = image.Rect(depth, p, depth+m, p+1)
+		}
+		if a.excluded(r) {
+			continue
+		}
+
+		d := a.derivative(samples)
+		for j := 0; ; {
+			peak, end, ok := util.FindPeak(d, a.Thresh, j)
+			if !ok {
+				break
+			}
+			j = end
+			pos = append(pos, float64(p))
+			dist = append(dist, float64(depth+peak))
+		}
+		putSamples(d)
+	}
+	if len(pos) == 0 {
+		return
+	}
+
+	// lines are j cos θ - p sin θ = ρ; ρ may go negative by up to the
+	// far end of the span times sin θ
+	var (
+		nAngles = 2*int(houghMaxAngle/houghStep) + 1
+		offset  = int(float64(sp.start+sp.length)*math.Sin(houghMaxAngle)) + 1
+		nRho    = max(sp.depthAt(sp.start), sp.depthAt(sp.start+sp.length)) + m + 2*offset + 1
+		acc     = make([]int, nAngles*nRho)
+		sins    = make([]float64, nAngles)
+		coss    = make([]float64, nAngles)
+	)
+	for t := range sins {
+		sins[t], coss[t] = math.Sincos(-houghMaxAngle + float64(t)*houghStep)
+	}
+	for k := range pos {
+		for t := 0; t < nAngles; t++ {
+			rho := int(math.Round(dist[k]*coss[t]-pos[k]*sins[t])) + offset
+			acc[t*nRho+rho]++
+		}
+	}
+
+	best := 0
+	for cell, votes := range acc {
+		if votes > acc[best] {
+			best = cell
+		}
+	}
+	theta := -houghMaxAngle + float64(best/nRho)*houghStep
+	rho := float64(best%nRho - offset)
+	sin, cos := math.Sincos(theta)
+	line := func(p float64) float64 { return (rho + p*sin) / cos }
+
+	// the supporting edge of every sample, by sample index, for the errors
+	mid := line(float64(size) / 2)
+	var (
+		in, out   float64
+		supported = 0
+		edges     = make([]float64, a.N)
+		scale     = float64(sp.length) / float64(a.N)
+		start     = float64(sp.start)
+	)
+	for k := range pos {
+		res := dist[k] - line(pos[k])
+		if math.Abs(res) > houghTolerance {
+			continue
+		}
+		if e := &edges[int(math.Round((pos[k]-start)/scale))]; *e == 0 {
+			*e = dist[k]
+			supported++
+		}
+		in = math.Max(in, res)
+		out = math.Min(out, res)
+	}
+
+	cover = float64(supported) / float64(a.N)
+	s = side{
+		angle:      dir * math.Atan(sin/cos),
+		slope:      sin / cos,
+		confidence: cover,
+		found:      supported,
+		crop:       int(mid),
+		inner:      int(mid + in),
+		outer:      int(mid + out),
+	}
+	s.trace = trace{edges, nil, 0, a.N, line(start), sin / cos * scale, 1}
+	s.cropErr, s.angleErr = lineErr(edges, line(start), sin/cos*scale, dir/scale, houghTolerance)
+	return
+}
@@ -0,0 +1,184 @@
+package autocrop
+
+// icc.go contains the reading of the ICC color profiles embedded in image
+// files, so that the pages written by Apply keep the calibration of a
+// color-managed scan, and a PNG encoder that embeds them along with the rest
+// of the Metadata.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"sort"
+)
+
+// jpegICCMarker starts the APP2 segments that a profile is split into.
+const jpegICCMarker = "ICC_PROFILE\x00"
+
+// jpegICC puts together the profile from the APP2 segments of a JPEG, each of
+// which has its number and the count of them after the marker.
+func jpegICC(b []byte) []byte {
+	chunks := map[byte][]byte{}
+	jpegSegments(b, func(marker byte, seg []byte) {
+		if marker == 0xe2 && bytes.HasPrefix(seg, []byte(jpegICCMarker)) && len(seg) >= len(jpegICCMarker)+2 {
+			chunks[seg[len(jpegICCMarker)]] = seg[len(jpegICCMarker)+2:]
+		}
+	})
+	if len(chunks) == 0 {
+		return nil
+	}
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, int(seq))
+	}
+	sort.Ints(seqs)
+	var icc []byte
+	for _, seq := range seqs {
+		icc = append(icc, chunks[byte(seq)]...)
+	}
+	return icc
+}
+
+// jpegICCSegments splits icc into the APP2 segments of a JPEG.
+func jpegICCSegments(icc []byte) [][]byte {
+	const size = 0xffff - 2 - len(jpegICCMarker) - 2
+	count := (len(icc) + size - 1) / size
+	var segs [][]byte
+	for i := 0; i < count; i++ {
+		chunk := icc[i*size : min((i+1)*size, len(icc))]
+		seg := append([]byte{0xff, 0xe2, 0, 0}, jpegICCMarker...)
+		seg = append(seg, byte(i+1), byte(count))
+		segs = append(segs, jpegLength(append(seg, chunk...)))
+	}
+	return segs
+}
+
+// pngICC returns the profile in the iCCP chunk of a PNG.
+func pngICC(b []byte) ([]byte, error) {
+	var icc []byte
+	var err error
+	pngChunks(b, func(kind string, data []byte) {
+		if kind != "iCCP" {
+			return
+		}
+		// a name, the compression method, and the compressed profile
+		i := bytes.IndexByte(data, 0)
+		if i < 0 || i+2 > len(data) {
+			return
+		}
+		icc, err = inflate(data[i+2:])
+	})
+	return icc, err
+}
+
+// pngChunks calls f with each chunk of a PNG that comes before the image
+// data, which is where the metadata is.
+func pngChunks(b []byte, f func(kind string, data []byte)) {
+	for b = b[8:]; len(b) >= 12; {
+		n := int(binary.BigEndian.Uint32(b))
+		if n < 0 || len(b) < 12+n || string(b[4:8]) == "IDAT" {
+			return
+		}
+		f(string(b[4:8]), b[8:8+n])
+		b = b[12+n:]
+	}
+}
+
+// pngChunk returns the chunk of a PNG of the given kind and data.
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// inflate and deflate decompress and compress with zlib.
+func inflate(b []byte) ([]byte, error) {
+	z, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(z)
+}
+
+func deflate(b []byte) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	z.Write(b)
+	z.Close()
+	return buf.Bytes()
+}
+
+// tiffBlob returns the value of the tag of type BYTE or UNDEFINED in the first
+// IFD of the TIFF structure tiff, like the ICC profile (34675) or the XMP
+// (700).
+func tiffBlob(tiff []byte, tag uint16) []byte {
+	e, order := tiffEntry(tiff, tag)
+	if e == nil {
+		return nil
+	}
+	n := int(order.Uint32(e[4:]))
+	if n <= 4 {
+		return append([]byte(nil), e[8:8+n]...)
+	}
+	off := int(order.Uint32(e[8:]))
+	if off < 0 || off+n > len(tiff) || off+n < off {
+		return nil
+	}
+	return append([]byte(nil), tiff[off:off+n]...)
+}
+
+// webpChunk returns the data of the first chunk of a WebP with the given
+// FourCC, like ICCP, EXIF or "XMP ".
+func webpChunk(b []byte, fourcc string) []byte {
+	for b = b[12:]; len(b) >= 8; {
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if n < 0 || len(b) < 8+n {
+			break
+		}
+		if string(b[:4]) == fourcc {
+			return append([]byte(nil), b[8:8+n]...)
+		}
+		b = b[min(8+n+n%2, len(b)):]
+	}
+	return nil
+}
+
+// PNGOptions are the settings of EncodePNG.
+type PNGOptions struct {
+	CompressionLevel png.CompressionLevel
+	// Metadata is embedded in the file.
+	Metadata
+}
+
+// EncodePNG writes img to w as a PNG, as image/png does, with the metadata of
+// o in it. A nil o means the default options.
+func EncodePNG(w io.Writer, img image.Image, o *PNGOptions) error {
+	var opts PNGOptions
+	if o != nil {
+		opts = *o
+	}
+	enc := png.Encoder{CompressionLevel: opts.CompressionLevel}
+	chunks := opts.pngMetadata()
+	if chunks == nil {
+		return enc.Encode(w, img)
+	}
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, img); err != nil {
+		return err
+	}
+
+	// the metadata goes right after the IHDR, which is first
+	const head = 8 + 12 + 13 // signature and IHDR
+	b := buf.Bytes()
+	for _, part := range [][]byte{b[:head], chunks, b[head:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
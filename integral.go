@@ -0,0 +1,116 @@
+package autocrop
+
+// integral.go contains Options.Block, which samples the sides with the
+// average gray level of a block of pixels around each sample instead of the
+// pixel itself, read from summed-area tables of the strips along the sides.
+
+import "image"
+
+// integral is a summed-area table of the gray levels of a rectangle of the
+// image: each entry is the sum of those above and to the left of it.
+type integral struct {
+	rect image.Rectangle
+	sums []float64 // (rect.Dx()+1)×(rect.Dy()+1), with a row and a column of zeros first
+}
+
+// newIntegral returns the summed-area table of the rectangle r of the image.
+func (a *analysis) newIntegral(r image.Rectangle) *integral {
+	w := r.Dx() + 1
+	t := &integral{rect: r, sums: make([]float64, w*(r.Dy()+1))}
+	buf := make([]uint16, r.Dx())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		above := t.sums[(y-r.Min.Y)*w:]
+		row := t.sums[(y-r.Min.Y+1)*w:]
+		var sum float64
+		if p := a.plane; p != nil {
+			// the gray levels that grayAt returns, converted straight from
+			// the image if they can be, as the strips along the left and
+			// right are only a little of each row
+			var gray []uint16
+			if p.pixels {
+				p.convert(r.Min.X, y, 1, 0, buf)
+				gray = buf
+			} else {
+				gray = p.row(y)[r.Min.X-p.rect.Min.X : r.Max.X-p.rect.Min.X]
+			}
+			for i, v := range gray {
+				sum += float64(v) / 257
+				row[i+1] = above[i+1] + sum
+			}
+			continue
+		}
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := x - r.Min.X + 1
+			sum += a.grayAt(x, y)
+			row[i] = above[i] + sum
+		}
+	}
+	return t
+}
+
+// mean returns the average gray level of the rectangle r, which must be in
+// the table.
+func (t *integral) mean(r image.Rectangle) float64 {
+	w := t.rect.Dx() + 1
+	x0, x1 := r.Min.X-t.rect.Min.X, r.Max.X-t.rect.Min.X
+	y0, y1 := (r.Min.Y-t.rect.Min.Y)*w, (r.Max.Y-t.rect.Min.Y)*w
+	sum := t.sums[y1+x1] - t.sums[y0+x1] - t.sums[y1+x0] + t.sums[y0+x0]
+	return sum / float64(r.Dx()*r.Dy())
+}
+
+// makeTables makes the summed-area tables of the strips of the image that
+// the samples of the spans of the sides (T,R,B,L) are taken in, so that
+// sampleAt can average a block around each sample in a few lookups. The
+// tables are made at once, each by a goroutine of its own.
+func (a *analysis) makeTables(spans *[4]span) {
+	b := a.img.Bounds()
+	dx, dy := b.Dx(), b.Dy()
+	var strips [4]image.Rectangle
+	for i, s := range spans {
+		// the depth of a span is linear along it, if clamped
+		d0, d1 := s.depthAt(s.start), s.depthAt(s.start+s.length)
+		lo, hi := min(d0, d1), max(d0, d1)+s.m
+		switch i {
+		case 0:
+			strips[i] = image.Rect(s.start, lo, s.start+s.length, hi)
+		case 1:
+			strips[i] = image.Rect(dx-hi, s.start, dx-lo, s.start+s.length)
+		case 2:
+			strips[i] = image.Rect(s.start, dy-hi, s.start+s.length, dy-lo)
+		case 3:
+			strips[i] = image.Rect(lo, s.start, hi, s.start+s.length)
+		}
+		// and the blocks around the samples along its edges
+		strips[i] = strips[i].Inset(-a.Block / 2).Intersect(b)
+	}
+	a.parallel(len(strips), 1, func(lo, hi int) {
+		for i := lo; i < hi; i++ {
+			a.tables[i] = a.newIntegral(strips[i])
+		}
+	})
+}
+
+// sampleAt returns the gray level that the sample at x, y takes: that of the
+// pixel, or with Block, the average of the block of Block×Block pixels
+// centered on it, or as near as an even Block allows, cut off at the sides of
+// the image. The blocks are averaged from the summed-area table of a strip if
+// one has been made that they are in, and pixel by pixel otherwise.
+func (a *analysis) sampleAt(x, y int) float64 {
+	b := a.img.Bounds()
+	if a.Block <= 1 || !(image.Point{x, y}.In(b)) {
+		return a.grayAt(x, y)
+	}
+	r := image.Rect(x-(a.Block-1)/2, y-(a.Block-1)/2, x+a.Block/2+1, y+a.Block/2+1).Intersect(b)
+	for _, t := range a.tables {
+		if t != nil && r.In(t.rect) {
+			return t.mean(r)
+		}
+	}
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sum += a.grayAt(x, y)
+		}
+	}
+	return sum / float64(r.Dx()*r.Dy())
+}
@@ -0,0 +1,688 @@
+package autocrop
+
+// jpegcrop.go contains the lossless crop of a JPEG, which copies the blocks of
+// DCT coefficients inside the crop into a new JPEG instead of decoding the
+// pixels and encoding them again, as jpegtran -crop does. It takes baseline
+// and extended sequential JPEGs with one scan, which is what scanners write.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// NotLossless is the error returned by ApplyJPEG for a Transform or a JPEG
+// that can't be cropped losslessly. Apply still works on them.
+type NotLossless struct {
+	Reason string
+}
+
+func (e *NotLossless) Error() string {
+	return "autocrop: can't crop losslessly: " + e.Reason
+}
+
+// Lossless reports whether ApplyJPEG can carry out t: it doesn't turn the
+// image or correct its perspective, and its angle is at most eps radians,
+// small enough to leave out.
+func (t *Transform) Lossless(eps float64) bool {
+	return t.Orientation%360 == 0 && !t.Perspective && math.Abs(t.Angle) <= eps
+}
+
+// ApplyJPEG crops the JPEG read from r as Apply would if t had no angle, and
+// writes the result to w without encoding the pixels again, so nothing is
+// lost. The crop has to start at the corner of a block of pixels (8 or 16
+// pixels wide and high, depending on the chroma subsampling), so its top left
+// corner is moved up and to the left to the nearest one. ApplyJPEG returns the
+// rectangle it cropped to. The other segments of the JPEG, like its EXIF
+// metadata and ICC profile, are copied as they are.
+//
+// It returns a *NotLossless if t turns the image or corrects its perspective,
+// or if the JPEG is progressive, arithmetic coded, or has several scans.
+func (t *Transform) ApplyJPEG(w io.Writer, r io.Reader) (image.Rectangle, error) {
+	switch {
+	case t.Orientation%360 != 0:
+		return image.Rectangle{}, &NotLossless{"the image is turned"}
+	case t.Perspective:
+		return image.Rectangle{}, &NotLossless{"the perspective is corrected"}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	f, err := readJPEG(b)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	size := image.Pt(f.width, f.height)
+	if t.Size != (image.Point{}) && t.Size != size {
+		return image.Rectangle{}, fmt.Errorf("autocrop: Transform is for a %dx%d image, not %dx%d", t.Size.X, t.Size.Y, size.X, size.Y)
+	}
+
+	u := *t
+	u.Angle = 0
+	rect := u.Crop().Intersect(image.Rectangle{Max: size})
+	if rect.Empty() {
+		return image.Rectangle{}, fmt.Errorf("autocrop: crop %v is outside of the image", u.Crop())
+	}
+	mcuw, mcuh := f.mcuSize()
+	rect.Min.X -= rect.Min.X % mcuw
+	rect.Min.Y -= rect.Min.Y % mcuh
+
+	if err := f.decode(rect); err != nil {
+		return image.Rectangle{}, err
+	}
+	bw := bufio.NewWriter(w)
+	f.encode(bw, rect)
+	return rect, bw.Flush()
+}
+
+// jpegComponent is a color component of a JPEG, and the blocks of it that
+// are inside the crop.
+type jpegComponent struct {
+	id, h, v, tq byte
+	td, ta       byte // Huffman tables of the scan
+
+	blocks   [][64]int32 // in zigzag order
+	bx0, by0 int         // the first block kept
+	bw, bh   int         // blocks kept across and down
+}
+
+// jpegFile is a parsed JPEG with one sequential Huffman coded scan.
+type jpegFile struct {
+	sof           byte // the start of frame marker
+	precision     byte
+	width, height int
+	comps         []jpegComponent
+	restart       int
+	dc, ac        [4]*jpegHuffman
+	segments      [][]byte // to copy, with their markers
+	data          []byte   // the scan and whatever follows it
+}
+
+func readJPEG(b []byte) (*jpegFile, error) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil, &NotLossless{"not a JPEG"}
+	}
+	f := &jpegFile{}
+	for i := 2; ; {
+		for i+1 < len(b) && b[i] == 0xff && b[i+1] == 0xff {
+			i++ // fill bytes
+		}
+		if i+4 > len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if b[i] != 0xff {
+			return nil, fmt.Errorf("autocrop: invalid JPEG marker at %d", i)
+		}
+		marker := b[i+1]
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return nil, fmt.Errorf("autocrop: invalid JPEG segment at %d", i)
+		}
+		seg := b[i+4 : i+2+n]
+		var err error
+		switch {
+		case marker == 0xc0 || marker == 0xc1:
+			err = f.readSOF(marker, seg)
+		case marker == 0xc4:
+			err = f.readDHT(seg)
+		case marker == 0xc8 || marker == 0xcc:
+			f.segments = append(f.segments, b[i:i+2+n])
+		case marker >= 0xc2 && marker <= 0xcf:
+			return nil, &NotLossless{fmt.Sprintf("JPEG is not baseline or sequential (SOF%d)", marker-0xc0)}
+		case marker == 0xdd:
+			if len(seg) < 2 {
+				return nil, fmt.Errorf("autocrop: invalid JPEG restart interval")
+			}
+			f.restart = int(binary.BigEndian.Uint16(seg))
+		case marker == 0xda:
+			if err := f.readSOS(seg); err != nil {
+				return nil, err
+			}
+			f.data = b[i+2+n:]
+			return f, nil
+		case marker == 0xd9:
+			return nil, fmt.Errorf("autocrop: JPEG has no scan")
+		default:
+			f.segments = append(f.segments, b[i:i+2+n])
+		}
+		if err != nil {
+			return nil, err
+		}
+		i += 2 + n
+	}
+}
+
+func (f *jpegFile) readSOF(marker byte, seg []byte) error {
+	if f.comps != nil {
+		return fmt.Errorf("autocrop: JPEG has more than one frame")
+	}
+	if len(seg) < 6 {
+		return fmt.Errorf("autocrop: invalid JPEG frame header")
+	}
+	f.sof, f.precision = marker, seg[0]
+	f.height = int(binary.BigEndian.Uint16(seg[1:]))
+	f.width = int(binary.BigEndian.Uint16(seg[3:]))
+	nf := int(seg[5])
+	if f.precision != 8 && f.precision != 12 {
+		return &NotLossless{fmt.Sprintf("JPEG has %d bit samples", f.precision)}
+	}
+	if f.width == 0 || f.height == 0 {
+		return &NotLossless{"JPEG has its height at the end"}
+	}
+	if nf < 1 || nf > 4 || len(seg) < 6+3*nf {
+		return fmt.Errorf("autocrop: invalid JPEG frame header")
+	}
+	for k := 0; k < nf; k++ {
+		c := seg[6+3*k:]
+		comp := jpegComponent{id: c[0], h: c[1] >> 4, v: c[1] & 15, tq: c[2]}
+		if comp.h < 1 || comp.h > 4 || comp.v < 1 || comp.v > 4 {
+			return fmt.Errorf("autocrop: invalid JPEG sampling factors %dx%d", comp.h, comp.v)
+		}
+		f.comps = append(f.comps, comp)
+	}
+	return nil
+}
+
+func (f *jpegFile) readDHT(seg []byte) error {
+	for len(seg) > 0 {
+		if len(seg) < 17 {
+			return fmt.Errorf("autocrop: invalid JPEG Huffman table")
+		}
+		class, id := seg[0]>>4, seg[0]&15
+		if class > 1 || id > 3 {
+			return fmt.Errorf("autocrop: invalid JPEG Huffman table %d/%d", class, id)
+		}
+		h := &jpegHuffman{}
+		n := 0
+		for l := range h.counts {
+			h.counts[l] = seg[1+l]
+			n += int(seg[1+l])
+		}
+		if n > 256 || len(seg) < 17+n {
+			return fmt.Errorf("autocrop: invalid JPEG Huffman table")
+		}
+		h.values = append([]byte(nil), seg[17:17+n]...)
+		h.build()
+		if class == 0 {
+			f.dc[id] = h
+		} else {
+			f.ac[id] = h
+		}
+		seg = seg[17+n:]
+	}
+	return nil
+}
+
+func (f *jpegFile) readSOS(seg []byte) error {
+	if f.comps == nil {
+		return fmt.Errorf("autocrop: JPEG scan before its frame header")
+	}
+	if len(seg) < 1 || len(seg) < 4+2*int(seg[0]) {
+		return fmt.Errorf("autocrop: invalid JPEG scan header")
+	}
+	ns := int(seg[0])
+	if ns != len(f.comps) {
+		return &NotLossless{"JPEG has a scan for each component"}
+	}
+	for k := 0; k < ns; k++ {
+		c := seg[1+2*k:]
+		if f.comps[k].id != c[0] {
+			return &NotLossless{"JPEG scan has its components out of order"}
+		}
+		f.comps[k].td, f.comps[k].ta = c[1]>>4, c[1]&15
+		if f.comps[k].td > 3 || f.comps[k].ta > 3 || f.dc[f.comps[k].td] == nil || f.ac[f.comps[k].ta] == nil {
+			return fmt.Errorf("autocrop: JPEG scan uses a missing Huffman table")
+		}
+	}
+	if s := seg[1+2*ns:]; s[0] != 0 || s[1] != 63 || s[2] != 0 {
+		return fmt.Errorf("autocrop: invalid JPEG spectral selection")
+	}
+	return nil
+}
+
+// mcuSize returns the size in pixels of the minimum coded unit: a block of
+// each component, at its sampling factors.
+func (f *jpegFile) mcuSize() (w, h int) {
+	if len(f.comps) == 1 {
+		// a single component isn't interleaved, whatever its factors
+		return 8, 8
+	}
+	var hmax, vmax byte
+	for _, c := range f.comps {
+		hmax, vmax = max(hmax, c.h), max(vmax, c.v)
+	}
+	return 8 * int(hmax), 8 * int(vmax)
+}
+
+// blocks returns the number of blocks of component c in a minimum coded
+// unit, across and down.
+func (f *jpegFile) blocks(c *jpegComponent) (int, int) {
+	if len(f.comps) == 1 {
+		return 1, 1
+	}
+	return int(c.h), int(c.v)
+}
+
+// decode decodes the scan as far as the bottom of rect, and keeps the blocks
+// of each component that are inside it. rect starts at the corner of a
+// minimum coded unit.
+func (f *jpegFile) decode(rect image.Rectangle) error {
+	mcuw, mcuh := f.mcuSize()
+	across := (f.width + mcuw - 1) / mcuw
+	mx0, my0 := rect.Min.X/mcuw, rect.Min.Y/mcuh
+	mx1, my1 := (rect.Max.X+mcuw-1)/mcuw, (rect.Max.Y+mcuh-1)/mcuh
+	for k := range f.comps {
+		c := &f.comps[k]
+		nh, nv := f.blocks(c)
+		c.bx0, c.by0 = mx0*nh, my0*nv
+		c.bw, c.bh = (mx1-mx0)*nh, (my1-my0)*nv
+		c.blocks = make([][64]int32, c.bw*c.bh)
+	}
+
+	br := jpegBits{b: f.data}
+	pred := make([]int32, len(f.comps))
+	var coef [64]int32
+	for m := 0; m < across*my1; m++ {
+		if f.restart > 0 && m > 0 && m%f.restart == 0 {
+			if err := br.restart(m/f.restart - 1); err != nil {
+				return err
+			}
+			clear(pred)
+		}
+		mx, my := m%across, m/across
+		for k := range f.comps {
+			c := &f.comps[k]
+			nh, nv := f.blocks(c)
+			for by := 0; by < nv; by++ {
+				for bx := 0; bx < nh; bx++ {
+					if err := br.block(&coef, &pred[k], f.dc[c.td], f.ac[c.ta]); err != nil {
+						return err
+					}
+					x, y := mx*nh+bx-c.bx0, my*nv+by-c.by0
+					if x >= 0 && x < c.bw && y >= 0 && y < c.bh {
+						c.blocks[y*c.bw+x] = coef
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// encode writes the JPEG of the blocks of f, of the size of rect, to w. The
+// Huffman tables are made anew for the blocks, as those of a whole image may
+// not have codes for all of the blocks that a crop leaves, and there are no
+// restart markers.
+func (f *jpegFile) encode(w *bufio.Writer, rect image.Rectangle) {
+	// the first component gets the first pair of tables and all others
+	// the second, like luma and chroma
+	table := func(k int) int { return min(k, 1) }
+	tables := min(len(f.comps), 2)
+
+	var freq [2][2][257]int // [table][dc, ac][symbol]
+	f.code(func(k, class int, sym byte, v int32, s uint) {
+		freq[table(k)][class][sym]++
+	})
+	var huff [2][2]*jpegHuffman
+	for i := 0; i < tables; i++ {
+		for class := 0; class < 2; class++ {
+			huff[i][class] = optimalHuffman(freq[i][class])
+		}
+	}
+
+	w.Write([]byte{0xff, 0xd8})
+	for _, seg := range f.segments {
+		w.Write(seg)
+	}
+
+	sof := []byte{0xff, f.sof, 0, 0, f.precision, 0, 0, 0, 0, byte(len(f.comps))}
+	binary.BigEndian.PutUint16(sof[5:], uint16(rect.Dy()))
+	binary.BigEndian.PutUint16(sof[7:], uint16(rect.Dx()))
+	for _, c := range f.comps {
+		sof = append(sof, c.id, c.h<<4|c.v, c.tq)
+	}
+	w.Write(jpegLength(sof))
+
+	dht := []byte{0xff, 0xc4, 0, 0}
+	for class := 0; class < 2; class++ {
+		for i := 0; i < tables; i++ {
+			h := huff[i][class]
+			dht = append(dht, byte(class<<4|i))
+			dht = append(dht, h.counts[:]...)
+			dht = append(dht, h.values...)
+		}
+	}
+	w.Write(jpegLength(dht))
+
+	sos := []byte{0xff, 0xda, 0, 0, byte(len(f.comps))}
+	for k, c := range f.comps {
+		sos = append(sos, c.id, byte(table(k)<<4|table(k)))
+	}
+	sos = append(sos, 0, 63, 0)
+	w.Write(jpegLength(sos))
+
+	bw := jpegBitWriter{w: w}
+	f.code(func(k, class int, sym byte, v int32, s uint) {
+		h := huff[table(k)][class]
+		bw.write(h.codes[sym], uint(h.sizes[sym]))
+		if s > 0 {
+			if v < 0 {
+				v--
+			}
+			bw.write(uint32(v)&(1<<s-1), s)
+		}
+	})
+	bw.flush()
+	w.Write([]byte{0xff, 0xd9})
+}
+
+// jpegLength fills in the length of the marker segment seg.
+func jpegLength(seg []byte) []byte {
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)-2))
+	return seg
+}
+
+// code calls emit with each symbol of the scan of the kept blocks, in order:
+// the component it is of, whether it is of a DC (0) or an AC (1) coefficient,
+// the symbol and the value of the s bits that follow it.
+func (f *jpegFile) code(emit func(k, class int, sym byte, v int32, s uint)) {
+	c0 := &f.comps[0]
+	nh0, nv0 := f.blocks(c0)
+	across, down := c0.bw/nh0, c0.bh/nv0
+	pred := make([]int32, len(f.comps))
+	for my := 0; my < down; my++ {
+		for mx := 0; mx < across; mx++ {
+			for k := range f.comps {
+				c := &f.comps[k]
+				nh, nv := f.blocks(c)
+				for by := 0; by < nv; by++ {
+					for bx := 0; bx < nh; bx++ {
+						b := &c.blocks[(my*nv+by)*c.bw+mx*nh+bx]
+						d := b[0] - pred[k]
+						pred[k] = b[0]
+						s := magnitude(d)
+						emit(k, 0, byte(s), d, s)
+
+						run := 0
+						for i := 1; i < 64; i++ {
+							if b[i] == 0 {
+								run++
+								continue
+							}
+							for ; run > 15; run -= 16 {
+								emit(k, 1, 0xf0, 0, 0)
+							}
+							s := magnitude(b[i])
+							emit(k, 1, byte(run<<4)|byte(s), b[i], s)
+							run = 0
+						}
+						if run > 0 {
+							emit(k, 1, 0, 0, 0)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// magnitude returns the number of bits of |v|, the category of v.
+func magnitude(v int32) uint {
+	if v < 0 {
+		v = -v
+	}
+	return uint(bits.Len32(uint32(v)))
+}
+
+// jpegHuffman is a Huffman table of a JPEG.
+type jpegHuffman struct {
+	counts [16]byte // codes of each length
+	values []byte   // symbols in order of their codes
+
+	// for decoding
+	maxcode, mincode [17]int32
+	valptr           [17]int32
+
+	// for encoding
+	codes [256]uint32
+	sizes [256]byte
+}
+
+// build makes the decoding and encoding tables from counts and values.
+func (h *jpegHuffman) build() {
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(h.counts[l-1])
+		h.valptr[l], h.mincode[l] = k, code
+		h.maxcode[l] = -1
+		if n > 0 {
+			h.maxcode[l] = code + n - 1
+		}
+		for i := k; i < k+n && int(i) < len(h.values); i++ {
+			h.codes[h.values[i]] = uint32(code + i - k)
+			h.sizes[h.values[i]] = byte(l)
+		}
+		code = (code + n) << 1
+		k += n
+	}
+}
+
+// optimalHuffman returns the Huffman table with the shortest codes for
+// symbols of the given frequencies, no longer than 16 bits and none all ones,
+// as made in Annex K.2 of the JPEG standard.
+func optimalHuffman(freq [257]int) *jpegHuffman {
+	var size [257]int
+	var next [257]int
+	for i := range next {
+		next[i] = -1
+	}
+	freq[256] = 1 // keeps any real symbol from getting the code of all ones
+	for {
+		// the two least frequent trees, the later one first on ties
+		c1, c2 := -1, -1
+		for i, n := range freq {
+			if n > 0 && (c1 < 0 || n <= freq[c1]) {
+				c1 = i
+			}
+		}
+		for i, n := range freq {
+			if n > 0 && i != c1 && (c2 < 0 || n <= freq[c2]) {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+		for size[c1]++; next[c1] >= 0; size[c1]++ {
+			c1 = next[c1]
+		}
+		next[c1] = c2
+		for size[c2]++; next[c2] >= 0; size[c2]++ {
+			c2 = next[c2]
+		}
+	}
+
+	var counts [33]int
+	for _, s := range size {
+		if s > 0 {
+			counts[s]++
+		}
+	}
+	// move the codes longer than 16 bits up the tree
+	for l := 32; l > 16; l-- {
+		for counts[l] > 0 {
+			j := l - 2
+			for counts[j] == 0 {
+				j--
+			}
+			counts[l] -= 2
+			counts[l-1]++
+			counts[j+1] += 2
+			counts[j]--
+		}
+	}
+	// and take out the code of the reserved symbol, the longest
+	l := 16
+	for l > 0 && counts[l] == 0 {
+		l--
+	}
+	counts[l]--
+
+	h := &jpegHuffman{}
+	for l := 1; l <= 16; l++ {
+		h.counts[l-1] = byte(counts[l])
+	}
+	for l := 1; l <= 32; l++ {
+		for sym := 0; sym < 256; sym++ {
+			if size[sym] == l {
+				h.values = append(h.values, byte(sym))
+			}
+		}
+	}
+	h.build()
+	return h
+}
+
+// jpegBits reads the bits of a scan.
+type jpegBits struct {
+	b   []byte
+	i   int
+	acc byte
+	n   uint
+}
+
+func (br *jpegBits) bit() (int32, error) {
+	if br.n == 0 {
+		if br.i >= len(br.b) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		c := br.b[br.i]
+		br.i++
+		if c == 0xff {
+			// a stuffed zero, or a marker where there should be data
+			if br.i >= len(br.b) || br.b[br.i] != 0 {
+				return 0, fmt.Errorf("autocrop: JPEG scan ends early")
+			}
+			br.i++
+		}
+		br.acc, br.n = c, 8
+	}
+	br.n--
+	return int32(br.acc>>br.n) & 1, nil
+}
+
+// receive reads s bits, and extends them to the value they stand for.
+func (br *jpegBits) receive(s int) (int32, error) {
+	var v int32
+	for i := 0; i < s; i++ {
+		b, err := br.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	if s > 0 && v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v, nil
+}
+
+func (br *jpegBits) decode(h *jpegHuffman) (byte, error) {
+	var code int32
+	for l := 1; l <= 16; l++ {
+		b, err := br.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | b
+		if code <= h.maxcode[l] {
+			return h.values[h.valptr[l]+code-h.mincode[l]], nil
+		}
+	}
+	return 0, fmt.Errorf("autocrop: invalid Huffman code in JPEG scan")
+}
+
+// block reads the coefficients of a block into coef, in zigzag order. pred
+// is the DC coefficient of the block before it in the same component.
+func (br *jpegBits) block(coef *[64]int32, pred *int32, dc, ac *jpegHuffman) error {
+	clear(coef[:])
+	s, err := br.decode(dc)
+	if err != nil {
+		return err
+	}
+	if s > 15 {
+		return fmt.Errorf("autocrop: invalid DC coefficient in JPEG scan")
+	}
+	d, err := br.receive(int(s))
+	if err != nil {
+		return err
+	}
+	*pred += d
+	coef[0] = *pred
+	for k := 1; k < 64; k++ {
+		rs, err := br.decode(ac)
+		if err != nil {
+			return err
+		}
+		r, s := int(rs>>4), int(rs&15)
+		if s == 0 {
+			if r != 15 {
+				break // end of block
+			}
+			k += 15
+			continue
+		}
+		if k += r; k > 63 {
+			return fmt.Errorf("autocrop: invalid AC coefficients in JPEG scan")
+		}
+		if coef[k], err = br.receive(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restart skips the restart marker that ends the nth interval.
+func (br *jpegBits) restart(n int) error {
+	br.n = 0
+	if br.i+1 >= len(br.b) || br.b[br.i] != 0xff || br.b[br.i+1] != 0xd0+byte(n%8) {
+		return fmt.Errorf("autocrop: missing restart marker in JPEG scan")
+	}
+	br.i += 2
+	return nil
+}
+
+// jpegBitWriter writes the bits of a scan.
+type jpegBitWriter struct {
+	w   *bufio.Writer
+	acc uint32
+	n   uint
+}
+
+// write writes the low n bits of v.
+func (bw *jpegBitWriter) write(v uint32, n uint) {
+	bw.acc = bw.acc<<n | v&(1<<n-1)
+	bw.n += n
+	for bw.n >= 8 {
+		bw.n -= 8
+		c := byte(bw.acc >> bw.n)
+		bw.w.WriteByte(c)
+		if c == 0xff {
+			bw.w.WriteByte(0)
+		}
+	}
+}
+
+// flush pads the last byte with ones.
+func (bw *jpegBitWriter) flush() {
+	if bw.n > 0 {
+		bw.write(1<<(8-bw.n)-1, 8-bw.n)
+	}
+}
@@ -0,0 +1,114 @@
+package autocrop
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// texture returns a w×h image of smooth gradients and sharp stripes, so that
+// every block of its JPEG has coefficients of its own.
+func texture(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{uint8(x * 255 / w), uint8(y * 255 / h), 128, 255}
+			if (x/3+y/5)%4 == 0 {
+				c.B = 20
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestApplyJPEG(t *testing.T) {
+	src := texture(100, 70)
+	gray := image.NewGray(src.Bounds())
+	for y := 0; y < 70; y++ {
+		for x := 0; x < 100; x++ {
+			gray.Set(x, y, src.At(x, y))
+		}
+	}
+	encode := func(img image.Image, s Subsampling, std bool) []byte {
+		var buf bytes.Buffer
+		var err error
+		if std {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+		} else {
+			err = EncodeJPEG(&buf, img, &JPEGOptions{Quality: 90, Subsampling: s})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		mcu  image.Point // the size of the blocks of pixels the crop starts at
+	}{
+		{"4:2:0", encode(src, Subsample420, true), image.Pt(16, 16)},
+		{"gray", encode(gray, 0, true), image.Pt(8, 8)},
+		{"4:2:2", encode(src, Subsample422, false), image.Pt(16, 8)},
+		{"4:4:4", encode(src, Subsample444, false), image.Pt(8, 8)},
+	}
+	for _, tt := range tests {
+		whole, err := jpeg.Decode(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, bounds := range []image.Rectangle{
+			image.Rect(21, 13, 77, 61),
+			image.Rect(0, 0, 100, 70),
+			image.Rect(32, 16, 41, 23),
+		} {
+			tr := Transform{Bounds: bounds, Size: image.Pt(100, 70)}
+			var buf bytes.Buffer
+			r, err := tr.ApplyJPEG(&buf, bytes.NewReader(tt.data))
+			if err != nil {
+				t.Errorf("%s %v: %v", tt.name, bounds, err)
+				continue
+			}
+			at := image.Pt(bounds.Min.X/tt.mcu.X*tt.mcu.X, bounds.Min.Y/tt.mcu.Y*tt.mcu.Y)
+			if r != (image.Rectangle{at, bounds.Max}) {
+				t.Errorf("%s %v: cropped to %v", tt.name, bounds, r)
+				continue
+			}
+
+			// the blocks are copied, so the crop decodes to the very
+			// pixels of the whole
+			crop, err := jpeg.Decode(&buf)
+			if err != nil {
+				t.Errorf("%s %v: %v", tt.name, bounds, err)
+				continue
+			}
+			if crop.Bounds().Size() != r.Size() {
+				t.Errorf("%s %v: %v cropped, want the size of %v", tt.name, bounds, crop.Bounds(), r)
+				continue
+			}
+			off := 0
+			for y := 0; y < r.Dy(); y++ {
+				for x := 0; x < r.Dx(); x++ {
+					if crop.At(x, y) != whole.At(r.Min.X+x, r.Min.Y+y) {
+						off++
+					}
+				}
+			}
+			if off > 0 {
+				t.Errorf("%s %v: %d pixels differ from the decoded whole", tt.name, bounds, off)
+			}
+		}
+	}
+
+	// turned pages can't be cropped losslessly
+	tr := Transform{Orientation: 90, Bounds: image.Rect(0, 0, 70, 100)}
+	var notLossless *NotLossless
+	if _, err := tr.ApplyJPEG(new(bytes.Buffer), bytes.NewReader(tests[0].data)); !errors.As(err, &notLossless) {
+		t.Errorf("turned: %v, want a *NotLossless", err)
+	}
+}
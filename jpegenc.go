@@ -0,0 +1,301 @@
+package autocrop
+
+// jpegenc.go contains a JPEG encoder that, unlike image/jpeg's, lets the
+// chroma subsampling be chosen, since digitization guidelines often ask for
+// 4:4:4. It writes baseline JPEGs with Huffman tables made for each image.
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+// Subsampling is the chroma subsampling of the JPEGs that EncodeJPEG writes.
+type Subsampling int
+
+const (
+	// Subsample420 halves the resolution of the chroma across and down, as
+	// image/jpeg does.
+	Subsample420 Subsampling = iota
+
+	// Subsample422 halves it across.
+	Subsample422
+
+	// Subsample444 keeps all of it.
+	Subsample444
+)
+
+var subsamplingNames = []string{
+	Subsample420: "420",
+	Subsample422: "422",
+	Subsample444: "444",
+}
+
+func (s Subsampling) String() string {
+	if s >= 0 && int(s) < len(subsamplingNames) {
+		return subsamplingNames[s]
+	}
+	return fmt.Sprintf("Subsampling(%d)", int(s))
+}
+
+// ParseSubsampling returns the Subsampling with the given name.
+func ParseSubsampling(name string) (Subsampling, error) {
+	for i, s := range subsamplingNames {
+		if s == name {
+			return Subsampling(i), nil
+		}
+	}
+	return 0, fmt.Errorf("autocrop: unknown subsampling %q", name)
+}
+
+// JPEGOptions are the settings of EncodeJPEG.
+type JPEGOptions struct {
+	// Quality ranges from 1 to 100 as with image/jpeg. Zero means 95.
+	Quality     int
+	Subsampling Subsampling
+	// Metadata is embedded in the file.
+	Metadata
+}
+
+// jpegQuality is the Quality of JPEGOptions by default.
+const jpegQuality = 95
+
+// EncodeJPEG writes img to w as a baseline JPEG. Gray images are written with
+// only the luma component, and other ones as YCbCr subsampled as o says. A
+// nil o means the default options.
+func EncodeJPEG(w io.Writer, img image.Image, o *JPEGOptions) error {
+	var opts JPEGOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.Quality == 0 {
+		opts.Quality = jpegQuality
+	}
+	if opts.Quality < 1 || opts.Quality > 100 {
+		return fmt.Errorf("autocrop: invalid JPEG quality %d", opts.Quality)
+	}
+	if opts.Subsampling < 0 || int(opts.Subsampling) >= len(subsamplingNames) {
+		return fmt.Errorf("autocrop: invalid subsampling %v", opts.Subsampling)
+	}
+	b := img.Bounds()
+	if b.Empty() || b.Dx() > 0xffff || b.Dy() > 0xffff {
+		return fmt.Errorf("autocrop: can't encode a %dx%d image as a JPEG", b.Dx(), b.Dy())
+	}
+
+	f := &jpegFile{sof: 0xc0, precision: 8, width: b.Dx(), height: b.Dy()}
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		f.comps = []jpegComponent{{id: 1, h: 1, v: 1}}
+	default:
+		h, v := byte(2), byte(2)
+		switch opts.Subsampling {
+		case Subsample422:
+			v = 1
+		case Subsample444:
+			h, v = 1, 1
+		}
+		f.comps = []jpegComponent{
+			{id: 1, h: h, v: v, tq: 0},
+			{id: 2, h: 1, v: 1, tq: 1},
+			{id: 3, h: 1, v: 1, tq: 1},
+		}
+	}
+
+	// the tables of Annex K, scaled as libjpeg does
+	scale := 200 - 2*opts.Quality
+	if opts.Quality < 50 {
+		scale = 5000 / opts.Quality
+	}
+	var quant [2][64]int32
+	dqt := []byte{0xff, 0xdb, 0, 0}
+	for i, base := range []*[64]int{&jpegLuma, &jpegChroma}[:min(len(f.comps), 2)] {
+		dqt = append(dqt, byte(i))
+		for k := range quant[i] {
+			q := min(max((base[jpegUnzig[k]]*scale+50)/100, 1), 255)
+			quant[i][k] = int32(q)
+			dqt = append(dqt, byte(q))
+		}
+	}
+	f.segments = append(opts.jpegMetadata(), jpegLength(dqt))
+
+	f.fdct(img, &quant)
+	bw := bufio.NewWriter(w)
+	f.encode(bw, image.Rect(0, 0, f.width, f.height))
+	return bw.Flush()
+}
+
+// fdct fills the blocks of the components of f with the quantized DCT of
+// img, one row of minimum coded units at a time. The image is extended to
+// whole units by repeating its last column and row.
+func (f *jpegFile) fdct(img image.Image, quant *[2][64]int32) {
+	mcuw, mcuh := f.mcuSize()
+	across, down := (f.width+mcuw-1)/mcuw, (f.height+mcuh-1)/mcuh
+	for k := range f.comps {
+		c := &f.comps[k]
+		nh, nv := f.blocks(c)
+		c.bw, c.bh = across*nh, down*nv
+		c.blocks = make([][64]int32, c.bw*c.bh)
+	}
+
+	// the samples of a row of units, level shifted, at full resolution
+	stride := across * mcuw
+	planes := make([][]float64, len(f.comps))
+	for k := range planes {
+		planes[k] = make([]float64, stride*mcuh)
+	}
+	sample := jpegSampler(img)
+
+	var px [64]float64
+	for my := 0; my < down; my++ {
+		for y := 0; y < mcuh; y++ {
+			sy := min(my*mcuh+y, f.height-1)
+			for x := 0; x < stride; x++ {
+				r, g, b := sample(min(x, f.width-1), sy)
+				i := y*stride + x
+				if len(f.comps) == 1 {
+					planes[0][i] = r - 128
+					continue
+				}
+				planes[0][i] = 0.299*r + 0.587*g + 0.114*b - 128
+				planes[1][i] = -0.168736*r - 0.331264*g + 0.5*b
+				planes[2][i] = 0.5*r - 0.418688*g - 0.081312*b
+			}
+		}
+
+		for k := range f.comps {
+			c := &f.comps[k]
+			_, nv := f.blocks(c)
+			// pixels averaged into each sample
+			sx, sy := mcuw/8/int(c.h), mcuh/8/int(c.v)
+			if len(f.comps) == 1 {
+				sx, sy = 1, 1
+			}
+			n := float64(sx * sy)
+			q := &quant[min(k, 1)]
+			for by := 0; by < nv; by++ {
+				for bx := 0; bx < c.bw; bx++ {
+					for y := 0; y < 8; y++ {
+						for x := 0; x < 8; x++ {
+							var sum float64
+							x0, y0 := (bx*8+x)*sx, (by*8+y)*sy
+							for j := 0; j < sy; j++ {
+								for i := 0; i < sx; i++ {
+									sum += planes[k][(y0+j)*stride+x0+i]
+								}
+							}
+							px[y*8+x] = sum / n
+						}
+					}
+					fdct8x8(&px)
+					block := &c.blocks[(my*nv+by)*c.bw+bx]
+					for z := range block {
+						block[z] = int32(math.Round(px[jpegUnzig[z]] / float64(q[z])))
+					}
+				}
+			}
+		}
+	}
+}
+
+// jpegSampler returns a function that gives the red, green and blue of the
+// pixel of img at (x, y) from its top left corner, from 0 to 255.
+func jpegSampler(img image.Image) func(x, y int) (r, g, b float64) {
+	o := img.Bounds().Min
+	switch m := img.(type) {
+	case *image.Gray:
+		return func(x, y int) (r, g, b float64) {
+			v := float64(m.Pix[m.PixOffset(o.X+x, o.Y+y)])
+			return v, v, v
+		}
+	case *image.NRGBA:
+		return func(x, y int) (r, g, b float64) {
+			p := m.Pix[m.PixOffset(o.X+x, o.Y+y):]
+			if p[3] == 0xff {
+				return float64(p[0]), float64(p[1]), float64(p[2])
+			}
+			// on black, like image/jpeg
+			a := float64(p[3]) / 0xff
+			return float64(p[0]) * a, float64(p[1]) * a, float64(p[2]) * a
+		}
+	}
+	return func(x, y int) (r, g, b float64) {
+		cr, cg, cb, _ := img.At(o.X+x, o.Y+y).RGBA()
+		return float64(cr) / 257, float64(cg) / 257, float64(cb) / 257
+	}
+}
+
+// jpegCos holds C(u)/2 cos((2x+1)uπ/16), the terms of the 8 point DCT.
+var jpegCos = func() (c [8][8]float64) {
+	for u := range c {
+		k := 0.5
+		if u == 0 {
+			k = 0.5 / math.Sqrt2
+		}
+		for x := range c[u] {
+			c[u][x] = k * math.Cos(float64((2*x+1)*u)*math.Pi/16)
+		}
+	}
+	return
+}()
+
+// fdct8x8 replaces the samples of a block with their DCT.
+func fdct8x8(px *[64]float64) {
+	var rows [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += jpegCos[u][x] * px[y*8+x]
+			}
+			rows[y*8+u] = s
+		}
+	}
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for y := 0; y < 8; y++ {
+				s += jpegCos[v][y] * rows[y*8+u]
+			}
+			px[v*8+u] = s
+		}
+	}
+}
+
+// jpegUnzig maps the zigzag order of the coefficients of a block to their
+// natural order.
+var jpegUnzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegLuma and jpegChroma are the quantization tables of Annex K of the JPEG
+// standard, in natural order.
+var jpegLuma = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+var jpegChroma = [64]int{
+	17, 18, 24, 47, 99, 99, 99, 99,
+	18, 21, 26, 66, 99, 99, 99, 99,
+	24, 26, 56, 99, 99, 99, 99, 99,
+	47, 66, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+}
@@ -0,0 +1,33 @@
+package autocrop
+
+// log.go contains the debug events the analysis sends to Options.Logger.
+
+import (
+	"context"
+	"log/slog"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// sideNames are the names of the sides in CSS box order.
+var sideNames = [4]string{"top", "right", "bottom", "left"}
+
+// debug logs msg with the key-value pairs args at debug level, if there is a
+// Logger to log to.
+func (a *analysis) debug(msg string, args ...any) {
+	if a.Options == nil || a.Logger == nil {
+		return
+	}
+	a.Logger.Log(context.Background(), slog.LevelDebug, msg, args...)
+}
+
+// debugSide logs what was found on side i: the window of samples that was
+// trusted and the line fitted to them.
+func (a *analysis) debugSide(i int, s *side, coverage float64) {
+	if a.Options == nil || a.Logger == nil || !a.Sides.Has(i) {
+		return
+	}
+	a.debug("side", "side", sideNames[i], "coverage", coverage, "found", s.found,
+		"trim", [2]int{s.lo, s.hi}, "r2", s.confidence, "angle", util.Rad2deg(s.angle),
+		"crop", s.crop, "crop_err", s.cropErr, "angle_err", util.Rad2deg(s.angleErr), "curl", s.curl)
+}
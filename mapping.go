@@ -0,0 +1,134 @@
+package autocrop
+
+// mapping.go contains the maps between the coordinates of a scan and of the
+// page cut out of it, so that what is found on the page (say, the boxes of
+// the words read by OCR) can be traced back to the scan, and the other way
+// round.
+
+import (
+	"image"
+	"math"
+)
+
+// Mapping is a projective map of the plane, as a 3×3 matrix that takes
+// (x, y, 1) to (X·w, Y·w, w). Coordinates are continuous: pixel (0, 0) covers
+// the square from (0, 0) to (1, 1), and its center is (0.5, 0.5).
+type Mapping [3][3]float64
+
+// Identity is the Mapping that leaves every point where it is.
+var Identity = Mapping{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+// Point maps the point (x, y).
+func (m Mapping) Point(x, y float64) (float64, float64) {
+	w := m[2][0]*x + m[2][1]*y + m[2][2]
+	return (m[0][0]*x + m[0][1]*y + m[0][2]) / w, (m[1][0]*x + m[1][1]*y + m[1][2]) / w
+}
+
+// Rect maps the corners of r and returns the smallest rectangle that holds
+// them all. Under a rotation, that is larger than r.
+func (m Mapping) Rect(r image.Rectangle) image.Rectangle {
+	lo, hi := [2]float64{math.Inf(1), math.Inf(1)}, [2]float64{math.Inf(-1), math.Inf(-1)}
+	for _, p := range [4]image.Point{r.Min, {r.Max.X, r.Min.Y}, r.Max, {r.Min.X, r.Max.Y}} {
+		x, y := m.Point(float64(p.X), float64(p.Y))
+		lo = [2]float64{math.Min(lo[0], x), math.Min(lo[1], y)}
+		hi = [2]float64{math.Max(hi[0], x), math.Max(hi[1], y)}
+	}
+	// allow for rounding errors, so that a rectangle mapped back and forth
+	// comes out the same
+	const eps = 1e-6
+	return image.Rect(int(math.Floor(lo[0]+eps)), int(math.Floor(lo[1]+eps)), int(math.Ceil(hi[0]-eps)), int(math.Ceil(hi[1]-eps)))
+}
+
+// Then returns the Mapping that maps by m and then by n.
+func (m Mapping) Then(n Mapping) Mapping {
+	var p Mapping
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				p[i][j] += n[i][k] * m[k][j]
+			}
+		}
+	}
+	return p
+}
+
+// Inverse returns the Mapping that undoes m. The Mappings of Transforms
+// always have one; a Mapping that squashes the plane onto a line maps
+// everything to NaN.
+func (m Mapping) Inverse() Mapping {
+	// the adjugate, over the determinant
+	var inv Mapping
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = m[a][c]*m[b][d] - m[a][d]*m[b][c]
+		}
+	}
+	det := m[0][0]*inv[0][0] + m[0][1]*inv[1][0] + m[0][2]*inv[2][0]
+	if det == 0 {
+		det = math.NaN()
+	}
+	for i := range inv {
+		for j := range inv[i] {
+			inv[i][j] /= det
+		}
+	}
+	return inv
+}
+
+// Mapping returns the map from the scan as it was analyzed, before it is
+// turned by Orientation, to the image that String and Apply make of it. The
+// scan is taken to have its origin at (0, 0). Size must be set, as it is by
+// the analysis; without it, only the crop is mapped, as with Crop.
+func (t *Transform) Mapping() Mapping {
+	r := t.Crop()
+	crop := Mapping{{1, 0, -float64(r.Min.X)}, {0, 1, -float64(r.Min.Y)}, {0, 0, 1}}
+	if t.Size == (image.Point{}) {
+		return crop
+	}
+
+	// turning the scan upright; Size is the size after it
+	w, h := float64(t.Size.X), float64(t.Size.Y)
+	var upright Mapping
+	switch (t.Orientation%360 + 360) % 360 {
+	case 90:
+		upright = Mapping{{0, -1, w}, {1, 0, 0}, {0, 0, 1}}
+	case 180:
+		upright = Mapping{{-1, 0, w}, {0, -1, h}, {0, 0, 1}}
+	case 270:
+		upright = Mapping{{0, 1, 0}, {-1, 0, h}, {0, 0, 1}}
+	default:
+		upright = Identity
+	}
+	return upright.Then(t.straighten()).Then(crop)
+}
+
+// straighten returns the map from the upright image to the canvas it is
+// rotated (or corrected for perspective) onto, where the crop is made.
+func (t *Transform) straighten() Mapping {
+	if t.Perspective {
+		c, dst, _ := t.perspectiveRect()
+		return homography(c, dst)
+	}
+	sin, cos := math.Sincos(t.Angle)
+	px, py, qx, qy := t.pivot()
+	return Mapping{
+		{cos, -sin, qx - cos*px + sin*py},
+		{sin, cos, qy - sin*px - cos*py},
+		{0, 0, 1},
+	}
+}
+
+// Inverse returns the map from the image that String and Apply make back to
+// the scan; see Mapping.
+func (t *Transform) Inverse() Mapping {
+	return t.Mapping().Inverse()
+}
+
+// Compose returns the map from the scan that t was analyzed from to the image
+// made by applying u to the image made by applying t, as when a page that was
+// cropped is analyzed and cropped again.
+func (t *Transform) Compose(u *Transform) Mapping {
+	return t.Mapping().Then(u.Mapping())
+}
@@ -0,0 +1,74 @@
+package autocrop
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestMapping(t *testing.T) {
+	const deg = math.Pi / 180
+
+	// a light scan with a dark dot, whose center is at (121.5, 81.5)
+	scan := image.NewGray(image.Rect(0, 0, 300, 200))
+	for i := range scan.Pix {
+		scan.Pix[i] = 230
+	}
+	for y := 80; y < 83; y++ {
+		for x := 120; x < 123; x++ {
+			scan.SetGray(x, y, color.Gray{0})
+		}
+	}
+	const dotX, dotY = 121.5, 81.5
+
+	tests := []struct {
+		name string
+		tr   Transform
+	}{
+		{"crop", Transform{Bounds: image.Rect(20, 10, 280, 190), Size: image.Pt(300, 200)}},
+		{"rotated", Transform{Angle: 3 * deg, Bounds: image.Rect(20, 10, 280, 190), Size: image.Pt(300, 200)}},
+		{"about the page", Transform{Angle: -2 * deg, Bounds: image.Rect(20, 10, 280, 190), Size: image.Pt(300, 200), Pivot: PivotPage}},
+		{"about the corner", Transform{Angle: 1 * deg, Bounds: image.Rect(20, 10, 280, 190), Size: image.Pt(300, 200), Pivot: PivotCorner}},
+		{"turned 90", Transform{Orientation: 90, Angle: 2 * deg, Bounds: image.Rect(10, 20, 190, 280), Size: image.Pt(200, 300)}},
+		{"turned 180", Transform{Orientation: 180, Bounds: image.Rect(20, 10, 280, 190), Size: image.Pt(300, 200)}},
+		{"turned 270", Transform{Orientation: 270, Angle: -1 * deg, Bounds: image.Rect(10, 20, 190, 280), Size: image.Pt(200, 300)}},
+		{"perspective", Transform{
+			Bounds:      image.Rect(20, 10, 280, 190),
+			Size:        image.Pt(300, 200),
+			Corners:     [4]image.Point{{20, 10}, {280, 14}, {276, 190}, {22, 186}},
+			Perspective: true,
+		}},
+	}
+	for _, tt := range tests {
+		m, inv := tt.tr.Mapping(), tt.tr.Inverse()
+
+		// the Inverse takes every point back to where it was
+		for _, p := range [][2]float64{{0, 0}, {300, 0}, {300, 200}, {0, 200}, {dotX, dotY}, {157.25, 33.5}} {
+			x, y := inv.Point(m.Point(p[0], p[1]))
+			if math.Abs(x-p[0]) > 1e-9 || math.Abs(y-p[1]) > 1e-9 {
+				t.Errorf("%s: %v maps back to (%g, %g)", tt.name, p, x, y)
+			}
+		}
+
+		// and the dot ends up where the Mapping says in the applied image
+		out := tt.tr.Apply(scan)
+		var sx, sy, n float64
+		b := out.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if w := 1 - float64(color.GrayModel.Convert(out.At(x, y)).(color.Gray).Y)/230; w > 0.1 {
+					sx += w * (float64(x) + 0.5)
+					sy += w * (float64(y) + 0.5)
+					n += w
+				}
+			}
+		}
+		x, y := m.Point(dotX, dotY)
+		if n == 0 {
+			t.Errorf("%s: no dot in the applied image, want it at (%g, %g)", tt.name, x, y)
+		} else if math.Abs(sx/n-x) > 0.5 || math.Abs(sy/n-y) > 0.5 {
+			t.Errorf("%s: dot at (%g, %g), mapped to (%g, %g)", tt.name, sx/n, sy/n, x, y)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package autocrop
+
+// metadata.go contains the metadata of image files that is carried over to
+// the pages written from them, and the recording of a Transform in the
+// metadata of an image in place of applying it, for workflows that render
+// the pages later.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// Metadata is the metadata of an image file that the encoders of this
+// package embed in the files they write.
+type Metadata struct {
+	// ICC is an ICC color profile.
+	ICC []byte
+	// EXIF is the TIFF structure of the EXIF metadata, as it follows the
+	// "Exif\x00\x00" header in a JPEG.
+	EXIF []byte
+	// XMP is an XMP packet.
+	XMP []byte
+}
+
+// Headers of the APP1 segments of a JPEG.
+const (
+	jpegEXIFMarker = "Exif\x00\x00"
+	jpegXMPMarker  = "http://ns.adobe.com/xap/1.0/\x00"
+)
+
+// pngXMPKeyword is the keyword of the iTXt chunk of a PNG that holds XMP.
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// ReadMetadata returns the metadata embedded in the JPEG, PNG, TIFF or WebP
+// image read from r. The EXIF metadata of a TIFF is in its own tags rather
+// than in a block of its own, and isn't read.
+func ReadMetadata(r io.Reader) (*Metadata, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	switch {
+	case bytes.HasPrefix(b, []byte{0xff, 0xd8}):
+		m.ICC = jpegICC(b)
+		jpegSegments(b, func(marker byte, seg []byte) {
+			if marker != 0xe1 {
+				return
+			}
+			if data, ok := bytes.CutPrefix(seg, []byte(jpegEXIFMarker)); ok && m.EXIF == nil {
+				m.EXIF = append([]byte(nil), data...)
+			}
+			if data, ok := bytes.CutPrefix(seg, []byte(jpegXMPMarker)); ok && m.XMP == nil {
+				m.XMP = append([]byte(nil), data...)
+			}
+		})
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		if m.ICC, err = pngICC(b); err != nil {
+			return nil, err
+		}
+		pngChunks(b, func(kind string, data []byte) {
+			switch kind {
+			case "eXIf":
+				m.EXIF = bytes.TrimPrefix(append([]byte(nil), data...), []byte(jpegEXIFMarker))
+			case "iTXt":
+				if x, ok := pngXMP(data); ok {
+					m.XMP = x
+				}
+			}
+		})
+	case bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*")):
+		m.ICC = tiffBlob(b, 34675)
+		m.XMP = tiffBlob(b, 700)
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		m.ICC = webpChunk(b, "ICCP")
+		m.EXIF = bytes.TrimPrefix(webpChunk(b, "EXIF"), []byte(jpegEXIFMarker))
+		m.XMP = webpChunk(b, "XMP ")
+	}
+	return m, nil
+}
+
+// jpegSegments calls f with the marker and the data of each segment of a
+// JPEG up to its scan.
+func jpegSegments(b []byte, f func(marker byte, seg []byte)) {
+	for b = b[2:]; len(b) >= 4 && b[0] == 0xff; {
+		marker := b[1]
+		n := int(binary.BigEndian.Uint16(b[2:4]))
+		if marker == 0xda || n < 2 || len(b) < 2+n {
+			return
+		}
+		f(marker, b[4:2+n])
+		b = b[2+n:]
+	}
+}
+
+// pngXMP returns the XMP in the iTXt chunk data, if it has the XMP keyword.
+func pngXMP(data []byte) ([]byte, bool) {
+	// the keyword, the compression flag and method, the language and the
+	// translated keyword, and the text
+	key, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok || string(key) != pngXMPKeyword || len(rest) < 2 {
+		return nil, false
+	}
+	compressed := rest[0] == 1
+	parts := bytes.SplitN(rest[2:], []byte{0}, 3)
+	if len(parts) < 3 {
+		return nil, false
+	}
+	if compressed {
+		x, err := inflate(parts[2])
+		return x, err == nil
+	}
+	return append([]byte(nil), parts[2]...), true
+}
+
+// jpegMetadata returns the APP1 and APP2 segments of a JPEG that hold m.
+// EXIF and XMP that are too large for a segment are left out.
+func (m *Metadata) jpegMetadata() [][]byte {
+	var segs [][]byte
+	for _, s := range []struct {
+		header string
+		data   []byte
+	}{{jpegEXIFMarker, m.EXIF}, {jpegXMPMarker, m.XMP}} {
+		if s.data == nil || 2+len(s.header)+len(s.data) > 0xffff {
+			continue
+		}
+		seg := append([]byte{0xff, 0xe1, 0, 0}, s.header...)
+		segs = append(segs, jpegLength(append(seg, s.data...)))
+	}
+	return append(segs, jpegICCSegments(m.ICC)...)
+}
+
+// pngMetadata returns the chunks of a PNG that hold m, or nil if it is empty.
+func (m *Metadata) pngMetadata() []byte {
+	var chunks []byte
+	if m.ICC != nil {
+		chunks = append(chunks, pngChunk("iCCP", append([]byte("ICC profile\x00\x00"), deflate(m.ICC)...))...)
+	}
+	if m.EXIF != nil {
+		chunks = append(chunks, pngChunk("eXIf", m.EXIF)...)
+	}
+	if m.XMP != nil {
+		data := append([]byte(pngXMPKeyword), 0, 0, 0, 0, 0)
+		chunks = append(chunks, pngChunk("iTXt", append(data, m.XMP...))...)
+	}
+	return chunks
+}
+
+// tiffMetadata returns the tags of a TIFF that hold m. EXIF isn't among them.
+func (m *Metadata) tiffMetadata() []tiffTag {
+	var tags []tiffTag
+	if m.XMP != nil {
+		tags = append(tags, tiffTag{700, tiffByte, nil, m.XMP})
+	}
+	if m.ICC != nil {
+		tags = append(tags, tiffTag{34675, tiffUndefined, nil, m.ICC})
+	}
+	return tags
+}
+
+// EXIF tags.
+const (
+	exifOrientationTag = 0x0112
+	exifIFDTag         = 0x8769
+	exifWidthTag       = 0xa002
+	exifHeightTag      = 0xa003
+)
+
+// Upright returns a copy of m for an image of the given size that has been
+// turned upright, like the result of Apply: its EXIF and XMP say that it
+// needs no turning and that size is its size. The EXIF thumbnail, if there
+// is one, is left as it is.
+func (m *Metadata) Upright(size image.Point) *Metadata {
+	u := &Metadata{ICC: m.ICC}
+	if m.EXIF != nil {
+		u.EXIF = exifSet(m.EXIF, exifOrientationTag, 1)
+		u.EXIF = exifSetSub(u.EXIF, exifWidthTag, uint32(size.X))
+		u.EXIF = exifSetSub(u.EXIF, exifHeightTag, uint32(size.Y))
+	}
+	if m.XMP != nil {
+		u.XMP = xmpSet(m.XMP, "tiff:Orientation", "1")
+		u.XMP = xmpSet(u.XMP, "exif:PixelXDimension", strconv.Itoa(size.X))
+		u.XMP = xmpSet(u.XMP, "exif:PixelYDimension", strconv.Itoa(size.Y))
+	}
+	return u
+}
+
+// exifSet returns a copy of the EXIF exif with the SHORT tag in its first
+// IFD set to v. If the tag isn't there, a copy of the IFD with it added is
+// put at the end, where it takes the place of the first one.
+func exifSet(exif []byte, tag uint16, v uint16) []byte {
+	if len(exif) < 8 {
+		// one IFD with only the orientation
+		exif = []byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00\x00\x00")
+	}
+	exif = append([]byte(nil), exif...)
+	order := tiffOrder(exif)
+	if order == nil {
+		return exif
+	}
+	e := tiffIFDEntry(exif, order, int(order.Uint32(exif[4:])), tag)
+	if e != nil {
+		if order.Uint16(e[2:]) == tiffShort && order.Uint32(e[4:]) == 1 {
+			order.PutUint16(e[8:], v)
+		}
+		return exif
+	}
+
+	ifd := int(order.Uint32(exif[4:]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return exif
+	}
+	count := int(order.Uint16(exif[ifd:]))
+	end := ifd + 2 + 12*count
+	if end+4 > len(exif) {
+		return exif
+	}
+	entries := make([][]byte, 0, count+1)
+	for i := 0; i < count; i++ {
+		entries = append(entries, exif[ifd+2+12*i:ifd+14+12*i])
+	}
+	entry := make([]byte, 12)
+	order.PutUint16(entry, tag)
+	order.PutUint16(entry[2:], tiffShort)
+	order.PutUint32(entry[4:], 1)
+	order.PutUint16(entry[8:], v)
+	entries = append(entries, entry)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return order.Uint16(entries[i]) < order.Uint16(entries[j])
+	})
+
+	// the out-of-line values are where they were, so their offsets hold
+	at := len(exif) + len(exif)%2
+	out := append(exif, make([]byte, at-len(exif))...)
+	out = append(out, 0, 0)
+	order.PutUint16(out[at:], uint16(len(entries)))
+	for _, e := range entries {
+		out = append(out, e...)
+	}
+	out = append(out, exif[end:end+4]...) // the next IFD
+	order.PutUint32(out[4:], uint32(at))
+	return out
+}
+
+// exifSetSub sets the SHORT or LONG tag of the EXIF IFD of exif, in place, to
+// v if it is there.
+func exifSetSub(exif []byte, tag uint16, v uint32) []byte {
+	p, order := tiffEntry(exif, exifIFDTag)
+	if p == nil {
+		return exif
+	}
+	e := tiffIFDEntry(exif, order, int(order.Uint32(p[8:])), tag)
+	if e == nil || order.Uint32(e[4:]) != 1 {
+		return exif
+	}
+	switch order.Uint16(e[2:]) {
+	case tiffShort:
+		if v <= 0xffff {
+			order.PutUint16(e[8:], uint16(v))
+		}
+	case tiffLong:
+		order.PutUint32(e[8:], v)
+	}
+	return exif
+}
+
+// xmpSet returns a copy of the XMP packet xmp with the simple property prop
+// set to v, whether it is written as an attribute or as an element. A
+// property that isn't there isn't added.
+func xmpSet(xmp []byte, prop, v string) []byte {
+	q := regexp.QuoteMeta(prop)
+	attr := regexp.MustCompile(`(\s` + q + `=)("[^"]*"|'[^']*')`)
+	elem := regexp.MustCompile(`(<` + q + `>)[^<]*(</` + q + `>)`)
+	xmp = attr.ReplaceAll(xmp, []byte(`${1}"`+v+`"`))
+	return elem.ReplaceAll(xmp, []byte(`${1}`+v+`${2}`))
+}
+
+// exifOrientations are the values of the EXIF orientation tag that ask for
+// clockwise rotations of 0, 90, 180 and 270 degrees.
+var exifOrientations = [4]uint16{1, 6, 3, 8}
+
+// Annotate copies the JPEG or PNG image read from r to w with its pixels as
+// they are, and t recorded in its metadata for software that renders pages
+// later: the EXIF orientation that turns the image upright, and, in its
+// XMP, the crop and angle as the crop settings of Camera Raw. crs:CropTop,
+// crs:CropLeft, crs:CropBottom and crs:CropRight are the sides of Bounds as
+// fractions of the upright image, and crs:CropAngle is the Angle in degrees,
+// clockwise. A correction of perspective can't be recorded like this.
+func (t *Transform) Annotate(w io.Writer, r io.Reader) error {
+	if t.Perspective {
+		return fmt.Errorf("autocrop: a perspective correction can't be recorded in metadata")
+	}
+	if t.Size.X <= 0 || t.Size.Y <= 0 {
+		return fmt.Errorf("autocrop: can't annotate with a Transform without a Size")
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m, err := ReadMetadata(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	m.EXIF = exifSet(m.EXIF, exifOrientationTag, exifOrientations[((t.Orientation%360+360)%360)/90])
+	m.XMP = t.cropXMP(m.XMP)
+
+	switch {
+	case bytes.HasPrefix(b, []byte{0xff, 0xd8}):
+		return annotateJPEG(w, b, m)
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return annotatePNG(w, b, m)
+	}
+	return fmt.Errorf("autocrop: only JPEGs and PNGs can be annotated")
+}
+
+// cropXMP returns the XMP packet xmp, or a new one if it is nil, with the
+// crop settings of t. They go in a description of their own unless an
+// earlier one has put them there. The orientation in it, if any, is set too.
+func (t *Transform) cropXMP(xmp []byte) []byte {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 6, 64) }
+	// Bounds can reach past the image when the rotation grows it
+	frac := func(v, n int) string { return f(min(max(float64(v)/float64(n), 0), 1)) }
+	b, size := t.Bounds, t.Size
+	props := [][2]string{
+		{"crs:HasCrop", "True"},
+		{"crs:CropTop", frac(b.Min.Y, size.Y)},
+		{"crs:CropLeft", frac(b.Min.X, size.X)},
+		{"crs:CropBottom", frac(b.Max.Y, size.Y)},
+		{"crs:CropRight", frac(b.Max.X, size.X)},
+		{"crs:CropAngle", f(util.Rad2deg(t.Angle))},
+	}
+
+	if bytes.Contains(xmp, []byte("crs:HasCrop")) {
+		for _, p := range props {
+			xmp = xmpSet(xmp, p[0], p[1])
+		}
+		o := exifOrientations[((t.Orientation%360+360)%360)/90]
+		return xmpSet(xmp, "tiff:Orientation", strconv.Itoa(int(o)))
+	}
+	desc := `<rdf:Description rdf:about="" xmlns:crs="http://ns.adobe.com/camera-raw-settings/1.0/"`
+	for _, p := range props {
+		desc += fmt.Sprintf(` %s="%s"`, p[0], p[1])
+	}
+	desc += "/>"
+	if i := bytes.LastIndex(xmp, []byte("</rdf:RDF>")); i >= 0 {
+		o := exifOrientations[((t.Orientation%360+360)%360)/90]
+		xmp = xmpSet(xmp, "tiff:Orientation", strconv.Itoa(int(o)))
+		return append(append(append([]byte(nil), xmp[:i]...), desc...), xmp[i:]...)
+	}
+	return []byte("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		desc + `</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`)
+}
+
+// annotateJPEG writes the JPEG b to w with its EXIF and XMP replaced by
+// those of m, after its JFIF segment if it has one.
+func annotateJPEG(w io.Writer, b []byte, m *Metadata) error {
+	out := []byte{0xff, 0xd8}
+	inserted := false
+	insert := func() {
+		if !inserted {
+			for _, seg := range (&Metadata{EXIF: m.EXIF, XMP: m.XMP}).jpegMetadata() {
+				out = append(out, seg...)
+			}
+			inserted = true
+		}
+	}
+	i := 2
+	jpegSegments(b, func(marker byte, seg []byte) {
+		whole := b[i : i+4+len(seg)]
+		i += 4 + len(seg)
+		if marker == 0xe1 && (bytes.HasPrefix(seg, []byte(jpegEXIFMarker)) || bytes.HasPrefix(seg, []byte(jpegXMPMarker))) {
+			return
+		}
+		if marker != 0xe0 {
+			insert()
+		}
+		out = append(out, whole...)
+	})
+	insert()
+	out = append(out, b[i:]...)
+	_, err := w.Write(out)
+	return err
+}
+
+// annotatePNG writes the PNG b to w with its EXIF and XMP replaced by those
+// of m, right after its IHDR.
+func annotatePNG(w io.Writer, b []byte, m *Metadata) error {
+	out := append([]byte(nil), b[:8]...)
+	i := 8
+	pngChunks(b, func(kind string, data []byte) {
+		whole := b[i : i+12+len(data)]
+		i += 12 + len(data)
+		if _, xmp := pngXMP(data); kind == "eXIf" || kind == "iTXt" && xmp {
+			return
+		}
+		out = append(out, whole...)
+		if kind == "IHDR" {
+			out = append(out, (&Metadata{EXIF: m.EXIF, XMP: m.XMP}).pngMetadata()...)
+		}
+	})
+	out = append(out, b[i:]...)
+	_, err := w.Write(out)
+	return err
+}
@@ -0,0 +1,621 @@
+package autocrop
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"strings"
+)
+
+// Algorithm selects how the rotation angle is estimated.
+type Algorithm int
+
+const (
+	// Border fits lines to the edges of the page against the black
+	// background of the scanner. This is what Analyze describes.
+	Border Algorithm = iota
+
+	// Projection estimates the skew of the text on the page instead, by
+	// finding the angle at which the horizontal ink projection profile has
+	// the most variance, i.e. the text lines are sharpest. It works on pages
+	// without a visible border. The crop is still found from the border, if
+	// there is one.
+	Projection
+
+	// Hough finds the page edges with a Hough transform over the rising edges
+	// near each side instead of picking one edge per sample. It costs more
+	// CPU, but a straight edge wins out over local damage like tears, tape or
+	// fingers in the scan, which Border would try to fit.
+	Hough
+
+	// Fused runs both Border and Projection and combines their angles,
+	// weighted by their confidence. Both estimates are reported in the
+	// Transform, so pages on which they disagree can be picked out.
+	Fused
+)
+
+var algorithmNames = []string{
+	Border:     "border",
+	Projection: "projection",
+	Hough:      "hough",
+	Fused:      "fused",
+}
+
+func (a Algorithm) String() string {
+	if a >= 0 && int(a) < len(algorithmNames) {
+		return algorithmNames[a]
+	}
+	return fmt.Sprintf("Algorithm(%d)", int(a))
+}
+
+// ParseAlgorithm returns the Algorithm with the given name.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for i, s := range algorithmNames {
+		if s == name {
+			return Algorithm(i), nil
+		}
+	}
+	return 0, fmt.Errorf("autocrop: unknown algorithm %q", name)
+}
+
+// OverAngle is what happens to a page whose fitted angle is beyond MaxAngle.
+type OverAngle int
+
+const (
+	OverError OverAngle = iota // fail the analysis
+	OverClamp                  // rotate by MaxAngle (with the sign of the fit)
+	OverZero                   // don't rotate at all
+)
+
+var overAngleNames = []string{
+	OverError: "error",
+	OverClamp: "clamp",
+	OverZero:  "zero",
+}
+
+func (o OverAngle) String() string {
+	if o >= 0 && int(o) < len(overAngleNames) {
+		return overAngleNames[o]
+	}
+	return fmt.Sprintf("OverAngle(%d)", int(o))
+}
+
+// ParseOverAngle returns the OverAngle with the given name.
+func ParseOverAngle(name string) (OverAngle, error) {
+	for i, s := range overAngleNames {
+		if s == name {
+			return OverAngle(i), nil
+		}
+	}
+	return 0, fmt.Errorf("autocrop: unknown over-angle policy %q", name)
+}
+
+// Sides is a set of the sides of an image.
+type Sides uint8
+
+// The sides, in CSS box order.
+const (
+	Top Sides = 1 << iota
+	Right
+	Bottom
+	Left
+
+	AllSides = Top | Right | Bottom | Left
+)
+
+// Has reports whether the side with index i in CSS box order (T,R,B,L) is in
+// s.
+func (s Sides) Has(i int) bool {
+	return s&(1<<uint(i)) != 0
+}
+
+// String returns the letters of the sides in s, as ParseSides takes them.
+func (s Sides) String() string {
+	var b strings.Builder
+	for i, c := range "trbl" {
+		if s.Has(i) {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// ParseSides returns the sides named by the letters t, r, b and l in str.
+func ParseSides(str string) (Sides, error) {
+	var s Sides
+	for _, c := range str {
+		switch c {
+		case 't':
+			s |= Top
+		case 'r':
+			s |= Right
+		case 'b':
+			s |= Bottom
+		case 'l':
+			s |= Left
+		default:
+			return 0, fmt.Errorf("autocrop: unknown side %q", c)
+		}
+	}
+	return s, nil
+}
+
+// GrayWeights are the weights of the red, green and blue components of the
+// gray levels that the edges are looked for in. They needn't add up to 1.
+type GrayWeights [3]float64
+
+// Luma weights of the usual standards. They set yellowed paper apart from a
+// dark background better than the plain average, which gives the blue that
+// the paper lacks as much weight as the rest.
+var (
+	Rec601 = GrayWeights{0.299, 0.587, 0.114}
+	Rec709 = GrayWeights{0.2126, 0.7152, 0.0722}
+)
+
+// ParseGrayWeights returns the GrayWeights named by str: "average", "601" or
+// "709", or three weights separated by commas.
+func ParseGrayWeights(str string) (GrayWeights, error) {
+	switch str {
+	case "average":
+		return GrayWeights{}, nil
+	case "601":
+		return Rec601, nil
+	case "709":
+		return Rec709, nil
+	}
+	var w GrayWeights
+	if _, err := fmt.Sscanf(str, "%g,%g,%g", &w[0], &w[1], &w[2]); err != nil {
+		return w, fmt.Errorf("autocrop: invalid gray weights %q", str)
+	}
+	return w, nil
+}
+
+// fixed returns w scaled so that they add up to 1<<24, or zeros if w is
+// zero, for weighing 16 bit components.
+func (w GrayWeights) fixed() (f [3]uint64) {
+	sum := w[0] + w[1] + w[2]
+	if sum <= 0 {
+		return f
+	}
+	for i := range w {
+		f[i] = uint64(math.Round(w[i] / sum * (1 << 24)))
+	}
+	return f
+}
+
+// Options holds the parameters of an analysis. Zero fields take their values
+// from DefaultOptions.
+type Options struct {
+	Thresh float64 // color value d/dx (out of 255 at any depth) considered to be a page border
+	Fc     float64 // cutoff frequency for the low-pass denoise filter
+	N      int     // number of samples to take per side, at least 3
+
+	// MaxN, if more than N, makes the number of samples adaptive. The page
+	// is fitted with N samples per side first, and then with twice as many,
+	// up to MaxN, as long as that keeps narrowing a wide AngleErr. Clean
+	// scans are done after a few samples; hard ones get more.
+	MaxN int
+
+	// EarlyStop takes the samples of each side coarse to fine: every 8th or
+	// so first, spread along the whole side, and then those halfway between
+	// them, a level at a time. The rows, which find the left and right
+	// sides, and the columns, which find the top and bottom, each stop as
+	// soon as the lines fitted to their sides move less than a pixel, a
+	// hundredth of a degree and 0.02 in confidence from one level to the
+	// next, and the rest of their samples are never taken. Clean scans are
+	// then done with a fraction of N, at the risk of missing a short tear or
+	// tab that the skipped samples would have found. Hough takes all of its
+	// samples regardless.
+	EarlyStop bool
+
+	Algorithm Algorithm // how to estimate the angle
+
+	// Sides are the sides the angle is derived from and that are cropped.
+	// The others are left alone. Bound periodicals, for example, are often
+	// trimmed flush on the left and right, so only the top and bottom are of
+	// any use.
+	Sides Sides
+
+	// Angle, if not nil, is used as the rotation (in radians) instead of the
+	// one fitted from the page edges. The crop is still computed from the
+	// image. This is meant for scanners with a fixed cradle, where the skew is
+	// the same for every page of a book and can be measured once on a
+	// reference page.
+	Angle *float64
+
+	// MaxAngle, if positive, is the largest angle (in radians) a page can
+	// plausibly be skewed by. A larger fitted angle almost always means the
+	// fit failed, and OverAngle says what to do about it.
+	MaxAngle  float64
+	OverAngle OverAngle
+
+	// Orientation, if set, detects whether the page is sideways or upside
+	// down from the text on it, and sets the Orientation of the Transform to
+	// turn it upright.
+	Orientation bool
+
+	// SourceRotation is the clockwise rotation in degrees (a multiple of 90)
+	// that the metadata of the source asks for on display, like the /Rotate
+	// of a PDF page or the rotation of a IIIF image request. The Transform
+	// acts on the image as stored, so the rotation is folded into its
+	// Orientation. The image is turned upright before the analysis, unless
+	// PreRotated says that it already has been, as thumbnails rendered from
+	// such sources usually are.
+	SourceRotation int
+	PreRotated     bool
+
+	// Gray are the weights of the color components in the gray levels that
+	// the edges are looked for in. If zero, they are weighted equally.
+	Gray GrayWeights
+
+	// Filter takes the noise out of the samples across the edges before
+	// they are looked for. If nil, it is a LowpassFilter with the cutoff
+	// frequency Fc.
+	Filter Filter
+
+	// Block, if more than 1, samples the sides with the average gray level
+	// of the Block×Block pixels around each sample instead of the pixel
+	// itself, which evens out grain and dust across the edge as well as
+	// along it, without shifting the edge as Filter does. The blocks are
+	// read from summed-area tables of the strips along the sides, which
+	// take about a quarter of the image to make.
+	Block int
+
+	// Skip is the number of rising edges to pass over before taking one as
+	// the page border. Pages with printed black rules or artwork bleeding to
+	// the edge show a second rising edge after the first; Skip = 1 lands on
+	// the paper boundary in that case.
+	Skip int
+
+	// MinRun, if positive, rejects any rising edge that is followed by a
+	// falling edge within MinRun samples, i.e. the paper must stay white for
+	// at least that long. This is a more targeted alternative to Skip.
+	MinRun int
+
+	// MaskHoles, if set, leaves out of the fit the samples that pass
+	// through small dark blobs just inside the edge of the page, like punched
+	// holes and staples, which throw off the edge found by Skip and MinRun.
+	// Blobs that run along much of a side, like printed frames, are kept.
+	MaskHoles bool
+
+	// Mask and Exclude cover areas of the image to leave out of the analysis,
+	// like barcode stickers, color targets or fingers holding the page. Mask
+	// covers its opaque pixels and must have the same bounds as the image.
+	// Exclude covers rectangles in the coordinates of the image. Samples of
+	// the edges that cross them are ignored, as is any ink in them.
+	Mask    image.Image
+	Exclude []image.Rectangle
+
+	// Hint, if not empty, is a rough crop rectangle in the coordinates of the
+	// image, such as one drawn by hand on the first page of a book. The edges
+	// are then only looked for near the sides of the hint, which keeps the
+	// analysis clear of whatever else is in the scan.
+	Hint image.Rectangle
+
+	// AvoidCurl, if set, fits only the straight part of a side whose edge
+	// curves, as near the spine of a book, so that the curve doesn't pull
+	// the angle and the crop with it. See Transform.Curl.
+	AvoidCurl bool
+
+	// Content, if set, crops to the block of ink on the page instead of to
+	// the page itself, keeping ContentMargin pixels of paper around it.
+	Content       bool
+	ContentMargin int
+
+	// Margins, if set, measures the Margins of the Transform: how far the
+	// ink is in from each side of the page.
+	Margins bool
+
+	// Overcrop, if set, guards against cutting through text or pictures that
+	// run up to the edge of the page, like page numbers: a cropped side with
+	// ink just inside it is moved out, as far as Conservative, until it is
+	// clear. The sides it can't clear are flagged in Transform.Overcrop.
+	Overcrop bool
+
+	// Targets, if set, looks for color targets and rulers along the sides
+	// of the image and leaves them out of the edge fit, so that their edges
+	// aren't taken for the page's. CropTargets does the same, and also
+	// cuts the crop in past any of them that reach into it.
+	Targets     bool
+	CropTargets bool
+
+	// Inset moves each cropped side of Bounds in by Inset pixels plus
+	// InsetFrac of the width or height of the crop, or out if negative. A
+	// small outset keeps a sliver of the border rather than risk shaving the
+	// page; an inset bites further into the shadow along its edges. The crop
+	// never grows past the image.
+	Inset     int
+	InsetFrac float64
+
+	// Size, if not zero, makes the crop exactly that size, centered on the
+	// page, so that every page of a book comes out the same. Otherwise
+	// Aspect, if not zero, widens or heightens the crop around its center
+	// until its width divided by its height is Aspect. Either way the crop
+	// is moved to stay within the image, and cut down if it doesn't fit.
+	Size   image.Point
+	Aspect float64
+
+	// Modulus, if more than 1, shrinks the crop so that its offsets, width
+	// and height are multiples of Modulus, as encoders that work in blocks
+	// (like lossless JPEG crops) want. When the page is also rotated, String
+	// moves the offsets by the triangles ImageMagick adds, so that only the
+	// width and height stay multiples. Perspective corrections are left as
+	// they are.
+	Modulus int
+
+	// Fit is how the crop is fitted to the page once it has been rotated,
+	// and Pivot the point it is rotated about.
+	Fit   Fit
+	Pivot Pivot
+
+	// Params are the finer points of the edge analysis.
+	Params Params
+
+	// Hardened, if set, turns a panic anywhere in the analysis, including in
+	// decoding the image with AnalyzeReader and in registered algorithms and
+	// Filters, into an error, rather than letting it crash the program.
+	// This is for images from untrusted sources, like a public upload
+	// endpoint. Apply is not covered.
+	Hardened bool
+
+	// DPI is the resolution of the image in pixels per inch, which converts
+	// the lengths in Physical to pixels. If zero, AnalyzeReader reads it from
+	// the metadata of JPEG and TIFF files.
+	DPI      float64
+	Physical Physical
+
+	// Downsample, if more than 1, analyzes a copy of the image shrunk by
+	// that factor, each pixel of which is the average of a block of
+	// Downsample×Downsample pixels, and scales the Transform back up. The
+	// image is still read once to shrink it, but the analysis of the copy
+	// reads Downsample² times fewer pixels, which is most of the time spent on
+	// large scans with Content, Overcrop or Hough. The edges are only found
+	// to the pixel of the copy, so Bounds may be off by up to Downsample
+	// pixels, and the Angle by about Downsample pixels over the length of a
+	// side. A 1200 dpi scan shrunk to 300 dpi (4) loses nothing that matters
+	// for deskewing and cropping; a 300 dpi one shrunk as far starts to miss
+	// thin borders. Composite and Diagnose show the analysis of the copy.
+	//
+	// Refine, with Downsample, then looks for each edge again in the image
+	// itself, but only within a couple of the copy's pixels of the line found
+	// on the copy. That keeps the accuracy of a full analysis while reading a
+	// small fraction of the pixels along the sides, so a heavily shrunk copy
+	// (8 or 16) does. Content, Overcrop and Targets still look at the whole
+	// image. Composite and Diagnose then show the refined analysis.
+	Downsample int
+	Refine     bool
+
+	// MaxPixels, if positive, is the largest image (in pixels) that is
+	// analyzed. Larger ones are refused with a *TooLarge error. AnalyzeReader
+	// reads the size from the header of the image and refuses it before
+	// decoding it, which is what takes the memory.
+	MaxPixels int
+
+	// Logger, if not nil, is told at debug level what the analysis found
+	// on each side and how it got to the Transform: the trim windows, the
+	// line fits and their errors, and what was done about their angle.
+	// Otherwise the analysis is silent.
+	Logger *slog.Logger
+
+	// session marks the image as that of a Session, which keeps what it can
+	// of the analysis for the next.
+	session sessionImage
+}
+
+// Params are the tunables of the edge analysis, which are seldom worth
+// changing but explain the results. Zero fields take their value from
+// DefaultParams.
+type Params struct {
+	// Band is how far in from each side of the image the edge of the page is
+	// looked for, as a fraction 1/Band of the image (but at least 8 pixels
+	// and at most halfway). With a hint, the search reaches 1/(2*Band) of
+	// the image either way from the side of the hint.
+	Band int
+
+	// DerivFc is the cutoff frequency of the low-pass filter run over the
+	// derivative of each sample, after Fc has been run over the sample.
+	DerivFc float64
+
+	// EdgeFc is the cutoff frequency of the low-pass filter run along the
+	// edges found on a side before a line is fitted to them.
+	EdgeFc float64
+
+	// TrimDepth is how far in (in pixels) an edge at either end of a side
+	// may be before it is trimmed off as not being on the page.
+	TrimDepth float64
+
+	// LineDev is how far (in pixels) an edge may be from the line fitted to
+	// the others before it is thrown out.
+	LineDev float64
+
+	// Runs of ChunkSize edges whose average absolute deviation is over
+	// ChunkDev pixels are thrown out as noise before the line is fitted.
+	ChunkSize int
+	ChunkDev  float64
+}
+
+// DefaultParams are the Params used in place of any zero fields.
+var DefaultParams = Params{
+	Band:      16,
+	DerivFc:   0.1,
+	EdgeFc:    0.1,
+	TrimDepth: 200,
+	LineDev:   24,
+	ChunkSize: 8,
+	ChunkDev:  4,
+}
+
+// fill returns a copy of p with its zero fields set to the defaults.
+func (p Params) fill() Params {
+	d := DefaultParams
+	if p.Band == 0 {
+		p.Band = d.Band
+	}
+	if p.DerivFc == 0 {
+		p.DerivFc = d.DerivFc
+	}
+	if p.EdgeFc == 0 {
+		p.EdgeFc = d.EdgeFc
+	}
+	if p.TrimDepth == 0 {
+		p.TrimDepth = d.TrimDepth
+	}
+	if p.LineDev == 0 {
+		p.LineDev = d.LineDev
+	}
+	if p.ChunkSize == 0 {
+		p.ChunkSize = d.ChunkSize
+	}
+	if p.ChunkDev == 0 {
+		p.ChunkDev = d.ChunkDev
+	}
+	return p
+}
+
+// check reports whether the (filled) params make sense.
+func (p *Params) check() error {
+	if p.Band < 2 {
+		return fmt.Errorf("autocrop: invalid band %d", p.Band)
+	}
+	if p.ChunkSize < 1 {
+		return fmt.Errorf("autocrop: invalid chunk size %d", p.ChunkSize)
+	}
+	for _, v := range []float64{p.DerivFc, p.EdgeFc, p.TrimDepth, p.LineDev, p.ChunkDev} {
+		if v < 0 || !finite(v) {
+			return fmt.Errorf("autocrop: invalid params %+v", *p)
+		}
+	}
+	return nil
+}
+
+// DefaultOptions are the options used by the command line tool, and in place
+// of any zero fields in an Options.
+var DefaultOptions = Options{
+	Thresh: 12,
+	Fc:     0.1,
+	N:      500,
+	Sides:  AllSides,
+}
+
+// fill returns a copy of o with its zero fields set to the defaults.
+func (o Options) fill() Options {
+	if o.Thresh == 0 {
+		o.Thresh = DefaultOptions.Thresh
+	}
+	if o.Fc == 0 {
+		o.Fc = DefaultOptions.Fc
+	}
+	if o.N == 0 {
+		o.N = DefaultOptions.N
+	}
+	if o.Filter == nil {
+		o.Filter = LowpassFilter{o.Fc}
+	}
+	o.Params = o.Params.fill()
+	o.pixels()
+	if o.Sides == 0 {
+		o.Sides = DefaultOptions.Sides
+	}
+	return o
+}
+
+// check reports whether the (filled) options make sense.
+func (o *Options) check() error {
+	if o.N < minSamples {
+		return fmt.Errorf("autocrop: invalid sample count %d", o.N)
+	}
+	if o.MaxN < 0 {
+		return fmt.Errorf("autocrop: invalid maximum sample count %d", o.MaxN)
+	}
+	if o.Algorithm < 0 || int(o.Algorithm) >= len(algorithmNames) {
+		return fmt.Errorf("autocrop: unknown algorithm %v", o.Algorithm)
+	}
+	if o.Sides&^AllSides != 0 {
+		return fmt.Errorf("autocrop: invalid sides %#x", o.Sides)
+	}
+	if o.SourceRotation%90 != 0 {
+		return fmt.Errorf("autocrop: source rotation %d is not a multiple of 90", o.SourceRotation)
+	}
+	for _, w := range o.Gray {
+		if w < 0 || !finite(w) {
+			return fmt.Errorf("autocrop: invalid gray weights %v", o.Gray)
+		}
+	}
+	if err := o.checkPhysical(); err != nil {
+		return err
+	}
+	if o.Downsample < 0 {
+		return fmt.Errorf("autocrop: invalid downsampling factor %d", o.Downsample)
+	}
+	if o.MaxPixels < 0 {
+		return fmt.Errorf("autocrop: invalid pixel budget %d", o.MaxPixels)
+	}
+	if o.Skip < 0 {
+		return fmt.Errorf("autocrop: invalid edge skip count %d", o.Skip)
+	}
+	if o.Block < 0 {
+		return fmt.Errorf("autocrop: invalid block size %d", o.Block)
+	}
+	if o.ContentMargin < 0 {
+		return fmt.Errorf("autocrop: invalid content margin %d", o.ContentMargin)
+	}
+	if o.Fc < 0 || !finite(o.Fc) {
+		return fmt.Errorf("autocrop: invalid cutoff frequency %f", o.Fc)
+	}
+	if !finite(o.Thresh) {
+		return fmt.Errorf("autocrop: invalid threshold %f", o.Thresh)
+	}
+	if !finite(o.InsetFrac) || o.InsetFrac <= -1 || o.InsetFrac >= 0.5 {
+		return fmt.Errorf("autocrop: invalid inset fraction %f", o.InsetFrac)
+	}
+	if o.Size.X < 0 || o.Size.Y < 0 || (o.Size.X == 0) != (o.Size.Y == 0) {
+		return fmt.Errorf("autocrop: invalid page size %v", o.Size)
+	}
+	if o.Fit < 0 || int(o.Fit) >= len(fitNames) {
+		return fmt.Errorf("autocrop: unknown fit %v", o.Fit)
+	}
+	if o.Pivot < 0 || int(o.Pivot) >= len(pivotNames) {
+		return fmt.Errorf("autocrop: unknown pivot %v", o.Pivot)
+	}
+	if o.Modulus < 0 {
+		return fmt.Errorf("autocrop: invalid modulus %d", o.Modulus)
+	}
+	if o.Aspect < 0 || !finite(o.Aspect) {
+		return fmt.Errorf("autocrop: invalid aspect ratio %f", o.Aspect)
+	}
+	if o.MaxAngle < 0 || !finite(o.MaxAngle) {
+		return fmt.Errorf("autocrop: invalid maximum angle %f", o.MaxAngle)
+	}
+	if o.OverAngle < 0 || int(o.OverAngle) >= len(overAngleNames) {
+		return fmt.Errorf("autocrop: unknown over-angle policy %v", o.OverAngle)
+	}
+	if o.Angle != nil && !finite(*o.Angle) {
+		return fmt.Errorf("autocrop: invalid angle %f", *o.Angle)
+	}
+	return o.Params.check()
+}
+
+// finite reports whether x is neither infinite nor NaN.
+func finite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
+// TooLarge is the error returned for an image with more pixels than
+// Options.MaxPixels.
+type TooLarge struct {
+	Size      image.Point
+	MaxPixels int
+}
+
+func (e *TooLarge) Error() string {
+	return fmt.Sprintf("autocrop: image %dx%d is larger than the budget of %d pixels", e.Size.X, e.Size.Y, e.MaxPixels)
+}
+
+// budget returns a *TooLarge if a dx×dy image is beyond MaxPixels.
+func (o *Options) budget(dx, dy int) error {
+	if o.MaxPixels > 0 && int64(dx)*int64(dy) > int64(o.MaxPixels) {
+		return &TooLarge{image.Pt(dx, dy), o.MaxPixels}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package autocrop
+
+// orientation.go contains the detection of the gross orientation of a page,
+// i.e. whether it was scanned sideways or upside down.
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// detectOrientation returns the clockwise rotation in degrees (0, 90, 180 or
+// 270) that makes the text in img upright.
+//
+// The text lines run along the axis whose leveled ink projection profile
+// varies the most, since lines alternate with empty leading while letters
+// across a line are fairly even. Which way is up is decided by the ink
+// outside of the core (x-height) band of every line: Latin text has far more
+// ascenders than descenders, so there should be more ink on the top side of
+// the core.
+func detectOrientation(img image.Image) int {
+	var (
+		best        = math.Inf(-1)
+		orientation = 0
+		alpha       = hasAlpha(img)
+	)
+
+	// Try the image as it is and turned clockwise. A page that was turned
+	// clockwise by the scanner then ends up upside down.
+	for _, deg := range []int{0, 90} {
+		a := &analysis{img: rotate90(img, deg), alpha: alpha}
+
+		// Keep to the middle of the image, away from any border.
+		b := a.img.Bounds()
+		r := image.Rect(b.Dx()/8, b.Dy()/8, b.Dx()*7/8, b.Dy()*7/8)
+		if r.Empty() {
+			return 0
+		}
+
+		p := a.project(r)
+		if len(p.xs) == 0 {
+			return 0
+		}
+		angle, _ := p.search()
+		if score := p.score(angle); score > best {
+			best = score
+			orientation = deg
+			if ascenderBias(p.profile(angle)) < 0 {
+				orientation += 180
+			}
+		}
+	}
+
+	return orientation
+}
+
+// ascenderBias splits an ink projection profile across text lines into the
+// lines, and returns how much more ink lies before the core band of the lines
+// than after it, as a fraction of all of the ink outside of the cores.
+func ascenderBias(profile []float64) float64 {
+	peak := 0.
+	for _, p := range profile {
+		peak = math.Max(peak, p)
+	}
+
+	var before, after float64
+	for i := 0; i < len(profile); {
+		// a line is a run of rows with any appreciable ink
+		if profile[i] < peak/20 {
+			i++
+			continue
+		}
+		start := i
+		linePeak := 0.
+		for ; i < len(profile) && profile[i] >= peak/20; i++ {
+			linePeak = math.Max(linePeak, profile[i])
+		}
+		line := profile[start:i]
+
+		// the core is the span of rows with at least half the line's peak
+		lo, hi := -1, 0
+		for j, p := range line {
+			if p >= linePeak/2 {
+				if lo < 0 {
+					lo = j
+				}
+				hi = j + 1
+			}
+		}
+		for _, p := range line[:lo] {
+			before += p
+		}
+		for _, p := range line[hi:] {
+			after += p
+		}
+	}
+
+	if before+after == 0 {
+		return 0
+	}
+	return (before - after) / (before + after)
+}
+
+// orient presents an image rotated clockwise by a multiple of 90 degrees,
+// with its origin at (0, 0).
+type orient struct {
+	image.Image
+	deg int
+}
+
+// rotate90 returns img turned clockwise by deg degrees, which must be a
+// multiple of 90.
+func rotate90(img image.Image, deg int) image.Image {
+	deg = (deg%360 + 360) % 360
+	if deg == 0 {
+		return img
+	}
+	return orient{img, deg}
+}
+
+// orientationIndex returns which of 0, 90, 180 and 270 the clockwise
+// rotation deg, a multiple of 90 degrees, comes to, as 0 to 3.
+func orientationIndex(deg int) int {
+	return (deg%360 + 360) % 360 / 90
+}
+
+func (o orient) Bounds() image.Rectangle {
+	b := o.Image.Bounds()
+	if o.deg == 180 {
+		return image.Rect(0, 0, b.Dx(), b.Dy())
+	}
+	return image.Rect(0, 0, b.Dy(), b.Dx())
+}
+
+func (o orient) At(x, y int) color.Color {
+	x, y = o.point(x, y)
+	return o.Image.At(x, y)
+}
+
+// RGBA64At is At without the color.Color, for the images that have it.
+func (o orient) RGBA64At(x, y int) color.RGBA64 {
+	x, y = o.point(x, y)
+	return rgba64At(o.Image, x, y)
+}
+
+// point returns the point of the image that the point x, y of o is.
+func (o orient) point(x, y int) (int, int) {
+	b := o.Image.Bounds()
+	switch o.deg {
+	case 90:
+		x, y = y, b.Dy()-1-x
+	case 180:
+		x, y = b.Dx()-1-x, b.Dy()-1-y
+	case 270:
+		x, y = b.Dx()-1-y, x
+	}
+	return b.Min.X + x, b.Min.Y + y
+}
+
+// rgba64At returns the color of img at x, y as an RGBA64, without going
+// through At if img has RGBA64At.
+func rgba64At(img image.Image, x, y int) color.RGBA64 {
+	if m, ok := img.(image.RGBA64Image); ok {
+		return m.RGBA64At(x, y)
+	}
+	r, g, b, a := img.At(x, y).RGBA()
+	return color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+}
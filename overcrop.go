@@ -0,0 +1,119 @@
+package autocrop
+
+// overcrop.go contains the guard against crops that cut into what is printed
+// on the page, like page numbers set close to its edge.
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// overcropBand is how far in from a side of the crop (in pixels) ink is
+	// looked for.
+	overcropBand = 3
+	// overcropChunk is the length (in pixels) of the pieces of the band
+	// that are looked at on their own, so that a page number isn't drowned
+	// out by the clean paper along the rest of the side. The pieces at
+	// either end are left out, since the border along the sides next to
+	// them can reach into them.
+	overcropChunk = 32
+	// overcropDensity is the fraction of ink in a piece of the band from
+	// which something is taken to run into the cut.
+	overcropDensity = 0.15
+	// overcropShadow is the fraction of the pieces of the band that, when
+	// they all have ink in them, make it the shadow along the edge of the
+	// page or the border, not content.
+	overcropShadow = 0.5
+)
+
+// guardOvercrop looks for ink in a thin band just inside each cropped side
+// of the crop, and moves the sides that have some out, one pixel at a time
+// but no further than t.Conservative, until they are clear of it. The sides
+// that still cut through ink are set in t.Overcrop.
+func (a *analysis) guardOvercrop(t *Transform) {
+	outer := t.Conservative.Union(t.Bounds).Intersect(a.img.Bounds())
+	for i := 0; i < 4; i++ {
+		if !t.Sides.Has(i) {
+			continue
+		}
+		for a.cutsInk(t, i) {
+			b := t.Bounds
+			switch i {
+			case 0:
+				b.Min.Y--
+			case 1:
+				b.Max.X++
+			case 2:
+				b.Max.Y++
+			case 3:
+				b.Min.X--
+			}
+			if !b.In(outer) {
+				t.Overcrop |= 1 << uint(i)
+				break
+			}
+			t.Bounds = b
+		}
+		if t.Overcrop.Has(i) {
+			a.debug("overcrop", "side", sideNames[i], "bounds", t.Bounds)
+		}
+	}
+}
+
+// cutsInk reports whether side i of the crop runs through ink. The band
+// along it is taken on the straightened page, so that a tilted page doesn't
+// bring the background into it near the corners.
+func (a *analysis) cutsInk(t *Transform, i int) bool {
+	r := t.Crop()
+	w, h := float64(r.Dx()), float64(r.Dy())
+	back := t.straighten().Inverse()
+
+	// (u, v) are along the side from its start and across it from the cut
+	// inwards
+	length, depth := w, h
+	if i%2 == 1 {
+		length, depth = h, w
+	}
+	at := func(u, v float64) image.Point {
+		var x, y float64
+		switch i {
+		case 0:
+			x, y = u, v
+		case 1:
+			x, y = w-v, u
+		case 2:
+			x, y = u, h-v
+		case 3:
+			x, y = v, u
+		}
+		x, y = back.Point(float64(r.Min.X)+x, float64(r.Min.Y)+y)
+		return image.Pt(int(math.Floor(x)), int(math.Floor(y)))
+	}
+
+	band := min(overcropBand, int(depth)/2)
+	chunks, inky := 0, 0
+	for start := overcropChunk; start+2*overcropChunk <= int(length); start += overcropChunk {
+		ink, n := 0, 0
+		for u := start; u < start+overcropChunk; u++ {
+			for v := 0; v < band; v++ {
+				p := at(float64(u)+0.5, float64(v)+0.5)
+				if !p.In(a.img.Bounds()) || a.excluded(image.Rectangle{p, p.Add(image.Pt(1, 1))}) {
+					continue
+				}
+				if a.ink(p.X, p.Y) {
+					ink++
+				}
+				n++
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		chunks++
+		if float64(ink) >= overcropDensity*float64(n) {
+			inky++
+		}
+	}
+	return inky > 0 && float64(inky) < overcropShadow*float64(chunks)
+}
@@ -0,0 +1,226 @@
+package autocrop
+
+// pdf.go contains the assembly of pages into a PDF document, which is what
+// most digitization projects deliver in the end. Each page is one image at
+// the physical size of the scan, so that OCR tools can add a text layer to
+// the document as it is.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// pdfDPI is the resolution of pages whose resolution isn't known.
+const pdfDPI = 300
+
+// PDFWriter writes a PDF document with a page for each image added to it.
+// The pages are written as they are added, and Close finishes the document.
+type PDFWriter struct {
+	w     *bufio.Writer
+	n     int   // bytes written
+	xref  []int // offsets of the objects, from object 1
+	pages []int // objects of the pages
+	err   error
+}
+
+// The objects that are written last, when all the pages are known.
+const (
+	pdfCatalog = 1
+	pdfPages   = 2
+)
+
+// NewPDFWriter returns a PDFWriter that writes a document to w.
+func NewPDFWriter(w io.Writer) *PDFWriter {
+	p := &PDFWriter{w: bufio.NewWriter(w), xref: make([]int, 2)}
+	// the comment of high bytes marks the file as binary
+	p.printf("%%PDF-1.5\n%%\xe2\xe3\xcf\xd3\n")
+	return p
+}
+
+// AddImage adds a page of img, which is dpi pixels per inch, or 300 if dpi is
+// zero. Its samples are compressed losslessly, with 16 bits each if img has
+// them, and those of a gray image are written as gray. The colors are in the
+// ICC profile icc if it isn't nil.
+func (p *PDFWriter) AddImage(img image.Image, dpi float64, icc []byte) error {
+	b := img.Bounds()
+	if b.Empty() {
+		return fmt.Errorf("autocrop: can't add an empty image to a PDF")
+	}
+	row, spp, depth := tiffRows(img)
+	comps := spp
+	if spp == 4 {
+		comps = 3 // the alpha is a soft mask of its own
+	}
+
+	// the samples of each row, made big endian, split into color and alpha
+	var pix, alpha bytes.Buffer
+	zpix, zalpha := zlib.NewWriter(&pix), zlib.NewWriter(&alpha)
+	size := depth / 8
+	buf := make([]byte, b.Dx()*spp*size)
+	for y := 0; y < b.Dy(); y++ {
+		row(y, buf)
+		if size == 2 {
+			// tiffRows writes them little endian
+			for i := 0; i < len(buf); i += 2 {
+				buf[i], buf[i+1] = buf[i+1], buf[i]
+			}
+		}
+		if spp != 4 {
+			zpix.Write(buf)
+			continue
+		}
+		for x := 0; x < b.Dx(); x++ {
+			px := buf[x*4*size : (x+1)*4*size]
+			zpix.Write(px[:3*size])
+			zalpha.Write(px[3*size:])
+		}
+	}
+	zpix.Close()
+	zalpha.Close()
+
+	smask := 0
+	if spp == 4 {
+		smask = p.stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent %d /Filter /FlateDecode",
+			b.Dx(), b.Dy(), depth), alpha.Bytes())
+	}
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent %d /Filter /FlateDecode",
+		b.Dx(), b.Dy(), p.colorSpace(comps, icc), depth)
+	if smask != 0 {
+		dict += fmt.Sprintf(" /SMask %d 0 R", smask)
+	}
+	p.page(p.stream(dict, pix.Bytes()), b.Size(), dpi)
+	return p.err
+}
+
+// AddJPEG adds a page of the JPEG jpeg as it is, without decoding it, which
+// is dpi pixels per inch, or 300 if dpi is zero. The ICC profile embedded in
+// it, if any, goes with it. CMYK JPEGs are decoded and added as AddImage
+// adds them, since readers disagree on their colors.
+func (p *PDFWriter) AddJPEG(jpeg []byte, dpi float64) error {
+	c, format, err := image.DecodeConfig(bytes.NewReader(jpeg))
+	if err != nil {
+		return err
+	}
+	if format != "jpeg" {
+		return fmt.Errorf("autocrop: not a JPEG but %s", format)
+	}
+	icc := jpegICC(jpeg)
+	var n int
+	switch c.ColorModel {
+	case color.GrayModel:
+		n = 1
+	case color.YCbCrModel:
+		n = 3
+	default:
+		img, _, err := image.Decode(bytes.NewReader(jpeg))
+		if err != nil {
+			return err
+		}
+		return p.AddImage(img, dpi, nil)
+	}
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode",
+		c.Width, c.Height, p.colorSpace(n, icc))
+	p.page(p.stream(dict, jpeg), image.Pt(c.Width, c.Height), dpi)
+	return p.err
+}
+
+// Close writes the rest of the document. It doesn't close the underlying
+// writer.
+func (p *PDFWriter) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.pages) == 0 {
+		return fmt.Errorf("autocrop: a PDF needs at least one page")
+	}
+	kids := make([]string, len(p.pages))
+	for i, n := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", n)
+	}
+	p.object(pdfPages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+	p.object(pdfCatalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pdfPages))
+
+	start := p.n
+	p.printf("xref\n0 %d\n0000000000 65535 f \n", len(p.xref)+1)
+	for _, off := range p.xref {
+		p.printf("%010d 00000 n \n", off)
+	}
+	p.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.xref)+1, pdfCatalog, start)
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// colorSpace returns the color space of images of n components in the ICC
+// profile icc, or the device's if icc is nil or not of n components.
+func (p *PDFWriter) colorSpace(n int, icc []byte) string {
+	device := map[int]string{1: "/DeviceGray", 3: "/DeviceRGB"}[n]
+	// the profile's color space is in its header
+	if len(icc) < 20 || string(icc[16:20]) != map[int]string{1: "GRAY", 3: "RGB "}[n] {
+		return device
+	}
+	s := p.stream(fmt.Sprintf("/N %d /Alternate %s", n, device), icc)
+	return fmt.Sprintf("[/ICCBased %d 0 R]", s)
+}
+
+// page writes a page of the image object img, of the given size in pixels,
+// at dpi pixels per inch.
+func (p *PDFWriter) page(img int, size image.Point, dpi float64) {
+	if dpi <= 0 {
+		dpi = pdfDPI
+	}
+	// in points of 1/72 inch
+	w, h := float64(size.X)*72/dpi, float64(size.Y)*72/dpi
+	content := p.stream("", []byte(fmt.Sprintf("q %.4f 0 0 %.4f 0 0 cm /Im0 Do Q", w, h)))
+	n := p.object(0, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.4f %.4f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		pdfPages, w, h, img, content))
+	p.pages = append(p.pages, n)
+}
+
+// stream writes a stream object with the entries dict in its dictionary, and
+// returns its number.
+func (p *PDFWriter) stream(dict string, data []byte) int {
+	p.xref = append(p.xref, p.n)
+	n := len(p.xref)
+	if dict != "" {
+		dict += " "
+	}
+	p.printf("%d 0 obj\n<< %s/Length %d >>\nstream\n", n, dict, len(data))
+	p.write(data)
+	p.printf("\nendstream\nendobj\n")
+	return n
+}
+
+// object writes the object obj as number n, or as a new object if n is zero,
+// and returns its number.
+func (p *PDFWriter) object(n int, obj string) int {
+	if n == 0 {
+		p.xref = append(p.xref, 0)
+		n = len(p.xref)
+	}
+	p.xref[n-1] = p.n
+	p.printf("%d 0 obj\n%s\nendobj\n", n, obj)
+	return n
+}
+
+// printf and write write to the document, keeping count of the bytes and
+// the first error.
+func (p *PDFWriter) printf(format string, a ...any) {
+	p.write([]byte(fmt.Sprintf(format, a...)))
+}
+
+func (p *PDFWriter) write(b []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(b)
+	p.n += n
+	p.err = err
+}
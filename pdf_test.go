@@ -0,0 +1,164 @@
+package autocrop
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// pdfObjects reads the cross-reference table at the end of the PDF doc and
+// returns its objects by number, checking that every entry points at the
+// object it is for.
+func pdfObjects(t *testing.T, doc []byte) map[int][]byte {
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(doc)
+	if m == nil {
+		t.Fatalf("no startxref at the end of %q", doc[max(0, len(doc)-100):])
+	}
+	start, _ := strconv.Atoi(string(m[1]))
+	var n int
+	if _, err := fmt.Sscanf(string(doc[start:]), "xref\n0 %d\n", &n); err != nil {
+		t.Fatalf("no xref at %d: %v", start, err)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n \n`).FindAllSubmatch(doc[start:], -1)
+	if len(entries) != n-1 {
+		t.Fatalf("%d xref entries, want %d", len(entries), n-1)
+	}
+	objs := make(map[int][]byte)
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		head := fmt.Sprintf("%d 0 obj\n", i+1)
+		if !bytes.HasPrefix(doc[off:], []byte(head)) {
+			t.Fatalf("object %d isn't at %d", i+1, off)
+		}
+		obj := doc[off+len(head):]
+		objs[i+1] = obj[:bytes.Index(obj, []byte("endobj\n"))]
+	}
+	return objs
+}
+
+// pdfStream returns the dictionary and the data of the stream object obj.
+func pdfStream(t *testing.T, obj []byte) (string, []byte) {
+	dict, rest, ok := bytes.Cut(obj, []byte(" >>\nstream\n"))
+	if !ok {
+		t.Fatalf("not a stream: %q", obj[:min(len(obj), 100)])
+	}
+	m := regexp.MustCompile(`/Length (\d+)$`).FindSubmatch(dict)
+	if m == nil {
+		t.Fatalf("stream without a length: %q", dict)
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(rest[n:], []byte("\nendstream\n")) {
+		t.Fatalf("stream of %d bytes doesn't end there", n)
+	}
+	return string(dict), rest[:n]
+}
+
+func TestPDFWriter(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 300, 150))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	copy(nrgba.Pix, []uint8{10, 20, 30, 255, 40, 50, 60, 128})
+	gray16 := image.NewGray16(image.Rect(0, 0, 2, 1))
+	copy(gray16.Pix, []uint8{0x12, 0x34, 0xab, 0xcd})
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, texture(60, 30), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		add     func(p *PDFWriter) error
+		media   string // the size of the page in points
+		dict    []string
+		data    []byte
+		inflate bool
+		alpha   []byte
+	}{
+		{"gray", func(p *PDFWriter) error { return p.AddImage(gray, 150, nil) },
+			"144.0000 72.0000", []string{"/Width 300 /Height 150", "/ColorSpace /DeviceGray", "/BitsPerComponent 8", "/FlateDecode"},
+			gray.Pix, true, nil},
+		{"alpha", func(p *PDFWriter) error { return p.AddImage(nrgba, 0, nil) },
+			"0.4800 0.2400", []string{"/ColorSpace /DeviceRGB", "/BitsPerComponent 8", "/SMask"},
+			[]byte{10, 20, 30, 40, 50, 60}, true, []byte{255, 128}},
+		{"16 bits", func(p *PDFWriter) error { return p.AddImage(gray16, 72, nil) },
+			"2.0000 1.0000", []string{"/ColorSpace /DeviceGray", "/BitsPerComponent 16"},
+			gray16.Pix, true, nil},
+		{"jpeg", func(p *PDFWriter) error { return p.AddJPEG(jpg.Bytes(), 600) },
+			"7.2000 3.6000", []string{"/Width 60 /Height 30", "/ColorSpace /DeviceRGB", "/DCTDecode"},
+			jpg.Bytes(), false, nil},
+	}
+
+	var doc bytes.Buffer
+	p := NewPDFWriter(&doc)
+	for _, tt := range tests {
+		if err := tt.add(p); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	objs := pdfObjects(t, doc.Bytes())
+
+	ref := func(obj []byte, key string) int {
+		m := regexp.MustCompile(key + ` (\d+) 0 R`).FindSubmatch(obj)
+		if m == nil {
+			t.Fatalf("no %s in %q", key, obj)
+		}
+		n, _ := strconv.Atoi(string(m[1]))
+		return n
+	}
+	pages := objs[ref(objs[1], "/Pages")]
+	kids := regexp.MustCompile(`(\d+) 0 R`).FindAllSubmatch(pages, -1)
+	if len(kids) != len(tests) || !bytes.Contains(pages, []byte(fmt.Sprintf("/Count %d", len(tests)))) {
+		t.Fatalf("pages %q, want %d", pages, len(tests))
+	}
+	for i, tt := range tests {
+		n, _ := strconv.Atoi(string(kids[i][1]))
+		page := objs[n]
+		if !bytes.Contains(page, []byte("/MediaBox [0 0 "+tt.media+"]")) {
+			t.Errorf("%s: page %q, want it %s points", tt.name, page, tt.media)
+		}
+		dict, data := pdfStream(t, objs[ref(page, "/Im0")])
+		for _, s := range tt.dict {
+			if !strings.Contains(dict, s) {
+				t.Errorf("%s: image %q without %s", tt.name, dict, s)
+			}
+		}
+		if tt.inflate {
+			var err error
+			if data, err = inflate(data); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: samples %x, want %x", tt.name, data[:min(len(data), 32)], tt.data[:min(len(tt.data), 32)])
+		}
+		if tt.alpha != nil {
+			_, alpha := pdfStream(t, objs[ref([]byte(dict), "/SMask")])
+			if alpha, err := inflate(alpha); err != nil || !bytes.Equal(alpha, tt.alpha) {
+				t.Errorf("%s: alpha %x, %v, want %x", tt.name, alpha, err, tt.alpha)
+			}
+		}
+	}
+}
+
+func TestPDFWriterEmpty(t *testing.T) {
+	p := NewPDFWriter(new(bytes.Buffer))
+	if err := p.AddImage(image.NewGray(image.Rectangle{}), 0, nil); err == nil {
+		t.Error("no error for an empty image")
+	}
+	if err := p.Close(); err == nil {
+		t.Error("no error for a PDF without pages")
+	}
+	if err := NewPDFWriter(new(bytes.Buffer)).AddJPEG([]byte("\x89PNG\r\n\x1a\n"), 0); err == nil {
+		t.Error("no error for a JPEG that isn't one")
+	}
+}
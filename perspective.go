@@ -0,0 +1,132 @@
+package autocrop
+
+// perspective.go contains the detection of keystone distortion, where the
+// page is a trapezoid rather than a rotated rectangle.
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// keystoneAngle is how far (in radians) opposite sides of the page may be
+// from parallel before the page is corrected for perspective rather than just
+// rotated.
+const keystoneAngle = 0.5 * math.Pi / 180
+
+// keystone finds the corners of the page in a dx×dy image where the lines
+// fitted to its sides meet, and sets Perspective if the opposite sides aren't
+// parallel. It needs edges on all four sides.
+func (t *Transform) keystone(dx, dy int, sides *[4]side) {
+	if t.Sides != AllSides {
+		return
+	}
+	for i, c := range t.Coverage {
+		if c < minCoverage || sides[i].found < minSamples {
+			return
+		}
+	}
+
+	top, right, bottom, left := sideLines(dx, dy, sides)
+
+	corner := func(horiz, vert [2]float64) image.Point {
+		x := (vert[0] + vert[1]*horiz[0]) / (1 - vert[1]*horiz[1])
+		y := horiz[0] + horiz[1]*x
+		return image.Pt(int(math.Round(x)), int(math.Round(y)))
+	}
+	t.Corners = [4]image.Point{
+		corner(top, left),
+		corner(top, right),
+		corner(bottom, right),
+		corner(bottom, left),
+	}
+
+	t.Perspective = math.Abs(math.Atan(top[1])-math.Atan(bottom[1])) > keystoneAngle ||
+		math.Abs(math.Atan(left[1])-math.Atan(right[1])) > keystoneAngle
+}
+
+// sideLines returns the lines fitted to the sides of a dx×dy image in its
+// coordinates. The top and bottom are lines y = a + b*x, the left and right
+// are lines x = c + d*y, given as {a, b} and {c, d}.
+func sideLines(dx, dy int, sides *[4]side) (top, right, bottom, left [2]float64) {
+	// Each side's slope is of its distance from the edge of the image, so it
+	// changes sign on the far sides.
+	w, h := float64(dx)/2, float64(dy)/2
+	top = [2]float64{float64(sides[0].crop) - sides[0].slope*w, sides[0].slope}
+	right = [2]float64{float64(dx-sides[1].crop) + sides[1].slope*h, -sides[1].slope}
+	bottom = [2]float64{float64(dy-sides[2].crop) + sides[2].slope*w, -sides[2].slope}
+	left = [2]float64{float64(sides[3].crop) - sides[3].slope*h, sides[3].slope}
+	return
+}
+
+// perspectiveString returns the ImageMagick flags that map the corners of the
+// page onto a rectangle and crop to it.
+func (t *Transform) perspectiveString(f NumberFormat) string {
+	c, dst, r := t.perspectiveRect()
+	pairs := make([]string, 4)
+	for i := range pairs {
+		pairs[i] = f.point(c[i]) + " " + f.point(dst[i])
+	}
+	return fmt.Sprintf("-distort Perspective '%s' -crop %s", strings.Join(pairs, " "), f.geometry(r))
+}
+
+// perspectiveRect returns the corners of the page, the corners of the
+// rectangle r they are mapped onto, and r. The rectangle is as big as the
+// average of the opposite sides of the page and shares its top left corner.
+func (t *Transform) perspectiveRect() (c, dst [4]image.Point, r image.Rectangle) {
+	c = t.Corners
+	length := func(p, q image.Point) float64 {
+		return math.Hypot(float64(q.X-p.X), float64(q.Y-p.Y))
+	}
+	w := int(math.Round((length(c[0], c[1]) + length(c[3], c[2])) / 2))
+	h := int(math.Round((length(c[0], c[3]) + length(c[1], c[2])) / 2))
+
+	r = image.Rectangle{c[0], c[0].Add(image.Pt(w, h))}
+	dst = [4]image.Point{r.Min, image.Pt(r.Max.X, r.Min.Y), r.Max, image.Pt(r.Min.X, r.Max.Y)}
+	return c, dst, r
+}
+
+// homography returns the projective map that takes the points from onto the
+// points to.
+func homography(from, to [4]image.Point) Mapping {
+	// Solve for h in
+	//   X = (h0 x + h1 y + h2) / (h6 x + h7 y + 1)
+	//   Y = (h3 x + h4 y + h5) / (h6 x + h7 y + 1)
+	// by Gaussian elimination, two equations per point.
+	var m [8][9]float64
+	for i := range from {
+		x, y := float64(from[i].X), float64(from[i].Y)
+		X, Y := float64(to[i].X), float64(to[i].Y)
+		m[2*i] = [9]float64{x, y, 1, 0, 0, 0, -x * X, -y * X, X}
+		m[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -x * Y, -y * Y, Y}
+	}
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		for row := 0; row < 8; row++ {
+			if row == col || m[col][col] == 0 {
+				continue
+			}
+			k := m[row][col] / m[col][col]
+			for j := col; j < 9; j++ {
+				m[row][j] -= k * m[col][j]
+			}
+		}
+	}
+	var h [8]float64
+	for i := range h {
+		h[i] = m[i][8] / m[i][i]
+	}
+
+	return Mapping{
+		{h[0], h[1], h[2]},
+		{h[3], h[4], h[5]},
+		{h[6], h[7], 1},
+	}
+}
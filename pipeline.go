@@ -0,0 +1,177 @@
+package autocrop
+
+// pipeline.go contains Pipeline, which runs a batch of pages, like the scans
+// of a book, through decoding, analysis and encoding at once, so that reading
+// and writing the files overlaps with the analysis instead of waiting on it.
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"sync"
+)
+
+// Pipeline analyzes a batch of image files in three stages that run at the
+// same time, each on goroutines of its own: one decodes the files, one
+// analyzes the pages decoded, and Encoders hand the pages analyzed to Encode.
+// So while a page is analyzed, the next is read and decoded and the last ones
+// are written. The stages are joined by channels that hold Depth pages each,
+// so that decoding runs only so far ahead of the rest: with an Encode, up to
+// 2+2×Depth+Encoders decoded images are held at once, instead of one.
+type Pipeline struct {
+	// Options are the options of the analysis of every page. The EXIF
+	// orientation and resolution of each file are added as AnalyzeAll adds
+	// them.
+	Options Options
+
+	// Encode, if not nil, is called with every page once it is analyzed.
+	// It is where the pages are usually cropped and written.
+	Encode func(p *Page) error
+
+	// Encoders is how many pages Encode is called with at once, each by a
+	// goroutine of its own. Zero means 1, which calls it in the order of the
+	// files and of their frames; with more, the pages are taken in that
+	// order, but may be finished in any.
+	Encoders int
+
+	// Depth is how many pages may wait between two stages. Zero means 1.
+	Depth int
+}
+
+// Page is a page on its way through a Pipeline.
+type Page struct {
+	Name      string // of the file
+	Frame     int    // the index of the page among the frames of the file, or -1 if it has only one
+	Image     image.Image
+	Transform *Transform
+}
+
+// pipelinePage is a decoded Page with the options of its analysis.
+type pipelinePage struct {
+	Page
+	opts Options
+}
+
+// Run runs the named files, opened with Open, through the pipeline, and
+// returns their pages in order, with their Transforms but without their
+// Images, which are let go of as soon as each page is through. Each frame of
+// a file of several is a page. The images are decoded whole only if there is an Encode
+// to take them; otherwise the pages of a TIFF are decoded as AnalyzeAll
+// decodes them. Run stops at the first error, of decoding or analyzing a file,
+// which the error names, or of Encode, which is returned as it is.
+func (p *Pipeline) Run(names []string) ([]*Page, error) {
+	depth := p.Depth
+	if depth <= 0 {
+		depth = 1
+	}
+	var (
+		once  sync.Once
+		first error
+		done  = make(chan struct{})
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			first = err
+			close(done)
+		})
+	}
+
+	decoded := make(chan *pipelinePage, depth)
+	go func() {
+		defer close(decoded)
+		for _, name := range names {
+			frames, opts, err := p.decode(name)
+			if err != nil {
+				fail(fmt.Errorf("autocrop: %s: %w", name, err))
+				return
+			}
+			for i, img := range frames {
+				pp := &pipelinePage{Page{Name: name, Frame: -1, Image: img}, opts}
+				if len(frames) > 1 {
+					pp.Frame = i
+				}
+				select {
+				case decoded <- pp:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	analyzed := make(chan *Page, depth)
+	for i := 0; p.Encode != nil && i < max(p.Encoders, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pg := range analyzed {
+				select {
+				case <-done:
+					return // another page failed
+				default:
+				}
+				if err := p.Encode(pg); err != nil {
+					fail(err)
+					return
+				}
+				pg.Image = nil
+			}
+		}()
+	}
+
+	var pages []*Page
+analysis:
+	for pp := range decoded {
+		t, err := analyzeLazily(pp.Image, pp.opts)
+		if err != nil {
+			name := pp.Name
+			if pp.Frame >= 0 {
+				name = fmt.Sprintf("%s frame %d", name, pp.Frame+1)
+			}
+			fail(fmt.Errorf("autocrop: %s: %w", name, err))
+			break
+		}
+		pp.Transform = t
+		pages = append(pages, &pp.Page)
+		if p.Encode == nil {
+			pp.Image = nil
+			continue
+		}
+		select {
+		case analyzed <- &pp.Page:
+		case <-done:
+			break analysis
+		}
+	}
+	close(analyzed)
+	wg.Wait()
+	for range decoded {
+		// until the decoding stops too
+	}
+
+	if first != nil {
+		return nil, first
+	}
+	return pages, nil
+}
+
+// decode decodes the frames of the named file for Run, and returns them with
+// the options of their analysis.
+func (p *Pipeline) decode(name string) (frames []image.Image, opts Options, err error) {
+	opts = p.Options
+	if opts.Hardened {
+		defer func() {
+			if v := recover(); v != nil {
+				frames, err = nil, recovered(v, opts.Logger)
+			}
+		}()
+	}
+	file, err := Open(name)
+	if err != nil {
+		return nil, opts, err
+	}
+	defer file.Close()
+	frames, _, err = decodeAll(bufio.NewReaderSize(file, exifPeek), &opts, p.Encode == nil)
+	return frames, opts, err
+}
@@ -0,0 +1,263 @@
+package autocrop
+
+// pnm.go contains a decoder for the netpbm formats (PBM, PGM and PPM, plain
+// and raw), which scanimage and other SANE frontends write by default.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+func init() {
+	for _, f := range []struct{ name, magic string }{
+		{"pbm", "P1"}, {"pbm", "P4"},
+		{"pgm", "P2"}, {"pgm", "P5"},
+		{"ppm", "P3"}, {"ppm", "P6"},
+	} {
+		image.RegisterFormat(f.name, f.magic, decodePNM, decodePNMConfig)
+	}
+}
+
+// pnmHeader is the header of a netpbm image. maxval is 1 for bitmaps.
+type pnmHeader struct {
+	kind          byte // the digit after the P
+	width, height int
+	maxval        int
+}
+
+// raw reports whether the samples are binary rather than decimal text.
+func (h *pnmHeader) raw() bool {
+	return h.kind >= '4'
+}
+
+// channels returns the number of samples per pixel.
+func (h *pnmHeader) channels() int {
+	if h.kind == '3' || h.kind == '6' {
+		return 3
+	}
+	return 1
+}
+
+func readPNMHeader(r *bufio.Reader) (*pnmHeader, error) {
+	var magic [2]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic[0] != 'P' || magic[1] < '1' || magic[1] > '6' {
+		return nil, fmt.Errorf("autocrop: not a netpbm image")
+	}
+	h := &pnmHeader{kind: magic[1], maxval: 1}
+	var err error
+	if h.width, err = pnmInt(r); err != nil {
+		return nil, err
+	}
+	if h.height, err = pnmInt(r); err != nil {
+		return nil, err
+	}
+	if h.kind != '1' && h.kind != '4' {
+		if h.maxval, err = pnmInt(r); err != nil {
+			return nil, err
+		}
+	}
+	if h.width <= 0 || h.height <= 0 || h.maxval <= 0 || h.maxval > 0xffff {
+		return nil, fmt.Errorf("autocrop: invalid netpbm header %dx%d, maxval %d", h.width, h.height, h.maxval)
+	}
+	if int64(h.width)*int64(h.height)*int64(h.channels()) > 1<<31 {
+		return nil, fmt.Errorf("autocrop: netpbm image %dx%d is too large", h.width, h.height)
+	}
+	return h, nil
+}
+
+// pnmInt reads a decimal number, skipping the whitespace and comments before
+// it and consuming the one whitespace character after it, which in a raw
+// image is all there is between the header and the samples.
+func pnmInt(r *bufio.Reader) (int, error) {
+	c, err := pnmSkip(r)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for ; c >= '0' && c <= '9'; c, err = r.ReadByte() {
+		if n = 10*n + int(c-'0'); n > 1<<30 {
+			return 0, fmt.Errorf("autocrop: netpbm number out of range")
+		}
+	}
+	if err == io.EOF {
+		return n, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !pnmSpace(c) {
+		return 0, fmt.Errorf("autocrop: unexpected %q in netpbm image", c)
+	}
+	return n, nil
+}
+
+// pnmSkip skips whitespace and comments, and returns the byte after them.
+func pnmSkip(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		switch {
+		case c == '#':
+			if _, err := r.ReadString('\n'); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+		case !pnmSpace(c):
+			return c, nil
+		}
+	}
+}
+
+func pnmSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func decodePNMConfig(r io.Reader) (image.Config, error) {
+	h, err := readPNMHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	c := image.Config{Width: h.width, Height: h.height}
+	switch {
+	case h.channels() == 3 && h.maxval > 0xff:
+		c.ColorModel = color.RGBA64Model
+	case h.channels() == 3:
+		c.ColorModel = color.RGBAModel
+	case h.maxval > 0xff:
+		c.ColorModel = color.Gray16Model
+	default:
+		c.ColorModel = color.GrayModel
+	}
+	return c, nil
+}
+
+// decodePNM decodes a netpbm image into an *image.Gray or *image.RGBA, or
+// their 16-bit counterparts if the maxval needs more than 8 bits. Samples
+// are scaled from 0..maxval to the full range.
+func decodePNM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readPNMHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	rect := image.Rect(0, 0, h.width, h.height)
+	if h.kind == '1' || h.kind == '4' {
+		return decodePBM(br, h, rect)
+	}
+
+	wide := h.maxval > 0xff
+	top := 0xff
+	if wide {
+		top = 0xffff
+	}
+	samples := make([]uint16, h.width*h.height*h.channels())
+	if h.raw() {
+		size := 1
+		if wide {
+			size = 2
+		}
+		buf := make([]byte, len(samples)*size)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			if wide {
+				samples[i] = binary.BigEndian.Uint16(buf[2*i:])
+			} else {
+				samples[i] = uint16(buf[i])
+			}
+		}
+	} else {
+		for i := range samples {
+			v, err := pnmInt(br)
+			if err != nil {
+				return nil, err
+			}
+			samples[i] = uint16(min(v, h.maxval))
+		}
+	}
+	if h.maxval != top {
+		for i, v := range samples {
+			samples[i] = uint16((min(int(v), h.maxval)*top + h.maxval/2) / h.maxval)
+		}
+	}
+
+	switch {
+	case h.channels() == 1 && !wide:
+		img := image.NewGray(rect)
+		for i, v := range samples {
+			img.Pix[i] = uint8(v)
+		}
+		return img, nil
+	case h.channels() == 1:
+		img := image.NewGray16(rect)
+		for i, v := range samples {
+			binary.BigEndian.PutUint16(img.Pix[2*i:], v)
+		}
+		return img, nil
+	case !wide:
+		img := image.NewRGBA(rect)
+		for i := 0; i < h.width*h.height; i++ {
+			img.Pix[4*i+0] = uint8(samples[3*i+0])
+			img.Pix[4*i+1] = uint8(samples[3*i+1])
+			img.Pix[4*i+2] = uint8(samples[3*i+2])
+			img.Pix[4*i+3] = 0xff
+		}
+		return img, nil
+	}
+	img := image.NewRGBA64(rect)
+	for i := 0; i < h.width*h.height; i++ {
+		for k := 0; k < 3; k++ {
+			binary.BigEndian.PutUint16(img.Pix[8*i+2*k:], samples[3*i+k])
+		}
+		img.Pix[8*i+6], img.Pix[8*i+7] = 0xff, 0xff
+	}
+	return img, nil
+}
+
+// decodePBM decodes the bitmap of a PBM, in which 1 is black.
+func decodePBM(r *bufio.Reader, h *pnmHeader, rect image.Rectangle) (image.Image, error) {
+	img := image.NewGray(rect)
+	for y := 0; y < h.height; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+h.width]
+		if h.raw() {
+			// rows are packed 8 pixels to a byte, padded to whole bytes
+			packed := make([]byte, (h.width+7)/8)
+			if _, err := io.ReadFull(r, packed); err != nil {
+				return nil, err
+			}
+			for x := range row {
+				if packed[x/8]&(0x80>>uint(x%8)) == 0 {
+					row[x] = 0xff
+				}
+			}
+			continue
+		}
+		// plain bits need no whitespace between them
+		for x := range row {
+			c, err := pnmSkip(r)
+			if err != nil {
+				return nil, err
+			}
+			switch c {
+			case '0':
+				row[x] = 0xff
+			case '1':
+			default:
+				return nil, fmt.Errorf("autocrop: unexpected %q in netpbm bitmap", c)
+			}
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,72 @@
+package autocrop
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestDecodePNM(t *testing.T) {
+	gray := func(w, h int, pix ...uint8) image.Image {
+		return &image.Gray{Pix: pix, Stride: w, Rect: image.Rect(0, 0, w, h)}
+	}
+	tests := []struct {
+		name  string
+		data  string
+		want  image.Image
+		model color.Model
+	}{
+		{"plain bitmap", "P1\n# scanimage\n3 2\n1 0 1\n010\n", gray(3, 2, 0, 255, 0, 255, 0, 255), color.GrayModel},
+		{"raw bitmap", "P4\n3 2\n\xa0\x40", gray(3, 2, 0, 255, 0, 255, 0, 255), color.GrayModel},
+		{"plain graymap", "P2 3 1 4\n0 2 4\n", gray(3, 1, 0, 128, 255), color.GrayModel},
+		{"raw graymap", "P5 2 1 255\n\x07\xc8", gray(2, 1, 7, 200), color.GrayModel},
+		{"16-bit graymap", "P5 2 1 65535\n\x12\x34\xff\xfe", &image.Gray16{
+			Pix: []uint8{0x12, 0x34, 0xff, 0xfe}, Stride: 4, Rect: image.Rect(0, 0, 2, 1),
+		}, color.Gray16Model},
+		{"plain pixmap", "P3 1 1 255 1 2 3", &image.RGBA{
+			Pix: []uint8{1, 2, 3, 255}, Stride: 4, Rect: image.Rect(0, 0, 1, 1),
+		}, color.RGBAModel},
+		{"raw pixmap", "P6\n# comment\n1 1\n255\n\x0a\x14\x1e", &image.RGBA{
+			Pix: []uint8{10, 20, 30, 255}, Stride: 4, Rect: image.Rect(0, 0, 1, 1),
+		}, color.RGBAModel},
+		{"12-bit pixmap", "P6 1 1 4095\n\x0f\xff\x00\x00\x08\x00", &image.RGBA64{
+			Pix: []uint8{0xff, 0xff, 0, 0, 0x80, 0x08, 0xff, 0xff}, Stride: 8, Rect: image.Rect(0, 0, 1, 1),
+		}, color.RGBA64Model},
+	}
+	for _, tt := range tests {
+		c, format, err := image.DecodeConfig(bytes.NewReader([]byte(tt.data)))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if b := tt.want.Bounds(); c.Width != b.Dx() || c.Height != b.Dy() || c.ColorModel != tt.model {
+			t.Errorf("%s: %s config %dx%d, want %v", tt.name, format, c.Width, c.Height, b)
+		}
+		img, _, err := image.Decode(bytes.NewReader([]byte(tt.data)))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(img, tt.want) {
+			t.Errorf("%s: decoded %#v, want %#v", tt.name, img, tt.want)
+		}
+	}
+}
+
+func TestDecodePNMInvalid(t *testing.T) {
+	for _, s := range []string{
+		"P7 1 1 255\n\x00",
+		"P5 0 1 255\n",
+		"P5 1 1 0\n\x00",
+		"P5 1 1 65536\n\x00\x00",
+		"P5 2 2 255\n\x00",
+		"P2 2 1 255\n1",
+		"P1 2 1\n1 2",
+		"P2 1 1 255\nx",
+		"P5 70000 70000 255\n",
+	} {
+		if _, err := decodePNM(bytes.NewReader([]byte(s))); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package autocrop
+
+// policy.go contains the interface for deciding whether the result of an
+// analysis can be trusted.
+
+import (
+	"fmt"
+	"math"
+)
+
+// Decision is what should be done with the result of an analysis.
+type Decision int
+
+const (
+	Accept Decision = iota // apply it without looking
+	Review                 // have a human look at it first
+	Reject                 // don't apply it
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Accept:
+		return "accept"
+	case Review:
+		return "review"
+	case Reject:
+		return "reject"
+	}
+	return fmt.Sprintf("Decision(%d)", int(d))
+}
+
+// Policy decides what to do with the result of an analysis. Implement it to
+// encode your own acceptance rules, e.g. "reject if any side's crop interval
+// is wider than 10 px":
+//
+//	autocrop.PolicyFunc(func(t *autocrop.Transform) autocrop.Decision {
+//		for _, e := range t.CropErr {
+//			if e > 10 {
+//				return autocrop.Reject
+//			}
+//		}
+//		return autocrop.Accept
+//	})
+type Policy interface {
+	Decide(t *Transform) Decision
+}
+
+// PolicyFunc adapts an ordinary function to a Policy.
+type PolicyFunc func(t *Transform) Decision
+
+// Decide calls f(t).
+func (f PolicyFunc) Decide(t *Transform) Decision {
+	return f(t)
+}
+
+// Thresholds is a Policy that accepts a Transform if it stays within all of
+// the limits that are set, i.e. nonzero. A Transform that falls outside of any
+// Review limit needs review, and one outside of any Reject limit is rejected.
+// Transforms that cut through ink (see Options.Overcrop) need review.
+// Transforms with no border are always accepted, since they don't change the
+// image.
+type Thresholds struct {
+	Review, Reject Limits
+}
+
+// Limits are the bounds on the quality of a Transform used by Thresholds.
+type Limits struct {
+	MinConfidence   float64 // lowest r^2 of any side
+	MaxAngleErr     float64 // widest angle interval, in radians
+	MaxCropErr      float64 // widest crop interval of any side, in pixels
+	MaxDisagreement float64 // largest difference between angle estimates, in radians
+}
+
+// DefaultPolicy is the Policy used by the command line tool.
+var DefaultPolicy Policy = Thresholds{
+	Review: Limits{MinConfidence: 0.8, MaxAngleErr: 0.1 * math.Pi / 180, MaxCropErr: 4},
+	Reject: Limits{MinConfidence: 0.5, MaxAngleErr: 1 * math.Pi / 180, MaxCropErr: 20},
+}
+
+// Decide implements Policy.
+func (p Thresholds) Decide(t *Transform) Decision {
+	switch {
+	case t.NoBorder:
+		return Accept
+	case !p.Reject.within(t):
+		return Reject
+	case !p.Review.within(t), t.Overcrop != 0:
+		return Review
+	}
+	return Accept
+}
+
+// within reports whether t is within the limits. NaNs are never within any
+// limit.
+func (l *Limits) within(t *Transform) bool {
+	if l.MinConfidence != 0 {
+		for i, c := range t.Confidence {
+			if t.Sides.Has(i) && !(c >= l.MinConfidence) {
+				return false
+			}
+		}
+	}
+	if l.MaxAngleErr != 0 && !(t.AngleErr <= l.MaxAngleErr) {
+		return false
+	}
+	if l.MaxCropErr != 0 {
+		for i, e := range t.CropErr {
+			if t.Sides.Has(i) && !(e <= l.MaxCropErr) {
+				return false
+			}
+		}
+	}
+	if l.MaxDisagreement != 0 && !(t.Disagreement() <= l.MaxDisagreement) {
+		return false
+	}
+	return true
+}
+
+// Thresholds on Score. A page that scores at least ScoreSafe can be applied
+// without looking, one below ScoreReview has almost certainly failed, and
+// those in between are worth a look.
+const (
+	ScoreSafe   = 0.85
+	ScoreReview = 0.5
+)
+
+const (
+	// agreeAngle is the difference in angle (in radians) between opposite
+	// sides of a page at which Score halves its agreement term.
+	agreeAngle = 0.5 * math.Pi / 180
+
+	// tightCrop is the crop interval (in pixels) at which a side that r^2
+	// doesn't vouch for counts as half confident.
+	tightCrop = 0.25
+)
+
+// Score rates how far t can be trusted, from 0 (not at all) to 1, in a single
+// number: the product of the mean confidence of the fitted sides, the mean
+// fraction of samples on them that found an edge, and how well opposite sides
+// agree on the angle.
+//
+// The r^2 of a side that is already level is close to 0 however well its line
+// fits, since there is no slope to explain, so a side is as confident as the
+// larger of its r^2 and how narrow its crop interval is. Pages with no
+// opposite sides fitted can't be checked for agreement and lose a quarter of
+// their score; pages corrected for perspective are not expected to agree and
+// aren't. A page with no border scores 0, even if leaving it alone is right.
+// See ScoreSafe and ScoreReview.
+func (t *Transform) Score() float64 {
+	var conf, cover float64
+	n := 0
+	for i := range t.Confidence {
+		if t.Fitted.Has(i) {
+			e := t.CropErr[i] / tightCrop
+			conf += math.Max(math.Min(math.Max(t.Confidence[i], 0), 1), 1/(1+e*e))
+			cover += t.Coverage[i]
+			n++
+		}
+	}
+	if t.NoBorder || n == 0 {
+		return 0
+	}
+	conf /= float64(n)
+	cover /= float64(n)
+
+	agree, pairs := 0.0, 0
+	for i := 0; i < 2; i++ {
+		if t.Fitted.Has(i) && t.Fitted.Has(i+2) {
+			d := (t.SideAngles[i] - t.SideAngles[i+2]) / agreeAngle
+			agree += 1 / (1 + d*d)
+			pairs++
+		}
+	}
+	switch {
+	case t.Perspective:
+		agree = 1
+	case pairs == 0:
+		agree = 0.75
+	default:
+		agree /= float64(pairs)
+	}
+
+	score := conf * cover * agree
+	if math.IsNaN(score) {
+		return 0
+	}
+	return score
+}
+
+// ScorePolicy is a Policy that decides by Score alone.
+var ScorePolicy Policy = PolicyFunc(func(t *Transform) Decision {
+	switch s := t.Score(); {
+	case t.NoBorder || s >= ScoreSafe:
+		return Accept
+	case s >= ScoreReview:
+		return Review
+	}
+	return Reject
+})
@@ -0,0 +1,156 @@
+package autocrop
+
+// projection.go contains the projection profile deskew, which estimates the
+// skew from the text lines on the page.
+
+import (
+	"image"
+	"math"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+const (
+	// projMaxAngle is the largest skew (in radians) the projection profile
+	// deskew will consider.
+	projMaxAngle = 5 * math.Pi / 180
+	// projStep is the coarse angular step of the search. It is refined by a
+	// factor of ten around the best coarse angle.
+	projStep = 0.2 * math.Pi / 180
+	// projErr is the half width of the interval the angle is known to, which
+	// is just the resolution of the search.
+	projErr = projStep / 20
+	// projPixels is the rough number of pixels along the longer side of the
+	// page that are looked at.
+	projPixels = 800
+)
+
+// projectionAngle estimates the rotation that makes the text lines inside
+// t.Bounds horizontal. For each candidate angle, the ink pixels of the page
+// are projected onto the vertical axis of the rotated frame. When the text
+// lines are level, the profile alternates between dense lines and empty
+// leading, so its variance is largest.
+//
+// confidence is between 0 and 1, and says how much the best angle stands out
+// from the others.
+func (a *analysis) projectionAngle(t *Transform) (angle, confidence float64) {
+	// Stay clear of the background in the corners of a tilted page.
+	r := t.Bounds
+	r = r.Inset(int(float64(max(r.Dx(), r.Dy()))*math.Sin(projMaxAngle)/2) + 4)
+	if r.Empty() {
+		return 0, 0
+	}
+
+	p := a.project(r)
+	if len(p.xs) == 0 {
+		return 0, 0
+	}
+	return p.search()
+}
+
+// projector projects a set of ink pixels onto the vertical axis of a
+// rotated frame.
+type projector struct {
+	xs, ys []float64 // coordinates of the ink pixels
+	step   int       // sampling step, which is also the bin height
+	offset float64   // keeps every rotated y coordinate positive
+	bins   []float64
+}
+
+// project collects the ink pixels of r, looking at every step-th pixel of
+// every step-th row so that about projPixels are looked at along the longer
+// side.
+func (a *analysis) project(r image.Rectangle) *projector {
+	p := &projector{step: max(1, max(r.Dx(), r.Dy())/projPixels)}
+	for y := r.Min.Y; y < r.Max.Y; y += p.step {
+		for x := r.Min.X; x < r.Max.X; x += p.step {
+			if a.ink(x, y) && !a.excluded(image.Rect(x, y, x+1, y+1)) {
+				p.xs = append(p.xs, float64(x-r.Min.X))
+				p.ys = append(p.ys, float64(y-r.Min.Y))
+			}
+		}
+	}
+
+	// there need to be enough bins for any rotated point
+	p.bins = make([]float64, (r.Dx()+r.Dy())/p.step+2)
+	p.offset = float64(r.Dx())*math.Sin(projMaxAngle+projStep) + 1
+	return p
+}
+
+// profile returns the projection profile of the ink rotated by theta. It is
+// only valid until the next call.
+func (p *projector) profile(theta float64) []float64 {
+	for i := range p.bins {
+		p.bins[i] = 0
+	}
+	sin, cos := math.Sincos(theta)
+	for i := range p.xs {
+		yr := p.xs[i]*sin + p.ys[i]*cos + p.offset
+		p.bins[int(yr)/p.step]++
+	}
+	return p.bins
+}
+
+// score is proportional to the variance of the profile at theta, since the
+// amount of ink is the same at every angle.
+func (p *projector) score(theta float64) float64 {
+	sum := 0.
+	for _, b := range p.profile(theta) {
+		sum += b * b
+	}
+	return sum
+}
+
+// search finds the angle with the best score, first coarsely and then finely
+// around the best coarse angle.
+func (p *projector) search() (angle, confidence float64) {
+	var (
+		best  = math.Inf(-1)
+		total float64
+		count int
+	)
+	for theta := -projMaxAngle; theta <= projMaxAngle; theta += projStep {
+		s := p.score(theta)
+		total += s
+		count++
+		if s > best {
+			best, angle = s, theta
+		}
+	}
+	coarse := angle
+	for theta := coarse - projStep; theta <= coarse+projStep; theta += projStep / 10 {
+		if s := p.score(theta); s > best {
+			best, angle = s, theta
+		}
+	}
+
+	confidence = 1 - total/float64(count)/best
+	return
+}
+
+// fuse combines the border angle already in t with the projection profile
+// estimate, weighted by their confidences. Both estimates are recorded in t.
+// If t has no border, the projection profile estimate is used alone.
+func (a *analysis) fuse(t *Transform) {
+	t.Estimates = t.Estimates[:0]
+	errs := []float64{}
+	if !t.NoBorder {
+		t.Estimates = append(t.Estimates, Estimate{Border, t.Angle, util.Mean(t.Confidence[:]...)})
+		errs = append(errs, t.AngleErr)
+	}
+	angle, confidence := a.projectionAngle(t)
+	t.Estimates = append(t.Estimates, Estimate{Projection, angle, confidence})
+	errs = append(errs, projErr)
+
+	var sum, angleErr, weights float64
+	for i, e := range t.Estimates {
+		w := math.Max(e.Confidence, 0)
+		sum += w * e.Angle
+		angleErr += w * errs[i]
+		weights += w
+	}
+	if weights > 0 {
+		t.Angle = sum / weights
+		t.AngleErr = angleErr / weights
+	}
+}
@@ -0,0 +1,308 @@
+package autocrop
+
+// rar.go contains the reading of RAR archives, which many comic libraries are
+// kept in as CBR files. The headers of RAR 4 and RAR 5 archives are read
+// here, and so are the files stored in them uncompressed; compressed files
+// are extracted by unrar or bsdtar, whichever is installed, since RAR's
+// compression is proprietary.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// rarFile is a file in a RAR archive.
+type rarFile struct {
+	name       string
+	offset     int64 // of its data
+	size       int64 // of its data
+	stored     bool  // rather than compressed
+	dir, split bool
+	encrypted  bool
+}
+
+// rarArchive is a RAR archive.
+type rarArchive struct {
+	name  string
+	f     *os.File
+	files []rarFile
+}
+
+func openRAR(name string) (archive, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &rarArchive{name: name, f: f}
+	br := bufio.NewReader(f)
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(br, sig[:7]); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("autocrop: %s is not a RAR archive", name)
+	}
+	switch {
+	case string(sig[:7]) == "Rar!\x1a\x07\x00":
+		err = r.readRAR4(br, 7)
+	case string(sig[:7]) == "Rar!\x1a\x07\x01":
+		if _, err = io.ReadFull(br, sig[7:]); err == nil {
+			err = r.readRAR5(br, 8)
+		}
+	default:
+		err = fmt.Errorf("autocrop: %s is not a RAR archive", name)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// readRAR4 reads the headers of a RAR 4 archive from br, which is at offset
+// off of it.
+func (r *rarArchive) readRAR4(br *bufio.Reader, off int64) error {
+	le := binary.LittleEndian
+	for {
+		// CRC, type, flags and size, and the size of the data if any
+		head := make([]byte, 7)
+		if _, err := io.ReadFull(br, head); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("autocrop: %s: %v", r.name, err)
+		}
+		typ, flags, size := head[2], le.Uint16(head[3:]), int(le.Uint16(head[5:]))
+		if size < 7 {
+			return fmt.Errorf("autocrop: %s: bad header", r.name)
+		}
+		rest := make([]byte, size-7)
+		if _, err := io.ReadFull(br, rest); err != nil {
+			return fmt.Errorf("autocrop: %s: %v", r.name, err)
+		}
+		var data int64
+		if flags&0x8000 != 0 && len(rest) >= 4 {
+			data = int64(le.Uint32(rest))
+		}
+
+		switch typ {
+		case 0x73: // the archive
+			if flags&0x80 != 0 {
+				return fmt.Errorf("autocrop: %s has encrypted headers", r.name)
+			}
+		case 0x74: // a file
+			if len(rest) < 25 {
+				return fmt.Errorf("autocrop: %s: bad file header", r.name)
+			}
+			data = int64(le.Uint32(rest))
+			n := int(le.Uint16(rest[19:]))
+			name := rest[25:]
+			if flags&0x100 != 0 && len(name) >= 8 {
+				// the high halves of the sizes
+				data |= int64(le.Uint32(name)) << 32
+				name = name[8:]
+			}
+			if n > len(name) {
+				return fmt.Errorf("autocrop: %s: bad file header", r.name)
+			}
+			// a Unicode name follows a zero byte after the plain one
+			name, _, _ = bytes.Cut(name[:n], []byte{0})
+			local := strings.ReplaceAll(string(name), `\`, "/")
+			if !filepath.IsLocal(local) {
+				return fmt.Errorf("autocrop: %s has a file outside of it: %s", r.name, local)
+			}
+			r.files = append(r.files, rarFile{
+				name:      local,
+				offset:    off + int64(size),
+				size:      data,
+				stored:    rest[18] == 0x30,
+				dir:       flags&0xe0 == 0xe0,
+				split:     flags&3 != 0,
+				encrypted: flags&4 != 0,
+			})
+		case 0x7b: // the end
+			return nil
+		}
+		off += int64(size) + data
+		if err := r.seek(br, off); err != nil {
+			return err
+		}
+	}
+}
+
+// readRAR5 reads the headers of a RAR 5 archive from br, which is at offset
+// off of it.
+func (r *rarArchive) readRAR5(br *bufio.Reader, off int64) error {
+	for {
+		var crc [4]byte
+		if _, err := io.ReadFull(br, crc[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("autocrop: %s: %v", r.name, err)
+		}
+		size, n := rarVint(br)
+		if n == 0 || size > 2<<20 {
+			return fmt.Errorf("autocrop: %s: bad header", r.name)
+		}
+		head := make([]byte, size)
+		if _, err := io.ReadFull(br, head); err != nil {
+			return fmt.Errorf("autocrop: %s: %v", r.name, err)
+		}
+		hr := bytes.NewReader(head)
+		typ, _ := rarVint(hr)
+		flags, _ := rarVint(hr)
+		// the data follows the header, after its CRC and size
+		dataOff := off + 4 + int64(n) + int64(size)
+		var extra, data uint64
+		if flags&1 != 0 {
+			extra, _ = rarVint(hr)
+		}
+		if flags&2 != 0 {
+			data, _ = rarVint(hr)
+		}
+
+		switch typ {
+		case 2: // a file
+			fileFlags, _ := rarVint(hr)
+			rarVint(hr) // unpacked size
+			rarVint(hr) // attributes
+			if fileFlags&2 != 0 {
+				hr.Seek(4, io.SeekCurrent) // modification time
+			}
+			if fileFlags&4 != 0 {
+				hr.Seek(4, io.SeekCurrent) // CRC
+			}
+			comp, _ := rarVint(hr)
+			rarVint(hr) // host OS
+			nameLen, _ := rarVint(hr)
+			name := make([]byte, nameLen)
+			if _, err := io.ReadFull(hr, name); err != nil {
+				return fmt.Errorf("autocrop: %s: bad file header", r.name)
+			}
+			if !filepath.IsLocal(string(name)) {
+				return fmt.Errorf("autocrop: %s has a file outside of it: %s", r.name, name)
+			}
+			r.files = append(r.files, rarFile{
+				name:      string(name),
+				offset:    dataOff,
+				size:      int64(data),
+				stored:    comp>>7&7 == 0,
+				dir:       fileFlags&1 != 0,
+				split:     flags&0x18 != 0,
+				encrypted: rarEncrypted(head[len(head)-int(min(extra, uint64(len(head)))):]),
+			})
+		case 4: // encryption of the headers
+			return fmt.Errorf("autocrop: %s has encrypted headers", r.name)
+		case 5: // the end
+			return nil
+		}
+		off = dataOff + int64(data)
+		if err := r.seek(br, off); err != nil {
+			return err
+		}
+	}
+}
+
+// seek moves br to offset off of the archive, past the data of a file rather
+// than through it.
+func (r *rarArchive) seek(br *bufio.Reader, off int64) error {
+	if _, err := r.f.Seek(off, io.SeekStart); err != nil {
+		return fmt.Errorf("autocrop: %s: %v", r.name, err)
+	}
+	br.Reset(r.f)
+	return nil
+}
+
+// rarVint reads a variable length integer of RAR 5, seven bits to a byte from
+// the lowest, and returns it with the number of bytes read, which is 0 if it
+// couldn't be.
+func rarVint(r io.ByteReader) (uint64, int) {
+	var v uint64
+	for n := 0; n < 10; n++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0
+		}
+		v |= uint64(b&0x7f) << (7 * n)
+		if b&0x80 == 0 {
+			return v, n + 1
+		}
+	}
+	return 0, 0
+}
+
+// rarEncrypted reports whether the extra area of the header of a file in a
+// RAR 5 archive has an encryption record.
+func rarEncrypted(extra []byte) bool {
+	r := bytes.NewReader(extra)
+	for r.Len() > 0 {
+		size, n := rarVint(r)
+		if n == 0 || size > uint64(r.Len()) {
+			return false
+		}
+		start := r.Len()
+		if typ, _ := rarVint(r); typ == 1 {
+			return true
+		}
+		r.Seek(int64(size)-int64(start-r.Len()), io.SeekCurrent)
+	}
+	return false
+}
+
+func (r *rarArchive) Names() []string {
+	var names []string
+	for _, f := range r.files {
+		name := f.name
+		if f.dir {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (r *rarArchive) Open(name string) (io.ReadCloser, error) {
+	for _, f := range r.files {
+		if f.name != name || f.dir {
+			continue
+		}
+		switch {
+		case f.encrypted:
+			return nil, fmt.Errorf("autocrop: %s in %s is encrypted", name, r.name)
+		case f.split:
+			return nil, fmt.Errorf("autocrop: %s in %s is split across volumes", name, r.name)
+		case f.stored:
+			return io.NopCloser(io.NewSectionReader(r.f, f.offset, f.size)), nil
+		}
+		return unrar(r.name, name)
+	}
+	return nil, fmt.Errorf("autocrop: no %s in the archive", name)
+}
+
+func (r *rarArchive) Close() error {
+	return r.f.Close()
+}
+
+// unrar extracts the file name compressed in the RAR archive arc with unrar
+// or bsdtar.
+func unrar(arc, name string) (io.ReadCloser, error) {
+	var cmd *exec.Cmd
+	if path, err := exec.LookPath("unrar"); err == nil {
+		cmd = exec.Command(path, "p", "-inul", "-@", "--", arc, name)
+	} else if path, err := exec.LookPath("bsdtar"); err == nil {
+		cmd = exec.Command(path, "-xOf", arc, name)
+	} else {
+		return nil, fmt.Errorf("autocrop: %s in %s is compressed, which takes unrar or bsdtar to extract", name, arc)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("autocrop: extracting %s from %s: %v %s", name, arc, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
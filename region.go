@@ -0,0 +1,120 @@
+package autocrop
+
+// region.go contains the analysis of part of an image.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// AnalyzeRect is like AnalyzeWith, but only looks at the part r of img, as if
+// the rest weren't there. This is for scans with more than the page in them,
+// like calibration strips or several items per frame. The Transform is in the
+// coordinates of img, turned by its Orientation, and the Mask, Exclude and
+// Hint in opts are in the coordinates of img.
+func AnalyzeRect(img image.Image, r image.Rectangle, opts Options) (*Transform, error) {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return nil, fmt.Errorf("autocrop: rectangle is outside of the image %v", img.Bounds())
+	}
+
+	if opts.Mask != nil {
+		if opts.Mask.Bounds() != img.Bounds() {
+			return nil, fmt.Errorf("autocrop: mask bounds %v don't match image bounds %v", opts.Mask.Bounds(), img.Bounds())
+		}
+		opts.Mask = within{opts.Mask, r}
+	}
+	t, err := AnalyzeWith(within{img, r}, opts)
+	if err != nil {
+		return nil, err
+	}
+	// t was placed as if img ended at the far corner of r
+	t.translate(image.Point{}.Sub(rotateRect(r, image.Rectangle{Max: r.Max}, t.Orientation).Min))
+	t.place(r, img.Bounds().Max)
+	return t, nil
+}
+
+// analyzeMoved does the work of analyze for an image that doesn't start at
+// (0, 0), like a SubImage, by moving it there. The Transform is moved back
+// into the coordinates of an image from (0, 0) to the far corner of img, of
+// which img is a part, turned by its Orientation (see place).
+func analyzeMoved(img image.Image, opts Options) (*analysis, *Transform, error) {
+	b := img.Bounds()
+	if opts.Mask != nil {
+		if opts.Mask.Bounds() != b {
+			return nil, nil, fmt.Errorf("autocrop: mask bounds %v don't match image bounds %v", opts.Mask.Bounds(), b)
+		}
+		opts.Mask = region{opts.Mask, b}
+	}
+	exclude := make([]image.Rectangle, len(opts.Exclude))
+	for i, e := range opts.Exclude {
+		exclude[i] = e.Sub(b.Min)
+	}
+	opts.Exclude = exclude
+	if !opts.Hint.Empty() {
+		opts.Hint = opts.Hint.Sub(b.Min)
+	}
+
+	a, t, err := analyze(region{img, b}, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.moved = t.place(b, b.Max)
+	return a, t, nil
+}
+
+// place moves t, the Transform of the part r of an image from (0, 0) to max,
+// into the coordinates of that image, turned by t.Orientation as the part
+// was, and sets Size to the size of the turned image. It returns how far t
+// was moved.
+func (t *Transform) place(r image.Rectangle, max image.Point) image.Point {
+	whole := image.Rectangle{Max: max}
+	at := rotateRect(r, whole, t.Orientation).Min
+	t.translate(at)
+	t.Size = rotateRect(whole, whole, t.Orientation).Size()
+	return at
+}
+
+// region presents the part r of an image as an image of its own, with its
+// origin at (0, 0) like the analysis expects.
+type region struct {
+	image.Image
+	r image.Rectangle
+}
+
+func (g region) Bounds() image.Rectangle {
+	return image.Rect(0, 0, g.r.Dx(), g.r.Dy())
+}
+
+func (g region) At(x, y int) color.Color {
+	return g.Image.At(x+g.r.Min.X, y+g.r.Min.Y)
+}
+
+func (g region) RGBA64At(x, y int) color.RGBA64 {
+	return rgba64At(g.Image, x+g.r.Min.X, y+g.r.Min.Y)
+}
+
+// within presents the part r of an image as an image of its own, in the
+// coordinates of the whole.
+type within struct {
+	image.Image
+	r image.Rectangle
+}
+
+func (w within) Bounds() image.Rectangle {
+	return w.r
+}
+
+// translate moves the bounds of t by p.
+func (t *Transform) translate(p image.Point) {
+	t.Bounds = t.Bounds.Add(p)
+	t.Conservative = t.Conservative.Add(p)
+	t.Aggressive = t.Aggressive.Add(p)
+	for i := range t.Corners {
+		t.Corners[i] = t.Corners[i].Add(p)
+	}
+	for i := range t.Targets {
+		t.Targets[i] = t.Targets[i].Add(p)
+	}
+}
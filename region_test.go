@@ -0,0 +1,141 @@
+package autocrop
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// drawTextPage draws a light page over p of img, with dark lines of text on
+// it that read upright once img is turned clockwise by 90 degrees.
+func drawTextPage(img *image.Gray, p image.Rectangle) {
+	for y := p.Min.Y; y < p.Max.Y; y++ {
+		for x := p.Min.X; x < p.Max.X; x++ {
+			// the point of the upright page, with the lines across it
+			u, v := p.Max.Y-1-y, x-p.Min.X
+			c := color.Gray{230}
+			if u >= 30 && u < p.Dy()-30 && v >= 30 && v < p.Dx()-30 {
+				switch line := v % 14; {
+				case line < 3 && u%7 == 0, line >= 3 && line < 8 && u%3 != 0:
+					// ascenders, and the core of the line
+					c = color.Gray{40}
+				}
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+}
+
+// turnedPage returns p, a rectangle of an image of the given size, where it
+// is in that image turned clockwise by deg degrees.
+func turnedPage(p image.Rectangle, size image.Point, deg int) image.Rectangle {
+	switch deg {
+	case 90:
+		return image.Rect(size.Y-p.Max.Y, p.Min.X, size.Y-p.Min.Y, p.Max.X)
+	case 180:
+		return image.Rect(size.X-p.Max.X, size.Y-p.Max.Y, size.X-p.Min.X, size.Y-p.Min.Y)
+	case 270:
+		return image.Rect(p.Min.Y, size.X-p.Max.X, p.Max.Y, size.X-p.Min.X)
+	}
+	return p
+}
+
+// near reports whether every side of r is within d of that of s.
+func near(r, s image.Rectangle, d int) bool {
+	abs := func(n int) int { return max(n, -n) }
+	return abs(r.Min.X-s.Min.X) <= d && abs(r.Min.Y-s.Min.Y) <= d &&
+		abs(r.Max.X-s.Max.X) <= d && abs(r.Max.Y-s.Max.Y) <= d
+}
+
+func TestAnalyzeRectTurned(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 640, 480))
+	for i := range img.Pix {
+		img.Pix[i] = 20
+	}
+	drawTextPage(img, image.Rect(10, 30, 220, 460))
+	page := image.Rect(250, 40, 620, 462)
+	drawTextPage(img, page)
+	r := image.Rect(236, 26, 634, 476)
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"source rotation", Options{SourceRotation: 90}},
+		{"orientation", Options{Orientation: true}},
+		{"both", Options{SourceRotation: 180, Orientation: true}},
+	}
+	for _, tt := range tests {
+		tr, err := AnalyzeRect(img, r, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := turnedPage(page, img.Bounds().Size(), tr.Orientation)
+		size := turnedPage(img.Bounds(), img.Bounds().Size(), tr.Orientation).Size()
+		if tr.Orientation == 0 || !near(tr.Bounds, want, 2) || tr.Size != size {
+			t.Errorf("%s: turned by %d to %v in %v, want %v in %v", tt.name, tr.Orientation, tr.Bounds, tr.Size, want, size)
+		}
+	}
+}
+
+func TestApplySubImageTurned(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 640, 480))
+	for i := range img.Pix {
+		img.Pix[i] = 20
+	}
+	page := image.Rect(250, 40, 620, 462)
+	drawTextPage(img, page)
+	r := image.Rect(236, 26, 634, 476)
+	sub := img.SubImage(r)
+
+	tr, err := AnalyzeWith(sub, Options{SourceRotation: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := turnedPage(page, r.Max, 90); !near(tr.Bounds, want, 2) {
+		t.Fatalf("turned to %v, want %v", tr.Bounds, want)
+	}
+
+	// the crop is the page: light at the edges
+	out := tr.Apply(sub)
+	b := out.Bounds()
+	if b.Size() != tr.Bounds.Size() {
+		t.Fatalf("applied to %v, want the size of %v", b, tr.Bounds)
+	}
+	gray := func(x, y int) uint8 {
+		return color.GrayModel.Convert(out.At(x, y)).(color.Gray).Y
+	}
+	for _, p := range []image.Point{{b.Min.X + 2, b.Min.Y + 2}, {b.Max.X - 3, b.Min.Y + 2}, {b.Min.X + 2, b.Max.Y - 3}, {b.Max.X - 3, b.Max.Y - 3}} {
+		if y := gray(p.X, p.Y); y < 200 {
+			t.Errorf("applied page is %d at %v, want the margin", y, p)
+		}
+	}
+	// and has the lines of text where the image turned clockwise has them,
+	// in which the point (x, y) is the point (y, 475-x) of img, give or take
+	// the rounding of the crop and the half pixels that it is shifted by. A
+	// slight angle can still put a few rows off by a line.
+	mean := func(y, d int) (got, want int) {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			X, Y := tr.Bounds.Min.X+x-b.Min.X, tr.Bounds.Min.Y+y-b.Min.Y+d
+			got += int(gray(x, y))
+			want += int(img.GrayAt(Y, r.Max.Y-1-X).Y)
+		}
+		return got / b.Dx(), want / b.Dx()
+	}
+	least := -1
+	for d := -1; d <= 1; d++ {
+		off := 0
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			if got, want := mean(y, d); got-want < -60 || got-want > 60 {
+				off++
+			}
+		}
+		if least < 0 || off < least {
+			least = off
+		}
+	}
+	if least > b.Dy()/50 {
+		t.Errorf("%d rows of the applied page are off", least)
+	}
+}
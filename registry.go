@@ -0,0 +1,155 @@
+package autocrop
+
+// registry.go contains the extension points through which other packages add
+// angle estimation algorithms, sources of images and output formats without
+// changing this one. Register them from init functions, before any analysis
+// is run; the registries are not safe to change concurrently with their use.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// AngleFunc estimates the angle (in radians, positive clockwise like
+// Transform.Angle) of the page in the upright image img, and the half width
+// of its 95% confidence interval. t is what the border analysis found, whose
+// Bounds and Angle can serve as a starting point.
+type AngleFunc func(img image.Image, t *Transform) (angle, angleErr float64, err error)
+
+// customAlgorithms holds the AngleFunc of each registered Algorithm.
+var customAlgorithms = map[Algorithm]AngleFunc{}
+
+// RegisterAlgorithm adds an angle estimation algorithm with the given name,
+// and returns the Algorithm that selects it. The crop is still found from the
+// border, as with Projection.
+func RegisterAlgorithm(name string, f AngleFunc) (Algorithm, error) {
+	if _, err := ParseAlgorithm(name); err == nil {
+		return 0, fmt.Errorf("autocrop: algorithm %q is already registered", name)
+	}
+	a := Algorithm(len(algorithmNames))
+	algorithmNames = append(algorithmNames, name)
+	customAlgorithms[a] = f
+	return a, nil
+}
+
+// Source opens the image with the given name, for a source of images other
+// than files, like an archive, a repository or a scanner.
+type Source func(name string) (io.ReadCloser, error)
+
+// sources holds the registered Sources by scheme.
+var sources = map[string]Source{}
+
+// RegisterSource makes Open (and so AnalyzeFile) open names of the form
+// scheme://rest with s, which is passed the whole name.
+func RegisterSource(scheme string, s Source) error {
+	if _, ok := sources[scheme]; ok || scheme == "" {
+		return fmt.Errorf("autocrop: source %q is already registered", scheme)
+	}
+	sources[scheme] = s
+	return nil
+}
+
+// Open opens the named image from the Source registered for its scheme, or as
+// a file if it has none. A name that goes through an archive, like
+// book.cbz/001.jpg, opens the file in the archive.
+func Open(name string) (io.ReadCloser, error) {
+	if scheme, _, ok := strings.Cut(name, "://"); ok {
+		if s, ok := sources[scheme]; ok {
+			return s(name)
+		}
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		if arc, member, ok := SplitArchive(name); ok {
+			return openMember(arc, member)
+		}
+	}
+	return f, err
+}
+
+// Formatter writes what it takes to apply t to the image name, so that the
+// result goes to out: a command line for some tool, a line of a manifest, or
+// the like. The numbers in it should follow f.
+type Formatter func(w io.Writer, name, out string, t *Transform, f NumberFormat) error
+
+// formatters holds the registered Formatters by name.
+var formatters = map[string]Formatter{
+	"convert": func(w io.Writer, name, out string, t *Transform, f NumberFormat) error {
+		_, err := fmt.Fprintln(w, "convert", name, t.Format(f), out)
+		return err
+	},
+	"json": func(w io.Writer, name, out string, t *Transform, f NumberFormat) error {
+		return json.NewEncoder(w).Encode(struct {
+			Name      string     `json:"name"`
+			Out       string     `json:"out"`
+			Transform *Transform `json:"transform"`
+		}{name, out, t})
+	},
+}
+
+// RegisterFormatter adds an output format with the given name. The command
+// line tool selects it with -output.
+func RegisterFormatter(name string, f Formatter) error {
+	if _, ok := formatters[name]; ok {
+		return fmt.Errorf("autocrop: formatter %q is already registered", name)
+	}
+	formatters[name] = f
+	return nil
+}
+
+// LookupFormatter returns the Formatter with the given name. "convert", the
+// ImageMagick command line, and "json", a line with the name, out and the
+// Transform in the form of MarshalJSON, are always there.
+func LookupFormatter(name string) (Formatter, error) {
+	if f, ok := formatters[name]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("autocrop: unknown formatter %q (have %s)", name, strings.Join(Formatters(), ", "))
+}
+
+// Formatters returns the names of the registered Formatters, sorted.
+func Formatters() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Decoder decodes an image of a format that the image package doesn't know
+// by itself, like those that phones save photos in.
+type Decoder func(r io.Reader) (image.Image, error)
+
+// RegisterDecoder makes AnalyzeReader (and so AnalyzeFile, AnalyzeAll and
+// the command line tool) decode the images whose data starts with magic with
+// d, in which, as with image.RegisterFormat, each "?" matches any one byte.
+// A format may be registered under several magic strings. config reads the
+// size of an image without decoding it, for Options.MaxPixels; if it is nil,
+// the size is found by decoding the whole image, so MaxPixels then only keeps
+// the analysis, not d, from running on one that is too large.
+func RegisterDecoder(name, magic string, d Decoder, config func(r io.Reader) (image.Config, error)) error {
+	if name == "" || magic == "" || d == nil {
+		return fmt.Errorf("autocrop: decoder %q needs a name, magic and decode function", name)
+	}
+	if config == nil {
+		config = func(r io.Reader) (image.Config, error) {
+			img, err := d(r)
+			if err != nil {
+				return image.Config{}, err
+			}
+			b := img.Bounds()
+			return image.Config{ColorModel: img.ColorModel(), Width: b.Dx(), Height: b.Dy()}, nil
+		}
+	}
+	image.RegisterFormat(name, magic, d, config)
+	return nil
+}
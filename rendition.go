@@ -0,0 +1,127 @@
+package autocrop
+
+// rendition.go contains the reconciliation of the analyses of several
+// renditions of the same scan, e.g. a master TIFF and the JPEG made from it.
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// Mismatch is the error returned by Merge when the renditions don't agree on
+// the page beyond what the uncertainty of either analysis allows, which
+// suggests that one of them isn't the scan it should be (a stale derivative,
+// a page from another scan, or a file that was cropped or damaged since).
+type Mismatch struct {
+	Orientation bool       // the renditions were turned differently
+	Border      bool       // only one of them has a border
+	Angle       float64    // difference in angle, in radians, if too large
+	Sides       [4]float64 // difference in each side (T,R,B,L), in pixels, if too large
+}
+
+func (m *Mismatch) Error() string {
+	names := [4]string{"top", "right", "bottom", "left"}
+	var what []string
+	if m.Orientation {
+		what = append(what, "orientation")
+	}
+	if m.Border {
+		what = append(what, "border")
+	}
+	if m.Angle != 0 {
+		what = append(what, fmt.Sprintf("angle off by %.3f°", util.Rad2deg(m.Angle)))
+	}
+	for i, d := range m.Sides {
+		if d != 0 {
+			what = append(what, fmt.Sprintf("%s side off by %.1f px", names[i], d))
+		}
+	}
+	return "autocrop: renditions disagree: " + strings.Join(what, ", ")
+}
+
+// renditionSlack is how far (in pixels of the smaller rendition) the sides of
+// two renditions may be apart on top of their crop intervals, to allow for
+// the rounding of scaling one to the other.
+const renditionSlack = 1
+
+// Merge reconciles the Transforms a and b found on two renditions of the same
+// page at different resolutions, and returns a Transform for the rendition
+// that a was found on. b is scaled to a's Size and whichever of the two has
+// the higher mean confidence over its fitted sides is kept.
+//
+// If they disagree by more than their confidence intervals allow (give or take
+// a pixel of the smaller rendition), Merge returns
+// the merged Transform along with a *Mismatch describing the disagreement.
+func Merge(a, b *Transform) (*Transform, error) {
+	if a.Size == (image.Point{}) || b.Size == (image.Point{}) {
+		return nil, fmt.Errorf("autocrop: can't merge Transforms without a Size")
+	}
+	if a.Orientation%180 != b.Orientation%180 {
+		// the sizes can't be compared
+		return nil, &Mismatch{Orientation: true}
+	}
+
+	kx := float64(a.Size.X) / float64(b.Size.X)
+	ky := float64(a.Size.Y) / float64(b.Size.Y)
+	s := b.scale(kx, ky)
+
+	merged := *a
+	if confidence(&s) > confidence(a) {
+		merged = s
+	}
+	merged.Estimates = append([]Estimate(nil), merged.Estimates...)
+	merged.Targets = append([]image.Rectangle(nil), merged.Targets...)
+
+	// a pixel of the smaller rendition, and the angle that moves one end of
+	// the page by that much against the other
+	slack := renditionSlack * math.Max(1, math.Max(kx, ky))
+	tilt := math.Atan2(slack, float64(max(a.Bounds.Dx(), a.Bounds.Dy(), 1)))
+
+	var m Mismatch
+	m.Orientation = a.Orientation != b.Orientation
+	m.Border = a.NoBorder != b.NoBorder
+	if !a.NoBorder && !b.NoBorder {
+		if d := math.Abs(a.Angle - s.Angle); d > a.AngleErr+s.AngleErr+tilt {
+			m.Angle = d
+		}
+		ra, rb := a.Bounds, s.Bounds
+		ea := [4]int{ra.Min.Y, ra.Max.X, ra.Max.Y, ra.Min.X}
+		eb := [4]int{rb.Min.Y, rb.Max.X, rb.Max.Y, rb.Min.X}
+		for i := range ea {
+			if !a.Sides.Has(i) || !b.Sides.Has(i) {
+				continue
+			}
+			if d := math.Abs(float64(ea[i] - eb[i])); d > a.CropErr[i]+s.CropErr[i]+slack {
+				m.Sides[i] = d
+			}
+		}
+	}
+	if m != (Mismatch{}) {
+		return &merged, &m
+	}
+	return &merged, nil
+}
+
+// confidence returns the mean confidence of the fitted sides of t, or 0 if it
+// has no border.
+func confidence(t *Transform) float64 {
+	if t.NoBorder {
+		return 0
+	}
+	var sum float64
+	var n int
+	for i, c := range t.Confidence {
+		if t.Sides.Has(i) && !math.IsNaN(c) {
+			sum += c
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
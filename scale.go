@@ -0,0 +1,66 @@
+package autocrop
+
+// scale.go carries a Transform over to the same image at another resolution.
+
+import (
+	"image"
+	"math"
+)
+
+// Scale returns t for the same image resized by a factor of k, so that a
+// Transform found on a quick thumbnail can be applied to the original.
+func (t Transform) Scale(k float64) Transform {
+	return t.scale(k, k)
+}
+
+// ScaleTo returns t, found for an image of size from, for the same image
+// resized to size to. Both sizes are of the image as it was passed to
+// Analyze, before Orientation.
+//
+// If the aspect ratio changes, the Angle is left as it is, which is only
+// close enough while the change is slight (as from rounding the size of a
+// thumbnail).
+func (t Transform) ScaleTo(from, to image.Point) Transform {
+	kx := float64(to.X) / float64(from.X)
+	ky := float64(to.Y) / float64(from.Y)
+	if t.Orientation%180 != 0 {
+		kx, ky = ky, kx
+	}
+	return t.scale(kx, ky)
+}
+
+// scale scales t by kx across and ky down, in the coordinates of the upright
+// page.
+func (t Transform) scale(kx, ky float64) Transform {
+	x := func(v int, round func(float64) float64) int { return int(round(float64(v) * kx)) }
+	y := func(v int, round func(float64) float64) int { return int(round(float64(v) * ky)) }
+	rect := func(r image.Rectangle, lo, hi func(float64) float64) image.Rectangle {
+		return image.Rect(x(r.Min.X, lo), y(r.Min.Y, lo), x(r.Max.X, hi), y(r.Max.Y, hi))
+	}
+
+	// Conservative and Aggressive are rounded so that they still keep all
+	// and only the page respectively
+	t.Bounds = rect(t.Bounds, math.Round, math.Round)
+	t.Conservative = rect(t.Conservative, math.Floor, math.Ceil)
+	t.Aggressive = rect(t.Aggressive, math.Ceil, math.Floor)
+	t.Size = image.Pt(x(t.Size.X, math.Round), y(t.Size.Y, math.Round))
+	for i, p := range t.Corners {
+		t.Corners[i] = image.Pt(x(p.X, math.Round), y(p.Y, math.Round))
+	}
+
+	// distances in from the top and bottom are vertical, and from the right
+	// and left horizontal
+	for i, k := range [4]float64{ky, kx, ky, kx} {
+		t.CropErr[i] *= k
+		t.Curl[i] *= k
+		t.Margins[i] = int(math.Round(float64(t.Margins[i]) * k))
+	}
+	t.Estimates = append([]Estimate(nil), t.Estimates...)
+	targets := t.Targets
+	t.Targets = nil
+	for _, r := range targets {
+		// grown, so that they still cover all of the target
+		t.Targets = append(t.Targets, rect(r, math.Floor, math.Ceil))
+	}
+	return t
+}
@@ -0,0 +1,244 @@
+package autocrop
+
+// schema.go contains the JSON (and YAML) form of a Transform, so that the
+// transforms of a batch can be stored, reviewed, edited by hand and replayed
+// by other tools.
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+// SchemaVersion is the version of the form Transforms are marshaled in. It is
+// written with every Transform, and Unmarshal refuses later versions than
+// this one.
+//
+// In version 1, angles are in degrees, like in the commands String gives, and
+// rectangles are given by their corners x0,y0 (inclusive) and x1,y1
+// (exclusive). Fit, Pivot and the algorithms of Estimates are given by name,
+// and sides by the letters t, r, b and l. An error that is infinite, because
+// too little of an edge was found to fit a line to it, is null.
+const SchemaVersion = 1
+
+type transformSchema struct {
+	Version      int              `json:"version" yaml:"version"`
+	Orientation  int              `json:"orientation" yaml:"orientation"`
+	Angle        float64          `json:"angle" yaml:"angle"`
+	AngleErr     *float64         `json:"angle_err" yaml:"angle_err"`
+	Bounds       rectSchema       `json:"bounds" yaml:"bounds"`
+	Size         pointSchema      `json:"size" yaml:"size"`
+	Fit          string           `json:"fit" yaml:"fit"`
+	Pivot        string           `json:"pivot" yaml:"pivot"`
+	Sides        string           `json:"sides" yaml:"sides"`
+	Fitted       string           `json:"fitted" yaml:"fitted"`
+	Confidence   [4]float64       `json:"confidence" yaml:"confidence"`
+	Coverage     [4]float64       `json:"coverage" yaml:"coverage"`
+	CropErr      [4]*float64      `json:"crop_err" yaml:"crop_err"`
+	SideAngles   [4]float64       `json:"side_angles" yaml:"side_angles"`
+	Conservative rectSchema       `json:"conservative" yaml:"conservative"`
+	Aggressive   rectSchema       `json:"aggressive" yaml:"aggressive"`
+	Corners      *[4]pointSchema  `json:"corners,omitempty" yaml:"corners,omitempty"`
+	Perspective  bool             `json:"perspective,omitempty" yaml:"perspective,omitempty"`
+	Curl         [4]float64       `json:"curl" yaml:"curl"`
+	Estimates    []estimateSchema `json:"estimates,omitempty" yaml:"estimates,omitempty"`
+	NoBorder     bool             `json:"no_border,omitempty" yaml:"no_border,omitempty"`
+	Margins      *[4]int          `json:"margins,omitempty" yaml:"margins,omitempty"`
+	Targets      []rectSchema     `json:"targets,omitempty" yaml:"targets,omitempty"`
+	Overcrop     string           `json:"overcrop,omitempty" yaml:"overcrop,omitempty"`
+}
+
+type rectSchema struct {
+	X0 int `json:"x0" yaml:"x0"`
+	Y0 int `json:"y0" yaml:"y0"`
+	X1 int `json:"x1" yaml:"x1"`
+	Y1 int `json:"y1" yaml:"y1"`
+}
+
+type pointSchema struct {
+	X int `json:"x" yaml:"x"`
+	Y int `json:"y" yaml:"y"`
+}
+
+type estimateSchema struct {
+	Algorithm  string  `json:"algorithm" yaml:"algorithm"`
+	Angle      float64 `json:"angle" yaml:"angle"`
+	Confidence float64 `json:"confidence" yaml:"confidence"`
+}
+
+func toRect(r image.Rectangle) rectSchema {
+	return rectSchema{r.Min.X, r.Min.Y, r.Max.X, r.Max.Y}
+}
+
+func (r rectSchema) rect() image.Rectangle {
+	return image.Rect(r.X0, r.Y0, r.X1, r.Y1)
+}
+
+// orNull returns a pointer to x, or nil if x is infinite or NaN, which JSON
+// can't hold.
+func orNull(x float64) *float64 {
+	if math.IsInf(x, 0) || math.IsNaN(x) {
+		return nil
+	}
+	return &x
+}
+
+// orInf returns *p, or +Inf if p is nil.
+func orInf(p *float64) float64 {
+	if p == nil {
+		return math.Inf(1)
+	}
+	return *p
+}
+
+func (t *Transform) schema() *transformSchema {
+	s := &transformSchema{
+		Version:      SchemaVersion,
+		Orientation:  t.Orientation,
+		Angle:        util.Rad2deg(t.Angle),
+		AngleErr:     orNull(util.Rad2deg(t.AngleErr)),
+		Bounds:       toRect(t.Bounds),
+		Size:         pointSchema{t.Size.X, t.Size.Y},
+		Fit:          t.Fit.String(),
+		Pivot:        t.Pivot.String(),
+		Sides:        t.Sides.String(),
+		Fitted:       t.Fitted.String(),
+		Confidence:   t.Confidence,
+		Coverage:     t.Coverage,
+		Conservative: toRect(t.Conservative),
+		Aggressive:   toRect(t.Aggressive),
+		Perspective:  t.Perspective,
+		Curl:         t.Curl,
+		NoBorder:     t.NoBorder,
+		Overcrop:     t.Overcrop.String(),
+	}
+	for i := range t.CropErr {
+		s.CropErr[i] = orNull(t.CropErr[i])
+		s.SideAngles[i] = util.Rad2deg(t.SideAngles[i])
+	}
+	if t.Corners != [4]image.Point{} {
+		s.Corners = new([4]pointSchema)
+		for i, p := range t.Corners {
+			s.Corners[i] = pointSchema{p.X, p.Y}
+		}
+	}
+	for _, e := range t.Estimates {
+		s.Estimates = append(s.Estimates, estimateSchema{e.Algorithm.String(), util.Rad2deg(e.Angle), e.Confidence})
+	}
+	if t.Margins != [4]int{} {
+		s.Margins = &t.Margins
+	}
+	for _, r := range t.Targets {
+		s.Targets = append(s.Targets, toRect(r))
+	}
+	return s
+}
+
+func (s *transformSchema) transform() (*Transform, error) {
+	if s.Version < 1 || s.Version > SchemaVersion {
+		return nil, fmt.Errorf("autocrop: unsupported transform schema version %d", s.Version)
+	}
+	t := &Transform{
+		Orientation:  s.Orientation,
+		Angle:        util.Deg2rad(s.Angle),
+		AngleErr:     util.Deg2rad(orInf(s.AngleErr)),
+		Bounds:       s.Bounds.rect(),
+		Size:         image.Pt(s.Size.X, s.Size.Y),
+		Confidence:   s.Confidence,
+		Coverage:     s.Coverage,
+		Conservative: s.Conservative.rect(),
+		Aggressive:   s.Aggressive.rect(),
+		Perspective:  s.Perspective,
+		Curl:         s.Curl,
+		NoBorder:     s.NoBorder,
+	}
+	if t.Orientation%90 != 0 {
+		return nil, fmt.Errorf("autocrop: invalid orientation %d", t.Orientation)
+	}
+	var err error
+	if s.Fit != "" {
+		if t.Fit, err = ParseFit(s.Fit); err != nil {
+			return nil, err
+		}
+	}
+	if s.Pivot != "" {
+		if t.Pivot, err = ParsePivot(s.Pivot); err != nil {
+			return nil, err
+		}
+	}
+	if t.Sides, err = ParseSides(s.Sides); err != nil {
+		return nil, err
+	}
+	if t.Fitted, err = ParseSides(s.Fitted); err != nil {
+		return nil, err
+	}
+	if t.Overcrop, err = ParseSides(s.Overcrop); err != nil {
+		return nil, err
+	}
+	for i := range s.CropErr {
+		t.CropErr[i] = orInf(s.CropErr[i])
+		t.SideAngles[i] = util.Deg2rad(s.SideAngles[i])
+	}
+	if s.Corners != nil {
+		for i, p := range s.Corners {
+			t.Corners[i] = image.Pt(p.X, p.Y)
+		}
+	}
+	for _, e := range s.Estimates {
+		a, err := ParseAlgorithm(e.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		t.Estimates = append(t.Estimates, Estimate{a, util.Deg2rad(e.Angle), e.Confidence})
+	}
+	if s.Margins != nil {
+		t.Margins = *s.Margins
+	}
+	for _, r := range s.Targets {
+		t.Targets = append(t.Targets, r.rect())
+	}
+	return t, nil
+}
+
+// MarshalJSON writes t in the form described by SchemaVersion.
+func (t Transform) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.schema())
+}
+
+// UnmarshalJSON reads a Transform written by MarshalJSON, of this or an
+// earlier SchemaVersion.
+func (t *Transform) UnmarshalJSON(data []byte) error {
+	var s transformSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	u, err := s.transform()
+	if err != nil {
+		return err
+	}
+	*t = *u
+	return nil
+}
+
+// MarshalYAML gives t to YAML encoders (such as gopkg.in/yaml.v3) in the same
+// form as MarshalJSON.
+func (t Transform) MarshalYAML() (interface{}, error) {
+	return t.schema(), nil
+}
+
+// UnmarshalYAML reads a Transform written by MarshalYAML.
+func (t *Transform) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s transformSchema
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	u, err := s.transform()
+	if err != nil {
+		return err
+	}
+	*t = *u
+	return nil
+}
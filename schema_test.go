@@ -0,0 +1,122 @@
+package autocrop
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// sameTransform reports whether t and u are the same but for the rounding of
+// their angles, which are written in degrees.
+func sameTransform(t, u *Transform) bool {
+	near := func(a, b float64) bool {
+		return a == b || math.Abs(a-b) < 1e-12
+	}
+	v := *u
+	if !near(t.Angle, v.Angle) || !near(t.AngleErr, v.AngleErr) {
+		return false
+	}
+	v.Angle, v.AngleErr = t.Angle, t.AngleErr
+	for i := range v.SideAngles {
+		if !near(t.SideAngles[i], v.SideAngles[i]) {
+			return false
+		}
+		v.SideAngles[i] = t.SideAngles[i]
+	}
+	if len(t.Estimates) != len(v.Estimates) {
+		return false
+	}
+	v.Estimates = append([]Estimate(nil), v.Estimates...)
+	for i := range v.Estimates {
+		if !near(t.Estimates[i].Angle, v.Estimates[i].Angle) {
+			return false
+		}
+		v.Estimates[i].Angle = t.Estimates[i].Angle
+	}
+	return reflect.DeepEqual(t, &v)
+}
+
+func TestSchemaRoundTrip(t *testing.T) {
+	analyzed, err := AnalyzeWith(tilted(600, 800, 1.5), Options{Algorithm: Fused, Margins: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		tr   *Transform
+	}{
+		{"analyzed", analyzed},
+		{"zero", &Transform{}},
+		{"by hand", &Transform{
+			Orientation:  270,
+			Angle:        -0.01,
+			AngleErr:     math.Inf(1),
+			Bounds:       image.Rect(10, 20, 590, 780),
+			Size:         image.Pt(800, 600),
+			Sides:        Top | Left,
+			Fitted:       Top,
+			CropErr:      [4]float64{math.Inf(1), 1.5, 2, math.Inf(1)},
+			Conservative: image.Rect(12, 22, 588, 778),
+			Aggressive:   image.Rect(8, 18, 592, 782),
+			Corners:      [4]image.Point{{10, 20}, {590, 22}, {588, 780}, {12, 778}},
+			Perspective:  true,
+			NoBorder:     true,
+			Fit:          FitOuter,
+			Pivot:        PivotPage,
+			Margins:      [4]int{1, 2, 3, 4},
+			Targets:      []image.Rectangle{image.Rect(0, 0, 40, 600)},
+			Overcrop:     Right | Bottom,
+		}},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.tr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got Transform
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Errorf("%s: %v in %s", tt.name, err, b)
+		} else if !sameTransform(tt.tr, &got) {
+			t.Errorf("%s: JSON gives %+v, want %+v", tt.name, got, *tt.tr)
+		}
+
+		// YAML encoders take the value of MarshalYAML as it is, and give
+		// UnmarshalYAML a function that decodes into what it's given
+		v, err := tt.tr.MarshalYAML()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got = Transform{}
+		err = got.UnmarshalYAML(func(s interface{}) error {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(b, s)
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !sameTransform(tt.tr, &got) {
+			t.Errorf("%s: YAML gives %+v, want %+v", tt.name, got, *tt.tr)
+		}
+	}
+}
+
+func TestSchemaInvalid(t *testing.T) {
+	for _, s := range []string{
+		`{"version": 0}`,
+		`{"version": 2}`,
+		`{"version": 1, "orientation": 45}`,
+		`{"version": 1, "fit": "snug"}`,
+		`{"version": 1, "pivot": "middle"}`,
+		`{"version": 1, "sides": "tx"}`,
+		`{"version": 1, "estimates": [{"algorithm": "guess"}]}`,
+	} {
+		var tr Transform
+		if err := json.Unmarshal([]byte(s), &tr); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package autocrop
+
+// session.go contains Session, which keeps an image decoded between analyses
+// of it with different options, for tuning them on one large scan.
+
+import (
+	"image"
+	"sync"
+)
+
+// Session analyzes one image again and again, with different Options each
+// time, and keeps what doesn't depend on most of them from one analysis to
+// the next: the gray levels of the image, for each Gray and turn of it
+// (SourceRotation and Orientation), the copies Downsample shrinks it to, and
+// the turns Orientation finds. Trying another Thresh, Fc or N on a large scan
+// then takes only the analysis itself, instead of decoding the image and
+// converting it to gray again. The gray levels take 2 bytes a pixel for each
+// Gray and turn that the image has been analyzed with, for as long as the
+// Session is kept. A Session may be used by several goroutines at once.
+type Session struct {
+	img    image.Image
+	mu     sync.Mutex
+	planes map[sessionKey]*grayPlane
+	shrunk map[sessionKey]*image.Gray16
+	turns  map[sessionKey]int
+}
+
+// sessionKey is what the gray levels, a shrunk copy or the orientation of the
+// image of a Session were made from.
+type sessionKey struct {
+	sessionImage
+	turn int       // the clockwise turn of the image, in degrees
+	gray [3]uint64 // the fixed point Gray weights
+}
+
+// sessionImage marks the image analyzed as that of the Session s, if s isn't
+// nil, or as a copy of it shrunk by a factor of shrink with the gray weights
+// shrunkGray, if shrink isn't zero.
+type sessionImage struct {
+	s          *Session
+	shrink     int
+	shrunkGray [3]uint64
+}
+
+// NewSession returns a Session that analyzes img.
+func NewSession(img image.Image) *Session {
+	return &Session{
+		img:    img,
+		planes: make(map[sessionKey]*grayPlane),
+		shrunk: make(map[sessionKey]*image.Gray16),
+		turns:  make(map[sessionKey]int),
+	}
+}
+
+// Image returns the image of the Session.
+func (s *Session) Image() image.Image {
+	return s.img
+}
+
+// Analyze analyzes the image of the Session like AnalyzeWith.
+func (s *Session) Analyze(opts Options) (*Transform, error) {
+	opts.session = sessionImage{s: s}
+	return AnalyzeWith(s.img, opts)
+}
+
+// Composite analyzes the image of the Session like Composite.
+func (s *Session) Composite(opts Options) (*image.NRGBA, *Transform, error) {
+	opts.session = sessionImage{s: s}
+	return Composite(s.img, opts)
+}
+
+// plane returns the gray plane of a.img, the image turned by turn degrees,
+// keeping it for the next analyses if the image is a Session's.
+func (si sessionImage) plane(a *analysis, turn int) *grayPlane {
+	if si.s == nil {
+		return a.makePlane()
+	}
+	k := sessionKey{si, (turn%360 + 360) % 360, a.gray}
+	si.s.mu.Lock()
+	defer si.s.mu.Unlock()
+	p, ok := si.s.planes[k]
+	if !ok {
+		// of an analysis of its own, which the plane keeps, rather than a
+		// and all it finds
+		p = (&analysis{img: a.img, gray: a.gray, palette: a.palette, alpha: a.alpha}).makePlane()
+		si.s.planes[k] = p
+	}
+	return p
+}
+
+// shrunk returns conv.shrunk(f), keeping it for the next analyses if conv.img
+// is a Session's.
+func (si sessionImage) shrunk(conv *analysis, f int) *image.Gray16 {
+	if si.s == nil {
+		return conv.shrunk(f)
+	}
+	k := sessionKey{sessionImage: si.shrunkBy(f, conv.gray)}
+	si.s.mu.Lock()
+	small, ok := si.s.shrunk[k]
+	si.s.mu.Unlock()
+	if !ok {
+		// without holding up the analyses that have what they need
+		small = conv.shrunk(f)
+		si.s.mu.Lock()
+		si.s.shrunk[k] = small
+		si.s.mu.Unlock()
+	}
+	return small
+}
+
+// orientation returns detectOrientation(img), where img is the image turned by
+// turn degrees, keeping it for the next analyses if the image is a Session's.
+func (si sessionImage) orientation(img image.Image, turn int) int {
+	if si.s == nil {
+		return detectOrientation(img)
+	}
+	k := sessionKey{sessionImage: si, turn: (turn%360 + 360) % 360}
+	si.s.mu.Lock()
+	o, ok := si.s.turns[k]
+	si.s.mu.Unlock()
+	if !ok {
+		o = detectOrientation(img)
+		si.s.mu.Lock()
+		si.s.turns[k] = o
+		si.s.mu.Unlock()
+	}
+	return o
+}
+
+// shrunkBy returns the mark of the copy of the image shrunk by a factor of f
+// with the gray weights gray, if the image is a Session's.
+func (si sessionImage) shrunkBy(f int, gray [3]uint64) sessionImage {
+	if si.s == nil {
+		return si
+	}
+	return sessionImage{si.s, f, gray}
+}
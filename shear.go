@@ -0,0 +1,231 @@
+package autocrop
+
+// shear.go contains the rotation of Apply by three shears (Paeth's), which
+// moves each row, then each column, then each row again along itself,
+// instead of resampling every pixel in two dimensions. Each move is by the
+// same fraction of a pixel along a whole row or column, so it is filtered
+// with a cubic whose weights are worked out once for the line, in fixed point.
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// maxShear is the largest angle that Apply rotates by three shears, which
+// covers any skew of a scan. Past it, the rows held at once for the column
+// shear grow toward the whole image, and it is resampled point by point
+// instead.
+const maxShear = math.Pi / 18
+
+// cubic returns the weights of the samples before, at, after and two after
+// the point t of the way from one sample to the next, for Catmull-Rom
+// interpolation. They are in fixed point, with shearOne as one, and the
+// second takes up their rounding so that they add up to one exactly and a
+// flat color stays as it is.
+func cubic(t float64) [4]int64 {
+	t2, t3 := t*t, t*t*t
+	w := [4]int64{
+		int64(math.Round((-t3 + 2*t2 - t) / 2 * shearOne)),
+		0,
+		int64(math.Round((-3*t3 + 4*t2 + t) / 2 * shearOne)),
+		int64(math.Round((t3 - t2) / 2 * shearOne)),
+	}
+	w[1] = shearOne - w[0] - w[2] - w[3]
+	return w
+}
+
+// The fixed point of the weights of cubic, in which shearOne is one.
+const (
+	shearBits = 16
+	shearOne  = 1 << shearBits
+)
+
+// shearRotate draws into dst the rectangle r of the canvas of u: src, the
+// upright image, rotated by u.Angle about its pivot. The rotation is
+// split into a shear along the rows by -tan(Angle/2), one along the columns
+// by sin(Angle), and the first again. The pixels are premultiplied 16-bit
+// RGBA throughout, clamped after each shear as cubics overshoot at sharp
+// edges, and whatever comes from outside of src is white.
+//
+// The rows of dst are split into a band for each CPU. Each band keeps only
+// the rows of the first shear that the column shear reaches across, about
+// sin(Angle) times the width of the image of them.
+func (u *Transform) shearRotate(dst draw.RGBA64Image, src image.Image, r image.Rectangle) {
+	px, py, qx, qy := u.pivot()
+	alpha, beta := -math.Tan(u.Angle/2), math.Sin(u.Angle)
+
+	// The columns of the sheared images are those of the canvas. The last
+	// shear reads row j shifted by shift3(j) pixels, so the columns i0 to i1
+	// of it are needed.
+	shift3 := func(j int) float64 { return -alpha * (float64(j) + 0.5 - qy) }
+	s0, s1 := int(math.Floor(shift3(r.Min.Y))), int(math.Floor(shift3(r.Max.Y-1)))
+	i0, i1 := r.Min.X+min(s0, s1)-1, r.Max.X+max(s0, s1)+2
+	w := i1 - i0
+
+	// The column shear reads column i from rows j+f2[i]+t of the first
+	// shear, whose rows are those of src, with the weights w2[i] of t.
+	f2 := make([]int, w)
+	w2 := make([][4]int64, w)
+	lo, hi := math.MaxInt, math.MinInt
+	for n := range f2 {
+		g := py - qy - beta*(float64(i0+n)+0.5-qx)
+		f := math.Floor(g)
+		f2[n], w2[n] = int(f), cubic(g-f)
+		lo, hi = min(lo, f2[n]), max(hi, f2[n])
+	}
+	// rows j+lo-1 to j+hi+2 are needed at once
+	held := hi - lo + 4
+
+	bands := min(runtime.GOMAXPROCS(0), r.Dy())
+	var wg sync.WaitGroup
+	for b := 0; b < bands; b++ {
+		j0, j1 := r.Min.Y+r.Dy()*b/bands, r.Min.Y+r.Dy()*(b+1)/bands
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &shearBand{
+				src: src, px: px, py: py, qx: qx, alpha: alpha, i0: i0, w: w,
+				rows:  make([]uint16, held*4*w),
+				keys:  make([]int, held),
+				taken: make([]uint16, 4*(w+3)),
+			}
+			for k := range s.keys {
+				s.keys[k] = math.MinInt
+			}
+			row := make([]uint16, 4*w)
+			near := make([][]uint16, held)
+			for j := j0; j < j1; j++ {
+				// the column shear, of row j, from rows j+lo-1 on
+				for k := range near {
+					near[k] = s.row(j + lo - 1 + k)
+				}
+				for n := 0; n < w; n++ {
+					wt := &w2[n]
+					k := f2[n] - lo
+					var v [4]int64
+					for m := 0; m < 4; m++ {
+						tap(&v, wt[m], near[k+m][4*n:])
+					}
+					premultiplied(row[4*n:4*n+4:4*n+4], v)
+				}
+
+				// and the second row shear, into dst
+				sh := shift3(j)
+				f := math.Floor(sh)
+				wt := cubic(sh - f)
+				off := r.Min.X + int(f) - 1 - i0
+				var out [4]uint16
+				for x := 0; x < r.Dx(); x++ {
+					premultiplied(out[:], along(&wt, row[4*(off+x):]))
+					dst.SetRGBA64(x, j-r.Min.Y, color.RGBA64{out[0], out[1], out[2], out[3]})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// shearBand holds the rows of the first shear of src that a band of the
+// rows of dst needs, each in the slot of its index modulo how many are held.
+type shearBand struct {
+	src        image.Image
+	px, py, qx float64
+	alpha      float64
+	i0, w      int
+	rows       []uint16 // held rows of w premultiplied RGBA pixels
+	keys       []int    // the index of the row in each slot
+	taken      []uint16 // the pixels of a row of src that a row is sheared from
+}
+
+// row returns row k of the first shear, shearing it from row k of src if it
+// isn't held already.
+func (s *shearBand) row(k int) []uint16 {
+	slot := (k%len(s.keys) + len(s.keys)) % len(s.keys)
+	row := s.rows[slot*4*s.w : (slot+1)*4*s.w]
+	if s.keys[slot] == k {
+		return row
+	}
+	s.keys[slot] = k
+	b := s.src.Bounds()
+	if k < b.Min.Y || k >= b.Max.Y {
+		for n := range row {
+			row[n] = ColorMax
+		}
+		return row
+	}
+
+	sh := s.px - s.qx - s.alpha*(float64(k)+0.5-s.py)
+	f := math.Floor(sh)
+	wt := cubic(sh - f)
+	readRow(s.src, s.i0+int(f)-1, k, s.taken)
+	for n := 0; n < s.w; n++ {
+		premultiplied(row[4*n:4*n+4:4*n+4], along(&wt, s.taken[4*n:]))
+	}
+	return row
+}
+
+// readRow reads the pixels of row y of img from x on, as many as row holds
+// four samples of, as premultiplied 16-bit RGBA. Those outside of img are
+// white.
+func readRow(img image.Image, x, y int, row []uint16) {
+	bounds := img.Bounds()
+	fast, _ := img.(image.RGBA64Image)
+	for n := 0; n < len(row); n, x = n+4, x+1 {
+		p := row[n : n+4 : n+4]
+		switch {
+		case !(image.Point{x, y}.In(bounds)):
+			p[0], p[1], p[2], p[3] = ColorMax, ColorMax, ColorMax, ColorMax
+		case fast != nil:
+			c := fast.RGBA64At(x, y)
+			p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
+		default:
+			r, g, b, a := img.At(x, y).RGBA()
+			p[0], p[1], p[2], p[3] = uint16(r), uint16(g), uint16(b), uint16(a)
+		}
+	}
+}
+
+// tap adds the pixel at the start of p, weighted by wt, to v.
+func tap(v *[4]int64, wt int64, p []uint16) {
+	p = p[:4]
+	v[0] += wt * int64(p[0])
+	v[1] += wt * int64(p[1])
+	v[2] += wt * int64(p[2])
+	v[3] += wt * int64(p[3])
+}
+
+// along returns the sum of the four pixels at the start of p, weighted by wt.
+func along(wt *[4]int64, p []uint16) [4]int64 {
+	var v [4]int64
+	p = p[:16]
+	tap(&v, wt[0], p[0:])
+	tap(&v, wt[1], p[4:])
+	tap(&v, wt[2], p[8:])
+	tap(&v, wt[3], p[12:])
+	return v
+}
+
+// premultiplied stores v, a sum of samples weighted by cubic, in p as a
+// premultiplied 16-bit color, rounded and clamped to one.
+func premultiplied(p []uint16, v [4]int64) {
+	a := (v[3] + shearOne/2) >> shearBits
+	if a < 0 {
+		a = 0
+	} else if a > ColorMax {
+		a = ColorMax
+	}
+	p[3] = uint16(a)
+	for c := 0; c < 3; c++ {
+		x := (v[c] + shearOne/2) >> shearBits
+		if x < 0 {
+			x = 0
+		} else if x > a {
+			x = a
+		}
+		p[c] = uint16(x)
+	}
+}
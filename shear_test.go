@@ -0,0 +1,69 @@
+package autocrop
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// TestShearRotate checks the rotation by three shears against resampling
+// each pixel bilinearly, which Apply does past maxShear. On an image of
+// waves a few pixels long, the two filters differ by a few levels at most,
+// where bilinear flattens the peaks, while a rotation off by half a pixel or
+// by a few percent of its angle is off by far more.
+func TestShearRotate(t *testing.T) {
+	const deg = math.Pi / 180
+	src := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			s := math.Sin(float64(x)/3) * math.Cos(float64(y)/2.5)
+			src.SetNRGBA(x, y, color.NRGBA{uint8(40 + x/2), uint8(60 + y/2), uint8(128 + 100*s), 255})
+		}
+	}
+	page := image.Rect(30, 20, 270, 180)
+
+	tests := []struct {
+		name string
+		tr   Transform
+	}{
+		{"small", Transform{Angle: 0.4 * deg, Bounds: page}},
+		{"counterclockwise", Transform{Angle: -3 * deg, Bounds: page}},
+		{"largest", Transform{Angle: 10 * deg, Bounds: page}},
+		{"about the page", Transform{Angle: 2 * deg, Bounds: page, Pivot: PivotPage}},
+		{"about the corner", Transform{Angle: -1.5 * deg, Bounds: page, Pivot: PivotCorner}},
+	}
+	for _, tt := range tests {
+		u := tt.tr
+		u.Size = src.Bounds().Size()
+		r := u.Crop()
+		got := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		u.shearRotate(got, src, r)
+
+		var sum, worst float64
+		n := 0
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				sx, sy := u.unrotate(float64(r.Min.X+x)+0.5, float64(r.Min.Y+y)+0.5)
+				if sx < 2 || sy < 2 || sx > 298 || sy > 198 {
+					// the filters reach the white outside differently
+					continue
+				}
+				w := bilinear(src, sx-0.5, sy-0.5)
+				wr, wg, wb, _ := w.RGBA()
+				gr, gg, gb, _ := got.At(x, y).RGBA()
+				for _, d := range []float64{float64(gr) - float64(wr), float64(gg) - float64(wg), float64(gb) - float64(wb)} {
+					d = math.Abs(d) / 0x101
+					sum += d
+					worst = math.Max(worst, d)
+					n++
+				}
+			}
+		}
+		if n == 0 {
+			t.Errorf("%s: nothing to compare in %v", tt.name, r)
+		} else if mean := sum / float64(n); mean > 0.6 || worst > 4.5 {
+			t.Errorf("%s: off from bilinear by %.2f on average and %.0f at worst", tt.name, mean, worst)
+		}
+	}
+}
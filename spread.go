@@ -0,0 +1,83 @@
+package autocrop
+
+// spread.go contains the detection and splitting of double-page spreads.
+
+import (
+	"image"
+
+	"ktkr.us/pkg/autocrop/util"
+)
+
+const (
+	// spreadAspect is the smallest width to height ratio of a spread.
+	spreadAspect = 1.2
+	// spreadGutter is how dark the gutter between two pages must be at its
+	// darkest, relative to the median brightness across the image.
+	spreadGutter = 0.6
+)
+
+// AnalyzeSpread is like AnalyzeWith, but first checks whether img is a
+// double-page spread: wider than it is tall, with a dark gutter running down
+// the middle. If it is, each page is analyzed separately and their Transforms
+// are returned, left page first. Their bounds are in the coordinates of img,
+// turned by their Orientation, so the pages can be split out of it.
+// Otherwise, the single Transform of the whole image is returned.
+func AnalyzeSpread(img image.Image, opts Options) ([]*Transform, error) {
+	gutter, ok := findGutter(img)
+	if !ok {
+		t, err := AnalyzeWith(img, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []*Transform{t}, nil
+	}
+
+	b := img.Bounds()
+	pages := []image.Rectangle{
+		image.Rect(b.Min.X, b.Min.Y, gutter, b.Max.Y),
+		image.Rect(gutter, b.Min.Y, b.Max.X, b.Max.Y),
+	}
+	ts := make([]*Transform, len(pages))
+	for i, r := range pages {
+		t, err := AnalyzeRect(img, r, opts)
+		if err != nil {
+			return nil, err
+		}
+		ts[i] = t
+	}
+
+	return ts, nil
+}
+
+// findGutter looks for the gutter of a double-page spread in the middle third
+// of img, and returns its x coordinate in img. ok is false if there isn't one.
+func findGutter(img image.Image) (gutter int, ok bool) {
+	b := img.Bounds()
+	dx, dy := b.Dx(), b.Dy()
+	if float64(dx) < spreadAspect*float64(dy) {
+		return 0, false
+	}
+
+	// Average brightness of every column over the middle of the height,
+	// which stays clear of the border above and below the pages.
+	a := &analysis{img: img}
+	step := max(1, dy/200)
+	profile := make([]float64, dx)
+	for x := range profile {
+		sum, count := 0., 0
+		for y := dy / 4; y < dy*3/4; y += step {
+			sum += a.grayAt(b.Min.X+x, b.Min.Y+y)
+			count++
+		}
+		profile[x] = sum / float64(count)
+	}
+
+	gutter = dx / 3
+	for x := dx / 3; x < dx*2/3; x++ {
+		if profile[x] < profile[gutter] {
+			gutter = x
+		}
+	}
+
+	return b.Min.X + gutter, profile[gutter] < spreadGutter*util.Median(profile...)
+}
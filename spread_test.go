@@ -0,0 +1,31 @@
+package autocrop
+
+import (
+	"image"
+	"testing"
+)
+
+func TestAnalyzeSpreadTurned(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 900, 400))
+	for i := range img.Pix {
+		img.Pix[i] = 20
+	}
+	pages := []image.Rectangle{image.Rect(15, 14, 438, 386), image.Rect(462, 14, 886, 386)}
+	for _, p := range pages {
+		drawTextPage(img, p)
+	}
+
+	ts, err := AnalyzeSpread(img, Options{Orientation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != len(pages) {
+		t.Fatalf("got %d pages, want %d", len(ts), len(pages))
+	}
+	for i, tr := range ts {
+		want := turnedPage(pages[i], img.Bounds().Size(), tr.Orientation)
+		if tr.Orientation == 0 || !near(tr.Bounds, want, 2) {
+			t.Errorf("page %d: turned by %d to %v, want %v", i, tr.Orientation, tr.Bounds, want)
+		}
+	}
+}
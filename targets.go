@@ -0,0 +1,208 @@
+package autocrop
+
+// targets.go contains the detection of calibration targets and rulers laid
+// along the sides of a scan, whose edges would otherwise be taken for the
+// edges of the page.
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// targetChunk is the length (in pixels) of the pieces of a line along a
+	// side that are checked for a target one at a time.
+	targetChunk = 128
+
+	// targetChroma is the difference between the largest and the smallest
+	// component (out of 255) above which a pixel is colorful, and
+	// targetColorful the fraction of colorful pixels that makes a piece part
+	// of a color target. Paper and the scanner's background are gray.
+	targetChroma   = 64
+	targetColorful = 0.25
+
+	// A piece is part of a ruler if its gray levels repeat with a period of
+	// targetMinLag to targetMaxLag pixels, with an autocorrelation of at
+	// least targetPeriodic, and vary by a standard deviation of at least
+	// targetContrast.
+	targetMinLag   = 3
+	targetMaxLag   = targetChunk / 2
+	targetPeriodic = 0.5
+	targetContrast = 24
+
+	// targetMinDepth is how many lines deep a strip of pieces must be to be
+	// taken for a target.
+	targetMinDepth = 4
+)
+
+// findTargets returns the calibration targets and rulers along the sides of
+// the image, in its coordinates. Only targets that start where the edge of
+// the page is looked for can be mistaken for it, but they are followed twice
+// as deep, a line at a time from the outside in.
+func (a *analysis) findTargets() []image.Rectangle {
+	b := a.img.Bounds()
+	dx, dy := b.Dx(), b.Dy()
+
+	var targets []image.Rectangle
+	for i := 0; i < 4; i++ {
+		length, across := dx, dy
+		if i%2 == 1 {
+			length, across = dy, dx
+		}
+		band := a.band(across)
+		depth := min(2*band, across/2)
+
+		// point returns the pixel at position p along line d in from side i
+		point := func(d, p int) image.Point {
+			switch i {
+			case 0:
+				return image.Pt(b.Min.X+p, b.Min.Y+d)
+			case 1:
+				return image.Pt(b.Max.X-1-d, b.Min.Y+p)
+			case 2:
+				return image.Pt(b.Min.X+p, b.Max.Y-1-d)
+			}
+			return image.Pt(b.Min.X+d, b.Min.Y+p)
+		}
+
+		// runs of consecutive lines with target pieces in them, and the
+		// extent of the pieces along the side
+		var (
+			run    = -1
+			lo, hi int
+		)
+		flush := func(end int) {
+			if run >= 0 && end-run >= targetMinDepth {
+				r := image.Rectangle{point(run, lo), point(end-1, hi-1)}.Canon()
+				targets = append(targets, image.Rectangle{r.Min, r.Max.Add(image.Pt(1, 1))})
+			}
+			run = -1
+		}
+		for d := 0; d < depth; d++ {
+			first, last := -1, -1
+			for p := 0; p+targetChunk <= length; p += targetChunk {
+				if a.isTarget(func(k int) image.Point { return point(d, p+k) }) {
+					if first < 0 {
+						first = p
+					}
+					last = p + targetChunk
+				}
+			}
+			switch {
+			case first < 0:
+				flush(d)
+			case run < 0 && d >= band:
+				// too deep to start a target
+			case run < 0:
+				run, lo, hi = d, first, last
+			default:
+				lo, hi = min(lo, first), max(hi, last)
+			}
+		}
+		flush(depth)
+	}
+	return targets
+}
+
+// isTarget reports whether the targetChunk pixels at(0), at(1)... look like
+// part of a color target or a ruler.
+func (a *analysis) isTarget(at func(k int) image.Point) bool {
+	var (
+		gray     [targetChunk]float64
+		colorful int
+		mean     float64
+	)
+	for k := range gray {
+		p := at(k)
+		r, g, b, _ := a.img.At(p.X, p.Y).RGBA()
+		r, g, b = r>>8, g>>8, b>>8
+		if max(r, g, b)-min(r, g, b) > targetChroma {
+			colorful++
+		}
+		gray[k] = float64(r+g+b) / 3
+		mean += gray[k]
+	}
+	if float64(colorful) >= targetColorful*targetChunk {
+		return true
+	}
+
+	mean /= targetChunk
+	var variance float64
+	for k := range gray {
+		gray[k] -= mean
+		variance += gray[k] * gray[k]
+	}
+	if math.Sqrt(variance/targetChunk) < targetContrast {
+		return false
+	}
+
+	// A step, like the edge of the page, correlates with itself at every
+	// small lag. Something periodic swings negative before it comes round
+	// again.
+	dipped := false
+	for lag := 1; lag <= targetMaxLag; lag++ {
+		var sum float64
+		for k := 0; k+lag < targetChunk; k++ {
+			sum += gray[k] * gray[k+lag]
+		}
+		r := sum / variance
+		switch {
+		case r < 0:
+			dipped = true
+		case dipped && lag >= targetMinLag && r >= targetPeriodic:
+			return true
+		}
+	}
+	return false
+}
+
+// cropTargets cuts t.Bounds in past the inner edge of any of the targets that
+// reaches into it from the side of the image it is nearest to, so that none
+// of it is left in the crop once the page has been straightened. If that
+// would leave nothing, Bounds are left as they were.
+func (t *Transform) cropTargets(targets []image.Rectangle, bounds image.Rectangle) {
+	crop := t.Bounds
+	cx, cy := float64(crop.Min.X+crop.Max.X)/2, float64(crop.Min.Y+crop.Max.Y)/2
+	sin, cos := math.Sincos(t.Angle)
+	for _, r := range targets {
+		if !r.Overlaps(crop) {
+			continue
+		}
+
+		// the target is square to the image, but turns with the page
+		lo, hi := [2]float64{math.Inf(1), math.Inf(1)}, [2]float64{math.Inf(-1), math.Inf(-1)}
+		for _, p := range [4]image.Point{r.Min, {r.Max.X, r.Min.Y}, r.Max, {r.Min.X, r.Max.Y}} {
+			x, y := float64(p.X)-cx, float64(p.Y)-cy
+			x, y = x*cos-y*sin+cx, x*sin+y*cos+cy
+			lo = [2]float64{math.Min(lo[0], x), math.Min(lo[1], y)}
+			hi = [2]float64{math.Max(hi[0], x), math.Max(hi[1], y)}
+		}
+		turned := image.Rect(int(math.Floor(lo[0])), int(math.Floor(lo[1])), int(math.Ceil(hi[0])), int(math.Ceil(hi[1])))
+
+		dist := [4]int{
+			r.Min.Y - bounds.Min.Y,
+			bounds.Max.X - r.Max.X,
+			bounds.Max.Y - r.Max.Y,
+			r.Min.X - bounds.Min.X,
+		}
+		side := 0
+		for i, d := range dist {
+			if d < dist[side] {
+				side = i
+			}
+		}
+		switch side {
+		case 0:
+			crop.Min.Y = max(crop.Min.Y, turned.Max.Y)
+		case 1:
+			crop.Max.X = min(crop.Max.X, turned.Min.X)
+		case 2:
+			crop.Max.Y = min(crop.Max.Y, turned.Min.Y)
+		case 3:
+			crop.Min.X = max(crop.Min.X, turned.Max.X)
+		}
+	}
+	if !crop.Empty() {
+		t.Bounds = crop
+	}
+}
@@ -0,0 +1,82 @@
+package autocrop
+
+// tiff.go contains the decoding of TIFFs, as scanner software writes them,
+// including the multi-page ones from document feeders.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+// decodeTIFF decodes every page of a TIFF. golang.org/x/image/tiff only
+// decodes the first IFD, so each one is made the first in turn. Reduced
+// resolution versions of the pages, like thumbnails, are left out.
+func decodeTIFF(r io.Reader) ([]image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return tiffPages(data, false)
+}
+
+// tiffPages decodes the pages of the TIFF structure data like decodeTIFF, or
+// if lazy is set, returns each that can be as a lazyTIFF.
+func tiffPages(data []byte, lazy bool) ([]image.Image, error) {
+	var pages []image.Image
+	for _, ifd := range tiffIFDs(data) {
+		order := binary.ByteOrder(binary.LittleEndian)
+		if data[0] == 'M' {
+			order = binary.BigEndian
+		}
+		order.PutUint32(data[4:8], uint32(ifd))
+
+		// tag 0x00fe is the NewSubfileType, whose lowest bit marks a
+		// reduced resolution image
+		if e, _ := tiffEntry(data, 0x00fe); e != nil && order.Uint32(e[8:])&1 != 0 {
+			continue
+		}
+		if lazy {
+			if l := newLazyTIFF(data, ifd); l != nil {
+				pages = append(pages, l)
+				continue
+			}
+		}
+		img, err := tiff.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, img)
+	}
+	if len(pages) == 0 {
+		return nil, tiff.FormatError("no pages")
+	}
+	return pages, nil
+}
+
+// tiffIFDs returns the offsets of the IFDs of the TIFF structure tiff, in
+// the order they are chained.
+func tiffIFDs(tiff []byte) []int {
+	if len(tiff) < 8 {
+		return nil
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if tiff[0] == 'M' {
+		order = binary.BigEndian
+	}
+	var ifds []int
+	seen := make(map[int]bool)
+	for ifd := int(order.Uint32(tiff[4:8])); ifd >= 8 && ifd+2 <= len(tiff) && !seen[ifd]; {
+		seen[ifd] = true
+		ifds = append(ifds, ifd)
+		next := ifd + 2 + 12*int(order.Uint16(tiff[ifd:]))
+		if next+4 > len(tiff) {
+			break
+		}
+		ifd = int(order.Uint32(tiff[next:]))
+	}
+	return ifds
+}
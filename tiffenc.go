@@ -0,0 +1,319 @@
+package autocrop
+
+// tiffenc.go contains a TIFF encoder that, unlike golang.org/x/image/tiff's,
+// can compress with LZW, which many archives require of their masters.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// TIFFCompression is the compression of the TIFFs that EncodeTIFF writes.
+type TIFFCompression int
+
+const (
+	// TIFFDeflate compresses with zlib, as x/image/tiff can.
+	TIFFDeflate TIFFCompression = iota
+
+	// TIFFLZW compresses with LZW.
+	TIFFLZW
+
+	// TIFFNone doesn't compress.
+	TIFFNone
+)
+
+var tiffCompressionNames = []string{
+	TIFFDeflate: "deflate",
+	TIFFLZW:     "lzw",
+	TIFFNone:    "none",
+}
+
+func (c TIFFCompression) String() string {
+	if c >= 0 && int(c) < len(tiffCompressionNames) {
+		return tiffCompressionNames[c]
+	}
+	return fmt.Sprintf("TIFFCompression(%d)", int(c))
+}
+
+// ParseTIFFCompression returns the TIFFCompression with the given name.
+func ParseTIFFCompression(name string) (TIFFCompression, error) {
+	for i, s := range tiffCompressionNames {
+		if s == name {
+			return TIFFCompression(i), nil
+		}
+	}
+	return 0, fmt.Errorf("autocrop: unknown TIFF compression %q", name)
+}
+
+// TIFFOptions are the settings of EncodeTIFF.
+type TIFFOptions struct {
+	Compression TIFFCompression
+	// Metadata is embedded in the file, except for its EXIF.
+	Metadata
+}
+
+// tiffStrip is about how many bytes of samples go in each strip.
+const tiffStrip = 64 << 10
+
+// EncodeTIFF writes img to w as a TIFF of one page. Gray images are written
+// as gray and other ones as RGB, with their alpha if they aren't opaque, and
+// with 16 bits per sample if img has them. A nil o means the default options.
+func EncodeTIFF(w io.Writer, img image.Image, o *TIFFOptions) error {
+	var opts TIFFOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.Compression < 0 || int(opts.Compression) >= len(tiffCompressionNames) {
+		return fmt.Errorf("autocrop: invalid TIFF compression %v", opts.Compression)
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return fmt.Errorf("autocrop: can't encode an empty image as a TIFF")
+	}
+
+	row, spp, depth := tiffRows(img)
+	rowBytes := b.Dx() * spp * depth / 8
+	perStrip := max(1, tiffStrip/rowBytes)
+
+	// the strips go between the header and the IFD
+	var strips [][]byte
+	buf := make([]byte, rowBytes*perStrip)
+	for y := 0; y < b.Dy(); y += perStrip {
+		n := min(perStrip, b.Dy()-y)
+		for i := 0; i < n; i++ {
+			row(y+i, buf[i*rowBytes:(i+1)*rowBytes])
+		}
+		raw := buf[:n*rowBytes]
+		var strip []byte
+		switch opts.Compression {
+		case TIFFDeflate:
+			var z bytes.Buffer
+			zw := zlib.NewWriter(&z)
+			zw.Write(raw)
+			zw.Close()
+			strip = z.Bytes()
+		case TIFFLZW:
+			strip = tiffLZW(raw)
+		default:
+			strip = append([]byte(nil), raw...)
+		}
+		strips = append(strips, strip)
+	}
+
+	offset := uint32(8)
+	offsets := make([]uint32, len(strips))
+	counts := make([]uint32, len(strips))
+	for i, s := range strips {
+		offsets[i], counts[i] = offset, uint32(len(s))
+		offset += uint32(len(s))
+	}
+	pad := offset & 1 // the IFD starts on a word
+	offset += pad
+
+	bits := make([]uint32, spp)
+	for i := range bits {
+		bits[i] = uint32(depth)
+	}
+	photometric := uint32(2)
+	if spp == 1 {
+		photometric = 1 // black is zero
+	}
+	tags := []tiffTag{
+		{256, tiffLong, []uint32{uint32(b.Dx())}, nil},
+		{257, tiffLong, []uint32{uint32(b.Dy())}, nil},
+		{258, tiffShort, bits, nil},
+		{259, tiffShort, []uint32{[]uint32{TIFFDeflate: 8, TIFFLZW: 5, TIFFNone: 1}[opts.Compression]}, nil},
+		{262, tiffShort, []uint32{photometric}, nil},
+		{273, tiffLong, offsets, nil},
+		{277, tiffShort, []uint32{uint32(spp)}, nil},
+		{278, tiffLong, []uint32{uint32(perStrip)}, nil},
+		{279, tiffLong, counts, nil},
+		{284, tiffShort, []uint32{1}, nil}, // samples are interleaved
+	}
+	if spp == 4 {
+		tags = append(tags, tiffTag{338, tiffShort, []uint32{2}, nil}) // unassociated alpha
+	}
+	tags = append(tags, opts.tiffMetadata()...)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("II*\x00")
+	binary.Write(bw, binary.LittleEndian, offset)
+	for _, s := range strips {
+		bw.Write(s)
+	}
+	if pad != 0 {
+		bw.WriteByte(0)
+	}
+	bw.Write(tiffIFD(binary.LittleEndian, tags, offset))
+	return bw.Flush()
+}
+
+// tiffRows returns a function that puts row y of img from its top, as it is
+// laid out in a TIFF, into buf, with the samples per pixel and the bits per
+// sample of that layout.
+func tiffRows(img image.Image) (row func(y int, buf []byte), spp, depth int) {
+	b := img.Bounds()
+	opaque := true
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		opaque = o.Opaque()
+	}
+	spp = 4
+	if opaque {
+		spp = 3
+	}
+
+	switch m := img.(type) {
+	case *image.Gray:
+		return func(y int, buf []byte) {
+			i := m.PixOffset(b.Min.X, b.Min.Y+y)
+			copy(buf, m.Pix[i:i+b.Dx()])
+		}, 1, 8
+	case *image.Gray16:
+		return func(y int, buf []byte) {
+			i := m.PixOffset(b.Min.X, b.Min.Y+y)
+			for x := 0; x < b.Dx(); x++ {
+				buf[2*x], buf[2*x+1] = m.Pix[i+2*x+1], m.Pix[i+2*x]
+			}
+		}, 1, 16
+	case *image.NRGBA64, *image.RGBA64:
+		return func(y int, buf []byte) {
+			for x := 0; x < b.Dx(); x++ {
+				c := color.NRGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+				for k, v := range []uint16{c.R, c.G, c.B, c.A}[:spp] {
+					binary.LittleEndian.PutUint16(buf[2*(x*spp+k):], v)
+				}
+			}
+		}, spp, 16
+	case *image.NRGBA:
+		return func(y int, buf []byte) {
+			i := m.PixOffset(b.Min.X, b.Min.Y+y)
+			for x := 0; x < b.Dx(); x++ {
+				copy(buf[x*spp:x*spp+spp], m.Pix[i+4*x:])
+			}
+		}, spp, 8
+	}
+	return func(y int, buf []byte) {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			copy(buf[x*spp:x*spp+spp], []byte{c.R, c.G, c.B, c.A})
+		}
+	}, spp, 8
+}
+
+// Field types of TIFF tags.
+const (
+	tiffByte      = 1
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffUndefined = 7
+)
+
+// tiffTag is an entry of an IFD. The value of a byte or undefined one is
+// raw.
+type tiffTag struct {
+	tag, typ uint16
+	values   []uint32
+	raw      []byte
+}
+
+// tiffIFD returns the IFD of tags, which must be in order, for it to be
+// written at offset in a TIFF of the given byte order, followed by the values
+// that don't fit in the entries.
+func tiffIFD(order binary.AppendByteOrder, tags []tiffTag, offset uint32) []byte {
+	ifd := order.AppendUint16(nil, uint16(len(tags)))
+	var extra []byte
+	extraAt := offset + 2 + 12*uint32(len(tags)) + 4
+	for _, t := range tags {
+		v, count := t.raw, len(t.raw)
+		if t.raw == nil {
+			count = len(t.values)
+		}
+		for _, x := range t.values {
+			if t.typ == tiffShort {
+				v = order.AppendUint16(v, uint16(x))
+			} else {
+				v = order.AppendUint32(v, x)
+			}
+		}
+		ifd = order.AppendUint16(ifd, t.tag)
+		ifd = order.AppendUint16(ifd, t.typ)
+		ifd = order.AppendUint32(ifd, uint32(count))
+		if len(v) <= 4 {
+			ifd = append(ifd, v...)
+			ifd = append(ifd, make([]byte, 4-len(v))...)
+			continue
+		}
+		ifd = order.AppendUint32(ifd, extraAt+uint32(len(extra)))
+		extra = append(extra, v...)
+		if len(extra)%2 != 0 {
+			extra = append(extra, 0)
+		}
+	}
+	ifd = order.AppendUint32(ifd, 0) // no next IFD
+	return append(ifd, extra...)
+}
+
+// tiffLZW compresses b with the LZW of TIFF, whose codes get a bit wider one
+// code before those of compress/lzw do.
+func tiffLZW(b []byte) []byte {
+	const clearCode, eoiCode = 256, 257
+	var out []byte
+	var acc uint32
+	var n uint
+	width := uint(9)
+	put := func(code int) {
+		acc = acc<<width | uint32(code)
+		n += width
+		for n >= 8 {
+			n -= 8
+			out = append(out, byte(acc>>n))
+		}
+	}
+	// after each new code, as libtiff does
+	grow := func(next int) bool {
+		if next == 4094 {
+			put(clearCode)
+			width = 9
+			return true
+		}
+		if next > 1<<width-1 {
+			width++
+		}
+		return false
+	}
+
+	put(clearCode)
+	table := make(map[uint32]int)
+	next := 258
+	if len(b) > 0 {
+		ent := int(b[0])
+		for _, c := range b[1:] {
+			key := uint32(ent)<<8 | uint32(c)
+			if code, ok := table[key]; ok {
+				ent = code
+				continue
+			}
+			put(ent)
+			table[key] = next
+			next++
+			ent = int(c)
+			if grow(next) {
+				clear(table)
+				next = 258
+			}
+		}
+		put(ent)
+		grow(next + 1)
+	}
+	put(eoiCode)
+	if n > 0 {
+		out = append(out, byte(acc<<(8-n)))
+	}
+	return out
+}
@@ -0,0 +1,319 @@
+package autocrop
+
+// tiffregion.go contains the decoding of TIFF pages a strip or tile at a
+// time, as the analysis reads them. Finding the border only reads the strips
+// or tiles along the sides of the page, so most of a large master is never
+// decoded, and takes no memory.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+	"sync"
+
+	"golang.org/x/image/tiff"
+)
+
+// lazyTIFF is a page of a TIFF whose blocks, strips or tiles, are decoded
+// when one of their pixels is first read. Each block is decoded by
+// golang.org/x/image/tiff as a TIFF of its own with the tags of the page, so
+// the pixels come out as they would decoding the whole page, in images of
+// the same types.
+type lazyTIFF struct {
+	data    []byte // the whole TIFF
+	order   binary.ByteOrder
+	rect    image.Rectangle
+	size    image.Point // of a block; the last strip may be short
+	tiled   bool
+	across  int         // blocks in a row of them
+	offsets []uint32    // of the data of each block
+	counts  []uint32    // of bytes of the data of each block
+	tags    []tiffTag   // of the page that its blocks are decoded with
+	opaque  bool        // there are no extra samples
+	model   color.Model // of the decoded blocks
+	blank   image.Image // an empty image of the type of the blocks
+	blocks  []lazyBlock // in the order of their data
+	errMu   sync.Mutex  // guards err
+	err     error       // the first error decoding a block
+}
+
+// lazyBlock is a block of a lazyTIFF, decoded once.
+type lazyBlock struct {
+	once sync.Once
+	img  image.Image
+}
+
+// lazyTags are the tags of a page that its blocks are decoded with: those
+// that say how its samples are laid out, compressed and colored.
+var lazyTags = []uint16{
+	258, // BitsPerSample
+	259, // Compression
+	262, // PhotometricInterpretation
+	266, // FillOrder
+	277, // SamplesPerPixel
+	292, // T4Options
+	293, // T6Options
+	317, // Predictor
+	320, // ColorMap
+	338, // ExtraSamples
+	339, // SampleFormat
+}
+
+// newLazyTIFF returns the page of the TIFF structure data whose IFD is at
+// offset ifd, to be decoded a block at a time. It returns nil if the page
+// can't be, because its samples are in planes of their own or its tags are
+// of types that x/image/tiff wouldn't read either, or if its first block
+// can't be decoded; the page is then best decoded whole, to get the error.
+func newLazyTIFF(data []byte, ifd int) *lazyTIFF {
+	order := tiffOrder(data)
+	if order == nil {
+		return nil
+	}
+	get := func(tag uint16) ([]uint32, uint16, bool) {
+		if tiffIFDEntry(data, order, ifd, tag) == nil {
+			return nil, 0, true
+		}
+		v, typ := tiffInts(data, order, ifd, tag)
+		return v, typ, v != nil
+	}
+	one := func(tag uint16) int {
+		if v, _, _ := get(tag); len(v) == 1 {
+			return int(v[0])
+		}
+		return 0
+	}
+
+	l := &lazyTIFF{data: data, order: order}
+	l.rect = image.Rect(0, 0, one(256), one(257))
+	if l.rect.Empty() {
+		return nil
+	}
+	if p, _, ok := get(284); !ok || len(p) > 0 && p[0] != 1 {
+		return nil // the samples are planar
+	}
+	if l.size = image.Pt(one(322), one(323)); l.size.X > 0 && l.size.Y > 0 {
+		l.tiled = true
+		l.offsets, _, _ = get(324)
+		l.counts, _, _ = get(325)
+	} else {
+		l.size = l.rect.Size()
+		if rows := one(278); rows > 0 && rows < l.size.Y {
+			l.size.Y = rows
+		}
+		l.offsets, _, _ = get(273)
+		l.counts, _, _ = get(279)
+	}
+	l.across = (l.rect.Dx() + l.size.X - 1) / l.size.X
+	n := l.across * ((l.rect.Dy() + l.size.Y - 1) / l.size.Y)
+	if len(l.offsets) < n || len(l.counts) < n {
+		return nil
+	}
+	for _, tag := range lazyTags {
+		v, typ, ok := get(tag)
+		if !ok {
+			return nil
+		}
+		if v != nil {
+			l.tags = append(l.tags, tiffTag{tag, typ, v, nil})
+		}
+		if tag == 258 {
+			l.opaque = len(v) < 4
+		}
+	}
+
+	l.blocks = make([]lazyBlock, n)
+	first, err := l.decode(0)
+	if err != nil {
+		return nil
+	}
+	l.model = first.ColorModel()
+	l.blank = first.(interface {
+		SubImage(image.Rectangle) image.Image
+	}).SubImage(image.Rectangle{})
+	l.blocks[0].once.Do(func() { l.blocks[0].img = first })
+	return l
+}
+
+// tiffInts returns the values of the tag of type SHORT or LONG in the IFD at
+// offset ifd of the TIFF structure tiff, with its type, or nil if there are
+// none.
+func tiffInts(tiff []byte, order binary.ByteOrder, ifd int, tag uint16) ([]uint32, uint16) {
+	e := tiffIFDEntry(tiff, order, ifd, tag)
+	if e == nil {
+		return nil, 0
+	}
+	typ := order.Uint16(e[2:])
+	size := map[uint16]int{tiffShort: 2, tiffLong: 4}[typ]
+	n := int(order.Uint32(e[4:]))
+	if size == 0 || n == 0 || n > len(tiff)/size {
+		return nil, 0
+	}
+	b := e[8:]
+	if n*size > 4 {
+		// stored elsewhere, at the offset in the entry
+		off := int(order.Uint32(e[8:]))
+		if off < 0 || off > len(tiff)-n*size {
+			return nil, 0
+		}
+		b = tiff[off:]
+	}
+	v := make([]uint32, n)
+	for i := range v {
+		if size == 2 {
+			v[i] = uint32(order.Uint16(b[2*i:]))
+		} else {
+			v[i] = order.Uint32(b[4*i:])
+		}
+	}
+	return v, typ
+}
+
+// decode decodes block i as a TIFF of its own, and returns it where it is in
+// the page.
+func (l *lazyTIFF) decode(i int) (image.Image, error) {
+	corner := image.Pt(i%l.across*l.size.X, i/l.across*l.size.Y)
+	size := l.size
+	if !l.tiled {
+		size.Y = min(size.Y, l.rect.Max.Y-corner.Y)
+	}
+	off, n := int(l.offsets[i]), int(l.counts[i])
+	if off < 0 || n < 0 || off > len(l.data)-n {
+		return nil, tiff.FormatError("block data is out of the file")
+	}
+
+	tags := append([]tiffTag{
+		{256, tiffLong, []uint32{uint32(size.X)}, nil},
+		{257, tiffLong, []uint32{uint32(size.Y)}, nil},
+	}, l.tags...)
+	if l.tiled {
+		tags = append(tags,
+			tiffTag{322, tiffLong, []uint32{uint32(size.X)}, nil},
+			tiffTag{323, tiffLong, []uint32{uint32(size.Y)}, nil},
+			tiffTag{324, tiffLong, []uint32{0}, nil},
+			tiffTag{325, tiffLong, []uint32{uint32(n)}, nil})
+	} else {
+		tags = append(tags,
+			tiffTag{273, tiffLong, []uint32{0}, nil},
+			tiffTag{278, tiffLong, []uint32{uint32(size.Y)}, nil},
+			tiffTag{279, tiffLong, []uint32{uint32(n)}, nil})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].tag < tags[j].tag })
+
+	// the data follows the IFD, whose length doesn't depend on where it is
+	order := l.order.(binary.AppendByteOrder)
+	at := uint32(8 + len(tiffIFD(order, tags, 8)))
+	for k := range tags {
+		if tags[k].tag == 273 || tags[k].tag == 324 {
+			tags[k].values = []uint32{at}
+		}
+	}
+	block := append([]byte(nil), l.data[:4]...)
+	block = order.AppendUint32(block, 8)
+	block = append(block, tiffIFD(order, tags, 8)...)
+	block = append(block, l.data[off:off+n]...)
+
+	img, err := tiff.Decode(bytes.NewReader(block))
+	if err != nil {
+		return nil, err
+	}
+	switch m := img.(type) {
+	case *image.Gray:
+		m.Rect = m.Rect.Add(corner)
+	case *image.Gray16:
+		m.Rect = m.Rect.Add(corner)
+	case *image.Paletted:
+		m.Rect = m.Rect.Add(corner)
+	case *image.RGBA:
+		m.Rect = m.Rect.Add(corner)
+	case *image.RGBA64:
+		m.Rect = m.Rect.Add(corner)
+	case *image.NRGBA:
+		m.Rect = m.Rect.Add(corner)
+	case *image.NRGBA64:
+		m.Rect = m.Rect.Add(corner)
+	default:
+		return nil, tiff.UnsupportedError("image type")
+	}
+	return img, nil
+}
+
+// block returns block i, decoding it if it hasn't been. A block that can't be
+// decoded is blank, and its error is kept for failed.
+func (l *lazyTIFF) block(i int) image.Image {
+	b := &l.blocks[i]
+	b.once.Do(func() {
+		img, err := l.decode(i)
+		if err != nil {
+			l.errMu.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.errMu.Unlock()
+			img = l.blank
+		}
+		b.img = img
+	})
+	return b.img
+}
+
+// blockAt returns the block that has the pixel at x, y in it, or an empty one
+// if the pixel is outside of the page.
+func (l *lazyTIFF) blockAt(x, y int) image.Image {
+	if !(image.Point{x, y}.In(l.rect)) {
+		return l.blank
+	}
+	return l.block(y/l.size.Y*l.across + x/l.size.X)
+}
+
+// failed returns the first error decoding a block, if any has failed.
+func (l *lazyTIFF) failed() error {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	return l.err
+}
+
+func (l *lazyTIFF) ColorModel() color.Model { return l.model }
+
+func (l *lazyTIFF) Bounds() image.Rectangle { return l.rect }
+
+func (l *lazyTIFF) At(x, y int) color.Color { return l.blockAt(x, y).At(x, y) }
+
+// Opaque reports whether the page has no alpha samples, which is when
+// x/image/tiff decodes all of its pixels opaque.
+func (l *lazyTIFF) Opaque() bool { return l.opaque }
+
+// decodeLazily decodes the image read from r like image.Decode, except that
+// the first page of a TIFF is decoded lazily if it can be.
+func decodeLazily(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	if f, ok := sniffFrames(br); !ok || f.name != "tiff" {
+		img, _, err := image.Decode(br)
+		return img, err
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	if ifds := tiffIFDs(data); len(ifds) > 0 {
+		if l := newLazyTIFF(data, ifds[0]); l != nil {
+			return l, nil
+		}
+	}
+	return tiff.Decode(bytes.NewReader(data))
+}
+
+// analyzeLazily is AnalyzeWith for an image that may be a lazyTIFF, which
+// only finds out that part of it is broken when the analysis reads it.
+func analyzeLazily(img image.Image, opts Options) (*Transform, error) {
+	t, err := AnalyzeWith(img, opts)
+	if l, ok := img.(*lazyTIFF); ok && err == nil {
+		if err := l.failed(); err != nil {
+			return nil, err
+		}
+	}
+	return t, err
+}
@@ -0,0 +1,194 @@
+package autocrop
+
+// units.go contains the physical lengths that some options can be given in,
+// since archives specify their margins and page sizes in millimeters or
+// inches rather than in pixels, and the resolution that converts them.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Length is a physical length, in millimeters.
+type Length float64
+
+// Units of Length.
+const (
+	Millimeter Length = 1
+	Centimeter Length = 10
+	Inch       Length = 25.4
+	Point      Length = Inch / 72
+)
+
+var lengthUnits = []struct {
+	name string
+	unit Length
+}{
+	{"mm", Millimeter},
+	{"cm", Centimeter},
+	{"in", Inch},
+	{"pt", Point},
+}
+
+// Pixels returns l in whole pixels at dpi pixels per inch.
+func (l Length) Pixels(dpi float64) int {
+	return int(math.Round(float64(l/Inch) * dpi))
+}
+
+func (l Length) String() string {
+	return strconv.FormatFloat(float64(l), 'g', -1, 64) + "mm"
+}
+
+// ParseLength parses a number followed by one of the units mm, cm, in or pt,
+// like "12.5mm" or "0.5in".
+func ParseLength(str string) (Length, error) {
+	for _, u := range lengthUnits {
+		if num, ok := strings.CutSuffix(str, u.name); ok {
+			v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+			if err != nil || !finite(v) {
+				break
+			}
+			return Length(v) * u.unit, nil
+		}
+	}
+	return 0, fmt.Errorf("autocrop: invalid length %q", str)
+}
+
+// Physical holds lengths of Options in physical units. Each nonzero one takes
+// the place of the option in pixels that it is named after, converted at
+// Options.DPI.
+type Physical struct {
+	ContentMargin Length
+	MinRun        Length
+	Inset         Length
+	// Width and Height are the page size, for Options.Size.
+	Width, Height Length
+}
+
+// pixels sets the pixel options in o from the lengths in o.Physical, at
+// o.DPI. Nothing is set without a resolution; check reports it.
+func (o *Options) pixels() {
+	p, dpi := &o.Physical, o.DPI
+	if !(dpi > 0) {
+		return
+	}
+	if p.ContentMargin != 0 {
+		o.ContentMargin = p.ContentMargin.Pixels(dpi)
+	}
+	if p.MinRun != 0 {
+		o.MinRun = p.MinRun.Pixels(dpi)
+	}
+	if p.Inset != 0 {
+		o.Inset = p.Inset.Pixels(dpi)
+	}
+	if p.Width != 0 || p.Height != 0 {
+		o.Size.X, o.Size.Y = p.Width.Pixels(dpi), p.Height.Pixels(dpi)
+	}
+}
+
+// checkPhysical reports whether the lengths in o.Physical can be converted.
+func (o *Options) checkPhysical() error {
+	if o.DPI < 0 || !finite(o.DPI) {
+		return fmt.Errorf("autocrop: invalid resolution %f dpi", o.DPI)
+	}
+	p := o.Physical
+	if p == (Physical{}) {
+		return nil
+	}
+	if o.DPI == 0 {
+		return fmt.Errorf("autocrop: lengths in physical units need the resolution of the image")
+	}
+	for _, l := range []Length{p.ContentMargin, p.MinRun, p.Inset, p.Width, p.Height} {
+		if !finite(float64(l)) {
+			return fmt.Errorf("autocrop: invalid length %v", l)
+		}
+	}
+	return nil
+}
+
+// ReadDPI returns the horizontal resolution in pixels per inch recorded in
+// the metadata of the JPEG or TIFF read from r, or 0 if there is none.
+func ReadDPI(r io.Reader) float64 {
+	return metadataDPI(bufio.NewReaderSize(r, exifPeek))
+}
+
+// metadataDPI returns the horizontal resolution in pixels per inch recorded
+// in the JFIF or EXIF metadata of the JPEG, or the tags of the TIFF, being
+// read by r, without consuming any of it. It returns 0 if there is none. The
+// tags of a TIFF are only found if they are near the start of the file, as
+// scanners usually write them.
+func metadataDPI(r *bufio.Reader) float64 {
+	b, _ := r.Peek(exifPeek)
+	if bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*")) {
+		return tiffResolution(b)
+	}
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return 0
+	}
+	b = b[2:]
+
+	var dpi float64
+	for len(b) >= 4 && b[0] == 0xff {
+		marker := b[1]
+		n := int(binary.BigEndian.Uint16(b[2:4]))
+		if marker == 0xda || n < 2 || len(b) < 2+n {
+			break
+		}
+		seg := b[4 : 2+n]
+		switch {
+		case marker == 0xe0 && bytes.HasPrefix(seg, []byte("JFIF\x00")) && len(seg) >= 12:
+			// version, units, then the densities
+			density := float64(binary.BigEndian.Uint16(seg[8:10]))
+			switch seg[7] {
+			case 1:
+				dpi = density
+			case 2:
+				dpi = density * 2.54
+			}
+		case marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")):
+			// EXIF is more likely to be what the scanner meant than
+			// the JFIF defaults many encoders write
+			if d := tiffResolution(seg[6:]); d > 0 {
+				return d
+			}
+		}
+		b = b[2+n:]
+	}
+	return dpi
+}
+
+// tiffResolution returns the horizontal resolution in pixels per inch given
+// by the tags in the first IFD of the TIFF structure tiff, or 0.
+func tiffResolution(tiff []byte) float64 {
+	e, order := tiffEntry(tiff, 0x011a)
+	if e == nil || order.Uint16(e[2:]) != 5 {
+		return 0
+	}
+	// a RATIONAL is stored elsewhere, at the offset in the entry
+	off := int(order.Uint32(e[8:]))
+	if off < 0 || off+8 > len(tiff) {
+		return 0
+	}
+	num, den := order.Uint32(tiff[off:]), order.Uint32(tiff[off+4:])
+	if den == 0 {
+		return 0
+	}
+	res := float64(num) / float64(den)
+
+	// the unit defaults to inches
+	if u, _ := tiffEntry(tiff, 0x0128); u != nil {
+		switch order.Uint16(u[8:]) {
+		case 1:
+			return 0
+		case 3:
+			res *= 2.54
+		}
+	}
+	return res
+}
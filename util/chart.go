@@ -0,0 +1,308 @@
+package util
+
+// chart.go contains a small plotting routine for diagnostic charts with axes,
+// tick labels and a legend, built on the drawing helpers in draw.go.
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Style is how a Series is drawn.
+type Style int
+
+const (
+	Bars   Style = iota // a histogram with one bar per sample
+	Lines               // a line joining the samples
+	Dashed              // a dashed line joining the samples
+)
+
+// Series is a named set of values plotted against their indices.
+type Series struct {
+	Name   string
+	Values []float64
+	Color  color.Color
+	Style  Style
+}
+
+// Span is a named range of indices [Lo, Hi) that is shaded behind the series.
+type Span struct {
+	Name   string
+	Lo, Hi int
+	Color  color.Color
+}
+
+// Chart is a plot of one or more Series over shared axes. If Min and Max are
+// equal, the value axis is fitted to the series.
+type Chart struct {
+	Title          string
+	XLabel, YLabel string
+	Width, Height  int // size of the plot area, without the axes and labels
+	Min, Max       float64
+	Spans          []Span
+	Series         []Series
+}
+
+// face is the font used for all chart text.
+var face = basicfont.Face7x13
+
+// The space around the plot area for the tick labels and axis titles.
+const (
+	marginLeft   = 64
+	marginRight  = 12
+	marginTop    = 24
+	marginBottom = 40
+	tickLen      = 4
+)
+
+// Draw renders the chart onto a new white image.
+func (c *Chart) Draw() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, c.Width+marginLeft+marginRight, c.Height+marginTop+marginBottom))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	lo, hi := c.Min, c.Max
+	if lo == hi {
+		lo, hi = c.extent()
+	}
+	n := 0
+	for _, s := range c.Series {
+		n = max(n, len(s.Values))
+	}
+
+	plot := image.Rect(marginLeft, marginTop, marginLeft+c.Width, marginTop+c.Height)
+	px := func(i float64) int {
+		if n < 2 {
+			return plot.Min.X
+		}
+		return plot.Min.X + int(i*float64(c.Width-1)/float64(n-1))
+	}
+	py := func(v float64) int {
+		return plot.Max.Y - 1 - int((v-lo)/(hi-lo)*float64(c.Height-1))
+	}
+
+	for _, s := range c.Spans {
+		r := image.Rect(px(float64(s.Lo)), plot.Min.Y, px(float64(s.Hi)), plot.Max.Y)
+		draw.Draw(img, r, image.NewUniform(s.Color), image.Point{}, draw.Over)
+	}
+	for _, s := range c.Series {
+		plotSeries(img.SubImage(plot).(*image.NRGBA), s, px, py, py(math.Max(lo, math.Min(hi, 0))))
+	}
+
+	// axes and ticks
+	axis := color.Black
+	hline(img, plot.Min.X-1, plot.Max.X, plot.Max.Y, axis)
+	vline(img, plot.Min.X-1, plot.Min.Y, plot.Max.Y+1, axis)
+	for _, v := range ticks(lo, hi, c.Height/40) {
+		y := py(v)
+		hline(img, plot.Min.X-1-tickLen, plot.Min.X-1, y, axis)
+		label := formatTick(v)
+		Text(img, plot.Min.X-tickLen-4-textWidth(label), y+face.Ascent/2, label, axis)
+	}
+	for _, v := range ticks(0, float64(n-1), c.Width/60) {
+		x := px(v)
+		vline(img, x, plot.Max.Y+1, plot.Max.Y+1+tickLen, axis)
+		label := formatTick(v)
+		Text(img, x-textWidth(label)/2, plot.Max.Y+tickLen+face.Height, label, axis)
+	}
+
+	Text(img, (img.Bounds().Dx()-textWidth(c.Title))/2, face.Height+2, c.Title, axis)
+	Text(img, plot.Max.X-textWidth(c.XLabel), img.Bounds().Dy()-4, c.XLabel, axis)
+	Text(img, 4, face.Height+2, c.YLabel, axis)
+
+	c.legend(img, plot)
+	return img
+}
+
+// extent finds the range of the values of all series.
+func (c *Chart) extent() (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, s := range c.Series {
+		if len(s.Values) == 0 {
+			continue
+		}
+		min, max := MinMax(s.Values)
+		lo, hi = math.Min(lo, min), math.Max(hi, max)
+	}
+	if lo > hi {
+		return 0, 1
+	}
+	if lo == hi {
+		return lo - 1, hi + 1
+	}
+	return
+}
+
+// legend draws a box in the top right corner of the plot with a swatch and the
+// name of each named series.
+func (c *Chart) legend(img draw.Image, plot image.Rectangle) {
+	type entry struct {
+		name string
+		c    color.Color
+	}
+	var names []entry
+	w := 0
+	for _, s := range c.Spans {
+		if s.Name != "" {
+			names = append(names, entry{s.Name, s.Color})
+			w = max(w, textWidth(s.Name))
+		}
+	}
+	for _, s := range c.Series {
+		if s.Name != "" {
+			names = append(names, entry{s.Name, s.Color})
+			w = max(w, textWidth(s.Name))
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	const swatch = 12
+	box := image.Rect(0, 0, w+swatch+12, len(names)*face.Height+6)
+	box = box.Add(image.Pt(plot.Max.X-box.Dx()-4, plot.Min.Y+4))
+	draw.Draw(img, box, image.NewUniform(color.NRGBA{255, 255, 255, 220}), image.Point{}, draw.Over)
+	for i, s := range names {
+		y := box.Min.Y + 3 + i*face.Height
+		sw := image.Rect(box.Min.X+4, y+3, box.Min.X+4+swatch, y+face.Height-3)
+		draw.Draw(img, sw, image.NewUniform(s.c), image.Point{}, draw.Over)
+		Text(img, sw.Max.X+4, y+face.Ascent, s.name, color.Black)
+	}
+}
+
+// plotSeries draws s into img, which is clipped to the plot area. zero is the
+// y coordinate that bars start from.
+func plotSeries(img *image.NRGBA, s Series, px func(float64) int, py func(float64) int, zero int) {
+	r := img.Bounds()
+	switch s.Style {
+	case Bars:
+		for i, v := range s.Values {
+			x, y := px(float64(i)), py(v)
+			vline(img, x, min(y, zero), max(y, zero)+1, s.Color)
+		}
+	case Lines, Dashed:
+		for i := 1; i < len(s.Values); i++ {
+			x0, y0 := px(float64(i-1)), py(s.Values[i-1])
+			x1, y1 := px(float64(i)), py(s.Values[i])
+			steps := max(abs(x1-x0), abs(y1-y0), 1)
+			for k := 0; k <= steps; k++ {
+				x := x0 + (x1-x0)*k/steps
+				y := y0 + (y1-y0)*k/steps
+				if s.Style == Dashed && (x-r.Min.X)%10 >= 5 {
+					continue
+				}
+				if (image.Point{x, y}).In(r) {
+					img.Set(x, y, s.Color)
+				}
+			}
+		}
+	}
+}
+
+// ticks returns round values between lo and hi, about n of them.
+func ticks(lo, hi float64, n int) []float64 {
+	if n < 1 || hi <= lo {
+		return nil
+	}
+	step := math.Pow(10, math.Floor(math.Log10((hi-lo)/float64(n))))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if (hi-lo)/(step*m) <= float64(n) {
+			step *= m
+			break
+		}
+	}
+	var vs []float64
+	for v := math.Ceil(lo/step) * step; v <= hi+step/1e6; v += step {
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func formatTick(v float64) string {
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
+
+// Text draws s in c with its baseline starting at (x, y).
+func Text(img draw.Image, x, y int, s string, c color.Color) {
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+func textWidth(s string) int {
+	return font.MeasureString(face, s).Round()
+}
+
+func hline(img draw.Image, x0, x1, y int, c color.Color) {
+	draw.Draw(img, image.Rect(x0, y, x1, y+1), image.NewUniform(c), image.Point{}, draw.Over)
+}
+
+func vline(img draw.Image, x, y0, y1 int, c color.Color) {
+	draw.Draw(img, image.Rect(x, y0, x+1, y1), image.NewUniform(c), image.Point{}, draw.Over)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Outline draws the outline of r in c.
+func Outline(img draw.Image, r image.Rectangle, c color.Color) {
+	hline(img, r.Min.X, r.Max.X, r.Min.Y, c)
+	hline(img, r.Min.X, r.Max.X, r.Max.Y-1, c)
+	vline(img, r.Min.X, r.Min.Y, r.Max.Y, c)
+	vline(img, r.Max.X-1, r.Min.Y, r.Max.Y, c)
+}
+
+// Segment draws a line in c from p to q.
+func Segment(img draw.Image, p, q image.Point, c color.Color) {
+	r := img.Bounds()
+	steps := max(abs(q.X-p.X), abs(q.Y-p.Y), 1)
+	for k := 0; k <= steps; k++ {
+		pt := image.Pt(p.X+(q.X-p.X)*k/steps, p.Y+(q.Y-p.Y)*k/steps)
+		if pt.In(r) {
+			img.Set(pt.X, pt.Y, c)
+		}
+	}
+}
+
+// Tile lays panels out in a grid cols wide on a white background, each under
+// its label, with title across the top.
+func Tile(title string, panels []image.Image, labels []string, cols int) *image.NRGBA {
+	const pad = 8
+	var cell image.Point
+	for _, p := range panels {
+		cell.X = max(cell.X, p.Bounds().Dx())
+		cell.Y = max(cell.Y, p.Bounds().Dy())
+	}
+	cell = cell.Add(image.Pt(pad, pad+face.Height))
+	rows := (len(panels) + cols - 1) / cols
+	top := face.Height + 2*pad
+
+	img := image.NewNRGBA(image.Rect(0, 0, cols*cell.X+pad, top+rows*cell.Y))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	Text(img, pad, pad+face.Ascent, title, color.Black)
+
+	for i, p := range panels {
+		at := image.Pt(pad+i%cols*cell.X, top+i/cols*cell.Y)
+		if i < len(labels) {
+			Text(img, at.X, at.Y+face.Ascent, labels[i], color.Black)
+		}
+		at.Y += face.Height
+		r := image.Rectangle{at, at.Add(p.Bounds().Size())}
+		draw.Draw(img, r, p, p.Bounds().Min, draw.Src)
+	}
+	return img
+}
@@ -4,12 +4,18 @@ package util
 // API.
 
 import (
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/jpeg"
 	"image/png"
-	"log"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/tiff"
 )
 
 type shape struct {
@@ -150,14 +156,58 @@ func Histo(img draw.Image, samples []float64, pos, neg, back color.Color, transf
 	draw.Draw(img, img.Bounds(), h, image.ZP, draw.Over)
 }
 
-// WriteImage writes an image to a png file.
-func WriteImage(img image.Image, filename string) {
+// An Encoder writes img to w in some image format.
+type Encoder func(w io.Writer, img image.Image) error
+
+var encoders = map[string]Encoder{
+	".png":  png.Encode,
+	".jpg":  encodeJPEG,
+	".jpeg": encodeJPEG,
+	".tif":  encodeTIFF,
+	".tiff": encodeTIFF,
+}
+
+func encodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 95})
+}
+
+func encodeTIFF(w io.Writer, img image.Image) error {
+	return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+}
+
+// RegisterEncoder makes WriteImage use enc for files whose names end in ext,
+// such as ".webp". The standard library has no WebP encoder, so one has to be
+// registered before WriteImage can write WebP files.
+func RegisterEncoder(ext string, enc Encoder) {
+	encoders[strings.ToLower(ext)] = enc
+}
+
+// Encode writes img to w in the format that WriteImage writes files whose
+// names end in ext.
+func Encode(w io.Writer, img image.Image, ext string) error {
+	enc, ok := encoders[strings.ToLower(ext)]
+	if !ok {
+		return fmt.Errorf("util: no encoder for %q files", ext)
+	}
+	return enc(w, img)
+}
+
+// WriteImage writes an image to a file, in the format given by the extension
+// of its name: PNG, JPEG, TIFF, or any format registered with RegisterEncoder.
+func WriteImage(img image.Image, filename string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if _, ok := encoders[ext]; !ok {
+		return fmt.Errorf("util: no encoder for %q files", ext)
+	}
+
 	out, err := os.Create(filename)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	if err = png.Encode(out, img); err != nil {
-		log.Fatal(err)
+	if err = Encode(out, img, ext); err != nil {
+		out.Close()
+		return err
 	}
+	return out.Close()
 }
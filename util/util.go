@@ -1,17 +1,46 @@
-// Package util contains some utility functions for package autocrop that might
-// be useful for other things. Some of them make assumptions specific to
-// autocrop, though.
+// Package util contains the signal processing and plotting routines that
+// package autocrop is built on. None of them know anything about autocrop, so
+// they may be useful for other things.
+//
+// A signal is a []float64 of samples taken at regular intervals; the index of
+// a sample is its x coordinate. Functions that fit lines to a signal treat
+// samples equal to zero as missing, so that bad samples can be knocked out
+// without moving the others.
+//
+// The functions fall into a few groups:
+//
+//   - filters: Lowpass, Differentiate and their To variants, Scale
+//   - features: FindPeak, Trim
+//   - statistics: Mean, Median, WeightedMedian, MAD, AvgAbsDev, MinMax, Finite
+//   - fits: LinearFit, QuadFit, StdErr, Clean
+//   - drawing: Histo, Line, DashedLine, DashedColumn, RectOver, Text, WriteImage
+//   - charts: Chart, which plots several Series with axes and a legend
+//
+// Mean and the fits return NaN when there is nothing to go on, such as a
+// signal that is all zero. Their OK variants (MeanOK, LinearFitOK, QuadFitOK,
+// StdErrOK) report that instead, for callers that would rather not check for
+// NaN.
 package util
 
 // util.go contains functions related to analyzing and cleaning noise from
 // sample sets.
 
-import "math"
+import (
+	"math"
+	"sort"
+)
 
 // Scale normalizes a set of values so that its highest and lowest values
-// correspond to hi and lo.
+// correspond to hi and lo. If all of the values are the same, they are set to
+// lo.
 func Scale(xs []float64, lo, hi float64) {
 	min, max := MinMax(xs)
+	if max == min {
+		for i := range xs {
+			xs[i] = lo
+		}
+		return
+	}
 	a := (hi - lo) / (max - min)
 	dy := (lo - min) * a
 	for i := range xs {
@@ -19,9 +48,19 @@ func Scale(xs []float64, lo, hi float64) {
 	}
 }
 
-// Lowpass applies a discrete low-pass filter with cutoff frequency fc to x.
+// Lowpass applies a discrete low-pass filter with cutoff frequency fc to x. A
+// sample that isn't Finite spoils every one after it.
 func Lowpass(x []float64, fc float64) (y []float64) {
-	y = make([]float64, len(x))
+	return LowpassTo(make([]float64, len(x)), x, fc)
+}
+
+// LowpassTo is like Lowpass, but writes the result into y, which must be as
+// long as x, and returns it. y may be x itself, to filter it in place.
+func LowpassTo(y, x []float64, fc float64) []float64 {
+	y = y[:len(x)]
+	if len(x) == 0 {
+		return y
+	}
 	RC := 1.0 / (2 * math.Pi * fc)
 	α := 1.0 / (RC + 1.0)
 	y[0] = x[0]
@@ -32,24 +71,58 @@ func Lowpass(x []float64, fc float64) (y []float64) {
 }
 
 // Differentiate performs a discrete signal differentiation over xs by taking
-// the slope between the two immediately adjacent samples for every sample.
+// the slope between the two immediately adjacent samples for every sample. The
+// result is as noisy as xs; Lowpass it if that matters.
 func Differentiate(xs []float64) []float64 {
-	if len(xs) == 0 {
-		return nil
-	}
+	return DifferentiateTo(make([]float64, len(xs)), xs)
+}
 
-	ddx := make([]float64, len(xs))
+// DifferentiateTo is like Differentiate, but writes the result into ddx,
+// which must be as long as xs, and returns it. ddx may be xs itself, to
+// differentiate it in place.
+func DifferentiateTo(ddx, xs []float64) []float64 {
+	ddx = ddx[:len(xs)]
+	if len(xs) < 2 {
+		clear(ddx)
+		return ddx
+	}
 
+	// the sample before, which ddx may have overwritten
+	prev := xs[0]
 	ddx[0] = xs[1] - xs[0]
 	for i := 1; i < len(ddx)-1; i++ {
-		ddx[i] = (xs[i+1] - xs[i-1]) / 2
+		x := xs[i]
+		ddx[i] = (xs[i+1] - prev) / 2
+		prev = x
+	}
+	ddx[len(ddx)-1] = xs[len(xs)-1] - prev
+
+	return ddx
+}
+
+// FindPeak finds the first run of values above thresh in xs, starting at
+// index from. It returns the index of the largest value in the run and the
+// index just past the end of the run. ok is false if there is no such run.
+func FindPeak(xs []float64, thresh float64, from int) (peak, end int, ok bool) {
+	for i := from; i < len(xs); i++ {
+		if xs[i] <= thresh {
+			continue
+		}
+
+		peak = i
+		for end = i; end < len(xs) && xs[end] > thresh; end++ {
+			if xs[end] > xs[peak] {
+				peak = end
+			}
+		}
+		return peak, end, true
 	}
-	ddx[len(ddx)-1] = xs[len(xs)-1] - xs[len(xs)-2]
 
-	return Lowpass(ddx, 1./10.)
+	return 0, len(xs), false
 }
 
-// Mean finds the mean of a set of values.
+// Mean finds the mean of a set of values. It returns NaN if there are no
+// values; see MeanOK.
 func Mean(xs ...float64) (a float64) {
 	for _, x := range xs {
 		a += x
@@ -58,9 +131,92 @@ func Mean(xs ...float64) (a float64) {
 	return
 }
 
-// MinMax finds the min and max of a set of values.
-func MinMax(xs []float64) (min, max float64) {
+// MeanOK is like Mean, but reports whether the mean is a number: ok is false
+// if there are no values or any are not finite.
+func MeanOK(xs ...float64) (a float64, ok bool) {
+	if len(xs) == 0 || !Finite(xs...) {
+		return 0, false
+	}
+	return Mean(xs...), true
+}
+
+// Finite reports whether none of xs are NaN or infinite.
+func Finite(xs ...float64) bool {
 	for _, x := range xs {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Median finds the median of a set of values without modifying it. It returns
+// NaN if there are no values.
+func Median(xs ...float64) float64 {
+	if len(xs) == 0 {
+		return math.NaN()
+	}
+
+	sorted := append([]float64(nil), xs...)
+	sort.Float64s(sorted)
+
+	m := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[m-1] + sorted[m]) / 2
+	}
+	return sorted[m]
+}
+
+// WeightedMedian finds the weighted median of a set of values, that is, the
+// value at which half of the total weight lies on either side. Values with a
+// weight that is not positive are ignored. It returns NaN if no values
+// remain.
+func WeightedMedian(xs, ws []float64) float64 {
+	idx := make([]int, 0, len(xs))
+	total := 0.
+	for i, w := range ws {
+		if w > 0 {
+			idx = append(idx, i)
+			total += w
+		}
+	}
+	if len(idx) == 0 {
+		return math.NaN()
+	}
+
+	sort.Slice(idx, func(i, j int) bool { return xs[idx[i]] < xs[idx[j]] })
+
+	acc := 0.
+	for _, i := range idx {
+		acc += ws[i]
+		if acc >= total/2 {
+			return xs[i]
+		}
+	}
+	return xs[idx[len(idx)-1]]
+}
+
+// MAD finds the median absolute deviation from the median of a set of values,
+// a measure of spread that is not thrown off by outliers. It returns NaN if
+// there are no values.
+func MAD(xs ...float64) float64 {
+	m := Median(xs...)
+	dev := make([]float64, len(xs))
+	for i, x := range xs {
+		dev[i] = math.Abs(x - m)
+	}
+	return Median(dev...)
+}
+
+// MinMax finds the min and max of a set of values. Both are zero if there are
+// no values.
+func MinMax(xs []float64) (min, max float64) {
+	if len(xs) == 0 {
+		return
+	}
+
+	min, max = xs[0], xs[0]
+	for _, x := range xs[1:] {
 		if x > max {
 			max = x
 		} else if x < min {
@@ -76,9 +232,26 @@ func Rad2deg(rad float64) float64 {
 	return rad * 180 / math.Pi
 }
 
+// Deg2rad converts from degrees to radians.
+func Deg2rad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
 // LinearFit returns the slope of a naïve linear regression on xs. It ignores
-// values equal to zero.
+// values equal to zero. All three results are NaN if the fit is degenerate;
+// see LinearFitOK.
 func LinearFit(xs []float64) (alpha, beta, r2 float64) {
+	alpha, beta, r2, ok := LinearFitOK(xs)
+	if !ok {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	return
+}
+
+// LinearFitOK is like LinearFit, but reports whether the fit was possible: ok
+// is false if fewer than two values are nonzero or any are not finite. r2 is
+// 1 if the values are all the same, since the line then fits exactly.
+func LinearFitOK(xs []float64) (alpha, beta, r2 float64, ok bool) {
 	var (
 		xy, sx, sy, x2, y2 float64
 		n                  = float64(len(xs))
@@ -95,6 +268,9 @@ func LinearFit(xs []float64) (alpha, beta, r2 float64) {
 		x2 += x * x
 		y2 += y * y
 	}
+	if n < 2 {
+		return 0, 0, 0, false
+	}
 	xy /= n
 	sx /= n
 	sy /= n
@@ -103,22 +279,136 @@ func LinearFit(xs []float64) (alpha, beta, r2 float64) {
 
 	beta = (xy - sx*sy) / (x2 - sx*sx)
 	alpha = sy - beta*sx
-	r := (xy - sx*sy) / math.Sqrt((x2-sx*sx)*(y2-sy*sy))
-	r2 = r * r
+	if !Finite(alpha, beta) {
+		return 0, 0, 0, false
+	}
+	if vy := y2 - sy*sy; vy <= 0 {
+		r2 = 1
+	} else {
+		r := (xy - sx*sy) / math.Sqrt((x2-sx*sx)*vy)
+		r2 = r * r
+	}
+	return alpha, beta, r2, true
+}
+
+// QuadFit fits the parabola alpha + beta*x + gamma*x^2 to xs by least
+// squares. Like LinearFit, it ignores values equal to zero. All three results
+// are NaN if the fit is degenerate; see QuadFitOK.
+func QuadFit(xs []float64) (alpha, beta, gamma float64) {
+	alpha, beta, gamma, ok := QuadFitOK(xs)
+	if !ok {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	return
+}
+
+// QuadFitOK is like QuadFit, but reports whether the fit was possible: ok is
+// false if fewer than three values are nonzero or any are not finite.
+func QuadFitOK(xs []float64) (alpha, beta, gamma float64, ok bool) {
+	// sums of x^k and x^k*y
+	var s [5]float64
+	var t [3]float64
+	for i, y := range xs {
+		if y == 0 {
+			continue
+		}
+		x := float64(i)
+		xk := 1.
+		for k := range s {
+			s[k] += xk
+			if k < len(t) {
+				t[k] += xk * y
+			}
+			xk *= x
+		}
+	}
+
+	// Solve the normal equations by Cramer's rule.
+	det3 := func(a, b, c [3]float64) float64 {
+		return a[0]*(b[1]*c[2]-b[2]*c[1]) - a[1]*(b[0]*c[2]-b[2]*c[0]) + a[2]*(b[0]*c[1]-b[1]*c[0])
+	}
+	c0 := [3]float64{s[0], s[1], s[2]}
+	c1 := [3]float64{s[1], s[2], s[3]}
+	c2 := [3]float64{s[2], s[3], s[4]}
+	d := det3(c0, c1, c2)
+	if s[0] < 3 || d == 0 {
+		return 0, 0, 0, false
+	}
+	alpha = det3(t, c1, c2) / d
+	beta = det3(c0, t, c2) / d
+	gamma = det3(c0, c1, t) / d
+	if !Finite(alpha, beta, gamma) {
+		return 0, 0, 0, false
+	}
+	return alpha, beta, gamma, true
+}
+
+// StdErr returns the standard errors of the line alpha + beta*x fitted to xs,
+// as by LinearFit: se is that of the line's value at x, and seBeta that of its
+// slope. Like LinearFit, it ignores values equal to zero. Both are NaN if
+// there are fewer than three values; see StdErrOK.
+func StdErr(xs []float64, alpha, beta, x float64) (se, seBeta float64) {
+	se, seBeta, ok := StdErrOK(xs, alpha, beta, x)
+	if !ok {
+		return math.NaN(), math.NaN()
+	}
 	return
 }
 
+// StdErrOK is like StdErr, but reports whether the errors could be estimated:
+// ok is false if there are fewer than three nonzero values, or they all have
+// the same x, or any result is not finite.
+func StdErrOK(xs []float64, alpha, beta, x float64) (se, seBeta float64, ok bool) {
+	var n, mean float64
+	for i, y := range xs {
+		if y != 0 {
+			n++
+			mean += float64(i)
+		}
+	}
+	if n < 3 {
+		return 0, 0, false
+	}
+	mean /= n
+
+	var sxx, ssr float64
+	for i, y := range xs {
+		if y == 0 {
+			continue
+		}
+		d := float64(i) - mean
+		sxx += d * d
+		res := y - (alpha + beta*float64(i))
+		ssr += res * res
+	}
+
+	s2 := ssr / (n - 2)
+	seBeta = math.Sqrt(s2 / sxx)
+	se = math.Sqrt(s2 * (1/n + (x-mean)*(x-mean)/sxx))
+	if !Finite(se, seBeta) {
+		return 0, 0, false
+	}
+	return se, seBeta, true
+}
+
 // Clean tries to recover a clean signal with a straight slope from a garbled
 // one. It employs several methods to attempt to detect irregular values and
-// allow the "correct" signal to dominate.
-func Clean(xs []float64, cutoff, regressionDev, chunkMeanDev float64, chunkSize int) {
+// allow the "correct" signal to dominate:
+//
+// Chunks of chunkSize samples whose average absolute deviation exceeds
+// chunkMeanDev are thrown out, as are samples further than regressionDev from
+// a line fitted to the rest. The samples thrown out are replaced by the values
+// of a line fitted to the samples that remain. If too few samples remain to
+// fit a line to, those thrown out are left zero. A chunkSize less than 1
+// throws out no chunks.
+func Clean(xs []float64, regressionDev, chunkMeanDev float64, chunkSize int) {
 	// Split up the signal into chunks and calculate the average absolute
 	// deviation across each. Chunks with a relatively high value are zeroed
 	// out.
 	var chunk []float64
-	zeroes := make([]float64, chunkSize)
-	for t := 0; t < len(xs); t += chunkSize {
-		if len(xs)-t < 8 {
+	zeroes := make([]float64, max(chunkSize, 0))
+	for t := 0; chunkSize > 0 && t < len(xs); t += chunkSize {
+		if len(xs)-t < chunkSize {
 			chunk = xs[t:]
 		} else {
 			chunk = xs[t : t+chunkSize]
@@ -132,7 +422,10 @@ func Clean(xs []float64, cutoff, regressionDev, chunkMeanDev float64, chunkSize
 
 	// calculate a linear regression and find the samples that are too far away
 	// from it. Then zero them out.
-	a, b, _ := LinearFit(xs)
+	a, b, _, ok := LinearFitOK(xs)
+	if !ok {
+		return
+	}
 	for t, y := range xs {
 		expected := a + b*float64(t)
 		if math.Abs(expected-y) > regressionDev {
@@ -143,7 +436,9 @@ func Clean(xs []float64, cutoff, regressionDev, chunkMeanDev float64, chunkSize
 	// The linear fit ignores zero samples. So it'll only recalculate from the
 	// "valid" samples. Hopefully. After that we put all the previously zeroed
 	// out values back in, aligned perfectly with the new linear fit.
-	a, b, _ = LinearFit(xs)
+	if a, b, _, ok = LinearFitOK(xs); !ok {
+		return
+	}
 	for t, y := range xs {
 		if y == 0 {
 			xs[t] = a + b*float64(t)
@@ -164,14 +459,13 @@ func AvgAbsDev(xs []float64) float64 {
 	return dev / float64(len(xs))
 }
 
-// Trim removes samples from either side of a signal that exceed thresh or are
-// zero.
+// Trim finds the window of a signal left after removing the samples from
+// either side that exceed thresh or are zero. The window is xs[lo:hi].
 func Trim(xs []float64, thresh float64) (lo, hi int) {
 	hi = len(xs)
 
 	for t, y := range xs {
 		if y < thresh && y > 0 {
-			//if y > 0 {
 			lo = t
 			break
 		}
@@ -179,7 +473,6 @@ func Trim(xs []float64, thresh float64) (lo, hi int) {
 	for t := len(xs); t > 0; t-- {
 		y := xs[t-1]
 		if y < thresh && y > 0 {
-			//if y > 0 {
 			hi = t
 			break
 		}
@@ -0,0 +1,285 @@
+package util
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+var nan = math.NaN()
+
+// same reports whether a and b are within rounding of each other, or both NaN.
+func same(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+
+// sameAll is same for each of a and b.
+func sameAll(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !same(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLowpass(t *testing.T) {
+	// a cutoff of 1/2π makes α a half
+	fc := 1 / (2 * math.Pi)
+	for _, test := range []struct {
+		xs, want []float64
+	}{
+		{[]float64{}, []float64{}},
+		{[]float64{5}, []float64{5}},
+		{[]float64{3, 3, 3}, []float64{3, 3, 3}},
+		{[]float64{0, 1, 1, 1}, []float64{0, 0.5, 0.75, 0.875}},
+		{[]float64{8, 0, 0}, []float64{8, 4, 2}},
+	} {
+		in := slices.Clone(test.xs)
+		if got := Lowpass(in, fc); !sameAll(got, test.want) {
+			t.Errorf("Lowpass(%v) = %v, want %v", test.xs, got, test.want)
+		}
+		if !slices.Equal(in, test.xs) {
+			t.Errorf("Lowpass(%v) changed its input to %v", test.xs, in)
+		}
+		if got := LowpassTo(in, in, fc); !sameAll(got, test.want) || !sameAll(in, test.want) {
+			t.Errorf("LowpassTo(xs, %v) in place = %v, want %v", test.xs, in, test.want)
+		}
+	}
+}
+
+func TestDifferentiate(t *testing.T) {
+	for _, test := range []struct {
+		xs, want []float64
+	}{
+		{[]float64{}, []float64{}},
+		{[]float64{4}, []float64{0}},
+		{[]float64{1, 3}, []float64{2, 2}},
+		{[]float64{2, 2, 2}, []float64{0, 0, 0}},
+		{[]float64{0, 1, 4, 9}, []float64{1, 2, 4, 5}},
+	} {
+		in := slices.Clone(test.xs)
+		if got := Differentiate(in); !sameAll(got, test.want) {
+			t.Errorf("Differentiate(%v) = %v, want %v", test.xs, got, test.want)
+		}
+		if !slices.Equal(in, test.xs) {
+			t.Errorf("Differentiate(%v) changed its input to %v", test.xs, in)
+		}
+		if got := DifferentiateTo(in, in); !sameAll(got, test.want) || !sameAll(in, test.want) {
+			t.Errorf("DifferentiateTo(xs, %v) in place = %v, want %v", test.xs, in, test.want)
+		}
+	}
+}
+
+func TestFindPeak(t *testing.T) {
+	for _, test := range []struct {
+		xs        []float64
+		thresh    float64
+		from      int
+		peak, end int
+		ok        bool
+	}{
+		{nil, 0, 0, 0, 0, false},
+		{[]float64{5}, 1, 0, 0, 1, true},
+		{[]float64{5}, 5, 0, 0, 1, false},
+		{[]float64{2, 2, 2}, 2, 0, 0, 3, false},
+		{[]float64{2, 2, 2}, 1, 0, 0, 3, true},
+		{[]float64{0, 3, 5, 4, 0, 9}, 1, 0, 2, 4, true},
+		{[]float64{0, 3, 5, 4, 0, 9}, 1, 3, 3, 4, true},
+		{[]float64{0, 3, 5, 4, 0, 9}, 1, 4, 5, 6, true},
+		{[]float64{0, 3, 5, 4, 0, 9}, 1, 10, 0, 6, false},
+	} {
+		peak, end, ok := FindPeak(test.xs, test.thresh, test.from)
+		if peak != test.peak || end != test.end || ok != test.ok {
+			t.Errorf("FindPeak(%v, %g, %d) = %d, %d, %t, want %d, %d, %t",
+				test.xs, test.thresh, test.from, peak, end, ok, test.peak, test.end, test.ok)
+		}
+	}
+}
+
+func TestLinearFit(t *testing.T) {
+	for _, test := range []struct {
+		xs              []float64
+		alpha, beta, r2 float64
+		ok              bool
+	}{
+		{[]float64{}, 0, 0, 0, false},
+		{[]float64{7}, 0, 0, 0, false},
+		{[]float64{0, 0, 0}, 0, 0, 0, false},
+		{[]float64{0, 7, 0}, 0, 0, 0, false},
+		{[]float64{1, math.Inf(1)}, 0, 0, 0, false},
+		{[]float64{nan, 1, 2}, 0, 0, 0, false},
+		{[]float64{2, 2, 2}, 2, 0, 1, true},
+		{[]float64{1, 3, 5}, 1, 2, 1, true},
+		// the zeros are missing samples
+		{[]float64{0, 3, 0, 7}, 1, 2, 1, true},
+		{[]float64{1, 3, 2}, 1.5, 0.5, 0.25, true},
+	} {
+		alpha, beta, r2, ok := LinearFitOK(test.xs)
+		if !same(alpha, test.alpha) || !same(beta, test.beta) || !same(r2, test.r2) || ok != test.ok {
+			t.Errorf("LinearFitOK(%v) = %g, %g, %g, %t, want %g, %g, %g, %t",
+				test.xs, alpha, beta, r2, ok, test.alpha, test.beta, test.r2, test.ok)
+		}
+		if !test.ok {
+			test.alpha, test.beta, test.r2 = nan, nan, nan
+		}
+		alpha, beta, r2 = LinearFit(test.xs)
+		if !same(alpha, test.alpha) || !same(beta, test.beta) || !same(r2, test.r2) {
+			t.Errorf("LinearFit(%v) = %g, %g, %g, want %g, %g, %g",
+				test.xs, alpha, beta, r2, test.alpha, test.beta, test.r2)
+		}
+	}
+}
+
+func TestQuadFit(t *testing.T) {
+	for _, test := range []struct {
+		xs                 []float64
+		alpha, beta, gamma float64
+		ok                 bool
+	}{
+		{[]float64{}, 0, 0, 0, false},
+		{[]float64{4}, 0, 0, 0, false},
+		{[]float64{1, 2}, 0, 0, 0, false},
+		{[]float64{0, 0, 0, 0}, 0, 0, 0, false},
+		{[]float64{1, 0, 9, 0}, 0, 0, 0, false},
+		{[]float64{1, math.Inf(-1), 3}, 0, 0, 0, false},
+		{[]float64{3, 3, 3}, 3, 0, 0, true},
+		{[]float64{1, 4, 9}, 1, 2, 1, true},
+		{[]float64{1, 0, 9, 16}, 1, 2, 1, true},
+	} {
+		alpha, beta, gamma, ok := QuadFitOK(test.xs)
+		if !same(alpha, test.alpha) || !same(beta, test.beta) || !same(gamma, test.gamma) || ok != test.ok {
+			t.Errorf("QuadFitOK(%v) = %g, %g, %g, %t, want %g, %g, %g, %t",
+				test.xs, alpha, beta, gamma, ok, test.alpha, test.beta, test.gamma, test.ok)
+		}
+		if !test.ok {
+			test.alpha, test.beta, test.gamma = nan, nan, nan
+		}
+		alpha, beta, gamma = QuadFit(test.xs)
+		if !same(alpha, test.alpha) || !same(beta, test.beta) || !same(gamma, test.gamma) {
+			t.Errorf("QuadFit(%v) = %g, %g, %g, want %g, %g, %g",
+				test.xs, alpha, beta, gamma, test.alpha, test.beta, test.gamma)
+		}
+	}
+}
+
+func TestStdErr(t *testing.T) {
+	for _, test := range []struct {
+		xs             []float64
+		alpha, beta, x float64
+		se, seBeta     float64
+		ok             bool
+	}{
+		{[]float64{}, 0, 0, 0, 0, 0, false},
+		{[]float64{1}, 1, 0, 0, 0, 0, false},
+		{[]float64{1, 2}, 1, 1, 0, 0, 0, false},
+		{[]float64{0, 0, 0, 0}, 0, 0, 0, 0, 0, false},
+		{[]float64{1, nan, 3, 4}, 1, 1, 0, 0, 0, false},
+		{[]float64{2, 2, 2}, 2, 0, 1, 0, 0, true},
+		{[]float64{1, 3, 5}, 1, 2, 1, 0, 0, true},
+		// one residual of 1 about the line, with the xs 1.5 ± 1.5 and 0.5
+		{[]float64{1, 3, 4, 7}, 1, 2, 1.5, math.Sqrt(1.0 / 8), math.Sqrt(0.1), true},
+	} {
+		se, seBeta, ok := StdErrOK(test.xs, test.alpha, test.beta, test.x)
+		if !same(se, test.se) || !same(seBeta, test.seBeta) || ok != test.ok {
+			t.Errorf("StdErrOK(%v, %g, %g, %g) = %g, %g, %t, want %g, %g, %t",
+				test.xs, test.alpha, test.beta, test.x, se, seBeta, ok, test.se, test.seBeta, test.ok)
+		}
+		if !test.ok {
+			test.se, test.seBeta = nan, nan
+		}
+		se, seBeta = StdErr(test.xs, test.alpha, test.beta, test.x)
+		if !same(se, test.se) || !same(seBeta, test.seBeta) {
+			t.Errorf("StdErr(%v, %g, %g, %g) = %g, %g, want %g, %g",
+				test.xs, test.alpha, test.beta, test.x, se, seBeta, test.se, test.seBeta)
+		}
+	}
+}
+
+func TestClean(t *testing.T) {
+	line := func(n int) []float64 {
+		xs := make([]float64, n)
+		for i := range xs {
+			xs[i] = float64(i + 1)
+		}
+		return xs
+	}
+	garbled := line(16)
+	garbled[5], garbled[6] = 90, -40
+
+	for _, test := range []struct {
+		name                        string
+		xs                          []float64
+		regressionDev, chunkMeanDev float64
+		chunkSize                   int
+		want                        []float64
+	}{
+		{"empty", []float64{}, 1, 1, 4, []float64{}},
+		{"one", []float64{5}, 1, 1, 4, []float64{5}},
+		{"equal", []float64{3, 3, 3, 3, 3}, 1, 1, 2, []float64{3, 3, 3, 3, 3}},
+		{"clean", line(10), 1, 5, 4, line(10)},
+		{"garbled chunk", garbled, 1, 5, 4, line(16)},
+		{"outlier", []float64{1, 2, 3, 4, 50, 6, 7, 8}, 20, 100, 4, line(8)},
+		{"too few left", []float64{1, 50, -40, 2}, 1, 5, 2, []float64{0, 0, 0, 0}},
+		{"no chunks", []float64{1, 2, 3}, 1, 5, 0, []float64{1, 2, 3}},
+	} {
+		xs := slices.Clone(test.xs)
+		Clean(xs, test.regressionDev, test.chunkMeanDev, test.chunkSize)
+		if !sameAll(xs, test.want) {
+			t.Errorf("%s: Clean(%v, %g, %g, %d) left %v, want %v",
+				test.name, test.xs, test.regressionDev, test.chunkMeanDev, test.chunkSize, xs, test.want)
+		}
+	}
+}
+
+func TestMedian(t *testing.T) {
+	for _, test := range []struct {
+		xs     []float64
+		median float64
+		mad    float64
+	}{
+		{[]float64{}, nan, nan},
+		{[]float64{4}, 4, 0},
+		{[]float64{2, 2, 2}, 2, 0},
+		{[]float64{3, 1, 2}, 2, 1},
+		{[]float64{4, 1, 3, 2}, 2.5, 1},
+		{[]float64{1, 2, 3, 4, 100}, 3, 1},
+	} {
+		in := slices.Clone(test.xs)
+		if got := Median(in...); !same(got, test.median) {
+			t.Errorf("Median(%v) = %g, want %g", test.xs, got, test.median)
+		}
+		if got := MAD(in...); !same(got, test.mad) {
+			t.Errorf("MAD(%v) = %g, want %g", test.xs, got, test.mad)
+		}
+		if !slices.Equal(in, test.xs) {
+			t.Errorf("Median(%v) changed its input to %v", test.xs, in)
+		}
+	}
+}
+
+func TestWeightedMedian(t *testing.T) {
+	for _, test := range []struct {
+		xs, ws []float64
+		want   float64
+	}{
+		{[]float64{}, []float64{}, nan},
+		{[]float64{1, 2}, []float64{0, -1}, nan},
+		{[]float64{5}, []float64{1}, 5},
+		{[]float64{2, 2, 2}, []float64{1, 3, 2}, 2},
+		{[]float64{3, 1, 2}, []float64{1, 1, 1}, 2},
+		{[]float64{1, 2, 3, 4}, []float64{1, 1, 1, 1}, 2},
+		{[]float64{1, 2, 3}, []float64{1, 1, 5}, 3},
+		{[]float64{1, 2, 3}, []float64{4, 1, 0}, 1},
+	} {
+		if got := WeightedMedian(test.xs, test.ws); !same(got, test.want) {
+			t.Errorf("WeightedMedian(%v, %v) = %g, want %g", test.xs, test.ws, got, test.want)
+		}
+	}
+}